@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/jhwbarlow/tcp-audit/pkg/alert"
+)
+
+const (
+	alertRulesFlagStr       = "alert-rules"
+	alertLogFlagStr         = "alert-log"
+	alertSinkFlagStr        = "alert-sink"
+	alertSinkOptFlagStr     = "alert-sink-opt"
+	alertSinkOptFileFlagStr = "alert-sink-opt-file"
+)
+
+var (
+	alertRulesFlag       = flag.String(alertRulesFlagStr, "", "path to YAML file of rules against which each event is evaluated, firing alerts (empty to disable)")
+	alertLogFlag         = flag.Bool(alertLogFlagStr, false, "log each alert fired")
+	alertSinkFlag        = flag.String(alertSinkFlagStr, "", "path to sinker plugin to which each alert fired is sunk, or the event which fired it if the sinker does not sink alerts (empty to disable)")
+	alertSinkOptFlag     = optsFlag(flag.CommandLine, alertSinkOptFlagStr, "alert sinker plugin option of the form key=value (may be repeated)")
+	alertSinkOptFileFlag = flag.String(alertSinkOptFileFlagStr, "", "path to file of alert sinker plugin options, one key=value per line")
+)
+
+func checkAlertFlags() error {
+	if *alertRulesFlag != "" && !*alertLogFlag && *alertSinkFlag == "" {
+		return &flagError{alertRulesFlagStr, "requires " + alertLogFlagStr + " or " + alertSinkFlagStr}
+	}
+
+	if *alertRulesFlag == "" && (*alertLogFlag || *alertSinkFlag != "") {
+		return &flagError{alertRulesFlagStr, "not supplied, but alerts are to be notified"}
+	}
+
+	return nil
+}
+
+// NewAlertEngine returns the alert engine and notifiers requested on the command-line.
+// The engine is nil if events are not evaluated against rules. The alert sinker is
+// registered with the cleaner.
+func newAlertEngine(cleaner cleaner) (*alert.Engine, []alert.Notifier, error) {
+	if *alertRulesFlag == "" {
+		return nil, nil, nil
+	}
+
+	rules, err := alert.LoadRules(*alertRulesFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	engine, err := alert.NewEngine(rules)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var notifiers []alert.Notifier
+	if *alertLogFlag {
+		notifiers = append(notifiers, alert.LogNotifier{})
+	}
+
+	if *alertSinkFlag != "" {
+		sinker, err := initSinkerFromFlags(*alertSinkFlag, *alertSinkOptFileFlag, alertSinkOptFlag)
+		if err != nil {
+			return nil, nil, err
+		}
+		cleaner.registerSinker(sinker)
+
+		notifiers = append(notifiers, alert.NewSinkerNotifier(sinker))
+	}
+
+	return engine, notifiers, nil
+}
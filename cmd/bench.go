@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"runtime"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/contextual"
+	"github.com/jhwbarlow/tcp-audit/pkg/generator"
+)
+
+const (
+	benchCommandStr      = "bench"
+	benchDurationFlagStr = "duration"
+
+	// Latencies are counted in buckets, each 1/latencySubBuckets of a power of two wide
+	latencySubBucketBits = 4
+	latencySubBuckets    = 1 << latencySubBucketBits
+	latencyBuckets       = (64 - latencySubBucketBits) * latencySubBuckets
+)
+
+var benchPercentiles = []float64{50, 90, 99, 99.9}
+
+// BenchResult is the result of a benchmark.
+type benchResult struct {
+	events    uint64
+	errors    uint64
+	duration  time.Duration
+	latencies latencyHistogram
+	mallocs   uint64 // Allocations made while sinking, less those made generating the events
+	bytes     uint64 // Bytes allocated while sinking, less those allocated generating the events
+}
+
+// RunBench runs the bench subcommand, which sinks events from the built-in generator
+// eventer to a sinker for a duration, and reports the rate and cost of sinking them to
+// the writer. Unless a rate is given, events are generated as fast as they can be sunk.
+func runBench(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet(benchCommandStr, flag.ContinueOnError)
+	sinkFlag := flags.String(sinkerFlagStr, "", "path to sinker plugin to benchmark")
+	sinkOptFlag := optsFlag(flags, sinkerOptFlagStr, "sinker plugin option of the form key=value (may be repeated)")
+	sinkOptFileFlag := flags.String(sinkerOptFileFlagStr, "", "path to file of sinker plugin options, one key=value per line")
+	eventOptFlag := optsFlag(flags, eventerOptFlagStr, "generator eventer option of the form key=value (may be repeated)")
+	durationFlag := flags.Duration(benchDurationFlagStr, 10*time.Second, "how long to sink events for")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *sinkFlag == "" {
+		return errors.New(sinkerFlagStr + " not supplied")
+	}
+
+	if *durationFlag <= 0 {
+		return errors.New(benchDurationFlagStr + " must be positive")
+	}
+
+	if _, ok := eventOptFlag[generator.RateOption]; !ok {
+		eventOptFlag[generator.RateOption] = "0"
+	}
+
+	options, err := generator.ParseOptions(eventOptFlag)
+	if err != nil {
+		return fmt.Errorf("generator options: %w", err)
+	}
+
+	eventer, err := generator.New(options)
+	if err != nil {
+		return fmt.Errorf("initialising generator: %w", err)
+	}
+	defer eventer.Close()
+
+	cleaner := new(closingCleaner)
+	defer cleaner.cleanupAll()
+
+	sinker, err := initSinkerFromFlags(*sinkFlag, *sinkOptFileFlag, sinkOptFlag)
+	if err != nil {
+		return err
+	}
+	cleaner.registerSinker(sinker)
+
+	result, err := benchmark(eventer, sinker, *durationFlag)
+	if err != nil {
+		return err
+	}
+
+	// Find the cost of generating the events, so that only that of sinking them is reported
+	options.Rate = 0
+	generatorMallocs, generatorBytes, err := generatorAllocs(options, result.events)
+	if err != nil {
+		return err
+	}
+	result.mallocs = saturatingSub(result.mallocs, generatorMallocs)
+	result.bytes = saturatingSub(result.bytes, generatorBytes)
+
+	result.report(out)
+	return nil
+}
+
+// Benchmark sinks events from the eventer to the sinker until the duration has passed,
+// measuring the latency of each sink and the allocations made.
+func benchmark(eventer event.Eventer, sinker sink.Sinker, duration time.Duration) (*benchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	result := new(benchResult)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for {
+		e, err := contextual.Event(ctx, eventer)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return nil, fmt.Errorf("generating event: %w", err)
+		}
+
+		sinkStart := time.Now()
+		// The sink is not cut short by the end of the benchmark
+		err = contextual.Sink(context.Background(), sinker, e)
+		result.latencies.record(time.Since(sinkStart))
+		result.events++
+		if err != nil {
+			if result.errors == 0 {
+				log.Printf("Error: sinking event (further errors are only counted): %v", err)
+			}
+			result.errors++
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	result.duration = time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	result.mallocs = after.Mallocs - before.Mallocs
+	result.bytes = after.TotalAlloc - before.TotalAlloc
+	return result, nil
+}
+
+// GeneratorAllocs returns the allocations made, and bytes allocated, generating the
+// number of events with a generator of the options.
+func generatorAllocs(options generator.Options, events uint64) (mallocs, bytes uint64, err error) {
+	eventer, err := generator.New(options)
+	if err != nil {
+		return 0, 0, fmt.Errorf("initialising generator: %w", err)
+	}
+	defer eventer.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := uint64(0); i < events; i++ {
+		if _, err := eventer.Event(); err != nil {
+			return 0, 0, fmt.Errorf("generating event: %w", err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+
+	return after.Mallocs - before.Mallocs, after.TotalAlloc - before.TotalAlloc, nil
+}
+
+func saturatingSub(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+
+	return a - b
+}
+
+func (br *benchResult) report(out io.Writer) {
+	fmt.Fprintf(out, "events:          %d\n", br.events)
+	fmt.Fprintf(out, "sink errors:     %d\n", br.errors)
+	fmt.Fprintf(out, "duration:        %v\n", br.duration.Round(time.Millisecond))
+	fmt.Fprintf(out, "events/s:        %.1f\n", float64(br.events)/br.duration.Seconds())
+	for _, p := range benchPercentiles {
+		fmt.Fprintf(out, "%-17s%v\n", fmt.Sprintf("latency p%v:", p), br.latencies.percentile(p))
+	}
+	fmt.Fprintf(out, "latency max:     %v\n", br.latencies.max)
+
+	if br.events != 0 {
+		fmt.Fprintf(out, "allocs/event:    %.1f\n", float64(br.mallocs)/float64(br.events))
+		fmt.Fprintf(out, "bytes/event:     %.0f\n", float64(br.bytes)/float64(br.events))
+	}
+}
+
+// LatencyHistogram counts latencies in buckets no wider than about 6% of their values, so
+// that percentiles can be found without keeping every latency, and so without allocating as
+// latencies are recorded.
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64
+	total  uint64
+	max    time.Duration
+}
+
+func (lh *latencyHistogram) record(latency time.Duration) {
+	if latency < 0 {
+		latency = 0
+	}
+
+	lh.counts[latencyBucket(uint64(latency))]++
+	lh.total++
+	if latency > lh.max {
+		lh.max = latency
+	}
+}
+
+// Percentile returns the upper bound of the bucket holding the latency at the percentile,
+// or the maximum latency if that is lower.
+func (lh *latencyHistogram) percentile(p float64) time.Duration {
+	if lh.total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(p / 100 * float64(lh.total)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, count := range lh.counts {
+		seen += count
+		if seen >= rank {
+			if upper := time.Duration(latencyBucketUpper(i)); upper < lh.max {
+				return upper
+			}
+			break
+		}
+	}
+
+	return lh.max
+}
+
+// LatencyBucket returns the bucket of the latency in nanoseconds. Latencies below
+// latencySubBuckets have a bucket each, and above that, each power of two is split into
+// latencySubBuckets buckets.
+func latencyBucket(ns uint64) int {
+	if ns < latencySubBuckets {
+		return int(ns)
+	}
+
+	shift := bits.Len64(ns) - latencySubBucketBits - 1
+	return latencySubBuckets + shift*latencySubBuckets + int(ns>>uint(shift)) - latencySubBuckets
+}
+
+// LatencyBucketUpper returns the highest latency in nanoseconds in the bucket.
+func latencyBucketUpper(bucket int) uint64 {
+	if bucket < latencySubBuckets {
+		return uint64(bucket)
+	}
+
+	shift := uint((bucket - latencySubBuckets) / latencySubBuckets)
+	mantissa := uint64((bucket-latencySubBuckets)%latencySubBuckets + latencySubBuckets)
+	return (mantissa+1)<<shift - 1
+}
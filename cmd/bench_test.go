@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit/pkg/generator"
+)
+
+// TestLatencyBuckets tests that each latency is within its bucket, and that the buckets
+// are no wider than about 6% of the latencies in them
+func TestLatencyBuckets(t *testing.T) {
+	for _, ns := range []uint64{0, 1, 15, 16, 17, 31, 32, 1000, 123456789, 1 << 62, 1<<63 - 1} {
+		bucket := latencyBucket(ns)
+		if bucket >= latencyBuckets {
+			t.Fatalf("expected bucket of %d below %d, got %d", ns, latencyBuckets, bucket)
+		}
+
+		upper := latencyBucketUpper(bucket)
+		lower := uint64(0)
+		if bucket > 0 {
+			lower = latencyBucketUpper(bucket-1) + 1
+		}
+
+		if ns < lower || ns > upper {
+			t.Errorf("expected %d in bucket %d, from %d to %d", ns, bucket, lower, upper)
+		}
+
+		if float64(upper-lower) > 0.0625*float64(ns) {
+			t.Errorf("expected bucket of %d to be no wider than 6.25%%, got %d to %d", ns, lower, upper)
+		}
+	}
+}
+
+// TestLatencyHistogramPercentiles tests that percentiles are found to within a bucket
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	var histogram latencyHistogram
+	for i := 1; i <= 1000; i++ {
+		histogram.record(time.Duration(i) * time.Microsecond)
+	}
+
+	for p, expected := range map[float64]time.Duration{
+		50:  500 * time.Microsecond,
+		99:  990 * time.Microsecond,
+		100: time.Millisecond,
+	} {
+		got := histogram.percentile(p)
+		if got < expected || float64(got) > 1.0625*float64(expected) {
+			t.Errorf("expected p%v of about %v, got %v", p, expected, got)
+		}
+	}
+
+	if histogram.max != time.Millisecond {
+		t.Errorf("expected max of 1ms, got %v", histogram.max)
+	}
+}
+
+// TestBenchmark tests that events are sunk until the duration has passed, and that sink
+// errors are counted rather than stopping the benchmark
+func TestBenchmark(t *testing.T) {
+	options, err := generator.ParseOptions(map[string]string{generator.RateOption: "0"})
+	if err != nil {
+		t.Fatalf("parsing generator options: %v", err)
+	}
+
+	eventer, err := generator.New(options)
+	if err != nil {
+		t.Fatalf("creating generator: %v", err)
+	}
+	defer eventer.Close()
+
+	mockError := errors.New("mock sink error")
+	mockSinker := &mockReplaySinker{errs: []error{mockError, nil, mockError}}
+	result, err := benchmark(eventer, mockSinker, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if result.events == 0 || result.errors != 2 || uint64(len(mockSinker.events)) != result.events-2 {
+		t.Errorf("expected events with 2 errors, got %d events, %d errors and %d sunk",
+			result.events, result.errors, len(mockSinker.events))
+	}
+
+	if result.duration < 50*time.Millisecond || result.latencies.total != result.events {
+		t.Errorf("expected a latency for each event over at least 50ms, got %d over %v",
+			result.latencies.total, result.duration)
+	}
+}
+
+// TestRunBench tests that the bench subcommand benchmarks a built-in sinker and reports
+// the results
+func TestRunBench(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	out := new(bytes.Buffer)
+	err := runBench([]string{
+		"--" + sinkerFlagStr, "builtin:jsonl",
+		"--" + sinkerOptFlagStr, "file=" + path,
+		"--" + eventerOptFlagStr, "concurrency=50",
+		"--" + benchDurationFlagStr, "50ms",
+	}, out)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	for _, line := range []string{"events/s:", "latency p99:", "latency max:", "allocs/event:"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected report to contain %q, got:\n%s", line, out.String())
+		}
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+		t.Errorf("expected events to be sunk to %s", path)
+	}
+}
+
+// TestRunBenchErrors tests that the bench subcommand rejects bad arguments
+func TestRunBenchErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"--" + sinkerFlagStr, "builtin:jsonl", "--" + benchDurationFlagStr, "0s"},
+		{"--" + sinkerFlagStr, "builtin:jsonl", "--" + eventerOptFlagStr, "concurrency=0"},
+		{"--" + sinkerFlagStr, "builtin:nonexistent"},
+	} {
+		err := runBench(args, new(bytes.Buffer))
+		if err == nil {
+			t.Errorf("expected error for arguments %v, got nil", args)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"plugin"
+	"sort"
+	"strings"
+
+	"github.com/jhwbarlow/tcp-audit/pkg/generator"
+	"github.com/jhwbarlow/tcp-audit/pkg/jsonl"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+	"github.com/jhwbarlow/tcp-audit/pkg/procnet"
+	"github.com/jhwbarlow/tcp-audit/pkg/replay"
+	"github.com/jhwbarlow/tcp-audit/pkg/rotate"
+	"github.com/jhwbarlow/tcp-audit/pkg/sockdiag"
+	"github.com/jhwbarlow/tcp-audit/pkg/syslog"
+	"github.com/jhwbarlow/tcp-audit/pkg/webhook"
+)
+
+// BuiltinPrefix marks a plugin path as naming a plugin compiled into tcp-audit, such as
+// "builtin:jsonl", rather than a shared object file.
+const builtinPrefix = "builtin:"
+
+// BuiltinPlugins holds the configuration constructors of the built-in plugins, by kind
+// and then name.
+var builtinPlugins = map[string]map[string]plugin.Symbol{
+	"eventer": {
+		"generator": generator.NewWithConfig,
+		"procnet":   procnet.NewWithConfig,
+		"replay":    replay.NewWithConfig,
+		"sockdiag":  sockdiag.NewWithConfig,
+	},
+	"sinker": {
+		"jsonl":   jsonl.NewWithConfig,
+		"file":    rotate.NewWithConfig,
+		"syslog":  syslog.NewWithConfig,
+		"webhook": webhook.NewWithConfig,
+	},
+}
+
+// SymbolLoader returns the loader for the plugin of the given kind at the path, which may
+// name a built-in plugin.
+func symbolLoader(kind, path string) (pluginconfig.SymbolLoader, error) {
+	if !strings.HasPrefix(path, builtinPrefix) {
+		return pluginconfig.NewFilesystemSharedObjectSymbolLoader(path), nil
+	}
+
+	name := strings.TrimPrefix(path, builtinPrefix)
+	constructor, ok := builtinPlugins[kind][name]
+	if !ok {
+		return nil, fmt.Errorf("unknown built-in %s %q (built-in %ss: %s)", kind, name, kind, builtinNames(kind))
+	}
+
+	return pluginconfig.NewBuiltinSymbolLoader(map[string]plugin.Symbol{
+		pluginconfig.ConfigConstructorSymbol: constructor,
+	}), nil
+}
+
+func builtinNames(kind string) string {
+	names := make([]string, 0, len(builtinPlugins[kind]))
+	for name := range builtinPlugins[kind] {
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit/pkg/jsonl"
+)
+
+func TestBuiltinSinkerLoaded(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	sinkers := registerPluginFlags(flags, sinkerFlagStr, sinkerOptFlagStr, sinkerOptFileFlagStr, "sinker")
+	if err := flags.Parse([]string{"--" + sinkerFlagStr, builtinPrefix + "jsonl"}); err != nil {
+		t.Fatalf("parsing flags: %v", err)
+	}
+
+	specs, err := sinkers.specs()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	sinker, err := initSinkerPlugin(specs[0])
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if _, ok := sinker.(*jsonl.Sinker); !ok {
+		t.Errorf("expected *jsonl.Sinker, got %T", sinker)
+	}
+}
+
+func TestUnknownBuiltinError(t *testing.T) {
+	for _, test := range []struct {
+		kind string
+		path string
+	}{
+		{"sinker", builtinPrefix + "nosuch"},
+		{"eventer", builtinPrefix + "jsonl"},
+	} {
+		_, err := symbolLoader(test.kind, test.path)
+		if err == nil {
+			t.Errorf("expected error for %s %s, got nil", test.kind, test.path)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
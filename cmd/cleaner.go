@@ -1,52 +1,181 @@
 package main
 
 import (
+	"io"
 	"log"
+	"reflect"
+	"sync"
 
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/transform"
 )
 
 type cleaner interface {
 	registerEventer(eventer event.Eventer)
 	cleanupEventer()
+	registerTransformer(transformer transform.Transformer)
+	cleanupTransformer()
 	registerSinker(sinker sink.Sinker)
 	cleanupSinker()
+	releaseSinkers(sinkers []sink.Sinker)
+	registerCloser(closer io.Closer)
 	cleanupAll()
 }
 
-// ClosingCleaner cleans-up the registered eventer and/or sinker by calling their
-// close methods, if applicable.
+// ClosingCleaner cleans-up the registered eventers, transformers and/or sinkers by
+// calling their close methods, if applicable. Any other registered resources are closed
+// after the plugins.
+// It is safe for concurrent use, so that sinkers can be replaced while the process runs.
+// Sinkers and resources registered after cleanupAll, such as by a replacement that raced
+// with shutdown, are closed immediately.
 type closingCleaner struct {
-	eventer event.Eventer
-	sinker  sink.Sinker
+	mutex        sync.Mutex
+	cleanedUp    bool
+	eventers     []event.Eventer
+	transformers []transform.Transformer
+	sinkers      []sink.Sinker
+	closers      []io.Closer
 }
 
+// RegisterEventer adds an eventer to those to be cleaned-up. It may be called
+// multiple times.
 func (cc *closingCleaner) registerEventer(eventer event.Eventer) {
-	cc.eventer = eventer
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	cc.eventers = append(cc.eventers, eventer)
 }
 
+// RegisterTransformer adds a transformer to those to be cleaned-up. It may be called
+// multiple times.
+func (cc *closingCleaner) registerTransformer(transformer transform.Transformer) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	cc.transformers = append(cc.transformers, transformer)
+}
+
+// RegisterSinker adds a sinker to those to be cleaned-up. It may be called
+// multiple times.
 func (cc *closingCleaner) registerSinker(sinker sink.Sinker) {
-	cc.sinker = sinker
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	if cc.cleanedUp {
+		closeSinker(sinker)
+		return
+	}
+
+	cc.sinkers = append(cc.sinkers, sinker)
 }
 
+// CleanupEventer closes all registered eventers. An error closing one eventer does
+// not prevent the others from being closed.
 func (cc *closingCleaner) cleanupEventer() {
-	if eventerCloser, ok := cc.eventer.(event.EventerCloser); ok {
-		if closeErr := eventerCloser.Close(); closeErr != nil {
-			log.Printf("Error: closing eventer: %v", closeErr)
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	for _, eventer := range cc.eventers {
+		if eventerCloser, ok := eventer.(event.EventerCloser); ok {
+			if closeErr := eventerCloser.Close(); closeErr != nil {
+				log.Printf("Error: closing eventer: %v", closeErr)
+			}
+		}
+	}
+}
+
+// CleanupTransformer closes all registered transformers. An error closing one transformer
+// does not prevent the others from being closed.
+func (cc *closingCleaner) cleanupTransformer() {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	for _, transformer := range cc.transformers {
+		if transformerCloser, ok := transformer.(transform.TransformerCloser); ok {
+			if closeErr := transformerCloser.Close(); closeErr != nil {
+				log.Printf("Error: closing transformer: %v", closeErr)
+			}
 		}
 	}
 }
 
+// CleanupSinker closes all registered sinkers. An error closing one sinker does
+// not prevent the others from being closed.
 func (cc *closingCleaner) cleanupSinker() {
-	if sinkerCloser, ok := cc.sinker.(sink.SinkerCloser); ok {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	for _, sinker := range cc.sinkers {
+		closeSinker(sinker)
+	}
+	cc.sinkers = nil // So that they cannot be released, and so closed, again
+}
+
+// ReleaseSinkers closes the given sinkers, which are no longer in use, and removes them
+// from those to be cleaned-up. Sinkers which are not registered, for example because they
+// have already been cleaned-up, are not closed.
+func (cc *closingCleaner) releaseSinkers(sinkers []sink.Sinker) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	for _, released := range sinkers {
+		if !reflect.TypeOf(released).Comparable() {
+			continue // Cannot be found, and comparing would panic
+		}
+
+		for i, sinker := range cc.sinkers {
+			if sinker == released {
+				cc.sinkers = append(cc.sinkers[:i], cc.sinkers[i+1:]...)
+				closeSinker(sinker)
+				break
+			}
+		}
+	}
+}
+
+func closeSinker(sinker sink.Sinker) {
+	if sinkerCloser, ok := sinker.(sink.SinkerCloser); ok {
 		if closeErr := sinkerCloser.Close(); closeErr != nil {
 			log.Printf("Error: closing sinker: %v", closeErr)
 		}
 	}
 }
 
+// RegisterCloser adds a resource, other than a plugin, to those to be cleaned-up.
+// It may be called multiple times.
+func (cc *closingCleaner) registerCloser(closer io.Closer) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	if cc.cleanedUp {
+		if closeErr := closer.Close(); closeErr != nil {
+			log.Printf("Error: closing resource: %v", closeErr)
+		}
+		return
+	}
+
+	cc.closers = append(cc.closers, closer)
+}
+
+func (cc *closingCleaner) cleanupClosers() {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	for _, closer := range cc.closers {
+		if closeErr := closer.Close(); closeErr != nil {
+			log.Printf("Error: closing resource: %v", closeErr)
+		}
+	}
+}
+
 func (cc *closingCleaner) cleanupAll() {
+	cc.mutex.Lock()
+	cc.cleanedUp = true
+	cc.mutex.Unlock()
+
 	cc.cleanupEventer()
+	cc.cleanupTransformer()
 	cc.cleanupSinker()
+	cc.cleanupClosers()
 }
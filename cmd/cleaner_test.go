@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
 )
 
 type mockEventerCloser struct {
@@ -19,6 +20,19 @@ func (mec *mockEventerCloser) Close() error {
 	return nil
 }
 
+type mockTransformerCloser struct {
+	closeCalled bool
+}
+
+func (*mockTransformerCloser) Transform(e *event.Event) ([]*event.Event, error) {
+	return []*event.Event{e}, nil
+}
+
+func (mtc *mockTransformerCloser) Close() error {
+	mtc.closeCalled = true
+	return nil
+}
+
 type mockSinkerCloser struct {
 	closeCalled bool
 }
@@ -44,6 +58,18 @@ func TestCleanerCleansEventer(t *testing.T) {
 	}
 }
 
+func TestCleanerCleansTransformer(t *testing.T) {
+	mockTransformerCloser := new(mockTransformerCloser)
+
+	cleaner := new(closingCleaner)
+	cleaner.registerTransformer(mockTransformerCloser)
+	cleaner.cleanupTransformer()
+
+	if !mockTransformerCloser.closeCalled {
+		t.Error("expected transformerCloser to be closed, but was not")
+	}
+}
+
 func TestCleanerCleansSinker(t *testing.T) {
 	mockSinkerCloser := new(mockSinkerCloser)
 
@@ -73,3 +99,91 @@ func TestCleanerCleansAll(t *testing.T) {
 		t.Error("expected sinkerrCloser to be closed, but was not")
 	}
 }
+
+func TestCleanerCleansMultipleSinkers(t *testing.T) {
+	mockSinkerClosers := []*mockSinkerCloser{new(mockSinkerCloser), new(mockSinkerCloser)}
+
+	cleaner := new(closingCleaner)
+	for _, mockSinkerCloser := range mockSinkerClosers {
+		cleaner.registerSinker(mockSinkerCloser)
+	}
+	cleaner.cleanupSinker()
+
+	for i, mockSinkerCloser := range mockSinkerClosers {
+		if !mockSinkerCloser.closeCalled {
+			t.Errorf("expected sinkerCloser %d to be closed, but was not", i)
+		}
+	}
+}
+
+func TestCleanerCleansMultipleEventers(t *testing.T) {
+	mockEventerClosers := []*mockEventerCloser{new(mockEventerCloser), new(mockEventerCloser)}
+
+	cleaner := new(closingCleaner)
+	for _, mockEventerCloser := range mockEventerClosers {
+		cleaner.registerEventer(mockEventerCloser)
+	}
+	cleaner.cleanupEventer()
+
+	for i, mockEventerCloser := range mockEventerClosers {
+		if !mockEventerCloser.closeCalled {
+			t.Errorf("expected eventerCloser %d to be closed, but was not", i)
+		}
+	}
+}
+
+type mockCloser struct {
+	closeCalled bool
+}
+
+func (mc *mockCloser) Close() error {
+	mc.closeCalled = true
+	return nil
+}
+
+func TestCleanerCleansAllClosesClosers(t *testing.T) {
+	mockCloser := new(mockCloser)
+
+	cleaner := new(closingCleaner)
+	cleaner.registerCloser(mockCloser)
+	cleaner.cleanupAll()
+
+	if !mockCloser.closeCalled {
+		t.Error("expected closer to be closed, but was not")
+	}
+}
+
+func TestCleanerReleasesSinkers(t *testing.T) {
+	releasedSinkerCloser := new(mockSinkerCloser)
+	keptSinkerCloser := new(mockSinkerCloser)
+
+	cleaner := new(closingCleaner)
+	cleaner.registerSinker(releasedSinkerCloser)
+	cleaner.registerSinker(keptSinkerCloser)
+	cleaner.releaseSinkers([]sink.Sinker{releasedSinkerCloser})
+
+	if !releasedSinkerCloser.closeCalled {
+		t.Error("expected released sinkerCloser to be closed, but was not")
+	}
+
+	if keptSinkerCloser.closeCalled {
+		t.Error("expected kept sinkerCloser not to be closed, but was")
+	}
+
+	cleaner.cleanupAll()
+	if !keptSinkerCloser.closeCalled {
+		t.Error("expected kept sinkerCloser to be closed on cleanup, but was not")
+	}
+}
+
+func TestCleanerClosesSinkerRegisteredAfterCleanup(t *testing.T) {
+	mockSinkerCloser := new(mockSinkerCloser)
+
+	cleaner := new(closingCleaner)
+	cleaner.cleanupAll()
+	cleaner.registerSinker(mockSinkerCloser)
+
+	if !mockSinkerCloser.closeCalled {
+		t.Error("expected sinkerCloser registered after cleanup to be closed, but was not")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jhwbarlow/tcp-audit/pkg/config"
+)
+
+const (
+	configFlagStr = "config"
+	envVarPrefix  = "TCP_AUDIT_"
+)
+
+// ConfigFlag is only registered so that it appears in the usage and is accepted by
+// flag.Parse. Its value is found before the flags are parsed, by configPath, as the
+// configuration file must be applied first so that flags override it.
+var configFlag = flag.String(configFlagStr, "", "path to YAML configuration file, or TOML if it ends in .toml (settings in it are overridden by "+envVarPrefix+"* environment variables, which are overridden by flags)")
+
+// ConfigSettings maps the keys of the scalar settings in the configuration file to the
+// flags they set.
+var configSettings = map[string]string{
+	"max-consecutive-errors":       maxErrorsFlagStr,
+	"queue.size":                   queueSizeFlagStr,
+	"queue.policy":                 queuePolicyFlagStr,
+	"spool.dir":                    spoolDirFlagStr,
+	"spool.max-bytes":              spoolMaxBytesFlagStr,
+	"spool.fsync":                  spoolFsyncFlagStr,
+	"spool.replay-interval":        spoolReplayFlagStr,
+	"retry.attempts":               retryAttemptsFlagStr,
+	"retry.initial-backoff":        retryInitialFlagStr,
+	"retry.max-backoff":            retryMaxFlagStr,
+	"retry.jitter":                 retryJitterFlagStr,
+	"dead-letter.file":             deadLetterFileFlagStr,
+	"metrics.addr":                 metricsAddrFlagStr,
+	"health.addr":                  healthAddrFlagStr,
+	"health.stall-timeout":         stallTimeoutFlagStr,
+	"batch.size":                   batchSizeFlagStr,
+	"batch.interval":               batchIntervalFlagStr,
+	"sink-timeout":                 sinkTimeoutFlagStr,
+	"tee-console":                  teeConsoleFlagStr,
+	"record":                       recordFlagStr,
+	"flows.idle-timeout":           flowIdleTimeoutFlagStr,
+	"flows.max":                    flowMaxFlagStr,
+	"handshakes.metrics":           handshakeMetricsFlagStr,
+	"handshakes.timeout-threshold": handshakeTimeoutThresholdFlagStr,
+	"handshakes.max-pending":       handshakeMaxPendingFlagStr,
+	"alerts.rules":                 alertRulesFlagStr,
+	"alerts.log":                   alertLogFlagStr,
+}
+
+// PluginFlagStrs are the names of the flags which describe a plugin.
+type pluginFlagStrs struct {
+	path    string
+	opt     string
+	optFile string
+}
+
+// ConfigPluginLists maps the keys of the plugin lists in the configuration file to the
+// flags they set.
+var configPluginLists = map[string]pluginFlagStrs{
+	"eventers":     {eventerFlagStr, eventerOptFlagStr, eventerOptFileFlagStr},
+	"transformers": {transformerFlagStr, transformerOptFlagStr, transformerOptFileFlagStr},
+	"sinkers":      {sinkerFlagStr, sinkerOptFlagStr, sinkerOptFileFlagStr},
+}
+
+// ConfigPlugins maps the keys of the single plugins in the configuration file to the
+// flags they set.
+var configPlugins = map[string]pluginFlagStrs{
+	"dead-letter.sink": {deadLetterSinkFlagStr, deadLetterSinkOptFlagStr, deadLetterSinkOptFileFlagStr},
+	"flows.sink":       {flowSinkFlagStr, flowSinkOptFlagStr, flowSinkOptFileFlagStr},
+	"handshakes.sink":  {handshakeSinkFlagStr, handshakeSinkOptFlagStr, handshakeSinkOptFileFlagStr},
+	"alerts.sink":      {alertSinkFlagStr, alertSinkOptFlagStr, alertSinkOptFileFlagStr},
+}
+
+func configSchema() *config.Schema {
+	schema := new(config.Schema)
+	for key := range configSettings {
+		schema.Settings = append(schema.Settings, key)
+	}
+
+	for key := range configPlugins {
+		schema.Plugins = append(schema.Plugins, key)
+	}
+
+	for key := range configPluginLists {
+		schema.PluginLists = append(schema.PluginLists, key)
+	}
+
+	return schema
+}
+
+// ConfigSources records the position in the configuration file of each flag set from it,
+// so that errors found when the flags are checked can be reported at that position.
+type configSources struct {
+	positions map[string]config.Position
+	values    map[string]string // The value of each flag as set from the file
+}
+
+// Position returns the position in the configuration file of the flag's value, if the
+// value still comes from the file, or false if it does not.
+func (cs *configSources) position(flags *flag.FlagSet, name string) (config.Position, bool) {
+	if cs == nil {
+		return config.Position{}, false
+	}
+
+	position, ok := cs.positions[name]
+	if !ok || flags.Lookup(name).Value.String() != cs.values[name] {
+		return config.Position{}, false
+	}
+
+	return position, true
+}
+
+// LoadConfig applies the configuration file and then the environment to the flags, before
+// the command-line is parsed. Each layer overrides the one before it. Plugins given in a
+// layer replace, rather than add to, those given in the layers before it.
+// Every error found is returned.
+func loadConfig(flags *flag.FlagSet,
+	args []string,
+	lookupEnv func(string) (string, bool),
+	pluginFlagsList []*pluginFlags) (*configSources, error) {
+	var errs config.Errors
+
+	var sources *configSources
+	if path := configPath(flags, args, lookupEnv); path != "" {
+		file, err := config.ParseFile(path, configSchema())
+		if err != nil {
+			return nil, err
+		}
+
+		sources, errs = applyConfigFile(flags, file)
+	}
+	overridePluginFlags(pluginFlagsList)
+
+	flags.VisitAll(func(f *flag.Flag) {
+		name := envVarName(f.Name)
+		if value, ok := lookupEnv(name); ok {
+			if err := flags.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("environment variable %s: %w", name, err))
+			}
+		}
+	})
+	overridePluginFlags(pluginFlagsList)
+
+	return sources, errs.Err()
+}
+
+func overridePluginFlags(pluginFlagsList []*pluginFlags) {
+	for _, pf := range pluginFlagsList {
+		pf.override()
+	}
+}
+
+// ApplyConfigFile sets the flags from the settings and plugins in the configuration file.
+func applyConfigFile(flags *flag.FlagSet, file *config.File) (*configSources, config.Errors) {
+	sources := &configSources{
+		positions: make(map[string]config.Position),
+		values:    make(map[string]string),
+	}
+
+	var errs config.Errors
+	set := func(name, value string, position config.Position, key string) {
+		if err := flags.Set(name, value); err != nil {
+			errs = append(errs, &config.Error{Position: position, Msg: fmt.Sprintf("%s: %v", key, err)})
+			return
+		}
+
+		sources.positions[name] = position
+		sources.values[name] = flags.Lookup(name).Value.String()
+	}
+
+	for _, key := range file.SortedSettings() {
+		value := file.Settings[key]
+		set(configSettings[key], value.Value, value.Position, key)
+	}
+
+	applyPlugin := func(plugin config.Plugin, flagStrs pluginFlagStrs, key string) {
+		set(flagStrs.path, plugin.Path.Value, plugin.Path.Position, key)
+		for _, option := range plugin.Options {
+			set(flagStrs.opt, option.Key+"="+option.Value.Value, option.Value.Position, key)
+		}
+
+		if plugin.OptionsFile != nil {
+			set(flagStrs.optFile, plugin.OptionsFile.Value, plugin.OptionsFile.Position, key)
+		}
+	}
+
+	for _, key := range sortedKeys(configPlugins) {
+		if plugin, ok := file.Plugins[key]; ok {
+			applyPlugin(plugin, configPlugins[key], key)
+		}
+	}
+
+	for _, key := range sortedKeys(configPluginLists) {
+		for _, plugin := range file.PluginLists[key] {
+			applyPlugin(plugin, configPluginLists[key], key)
+		}
+	}
+
+	return sources, errs
+}
+
+func sortedKeys(m map[string]pluginFlagStrs) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// ConfigPath returns the path of the configuration file given on the command-line or,
+// failing that, in the environment. The command-line is searched by hand, as the file
+// must be applied before the command-line is parsed.
+func configPath(flags *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break // As flag.Parse does, stop at the first non-flag argument
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			if strings.HasPrefix(name, configFlagStr+"=") {
+				return strings.TrimPrefix(name, configFlagStr+"=")
+			}
+			continue
+		}
+
+		if name == configFlagStr && i+1 < len(args) {
+			return args[i+1]
+		}
+
+		// Skip the value of a non-boolean flag
+		if f := flags.Lookup(name); f != nil {
+			if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !boolFlag.IsBoolFlag() {
+				i++
+			}
+		}
+	}
+
+	if path, ok := lookupEnv(envVarName(configFlagStr)); ok {
+		return path
+	}
+
+	return ""
+}
+
+// EnvVarName returns the name of the environment variable which sets the flag,
+// for example TCP_AUDIT_SINK_RETRY_ATTEMPTS for sink-retry-attempts.
+func envVarName(flagName string) string {
+	return envVarPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// FlagError is an error in the value of a flag.
+type flagError struct {
+	flag string
+	msg  string
+}
+
+func (fe *flagError) Error() string {
+	return fe.flag + " " + fe.msg
+}
+
+// LocateFlagErrors returns the errors, with those in flags set from the configuration file
+// reported at their position in the file.
+func locateFlagErrors(err error, flags *flag.FlagSet, sources *configSources) error {
+	var errs config.Errors
+	if !errors.As(err, &errs) {
+		errs = config.Errors{err}
+	}
+
+	located := make(config.Errors, 0, len(errs))
+	for _, err := range errs {
+		var flagErr *flagError
+		if errors.As(err, &flagErr) {
+			if position, ok := sources.position(flags, flagErr.flag); ok {
+				err = &config.Error{Position: position, Msg: flagErr.Error()}
+			}
+		}
+
+		located = append(located, err)
+	}
+
+	return located.Err()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit/pkg/config"
+)
+
+type testConfigFlags struct {
+	flags        *flag.FlagSet
+	sinkers      *pluginFlags
+	queueSize    *int
+	queuePolicy  *string
+	stallTimeout *time.Duration
+}
+
+func newTestConfigFlags() *testConfigFlags {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	return &testConfigFlags{
+		flags:        flags,
+		sinkers:      registerPluginFlags(flags, sinkerFlagStr, sinkerOptFlagStr, sinkerOptFileFlagStr, "sinker"),
+		queueSize:    flags.Int(queueSizeFlagStr, 0, ""),
+		queuePolicy:  flags.String(queuePolicyFlagStr, "block", ""),
+		stallTimeout: flags.Duration(stallTimeoutFlagStr, time.Minute, ""),
+	}
+}
+
+func (tcf *testConfigFlags) load(t *testing.T, args []string, env map[string]string) (*configSources, error) {
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	sources, err := loadConfig(tcf.flags, args, lookupEnv, []*pluginFlags{tcf.sinkers})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tcf.flags.Parse(args); err != nil {
+		t.Fatalf("parsing flags: %v", err)
+	}
+
+	return sources, nil
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+
+	return path
+}
+
+const testConfigFile = `
+queue:
+  size: 100
+  policy: drop-oldest
+sinkers:
+  - path: a.so
+    options:
+      host: db.example.com
+  - b.so
+`
+
+func TestLoadConfig(t *testing.T) {
+	tcf := newTestConfigFlags()
+	tcf.flags.String(configFlagStr, "", "")
+	path := writeConfigFile(t, testConfigFile)
+
+	if _, err := tcf.load(t, []string{"--" + configFlagStr, path}, nil); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if *tcf.queueSize != 100 || *tcf.queuePolicy != "drop-oldest" {
+		t.Errorf("expected queue of 100 with drop-oldest policy, got %d with %s", *tcf.queueSize, *tcf.queuePolicy)
+	}
+
+	paths := tcf.sinkers.paths()
+	if len(paths) != 2 || paths[0] != "a.so" || paths[1] != "b.so" {
+		t.Errorf("expected sinkers a.so and b.so, got %v", paths)
+	}
+
+	if host := tcf.sinkers.plugins[0].opts["host"]; host != "db.example.com" {
+		t.Errorf("expected host option of first sinker to be db.example.com, got %q", host)
+	}
+}
+
+// TestLoadConfigPrecedence tests that the environment overrides the configuration file,
+// and the command-line overrides both
+func TestLoadConfigPrecedence(t *testing.T) {
+	tcf := newTestConfigFlags()
+	path := writeConfigFile(t, testConfigFile)
+	env := map[string]string{
+		"TCP_AUDIT_CONFIG":       path,
+		"TCP_AUDIT_QUEUE_SIZE":   "200",
+		"TCP_AUDIT_QUEUE_POLICY": "block",
+		"TCP_AUDIT_SINK":         "c.so",
+	}
+	args := []string{"--" + queuePolicyFlagStr, "drop-newest", "--" + sinkerOptFlagStr, "port=5432"}
+
+	if _, err := tcf.load(t, args, env); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if *tcf.queueSize != 200 {
+		t.Errorf("expected queue size from environment of 200, got %d", *tcf.queueSize)
+	}
+
+	if *tcf.queuePolicy != "drop-newest" {
+		t.Errorf("expected queue policy from command-line of drop-newest, got %s", *tcf.queuePolicy)
+	}
+
+	specs, err := tcf.sinkers.specs()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(specs) != 1 || specs[0].name != "c.so" {
+		t.Fatalf("expected sinkers from environment to replace those in file, got %v", tcf.sinkers.paths())
+	}
+
+	if port := specs[0].config["port"]; port != "5432" {
+		t.Errorf("expected command-line option to apply to sinker from environment, got %q", port)
+	}
+}
+
+func TestLoadConfigCommandLineReplacesPlugins(t *testing.T) {
+	tcf := newTestConfigFlags()
+	path := writeConfigFile(t, testConfigFile)
+	args := []string{"--config=" + path, "--" + sinkerFlagStr, "c.so", "--" + sinkerFlagStr, "d.so"}
+	tcf.flags.String(configFlagStr, "", "")
+
+	if _, err := tcf.load(t, args, nil); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	paths := tcf.sinkers.paths()
+	if len(paths) != 2 || paths[0] != "c.so" || paths[1] != "d.so" {
+		t.Errorf("expected sinkers c.so and d.so, got %v", paths)
+	}
+}
+
+// TestLoadConfigErrors tests that every invalid setting is reported at its position
+func TestLoadConfigErrors(t *testing.T) {
+	tcf := newTestConfigFlags()
+	path := writeConfigFile(t, "queue:\n  size: lots\nhealth:\n  stall-timeout: soon\n")
+
+	_, err := tcf.load(t, nil, map[string]string{"TCP_AUDIT_CONFIG": path})
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	var errs config.Errors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+
+	if !strings.HasPrefix(errs[0].Error(), path+":4:18: health.stall-timeout:") {
+		t.Errorf("expected error at position of stall-timeout, got %q", errs[0])
+	}
+
+	if !strings.HasPrefix(errs[1].Error(), path+":2:9: queue.size:") {
+		t.Errorf("expected error at position of queue size, got %q", errs[1])
+	}
+}
+
+func TestLocateFlagErrors(t *testing.T) {
+	tcf := newTestConfigFlags()
+	path := writeConfigFile(t, "queue:\n  size: -1\n  policy: sideways\n")
+
+	sources, err := tcf.load(t, []string{"--" + queuePolicyFlagStr, "sometimes"}, map[string]string{"TCP_AUDIT_CONFIG": path})
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	flagErrs := config.Errors{
+		&flagError{queueSizeFlagStr, "must not be negative"},
+		&flagError{queuePolicyFlagStr, "is unknown"},
+	}
+	err = locateFlagErrors(flagErrs, tcf.flags, sources)
+
+	expected := path + ":2:9: " + queueSizeFlagStr + " must not be negative\n" +
+		queuePolicyFlagStr + " is unknown" // Set on the command-line, so has no position
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.String(sinkerFlagStr, "", "")
+	flags.Bool("verbose", false, "")
+	noEnv := func(string) (string, bool) { return "", false }
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"--config", "a.yaml"}, "a.yaml"},
+		{[]string{"-config=a.yaml"}, "a.yaml"},
+		{[]string{"--sink", "--config", "--config", "a.yaml"}, "a.yaml"},
+		{[]string{"--verbose", "--config", "a.yaml"}, "a.yaml"},
+		{[]string{"--sink=x.so", "--config", "a.yaml"}, "a.yaml"},
+		{[]string{"--", "--config", "a.yaml"}, ""},
+		{[]string{"arg", "--config", "a.yaml"}, ""},
+	}
+
+	for _, test := range tests {
+		if path := configPath(flags, test.args, noEnv); path != test.expected {
+			t.Errorf("args %v: expected %q, got %q", test.args, test.expected, path)
+		}
+	}
+}
+
+func TestEnvVarName(t *testing.T) {
+	if name := envVarName(retryAttemptsFlagStr); name != "TCP_AUDIT_SINK_RETRY_ATTEMPTS" {
+		t.Errorf("expected TCP_AUDIT_SINK_RETRY_ATTEMPTS, got %s", name)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/deadletter"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+	"github.com/jhwbarlow/tcp-audit/pkg/record"
+)
+
+const (
+	dlqCommandStr       = "dlq"
+	dlqReplayCommandStr = "replay"
+
+	deadLetterFileFlagStr        = "dead-letter-file"
+	deadLetterSinkFlagStr        = "dead-letter-sink"
+	deadLetterSinkOptFlagStr     = "dead-letter-sink-opt"
+	deadLetterSinkOptFileFlagStr = "dead-letter-sink-opt-file"
+	dlqFileFlagStr               = "file"
+	dlqFailedFileFlagStr         = "failed-file"
+)
+
+var (
+	deadLetterFileFlag        = flag.String(deadLetterFileFlagStr, "", "path to file to which events that could not be sunk are appended as newline-delimited JSON")
+	deadLetterSinkFlag        = flag.String(deadLetterSinkFlagStr, "", "path to sinker plugin to which events that could not be sunk are sent")
+	deadLetterSinkOptFlag     = optsFlag(flag.CommandLine, deadLetterSinkOptFlagStr, "dead-letter sinker plugin option of the form key=value (may be repeated)")
+	deadLetterSinkOptFileFlag = flag.String(deadLetterSinkOptFileFlagStr, "", "path to file of dead-letter sinker plugin options, one key=value per line")
+)
+
+func optsFlag(flags *flag.FlagSet, name, usage string) pluginconfig.Config {
+	opts := make(pluginconfig.Config)
+	flags.Var(opts, name, usage)
+	return opts
+}
+
+func checkDeadLetterFlags() error {
+	if *deadLetterFileFlag != "" && *deadLetterSinkFlag != "" {
+		return &flagError{deadLetterSinkFlagStr, "and " + deadLetterFileFlagStr + " are mutually exclusive"}
+	}
+
+	return nil
+}
+
+// NewDeadLetterer returns the dead-letterer requested on the command-line, or nil if
+// dead-lettering is disabled. The dead-letterer is registered with the cleaner.
+func newDeadLetterer(cleaner cleaner) (deadletter.DeadLetterer, error) {
+	switch {
+	case *deadLetterFileFlag != "":
+		deadLetterer, err := deadletter.NewFileDeadLetterer(*deadLetterFileFlag)
+		if err != nil {
+			return nil, err
+		}
+		cleaner.registerCloser(deadLetterer)
+
+		return deadLetterer, nil
+	case *deadLetterSinkFlag != "":
+		sinker, err := initRecordSinkerFromFlags(cleaner, *deadLetterSinkFlag, *deadLetterSinkOptFileFlag, deadLetterSinkOptFlag)
+		if err != nil {
+			return nil, err
+		}
+
+		return deadletter.NewSinkerDeadLetterer(sinker), nil
+	default:
+		return nil, nil
+	}
+}
+
+func initSinkerFromFlags(path, optFilePath string, opts pluginconfig.Config) (sink.Sinker, error) {
+	config, err := pluginConfig(optFilePath, opts)
+	if err != nil {
+		return nil, fmt.Errorf("options for sinker %s: %w", path, err)
+	}
+
+	loader, err := symbolLoader("sinker", path)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := pluginSpec{
+		name:   path,
+		loader: loader,
+		config: config,
+	}
+
+	sinker, err := initSinkerPlugin(spec)
+	if err != nil {
+		return nil, fmt.Errorf("initialising sinker %s: %w", path, err)
+	}
+
+	return sinker, nil
+}
+
+// InitRecordSinkerFromFlags initialises a sinker as initSinkerFromFlags does, and
+// registers it with the cleaner, returning an error if it does not sink records.
+func initRecordSinkerFromFlags(cleaner cleaner, path, optFilePath string, opts pluginconfig.Config) (record.Sinker, error) {
+	sinker, err := initSinkerFromFlags(path, optFilePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	cleaner.registerSinker(sinker)
+
+	recordSinker, ok := record.AsSinker(sinker)
+	if !ok {
+		return nil, fmt.Errorf("sinker %s does not sink records, as it has no SinkRecord method", path)
+	}
+
+	return recordSinker, nil
+}
+
+// RunDLQ runs the dlq subcommand. The only action is "replay", which re-submits the events
+// in a dead-letter file to a sinker. Events which fail again are optionally appended to
+// another dead-letter file.
+func runDLQ(args []string) error {
+	if len(args) == 0 || args[0] != dlqReplayCommandStr {
+		return errors.New("usage: tcp-audit " + dlqCommandStr + " " + dlqReplayCommandStr + " --file <path> --sink <path> [options]")
+	}
+
+	flags := flag.NewFlagSet(dlqCommandStr+" "+dlqReplayCommandStr, flag.ContinueOnError)
+	fileFlag := flags.String(dlqFileFlagStr, "", "path to dead-letter file to replay")
+	sinkFlag := flags.String(sinkerFlagStr, "", "path to sinker plugin to which events are replayed")
+	sinkOptFlag := optsFlag(flags, sinkerOptFlagStr, "sinker plugin option of the form key=value (may be repeated)")
+	sinkOptFileFlag := flags.String(sinkerOptFileFlagStr, "", "path to file of sinker plugin options, one key=value per line")
+	failedFileFlag := flags.String(dlqFailedFileFlagStr, "", "path to dead-letter file to which events which fail to replay are appended")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *fileFlag == "" {
+		return errors.New(dlqFileFlagStr + " not supplied")
+	}
+
+	if *sinkFlag == "" {
+		return errors.New(sinkerFlagStr + " not supplied")
+	}
+
+	file, err := os.Open(*fileFlag)
+	if err != nil {
+		return fmt.Errorf("opening dead-letter file: %w", err)
+	}
+	defer file.Close()
+
+	if *failedFileFlag != "" {
+		same, err := sameFile(file, *failedFileFlag)
+		if err != nil {
+			return err
+		}
+
+		if same {
+			// Replaying would append to the file being read, and might never finish
+			return errors.New(dlqFailedFileFlagStr + " must not be the file being replayed")
+		}
+	}
+
+	cleaner := new(closingCleaner)
+	defer cleaner.cleanupAll()
+
+	var failedDeadLetterer deadletter.DeadLetterer
+	if *failedFileFlag != "" {
+		fileDeadLetterer, err := deadletter.NewFileDeadLetterer(*failedFileFlag)
+		if err != nil {
+			return err
+		}
+		cleaner.registerCloser(fileDeadLetterer)
+		failedDeadLetterer = fileDeadLetterer
+	}
+
+	sinker, err := initSinkerFromFlags(*sinkFlag, *sinkOptFileFlag, sinkOptFlag)
+	if err != nil {
+		return err
+	}
+	cleaner.registerSinker(sinker)
+
+	replayed, failed, err := replayDeadLetters(deadletter.NewReader(file), sinker, failedDeadLetterer)
+	log.Printf("replayed %d dead-lettered events, %d failed", replayed, failed)
+	if err != nil {
+		return err
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d events failed to replay", failed)
+	}
+
+	return nil
+}
+
+// SameFile returns whether the path is of the open file. A path which does not exist is
+// not.
+func sameFile(file *os.File, path string) (bool, error) {
+	if filepath.Clean(file.Name()) == filepath.Clean(path) {
+		return true, nil
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("getting dead-letter file info: %w", err)
+	}
+
+	pathInfo, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("getting failed dead-letter file info: %w", err)
+	}
+
+	return os.SameFile(fileInfo, pathInfo), nil
+}
+
+// ReplayDeadLetters sinks the event of each record read from the reader. Records whose
+// events fail to sink again are sent to the failed dead-letterer, if not nil, with their
+// attempt count incremented.
+func replayDeadLetters(reader *deadletter.Reader,
+	sinker sink.Sinker,
+	failedDeadLetterer deadletter.DeadLetterer) (replayed, failed int, err error) {
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return replayed, failed, nil
+		}
+
+		if err != nil {
+			return replayed, failed, err
+		}
+
+		if sinkErr := sinker.Sink(record.Event); sinkErr != nil {
+			log.Printf("Error: replaying event: %v", sinkErr)
+			failed++
+
+			if failedDeadLetterer != nil {
+				record.Time = time.Now()
+				record.Error = sinkErr.Error()
+				record.Attempts++
+				if err := failedDeadLetterer.DeadLetter(record); err != nil {
+					return replayed, failed, err
+				}
+			}
+
+			continue
+		}
+
+		replayed++
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/deadletter"
+)
+
+type mockReplaySinker struct {
+	errs   []error
+	events []*event.Event
+}
+
+func (mrs *mockReplaySinker) Sink(event *event.Event) error {
+	var err error
+	if len(mrs.errs) != 0 {
+		err, mrs.errs = mrs.errs[0], mrs.errs[1:]
+	}
+
+	if err == nil {
+		mrs.events = append(mrs.events, event)
+	}
+
+	return err
+}
+
+type mockRecordingDeadLetterer struct {
+	records []*deadletter.Record
+}
+
+func (mrdl *mockRecordingDeadLetterer) DeadLetter(record *deadletter.Record) error {
+	mrdl.records = append(mrdl.records, record)
+	return nil
+}
+
+func mockDeadLetterFile(t *testing.T, noRecords int) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	for i := 0; i < noRecords; i++ {
+		record := &deadletter.Record{
+			Time: time.Now(),
+			Event: &event.Event{
+				Time:         time.Now(),
+				PIDOnCPU:     7337,
+				CommandOnCPU: "test",
+				SourceIP:     net.ParseIP("1.2.3.4"),
+				DestIP:       net.ParseIP("7.3.3.7"),
+				SourcePort:   uint16(1234 + i),
+				DestPort:     7337,
+				OldState:     tcpstate.StateClosed,
+				NewState:     tcpstate.StateSynReceived,
+			},
+			Error:    "mock sinker error",
+			Attempts: 1,
+		}
+
+		if err := json.NewEncoder(buf).Encode(record); err != nil {
+			t.Fatalf("writing mock dead-letter record: %v", err)
+		}
+	}
+
+	return buf
+}
+
+// TestReplayDeadLetters tests that every dead-lettered event is sunk
+func TestReplayDeadLetters(t *testing.T) {
+	mockSinker := new(mockReplaySinker)
+	reader := deadletter.NewReader(mockDeadLetterFile(t, 3))
+
+	replayed, failed, err := replayDeadLetters(reader, mockSinker, nil)
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if replayed != 3 || failed != 0 {
+		t.Errorf("expected 3 replayed and 0 failed, got %d and %d", replayed, failed)
+	}
+
+	for i, event := range mockSinker.events {
+		if event.SourcePort != uint16(1234+i) {
+			t.Errorf("expected events to be replayed in order, got source port %d at %d", event.SourcePort, i)
+		}
+	}
+}
+
+// TestReplayDeadLettersFailure tests that events which fail to replay are sent
+// to the failed dead-letterer with their attempt count incremented
+func TestReplayDeadLettersFailure(t *testing.T) {
+	mockError := errors.New("mock replay error")
+	mockSinker := &mockReplaySinker{errs: []error{nil, mockError}}
+	mockDeadLetterer := new(mockRecordingDeadLetterer)
+	reader := deadletter.NewReader(mockDeadLetterFile(t, 3))
+
+	replayed, failed, err := replayDeadLetters(reader, mockSinker, mockDeadLetterer)
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if replayed != 2 || failed != 1 {
+		t.Errorf("expected 2 replayed and 1 failed, got %d and %d", replayed, failed)
+	}
+
+	if len(mockDeadLetterer.records) != 1 {
+		t.Fatalf("expected 1 dead-lettered record, got %d", len(mockDeadLetterer.records))
+	}
+
+	record := mockDeadLetterer.records[0]
+	if record.Error != mockError.Error() {
+		t.Errorf("expected error text %q, got %q", mockError.Error(), record.Error)
+	}
+
+	if record.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", record.Attempts)
+	}
+}
+
+// TestReplayDeadLettersCorrupt tests that a corrupt dead-letter file causes an error
+func TestReplayDeadLettersCorrupt(t *testing.T) {
+	mockSinker := new(mockReplaySinker)
+	reader := deadletter.NewReader(strings.NewReader("not json\n"))
+
+	_, _, err := replayDeadLetters(reader, mockSinker, nil)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+// TestRunDLQUnknownAction tests that an unknown dlq action is rejected
+func TestRunDLQUnknownAction(t *testing.T) {
+	err := runDLQ([]string{"unknown"})
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestRunDLQFailedFileIsReplayedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dead-letters.jsonl")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	link := filepath.Join(dir, "link.jsonl")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	for _, failedPath := range []string{dir + "/./dead-letters.jsonl", link} {
+		err := runDLQ([]string{dlqReplayCommandStr,
+			"--" + dlqFileFlagStr, path,
+			"--" + sinkerFlagStr, "builtin:jsonl",
+			"--" + dlqFailedFileFlagStr, failedPath})
+		if err == nil {
+			t.Errorf("expected error for failed file %s, got nil", failedPath)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
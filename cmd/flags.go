@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+)
+
+// PluginFlags collects the paths of a repeatable plugin flag, along with the options
+// and options file given for each plugin.
+// Each option applies to the most recently given plugin path. Options given before
+// any plugin path apply to the first plugin.
+// Flags are set in layers (the configuration file, the environment and the command-line).
+// Plugin paths given in a layer replace those given in the layers before it.
+type pluginFlags struct {
+	kind       string
+	plugins    []*pluginFlag
+	pending    *pluginFlag
+	overriding bool // A new layer has begun, in which no plugin path has yet been given
+}
+
+type pluginFlag struct {
+	path    string
+	opts    pluginconfig.Config
+	optFile string
+}
+
+func newPluginFlag() *pluginFlag {
+	return &pluginFlag{opts: make(pluginconfig.Config)}
+}
+
+// RegisterPluginFlags registers the path, option and options file flags for a plugin kind.
+func registerPluginFlags(flags *flag.FlagSet, pathFlagStr, optFlagStr, optFileFlagStr, kind string) *pluginFlags {
+	pf := &pluginFlags{kind: kind}
+	flags.Var(pluginPathValue{pf}, pathFlagStr, "path to "+kind+" plugin, or "+builtinPrefix+"<name> for a built-in "+kind+" (may be repeated)")
+	flags.Var(pluginOptValue{pf}, optFlagStr, kind+" plugin option of the form key=value (may be repeated, applies to the preceding "+kind+")")
+	flags.Var(pluginOptFileValue{pf}, optFileFlagStr, "path to file of "+kind+" plugin options, one key=value per line (applies to the preceding "+kind+")")
+	return pf
+}
+
+// Override begins a new layer.
+func (pf *pluginFlags) override() {
+	pf.overriding = true
+}
+
+func (pf *pluginFlags) paths() []string {
+	paths := make([]string, 0, len(pf.plugins))
+	for _, plugin := range pf.plugins {
+		paths = append(paths, plugin.path)
+	}
+
+	return paths
+}
+
+// Specs returns the specifications needed to load each of the plugins given on the
+// command-line.
+func (pf *pluginFlags) specs() ([]pluginSpec, error) {
+	// Options given in the last layer, before any plugin path, apply to the first plugin
+	// of an earlier layer
+	if pf.pending != nil && len(pf.plugins) != 0 {
+		pf.plugins[0].opts.Merge(pf.pending.opts)
+		if pf.pending.optFile != "" {
+			pf.plugins[0].optFile = pf.pending.optFile
+		}
+		pf.pending = nil
+	}
+
+	specs := make([]pluginSpec, 0, len(pf.plugins))
+	for _, plugin := range pf.plugins {
+		config, err := pluginConfig(plugin.optFile, plugin.opts)
+		if err != nil {
+			return nil, fmt.Errorf("options for plugin %s: %w", plugin.path, err)
+		}
+
+		loader, err := symbolLoader(pf.kind, plugin.path)
+		if err != nil {
+			return nil, err
+		}
+
+		specs = append(specs, pluginSpec{
+			name:   plugin.path,
+			loader: loader,
+			config: config,
+		})
+	}
+
+	return specs, nil
+}
+
+// Current returns the plugin to which options should be applied.
+func (pf *pluginFlags) current() *pluginFlag {
+	if len(pf.plugins) != 0 && !pf.overriding {
+		return pf.plugins[len(pf.plugins)-1]
+	}
+
+	if pf.pending == nil {
+		pf.pending = newPluginFlag()
+	}
+
+	return pf.pending
+}
+
+func (pf *pluginFlags) addPath(path string) {
+	if pf.overriding {
+		pf.plugins = nil
+		pf.overriding = false
+	}
+
+	plugin := pf.pending
+	if plugin == nil {
+		plugin = newPluginFlag()
+	}
+	pf.pending = nil
+
+	plugin.path = path
+	pf.plugins = append(pf.plugins, plugin)
+}
+
+type pluginPathValue struct{ *pluginFlags }
+
+func (v pluginPathValue) String() string {
+	if v.pluginFlags == nil {
+		return ""
+	}
+
+	return strings.Join(v.paths(), ",")
+}
+
+func (v pluginPathValue) Set(path string) error {
+	v.addPath(path)
+	return nil
+}
+
+type pluginOptValue struct{ *pluginFlags }
+
+func (v pluginOptValue) String() string {
+	return ""
+}
+
+func (v pluginOptValue) Set(option string) error {
+	return v.current().opts.Set(option)
+}
+
+type pluginOptFileValue struct{ *pluginFlags }
+
+func (v pluginOptFileValue) String() string {
+	return ""
+}
+
+func (v pluginOptFileValue) Set(path string) error {
+	v.current().optFile = path
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestPluginFlagsOptionsApplyToPrecedingPlugin(t *testing.T) {
+	pf := new(pluginFlags)
+	pathValue := pluginPathValue{pf}
+	optValue := pluginOptValue{pf}
+
+	optValue.Set("first=1") // Given before any path, so applies to the first plugin
+	pathValue.Set("first.so")
+	optValue.Set("also-first=1")
+	pathValue.Set("second.so")
+	optValue.Set("second=2")
+
+	if len(pf.plugins) != 2 {
+		t.Fatalf("expected 2 plugins, got %d", len(pf.plugins))
+	}
+
+	first, second := pf.plugins[0], pf.plugins[1]
+	if first.path != "first.so" || second.path != "second.so" {
+		t.Errorf("expected paths first.so and second.so, got %s and %s", first.path, second.path)
+	}
+
+	if len(first.opts) != 2 || first.opts["first"] != "1" || first.opts["also-first"] != "1" {
+		t.Errorf("expected first plugin options first=1,also-first=1, got %v", first.opts)
+	}
+
+	if len(second.opts) != 1 || second.opts["second"] != "2" {
+		t.Errorf("expected second plugin options second=2, got %v", second.opts)
+	}
+}
+
+func TestPluginFlagsSpecs(t *testing.T) {
+	pf := new(pluginFlags)
+	pluginPathValue{pf}.Set("test.so")
+	pluginOptValue{pf}.Set("key=value")
+
+	specs, err := pf.specs()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(specs) != 1 {
+		t.Fatalf("expected 1 spec, got %d", len(specs))
+	}
+
+	if specs[0].name != "test.so" || specs[0].config["key"] != "value" {
+		t.Errorf("expected spec for test.so with key=value, got %s with %v", specs[0].name, specs[0].config)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit/pkg/flow"
+	"github.com/jhwbarlow/tcp-audit/pkg/record"
+)
+
+const (
+	flowSinkFlagStr        = "flow-sink"
+	flowSinkOptFlagStr     = "flow-sink-opt"
+	flowSinkOptFileFlagStr = "flow-sink-opt-file"
+	flowIdleTimeoutFlagStr = "flow-idle-timeout"
+	flowMaxFlagStr         = "flow-max"
+)
+
+var (
+	flowSinkFlag        = flag.String(flowSinkFlagStr, "", "path to sinker plugin to which a flow record of each connection is sunk when it closes (empty to disable flow tracking)")
+	flowSinkOptFlag     = optsFlag(flag.CommandLine, flowSinkOptFlagStr, "flow sinker plugin option of the form key=value (may be repeated)")
+	flowSinkOptFileFlag = flag.String(flowSinkOptFileFlagStr, "", "path to file of flow sinker plugin options, one key=value per line")
+	flowIdleTimeoutFlag = flag.Duration(flowIdleTimeoutFlagStr, time.Hour, "time without an event after which a connection's flow record is sunk with a close path of timeout")
+	flowMaxFlag         = flag.Int(flowMaxFlagStr, 100000, "maximum number of connections tracked, beyond which the least recently seen is sunk with a close path of evicted")
+)
+
+func checkFlowFlags() error {
+	if *flowIdleTimeoutFlag <= 0 {
+		return &flagError{flowIdleTimeoutFlagStr, "must be positive"}
+	}
+
+	if *flowMaxFlag < 1 {
+		return &flagError{flowMaxFlagStr, "must be at least 1"}
+	}
+
+	return nil
+}
+
+// NewFlowTracker returns the flow tracker and flow sinker requested on the command-line,
+// or nil if flow tracking is disabled. The flow sinker is registered with the cleaner.
+func newFlowTracker(cleaner cleaner) (*flow.Tracker, record.Sinker, error) {
+	if *flowSinkFlag == "" {
+		return nil, nil, nil
+	}
+
+	tracker, err := flow.NewTracker(flow.Options{IdleTimeout: *flowIdleTimeoutFlag, MaxFlows: *flowMaxFlag})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sinker, err := initRecordSinkerFromFlags(cleaner, *flowSinkFlag, *flowSinkOptFileFlag, flowSinkOptFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tracker, sinker, nil
+}
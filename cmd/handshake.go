@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit/pkg/handshake"
+	"github.com/jhwbarlow/tcp-audit/pkg/record"
+)
+
+const (
+	handshakeMetricsFlagStr          = "handshake-metrics"
+	handshakeSinkFlagStr             = "handshake-sink"
+	handshakeSinkOptFlagStr          = "handshake-sink-opt"
+	handshakeSinkOptFileFlagStr      = "handshake-sink-opt-file"
+	handshakeTimeoutThresholdFlagStr = "handshake-timeout-threshold"
+	handshakeMaxPendingFlagStr       = "handshake-max-pending"
+)
+
+var (
+	handshakeMetricsFlag          = flag.Bool(handshakeMetricsFlagStr, false, "publish metrics of the time taken by handshakes and how they ended, by the address of the listening side (requires "+metricsAddrFlagStr+")")
+	handshakeSinkFlag             = flag.String(handshakeSinkFlagStr, "", "path to sinker plugin to which the result of each failed handshake is sunk (empty to disable)")
+	handshakeSinkOptFlag          = optsFlag(flag.CommandLine, handshakeSinkOptFlagStr, "handshake sinker plugin option of the form key=value (may be repeated)")
+	handshakeSinkOptFileFlag      = flag.String(handshakeSinkOptFileFlagStr, "", "path to file of handshake sinker plugin options, one key=value per line")
+	handshakeTimeoutThresholdFlag = flag.Duration(handshakeTimeoutThresholdFlagStr, time.Second, "time after which a failed outbound handshake is taken to have timed out, rather than been refused")
+	handshakeMaxPendingFlag       = flag.Int(handshakeMaxPendingFlagStr, 100000, "maximum number of outbound handshakes timed at once, beyond which the oldest is forgotten")
+)
+
+func checkHandshakeFlags() error {
+	if *handshakeMetricsFlag && *metricsAddrFlag == "" {
+		return &flagError{handshakeMetricsFlagStr, "requires " + metricsAddrFlagStr}
+	}
+
+	if *handshakeTimeoutThresholdFlag <= 0 {
+		return &flagError{handshakeTimeoutThresholdFlagStr, "must be positive"}
+	}
+
+	if *handshakeMaxPendingFlag < 1 {
+		return &flagError{handshakeMaxPendingFlagStr, "must be at least 1"}
+	}
+
+	return nil
+}
+
+// NewHandshakeTracker returns the handshake tracker and handshake sinker requested on the
+// command-line. The tracker is nil if handshakes are not tracked, and the sinker is nil if
+// the results of failed handshakes are not sunk. The handshake sinker is registered with
+// the cleaner.
+func newHandshakeTracker(cleaner cleaner) (*handshake.Tracker, record.Sinker, error) {
+	if !*handshakeMetricsFlag && *handshakeSinkFlag == "" {
+		return nil, nil, nil
+	}
+
+	tracker, err := handshake.NewTracker(handshake.Options{
+		TimeoutThreshold: *handshakeTimeoutThresholdFlag,
+		MaxPending:       *handshakeMaxPendingFlag,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if *handshakeSinkFlag == "" {
+		return tracker, nil, nil
+	}
+
+	sinker, err := initRecordSinkerFromFlags(cleaner, *handshakeSinkFlag, *handshakeSinkOptFileFlag, handshakeSinkOptFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tracker, sinker, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+)
+
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+const (
+	minStallTimeout      = time.Second
+	minHeartbeatInterval = time.Millisecond
+)
+
+// HealthChecker is an optional interface which plugins implement to contribute to the
+// health of the process. A non-nil error means the plugin is unhealthy.
+type healthChecker interface {
+	Healthy() error
+}
+
+// NamedHealthChecker is a health checker along with a description of the plugin, for
+// reporting.
+type namedHealthChecker struct {
+	healthChecker
+	name string
+}
+
+// Health tracks the health of the processor.
+// The process is live if the processor loop has iterated within the stall timeout and every
+// plugin health checker is healthy.
+// The process is ready if it is live, the processor is running (and so all plugins have
+// been initialised) and no component's consecutive error count has reached the threshold.
+// The methods may be called on a nil *health, in which case they do nothing.
+type health struct {
+	// Accessed atomically, so must be 64-bit aligned
+	lastIteration int64 // Unix nanoseconds
+	running       int32
+
+	stallTimeout         time.Duration
+	maxConsecutiveErrors int
+	now                  func() time.Time
+
+	mutex             sync.Mutex
+	checkers          []namedHealthChecker
+	sinkerCheckers    []namedHealthChecker // Kept separately, as the sinkers can be replaced
+	consecutiveErrors map[string]int       // Keyed on component and index
+}
+
+func newHealth(stallTimeout time.Duration, maxConsecutiveErrors int) *health {
+	return &health{
+		stallTimeout:         stallTimeout,
+		maxConsecutiveErrors: maxConsecutiveErrors,
+		now:                  time.Now,
+		consecutiveErrors:    make(map[string]int),
+	}
+}
+
+// AddChecker adds a plugin health checker.
+func (h *health) addChecker(name string, checker healthChecker) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.checkers = append(h.checkers, namedHealthChecker{checker, name})
+}
+
+// AddPluginCheckers adds a health checker for each of the plugins which implement one.
+func (h *health) addPluginCheckers(plugins *plugins) {
+	for i, eventer := range plugins.eventers {
+		if checker, ok := eventer.(healthChecker); ok {
+			h.addChecker(fmt.Sprintf("eventer %d", i), checker)
+		}
+	}
+
+	for i, transformer := range plugins.transformers {
+		if checker, ok := transformer.(healthChecker); ok {
+			h.addChecker(fmt.Sprintf("transformer %d", i), checker)
+		}
+	}
+
+	h.setSinkerCheckers(plugins.sinkers)
+}
+
+// SetSinkerCheckers replaces the sinker health checkers with those of the given sinkers
+// which implement one.
+func (h *health) setSinkerCheckers(sinkers []sink.Sinker) {
+	if h == nil {
+		return
+	}
+
+	var checkers []namedHealthChecker
+	for i, sinker := range sinkers {
+		if checker, ok := sinker.(healthChecker); ok {
+			checkers = append(checkers, namedHealthChecker{checker, fmt.Sprintf("sinker %d", i)})
+		}
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.sinkerCheckers = checkers
+}
+
+// HeartbeatInterval returns how often the processor loop must iterate, even if there are
+// no events, to avoid appearing stalled. It is always positive, as a ticker requires.
+func (h *health) heartbeatInterval() time.Duration {
+	if interval := h.stallTimeout / 4; interval > minHeartbeatInterval {
+		return interval
+	}
+
+	return minHeartbeatInterval
+}
+
+func (h *health) markIteration() {
+	if h == nil {
+		return
+	}
+
+	atomic.StoreInt64(&h.lastIteration, h.now().UnixNano())
+}
+
+func (h *health) setRunning(running bool) {
+	if h == nil {
+		return
+	}
+
+	var value int32
+	if running {
+		value = 1
+	}
+	atomic.StoreInt32(&h.running, value)
+}
+
+func (h *health) setConsecutiveErrors(component string, index, count int) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := fmt.Sprintf("%s %d", component, index)
+	if count == 0 {
+		delete(h.consecutiveErrors, key)
+		return
+	}
+	h.consecutiveErrors[key] = count
+}
+
+// Liveness returns the reasons the process is not live, if any.
+func (h *health) liveness() []string {
+	var problems []string
+
+	// The processor loop is not considered stalled before it first iterates
+	if lastIteration := atomic.LoadInt64(&h.lastIteration); lastIteration != 0 {
+		if stalled := h.now().Sub(time.Unix(0, lastIteration)); stalled > h.stallTimeout {
+			problems = append(problems, fmt.Sprintf("processor loop stalled for %v", stalled.Round(time.Millisecond)))
+		}
+	}
+
+	h.mutex.Lock()
+	checkers := append(append([]namedHealthChecker(nil), h.checkers...), h.sinkerCheckers...)
+	h.mutex.Unlock()
+
+	for _, checker := range checkers {
+		if err := checker.Healthy(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s unhealthy: %v", checker.name, err))
+		}
+	}
+
+	return problems
+}
+
+// Readiness returns the reasons the process is not ready, if any.
+func (h *health) readiness() []string {
+	var problems []string
+
+	if atomic.LoadInt32(&h.running) == 0 {
+		problems = append(problems, "processor not running")
+	}
+
+	h.mutex.Lock()
+	components := make([]string, 0, len(h.consecutiveErrors))
+	for component, count := range h.consecutiveErrors {
+		if count >= h.maxConsecutiveErrors {
+			components = append(components, fmt.Sprintf("%s has %d consecutive errors", component, count))
+		}
+	}
+	h.mutex.Unlock()
+	sort.Strings(components)
+	problems = append(problems, components...)
+
+	return append(problems, h.liveness()...)
+}
+
+func (h *health) livenessHandler() http.Handler {
+	return healthHandler(h.liveness)
+}
+
+func (h *health) readinessHandler() http.Handler {
+	return healthHandler(h.readiness)
+}
+
+// HealthHandler responds with 200 if the check reports no problems, otherwise with 503
+// and one problem per line.
+func healthHandler(check func() []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		problems := check()
+		if len(problems) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+)
+
+type mockHealthChecker struct {
+	errToReturn error
+}
+
+func (mhc *mockHealthChecker) Healthy() error {
+	return mhc.errToReturn
+}
+
+type mockHealthCheckingSinker struct {
+	mockSinker
+	mockHealthChecker
+}
+
+func getHealth(t *testing.T, handler http.Handler) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestHealthLive(t *testing.T) {
+	health := newHealth(time.Minute, maxErrors)
+	health.markIteration()
+
+	if code, body := getHealth(t, health.livenessHandler()); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, code, body)
+	}
+}
+
+func TestHealthStalled(t *testing.T) {
+	now := time.Now()
+	health := newHealth(time.Minute, maxErrors)
+	health.now = func() time.Time { return now }
+	health.markIteration()
+	now = now.Add(2 * time.Minute)
+
+	code, body := getHealth(t, health.livenessHandler())
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	if !strings.Contains(body, "stalled") {
+		t.Errorf("expected body to report stall, got %q", body)
+	}
+}
+
+func TestHealthUnhealthyPlugin(t *testing.T) {
+	mockError := errors.New("mock unhealthy error")
+	plugins := &plugins{
+		sinkers: []sink.Sinker{
+			newMockSinker(nil, 0),
+			&mockHealthCheckingSinker{mockHealthChecker: mockHealthChecker{mockError}},
+		},
+	}
+	health := newHealth(time.Minute, maxErrors)
+	health.addPluginCheckers(plugins)
+
+	code, body := getHealth(t, health.livenessHandler())
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	if !strings.Contains(body, "sinker 1 unhealthy: "+mockError.Error()) {
+		t.Errorf("expected body to report unhealthy sinker, got %q", body)
+	}
+}
+
+func TestHealthNotReadyUntilRunning(t *testing.T) {
+	health := newHealth(time.Minute, maxErrors)
+
+	if code, _ := getHealth(t, health.readinessHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	health.setRunning(true)
+	if code, body := getHealth(t, health.readinessHandler()); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, code, body)
+	}
+}
+
+func TestHealthNotReadyAtErrorThreshold(t *testing.T) {
+	health := newHealth(time.Minute, 3)
+	health.setRunning(true)
+
+	health.setConsecutiveErrors(componentSinker, 0, 2)
+	if code, body := getHealth(t, health.readinessHandler()); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, code, body)
+	}
+
+	health.setConsecutiveErrors(componentSinker, 0, 3)
+	code, body := getHealth(t, health.readinessHandler())
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	if !strings.Contains(body, "sinker 0 has 3 consecutive errors") {
+		t.Errorf("expected body to report consecutive errors, got %q", body)
+	}
+
+	health.setConsecutiveErrors(componentSinker, 0, 0)
+	if code, body := getHealth(t, health.readinessHandler()); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, code, body)
+	}
+}
+
+// TestProcessorHealthHeartbeat tests that the processor is marked as running and that
+// its loop iterates even when there are no events
+func TestProcessorHealthHeartbeat(t *testing.T) {
+	mockEventer := newMockEventer(nil, nil, 0) // Never returns an event
+	mockSinker := newMockSinker(nil, 0)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+
+	iterations := make(chan struct{}, 10)
+	health := newHealth(40*time.Millisecond, maxErrors)
+	health.now = func() time.Time {
+		select {
+		case iterations <- struct{}{}:
+		default:
+		}
+		return time.Now()
+	}
+	processor.registerHealth(health)
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	// The first iteration is on starting the loop, the rest are heartbeats
+	for i := 0; i < 3; i++ {
+		select {
+		case <-iterations:
+		case <-time.After(time.Second):
+			t.Fatal("expected processor loop to iterate, but did not")
+		}
+	}
+
+	if code, body := getHealth(t, health.readinessHandler()); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, code, body)
+	}
+
+	close(done)
+	<-errChan
+
+	if code, _ := getHealth(t, health.readinessHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d once processor stopped, got %d", http.StatusServiceUnavailable, code)
+	}
+}
+
+// TestHealthHeartbeatIntervalPositive tests that the heartbeat interval is positive, even
+// for a stall timeout too short to divide
+func TestHealthHeartbeatIntervalPositive(t *testing.T) {
+	for _, stallTimeout := range []time.Duration{3 * time.Nanosecond, time.Minute} {
+		if interval := newHealth(stallTimeout, maxErrors).heartbeatInterval(); interval <= 0 {
+			t.Errorf("expected positive heartbeat interval for stall timeout %v, got %v", stallTimeout, interval)
+		}
+	}
+}
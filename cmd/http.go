@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPMuxes holds a mux for each address on which HTTP endpoints are served, so that
+// endpoints given the same address share a server.
+type httpMuxes map[string]*http.ServeMux
+
+// Mux returns the mux for the address, creating it if necessary.
+func (hm httpMuxes) mux(addr string) *http.ServeMux {
+	mux, ok := hm[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		hm[addr] = mux
+	}
+
+	return mux
+}
+
+// Start starts a server for each address.
+func (hm httpMuxes) start(cleaner cleaner) error {
+	for addr, mux := range hm {
+		if err := startHTTPServer(addr, mux, cleaner); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StartHTTPServer listens on the given address and serves the handler in a new goroutine.
+// Listening is done before returning, so that an unusable address is reported at startup.
+// The server is registered with the cleaner, so it is shut down with the rest of the process.
+func startHTTPServer(addr string, handler http.Handler, cleaner cleaner) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", addr, err)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	cleaner.registerCloser(server)
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error: HTTP server on %s: %v", addr, err)
+		}
+	}()
+
+	return nil
+}
@@ -1,87 +1,482 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
-	"github.com/jhwbarlow/tcp-audit-common/pkg/pluginload"
-	"github.com/jhwbarlow/tcp-audit/pkg/signalhandler"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/capture"
+	"github.com/jhwbarlow/tcp-audit/pkg/config"
+	"github.com/jhwbarlow/tcp-audit/pkg/metrics"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+	"github.com/jhwbarlow/tcp-audit/pkg/queue"
+	"github.com/jhwbarlow/tcp-audit/pkg/retry"
+	"github.com/jhwbarlow/tcp-audit/pkg/signalhandler"
+	"github.com/jhwbarlow/tcp-audit/pkg/spool"
+	"github.com/jhwbarlow/tcp-audit/pkg/transform"
 	"golang.org/x/sys/unix"
 )
 
 const (
-	eventerFlagStr = "event"
-	sinkerFlagStr  = "sink"
+	eventerFlagStr            = "event"
+	transformerFlagStr        = "transform"
+	sinkerFlagStr             = "sink"
+	eventerOptFlagStr         = "event-opt"
+	transformerOptFlagStr     = "transform-opt"
+	sinkerOptFlagStr          = "sink-opt"
+	eventerOptFileFlagStr     = "event-opt-file"
+	transformerOptFileFlagStr = "transform-opt-file"
+	sinkerOptFileFlagStr      = "sink-opt-file"
+	queueSizeFlagStr          = "queue-size"
+	queuePolicyFlagStr        = "queue-policy"
+	spoolDirFlagStr           = "spool-dir"
+	spoolMaxBytesFlagStr      = "spool-max-bytes"
+	spoolFsyncFlagStr         = "spool-fsync"
+	spoolReplayFlagStr        = "spool-replay-interval"
+	retryAttemptsFlagStr      = "sink-retry-attempts"
+	retryInitialFlagStr       = "sink-retry-initial-backoff"
+	retryMaxFlagStr           = "sink-retry-max-backoff"
+	retryJitterFlagStr        = "sink-retry-jitter"
+	metricsAddrFlagStr        = "metrics-addr"
+	healthAddrFlagStr         = "health-addr"
+	stallTimeoutFlagStr       = "stall-timeout"
+	maxErrorsFlagStr          = "max-consecutive-errors"
+	batchSizeFlagStr          = "batch-size"
+	batchIntervalFlagStr      = "batch-interval"
+	sinkTimeoutFlagStr        = "sink-timeout"
+	teeConsoleFlagStr         = "tee-console"
+	recordFlagStr             = "record"
 
 	maxErrors = 5
 )
 
 var (
-	eventerFlag = flag.String(eventerFlagStr, "", "path to eventer plugin")
-	sinkerFlag  = flag.String(sinkerFlagStr, "", "path to sinker plugin")
+	eventerFlags      = registerPluginFlags(flag.CommandLine, eventerFlagStr, eventerOptFlagStr, eventerOptFileFlagStr, "eventer")
+	transformerFlags  = registerPluginFlags(flag.CommandLine, transformerFlagStr, transformerOptFlagStr, transformerOptFileFlagStr, "transformer")
+	sinkerFlags       = registerPluginFlags(flag.CommandLine, sinkerFlagStr, sinkerOptFlagStr, sinkerOptFileFlagStr, "sinker")
+	queueSizeFlag     = flag.Int(queueSizeFlagStr, 0, "number of events to buffer between the eventers and sinkers (0 to sink synchronously)")
+	queuePolicyFlag   = flag.String(queuePolicyFlagStr, queue.Block.String(), "action when the event queue is full (block, drop-newest or drop-oldest)")
+	spoolDirFlag      = flag.String(spoolDirFlagStr, "", "directory in which to spool events that could not be sunk (empty to disable spooling)")
+	spoolMaxBytesFlag = flag.Int64(spoolMaxBytesFlagStr, 256<<20, "maximum size in bytes of each sinker's spool (0 for unlimited)")
+	spoolFsyncFlag    = flag.String(spoolFsyncFlagStr, spool.SyncAlways.String(), "when to fsync the spool (always, never, or a minimum interval such as 1s)")
+	spoolReplayFlag   = flag.Duration(spoolReplayFlagStr, 5*time.Second, "minimum interval between attempts to replay spooled events to a failed sinker")
+	retryAttemptsFlag = flag.Int(retryAttemptsFlagStr, 1, "maximum number of attempts to sink each event (1 to disable retries)")
+	retryInitialFlag  = flag.Duration(retryInitialFlagStr, 100*time.Millisecond, "wait before the first retry of a failed sink")
+	retryMaxFlag      = flag.Duration(retryMaxFlagStr, 5*time.Second, "maximum wait between retries of a failed sink")
+	retryJitterFlag   = flag.Float64(retryJitterFlagStr, 0.2, "fraction (0-1) by which each retry wait is randomly varied")
+	metricsAddrFlag   = flag.String(metricsAddrFlagStr, "", "address on which to serve Prometheus metrics at "+metricsPath+", such as :9100 (empty to disable)")
+	healthAddrFlag    = flag.String(healthAddrFlagStr, "", "address on which to serve "+livenessPath+" and "+readinessPath+" (empty to disable)")
+	stallTimeoutFlag  = flag.Duration(stallTimeoutFlagStr, time.Minute, "time without an iteration of the processor loop after which the processor is not live")
+	maxErrorsFlag     = flag.Int(maxErrorsFlagStr, maxErrors, "number of consecutive errors from any one eventer, sinker or the transformers at which to stop")
+	batchSizeFlag     = flag.Int(batchSizeFlagStr, defaultBatchSize, "maximum number of events sunk together by sinkers which sink batches")
+	batchIntervalFlag = flag.Duration(batchIntervalFlagStr, defaultBatchInterval, "longest an event waits for its batch to be sunk by sinkers which sink batches")
+	teeConsoleFlag    = flag.Bool(teeConsoleFlagStr, false, "also print each event received from the eventers to stdout, in a human-readable form")
+	recordFlag        = flag.String(recordFlagStr, "", "path to capture file to which each event received from the eventers is recorded, for replay with the built-in replay eventer (empty to disable)")
+	sinkTimeoutFlag   = flag.Duration(sinkTimeoutFlagStr, 0, "deadline of each sink, including any retries, after which sinkers which accept a context abandon it (0 for none)")
 )
 
+// PluginSpec describes how to load a plugin and the configuration to pass to it.
+type pluginSpec struct {
+	name   string
+	loader pluginconfig.SymbolLoader
+	config pluginconfig.Config
+}
+
+// Plugins holds the initialised plugins of each kind, in the order they were given.
+type plugins struct {
+	eventers     []event.Eventer
+	transformers []transform.Transformer
+	sinkers      []sink.Sinker
+}
+
 func main() {
 	exiter := new(unixExiter)
 
+	if len(os.Args) > 1 && os.Args[1] == dlqCommandStr {
+		if err := runDLQ(os.Args[2:]); err != nil {
+			log.Printf("Error: %s: %v", dlqCommandStr, err)
+			exiter.exitOnError()
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == benchCommandStr {
+		if err := runBench(os.Args[2:], os.Stdout); err != nil {
+			log.Printf("Error: %s: %v", benchCommandStr, err)
+			exiter.exitOnError()
+		}
+		return
+	}
+
+	sources, err := loadConfig(flag.CommandLine,
+		os.Args[1:],
+		os.LookupEnv,
+		[]*pluginFlags{eventerFlags, transformerFlags, sinkerFlags})
+	if err != nil {
+		log.Printf("Error: configuration:\n%v", err)
+		exiter.exitOnError()
+	}
+
 	flag.Parse()
 	if err := checkFlags(); err != nil {
-		log.Printf("Error: command-line flags: %v", err)
+		log.Printf("Error: configuration:\n%v", locateFlagErrors(err, flag.CommandLine, sources))
+		exiter.exitOnError()
+	}
+
+	eventerSpecs, err := eventerFlags.specs()
+	if err != nil {
+		log.Printf("Error: eventer options: %v", err)
+		exiter.exitOnError()
+	}
+
+	transformerSpecs, err := transformerFlags.specs()
+	if err != nil {
+		log.Printf("Error: transformer options: %v", err)
+		exiter.exitOnError()
+	}
+
+	sinkerSpecs, err := sinkerFlags.specs()
+	if err != nil {
+		log.Printf("Error: sinker options: %v", err)
+		exiter.exitOnError()
+	}
+
+	eventQueue, err := newQueue()
+	if err != nil {
+		log.Printf("Error: event queue: %v", err)
 		exiter.exitOnError()
 	}
 
 	cleaner := new(closingCleaner)
-	eventerPluginLoader := pluginload.NewFilesystemSharedObjectPluginLoader(*eventerFlag)
-	sinkerPluginLoader := pluginload.NewFilesystemSharedObjectPluginLoader(*sinkerFlag)
-	eventer, sinker, err := initPlugins(eventerPluginLoader, sinkerPluginLoader, cleaner)
+	plugins, err := initPlugins(eventerSpecs, transformerSpecs, sinkerSpecs, cleaner)
 	if err != nil {
 		log.Printf("Error: initialising plugins: %v", err)
 		exiter.exitOnError()
 	}
+
+	// Plugin health checkers must be found before the sinkers are wrapped
+	var processorHealth *health
+	if *healthAddrFlag != "" {
+		processorHealth = newHealth(*stallTimeoutFlag, *maxErrorsFlag)
+		processorHealth.addPluginCheckers(plugins)
+	}
+
+	if *retryAttemptsFlag > 1 {
+		if err := retrySinkers(plugins.sinkers); err != nil {
+			log.Printf("Error: sink retry policy: %v", err)
+			cleaner.cleanupAll()
+			exiter.exitOnError()
+		}
+	}
+
+	// The sinkers as initialised, before they are wrapped, are needed to release them
+	// when they are replaced
+	rawSinkers := append([]sink.Sinker(nil), plugins.sinkers...)
+
+	var spools map[string]*spool.Spool
+	if *spoolDirFlag != "" {
+		names := spoolNames(sinkerSpecs)
+		if spools, err = openSpools(plugins.sinkers, names, nil, cleaner); err == nil {
+			err = spoolSinkers(plugins.sinkers, names, spools)
+		}
+
+		if err != nil {
+			log.Printf("Error: initialising spools: %v", err)
+			cleaner.cleanupAll()
+			exiter.exitOnError()
+		}
+	}
+
+	deadLetterer, err := newDeadLetterer(cleaner)
+	if err != nil {
+		log.Printf("Error: initialising dead-letter output: %v", err)
+		cleaner.cleanupAll()
+		exiter.exitOnError()
+	}
+
+	var recorder *capture.Writer
+	if *recordFlag != "" {
+		if recorder, err = capture.Create(*recordFlag); err != nil {
+			log.Printf("Error: initialising recording: %v", err)
+			cleaner.cleanupAll()
+			exiter.exitOnError()
+		}
+		cleaner.registerCloser(recorder)
+	}
+
+	flowTracker, flowSinker, err := newFlowTracker(cleaner)
+	if err != nil {
+		log.Printf("Error: initialising flow tracking: %v", err)
+		cleaner.cleanupAll()
+		exiter.exitOnError()
+	}
+
+	handshakeTracker, handshakeSinker, err := newHandshakeTracker(cleaner)
+	if err != nil {
+		log.Printf("Error: initialising handshake tracking: %v", err)
+		cleaner.cleanupAll()
+		exiter.exitOnError()
+	}
+
+	alertEngine, alertNotifiers, err := newAlertEngine(cleaner)
+	if err != nil {
+		log.Printf("Error: initialising alerting: %v", err)
+		cleaner.cleanupAll()
+		exiter.exitOnError()
+	}
+
 	signalHandler := signalhandler.NewOSSignalHandler()
-	processor := newPipingEventProcessor(eventer, sinker, maxErrors)
+	processor := newPipingEventProcessor(plugins.eventers,
+		transform.Chain(plugins.transformers),
+		plugins.sinkers,
+		eventQueue,
+		*maxErrorsFlag)
+	processor.registerBatchLimits(*batchSizeFlag, *batchIntervalFlag)
+	processor.registerSinkTimeout(*sinkTimeoutFlag)
+	if *teeConsoleFlag {
+		processor.registerTee(os.Stdout)
+	}
+	if deadLetterer != nil {
+		processor.registerDeadLetterer(deadLetterer)
+	}
+	if recorder != nil {
+		processor.registerRecorder(recorder)
+	}
+	if flowTracker != nil {
+		processor.registerFlowTracker(flowTracker, flowSinker)
+	}
+	if handshakeTracker != nil {
+		processor.registerHandshakeTracker(handshakeTracker, handshakeSinker)
+	}
+	if alertEngine != nil {
+		processor.registerAlertEngine(alertEngine, alertNotifiers)
+	}
+
+	muxes := make(httpMuxes)
+	if *metricsAddrFlag != "" {
+		if err := serveMetrics(processor, muxes.mux(*metricsAddrFlag)); err != nil {
+			log.Printf("Error: serving metrics: %v", err)
+			cleaner.cleanupAll()
+			exiter.exitOnError()
+		}
+	}
+
+	if processorHealth != nil {
+		serveHealth(processor, processorHealth, muxes.mux(*healthAddrFlag))
+	}
+
+	if err := muxes.start(cleaner); err != nil {
+		log.Printf("Error: starting HTTP server: %v", err)
+		cleaner.cleanupAll()
+		exiter.exitOnError()
+	}
+
+	reloader := &sinkerReloader{
+		processor:  processor,
+		cleaner:    cleaner,
+		health:     processorHealth,
+		args:       os.Args[1:],
+		lookupEnv:  os.LookupEnv,
+		rawSinkers: rawSinkers,
+		spools:     spools,
+	}
+	go reloader.handle(signalHandler.Notify(unix.SIGHUP))
 
 	run(processor, signalHandler, cleaner, exiter)
 }
 
+// CheckFlags checks the flags, however they were set, returning every error found.
 func checkFlags() error {
-	if *sinkerFlag == "" {
-		return errors.New(sinkerFlagStr + " not supplied")
+	var errs config.Errors
+
+	if len(sinkerFlags.plugins) == 0 {
+		errs = append(errs, &flagError{sinkerFlagStr, "not supplied"})
 	}
 
-	if *eventerFlag == "" {
-		return errors.New(eventerFlagStr + " not supplied")
+	if len(eventerFlags.plugins) == 0 {
+		errs = append(errs, &flagError{eventerFlagStr, "not supplied"})
 	}
 
-	return nil
+	if *maxErrorsFlag < 1 {
+		errs = append(errs, &flagError{maxErrorsFlagStr, "must be at least 1"})
+	}
+
+	if *queueSizeFlag < 0 {
+		errs = append(errs, &flagError{queueSizeFlagStr, "must not be negative"})
+	}
+
+	if _, err := queue.ParsePolicy(*queuePolicyFlag); err != nil {
+		errs = append(errs, &flagError{queuePolicyFlagStr, err.Error()})
+	}
+
+	if _, err := spool.ParseSyncPolicy(*spoolFsyncFlag); err != nil {
+		errs = append(errs, &flagError{spoolFsyncFlagStr, err.Error()})
+	}
+
+	if *retryAttemptsFlag > 1 {
+		if err := retryPolicy().Validate(); err != nil {
+			errs = append(errs, &flagError{retryAttemptsFlagStr, err.Error()})
+		}
+	}
+
+	if *stallTimeoutFlag < minStallTimeout {
+		errs = append(errs, &flagError{stallTimeoutFlagStr, "must be at least " + minStallTimeout.String()})
+	}
+
+	if *sinkTimeoutFlag < 0 {
+		errs = append(errs, &flagError{sinkTimeoutFlagStr, "must not be negative"})
+	}
+
+	if *batchSizeFlag < 1 {
+		errs = append(errs, &flagError{batchSizeFlagStr, "must be at least 1"})
+	}
+
+	if *batchIntervalFlag < time.Millisecond {
+		errs = append(errs, &flagError{batchIntervalFlagStr, "must be at least 1ms"})
+	}
+
+	if err := checkDeadLetterFlags(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := checkFlowFlags(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := checkHandshakeFlags(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := checkAlertFlags(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs.Err()
+}
+
+// RetryPolicy returns the sink retry policy given by the flags.
+func retryPolicy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts:    *retryAttemptsFlag,
+		InitialBackoff: *retryInitialFlag,
+		MaxBackoff:     *retryMaxFlag,
+		Jitter:         *retryJitterFlag,
+	}
 }
 
-func initPlugins(eventerPluginLoader pluginload.PluginLoader,
-	sinkerPluginLoader pluginload.PluginLoader,
-	cleaner cleaner) (event.Eventer, sink.Sinker, error) {
-	eventer, err := initEventerPlugin(eventerPluginLoader)
+// NewQueue returns the queue requested on the command-line, or nil if events should be
+// sunk synchronously.
+func newQueue() (*queue.Queue, error) {
+	policy, err := queue.ParsePolicy(*queuePolicyFlag)
 	if err != nil {
-		return nil, nil, fmt.Errorf("initialising eventer: %w", err)
+		return nil, err
 	}
-	cleaner.registerEventer(eventer)
 
-	sinker, err := initSinkerPlugin(sinkerPluginLoader)
+	if *queueSizeFlag == 0 {
+		return nil, nil
+	}
+
+	return queue.New(*queueSizeFlag, policy), nil
+}
+
+// RetrySinkers wraps each sinker so that failed sinks are retried with exponential backoff.
+func retrySinkers(sinkers []sink.Sinker) error {
+	policy := retryPolicy()
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	for i, sinker := range sinkers {
+		sinkers[i] = retry.NewSinker(sinker, policy)
+	}
+
+	return nil
+}
+
+// ServeMetrics registers metrics with the processor and adds their endpoint to the mux.
+func serveMetrics(processor *pipingEventProcessor, mux *http.ServeMux) error {
+	registry := metrics.NewRegistry()
+	processorMetrics, err := newProcessorMetrics(registry, processor.maxConsecutiveErrors)
 	if err != nil {
-		cleaner.cleanupEventer()
-		return nil, nil, fmt.Errorf("initialising sinker: %w", err)
+		return err
+	}
+	processor.registerMetrics(processorMetrics)
+	mux.Handle(metricsPath, registry)
+
+	return nil
+}
+
+// ServeHealth registers health with the processor and adds the liveness and readiness
+// endpoints to the mux.
+func serveHealth(processor *pipingEventProcessor, health *health, mux *http.ServeMux) {
+	processor.registerHealth(health)
+	mux.Handle(livenessPath, health.livenessHandler())
+	mux.Handle(readinessPath, health.readinessHandler())
+}
+
+// PluginConfig builds the configuration for a plugin from the options file, if any,
+// and the command-line options. Command-line options override those in the file.
+func pluginConfig(optFilePath string, opts pluginconfig.Config) (pluginconfig.Config, error) {
+	config := make(pluginconfig.Config)
+	if optFilePath != "" {
+		fileConfig, err := pluginconfig.ParseFile(optFilePath)
+		if err != nil {
+			return nil, err
+		}
+		config.Merge(fileConfig)
 	}
-	cleaner.registerSinker(sinker)
 
-	return eventer, sinker, nil
+	config.Merge(opts)
+	return config, nil
 }
 
-func initEventerPlugin(eventerPluginLoader pluginload.PluginLoader) (event.Eventer, error) {
-	eventerLoader := getEventerLoader(eventerPluginLoader)
+// InitPlugins initialises the eventers, transformers and sinkers, registering each with
+// the cleaner. If any plugin fails to initialise, those already initialised are cleaned-up.
+func initPlugins(eventerSpecs, transformerSpecs, sinkerSpecs []pluginSpec, cleaner cleaner) (*plugins, error) {
+	plugins := new(plugins)
+	for _, eventerSpec := range eventerSpecs {
+		eventer, err := initEventerPlugin(eventerSpec)
+		if err != nil {
+			cleaner.cleanupEventer() // Clean up any eventers already initialised
+			return nil, fmt.Errorf("initialising eventer %s: %w", eventerSpec.name, err)
+		}
+		cleaner.registerEventer(eventer)
+		plugins.eventers = append(plugins.eventers, eventer)
+	}
+
+	for _, transformerSpec := range transformerSpecs {
+		transformer, err := initTransformerPlugin(transformerSpec)
+		if err != nil {
+			cleaner.cleanupEventer()
+			cleaner.cleanupTransformer() // Clean up any transformers already initialised
+			return nil, fmt.Errorf("initialising transformer %s: %w", transformerSpec.name, err)
+		}
+		cleaner.registerTransformer(transformer)
+		plugins.transformers = append(plugins.transformers, transformer)
+	}
+
+	for _, sinkerSpec := range sinkerSpecs {
+		sinker, err := initSinkerPlugin(sinkerSpec)
+		if err != nil {
+			cleaner.cleanupEventer()
+			cleaner.cleanupTransformer()
+			cleaner.cleanupSinker() // Clean up any sinkers already initialised
+			return nil, fmt.Errorf("initialising sinker %s: %w", sinkerSpec.name, err)
+		}
+		cleaner.registerSinker(sinker)
+		plugins.sinkers = append(plugins.sinkers, sinker)
+	}
+
+	return plugins, nil
+}
+
+func initEventerPlugin(spec pluginSpec) (event.Eventer, error) {
+	eventerLoader := getEventerLoader(spec.loader, spec.config)
 	eventer, err := loadEventer(eventerLoader)
 	if err != nil {
 		return nil, fmt.Errorf("loading eventer: %w", err)
@@ -90,8 +485,18 @@ func initEventerPlugin(eventerPluginLoader pluginload.PluginLoader) (event.Event
 	return eventer, nil
 }
 
-func initSinkerPlugin(sinkerPluginLoader pluginload.PluginLoader) (sink.Sinker, error) {
-	sinkerLoader := getSinkerLoader(sinkerPluginLoader)
+func initTransformerPlugin(spec pluginSpec) (transform.Transformer, error) {
+	transformerLoader := getTransformerLoader(spec.loader, spec.config)
+	transformer, err := loadTransformer(transformerLoader)
+	if err != nil {
+		return nil, fmt.Errorf("loading transformer: %w", err)
+	}
+
+	return transformer, nil
+}
+
+func initSinkerPlugin(spec pluginSpec) (sink.Sinker, error) {
+	sinkerLoader := getSinkerLoader(spec.loader, spec.config)
 	sinker, err := loadSinker(sinkerLoader)
 	if err != nil {
 		return nil, fmt.Errorf("loading sinker: %w", err)
@@ -100,18 +505,26 @@ func initSinkerPlugin(sinkerPluginLoader pluginload.PluginLoader) (sink.Sinker,
 	return sinker, nil
 }
 
-func getSinkerLoader(pluginLoader pluginload.PluginLoader) sink.SinkerLoader {
-	return sink.NewPluginSinkerLoader(pluginLoader)
+func getSinkerLoader(symbolLoader pluginconfig.SymbolLoader, config pluginconfig.Config) sink.SinkerLoader {
+	return pluginconfig.NewPluginSinkerLoader(symbolLoader, config)
 }
 
-func getEventerLoader(pluginLoader pluginload.PluginLoader) event.EventerLoader {
-	return event.NewPluginEventerLoader(pluginLoader)
+func getEventerLoader(symbolLoader pluginconfig.SymbolLoader, config pluginconfig.Config) event.EventerLoader {
+	return pluginconfig.NewPluginEventerLoader(symbolLoader, config)
+}
+
+func getTransformerLoader(symbolLoader pluginconfig.SymbolLoader, config pluginconfig.Config) transform.TransformerLoader {
+	return pluginconfig.NewPluginTransformerLoader(symbolLoader, config)
 }
 
 func loadEventer(eventerLoader event.EventerLoader) (event.Eventer, error) {
 	return eventerLoader.Load()
 }
 
+func loadTransformer(transformerLoader transform.TransformerLoader) (transform.Transformer, error) {
+	return transformerLoader.Load()
+}
+
 func loadSinker(sinkerLoader sink.SinkerLoader) (sink.Sinker, error) {
 	return sinkerLoader.Load()
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"plugin"
@@ -10,6 +12,8 @@ import (
 
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+	"github.com/jhwbarlow/tcp-audit/pkg/transform"
 	"golang.org/x/sys/unix"
 )
 
@@ -67,10 +71,12 @@ func (msh *mockSignalHandler) Install(signals ...os.Signal) (<-chan os.Signal, <
 }
 
 type mockCleaner struct {
-	cleanupAllCalled      bool
-	cleanupEventerCalled  bool
-	registerEventerCalled bool
-	registerSinkerCalled  bool
+	cleanupAllCalled          bool
+	cleanupEventerCalled      bool
+	registerEventerCalled     bool
+	registerTransformerCalled bool
+	registerSinkerCalled      bool
+	releasedSinkers           []sink.Sinker
 }
 
 func (mc *mockCleaner) cleanupAll() {
@@ -85,12 +91,24 @@ func (mc *mockCleaner) cleanupEventer() {
 	mc.cleanupEventerCalled = true
 }
 
+func (mc *mockCleaner) registerTransformer(transformer transform.Transformer) {
+	mc.registerTransformerCalled = true
+}
+
+func (*mockCleaner) cleanupTransformer() {}
+
 func (mc *mockCleaner) registerSinker(sinker sink.Sinker) {
 	mc.registerSinkerCalled = true
 }
 
 func (*mockCleaner) cleanupSinker() {}
 
+func (mc *mockCleaner) releaseSinkers(sinkers []sink.Sinker) {
+	mc.releasedSinkers = append(mc.releasedSinkers, sinkers...)
+}
+
+func (*mockCleaner) registerCloser(closer io.Closer) {}
+
 type mockExiter struct {
 	exitOnErrorCalled  bool
 	exitOnSignalCalled bool
@@ -138,23 +156,30 @@ func (msl *mockSinkerLoader) Load() (sink.Sinker, error) {
 }
 
 type mockPluginLoader struct {
-	errorToReturn  error
-	symbolToReturn plugin.Symbol
+	errorToReturn error
+	symbols       map[string]plugin.Symbol
 }
 
+// NewMockPluginLoader returns a mock plugin loader which has the given symbol as its
+// legacy constructor.
 func newMockPluginLoader(symbolToReturn plugin.Symbol, errorToReturn error) *mockPluginLoader {
 	return &mockPluginLoader{
-		symbolToReturn: symbolToReturn,
-		errorToReturn:  errorToReturn,
+		symbols:       map[string]plugin.Symbol{pluginconfig.LegacyConstructorSymbol: symbolToReturn},
+		errorToReturn: errorToReturn,
 	}
 }
 
-func (mpl *mockPluginLoader) Load() (plugin.Symbol, error) {
+func (mpl *mockPluginLoader) Lookup(name string) (plugin.Symbol, error) {
 	if mpl.errorToReturn != nil {
 		return nil, mpl.errorToReturn
 	}
 
-	return mpl.symbolToReturn, nil
+	symbol, ok := mpl.symbols[name]
+	if !ok {
+		return nil, pluginconfig.ErrSymbolNotFound
+	}
+
+	return symbol, nil
 }
 
 func TestRun(t *testing.T) {
@@ -245,9 +270,9 @@ func TestRunProcessorError(t *testing.T) {
 func TestGetEventerLoader(t *testing.T) {
 	mockPluginLoader := new(mockPluginLoader)
 
-	eventerLoader := getEventerLoader(mockPluginLoader)
+	eventerLoader := getEventerLoader(mockPluginLoader, nil)
 
-	if _, ok := eventerLoader.(*event.PluginEventerLoader); !ok {
+	if _, ok := eventerLoader.(*pluginconfig.PluginEventerLoader); !ok {
 		t.Logf("expected EventerLoader of type PluginEventerLoader, got %T", eventerLoader)
 	}
 }
@@ -255,13 +280,55 @@ func TestGetEventerLoader(t *testing.T) {
 func TestGetSinkerLoader(t *testing.T) {
 	mockPluginLoader := new(mockPluginLoader)
 
-	sinkerLoader := getSinkerLoader(mockPluginLoader)
+	sinkerLoader := getSinkerLoader(mockPluginLoader, nil)
 
-	if _, ok := sinkerLoader.(*sink.PluginSinkerLoader); !ok {
+	if _, ok := sinkerLoader.(*pluginconfig.PluginSinkerLoader); !ok {
 		t.Logf("expected SinkerLoader of type PluginSinkerLoader, got %T", sinkerLoader)
 	}
 }
 
+// mockLegacyPluginLoader is a pluginload.PluginLoader, which loads only the legacy
+// constructor.
+type mockLegacyPluginLoader struct {
+	symbolToReturn plugin.Symbol
+}
+
+func (mlpl *mockLegacyPluginLoader) Load() (plugin.Symbol, error) {
+	return mlpl.symbolToReturn, nil
+}
+
+func TestGetEventerLoaderFromPluginLoader(t *testing.T) {
+	mockEventer := newMockEventer(nil, nil, 0)
+	mockPluginLoader := &mockLegacyPluginLoader{func() (event.Eventer, error) { return mockEventer, nil }}
+
+	eventerLoader := getEventerLoader(pluginconfig.NewPluginLoaderSymbolLoader(mockPluginLoader), nil)
+
+	eventer, err := loadEventer(eventerLoader)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if eventer != mockEventer {
+		t.Errorf("expected eventer constructed by plugin, got %v", eventer)
+	}
+}
+
+func TestGetSinkerLoaderFromPluginLoader(t *testing.T) {
+	mockSinker := newMockSinker(nil, 0)
+	mockPluginLoader := &mockLegacyPluginLoader{func() (sink.Sinker, error) { return mockSinker, nil }}
+
+	sinkerLoader := getSinkerLoader(pluginconfig.NewPluginLoaderSymbolLoader(mockPluginLoader), nil)
+
+	sinker, err := loadSinker(sinkerLoader)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if sinker != mockSinker {
+		t.Errorf("expected sinker constructed by plugin, got %v", sinker)
+	}
+}
+
 func TestLoadEventer(t *testing.T) {
 	mockEventerLoader := new(mockEventerLoader)
 
@@ -319,15 +386,14 @@ func TestLoadSinkerLoaderError(t *testing.T) {
 }
 
 func TestNilEventerFlagError(t *testing.T) {
-	eventerFlagVar := ""
-	eventerFlag = &eventerFlagVar
+	eventerFlags = new(pluginFlags)
 
-	// Set the sinkerFlag to some non-empty value to avoid interfering with the test
-	sinkerFlagVar := "test sinker flag"
-	sinkerFlag = &sinkerFlagVar
+	// Set the sinkerFlags to some non-empty value to avoid interfering with the test
+	sinkerFlags = new(pluginFlags)
+	sinkerFlags.addPath("test sinker flag")
 	defer func() {
-		sinkerFlag = nil
-		eventerFlag = nil
+		sinkerFlags = nil
+		eventerFlags = nil
 	}()
 
 	err := checkFlags()
@@ -339,15 +405,14 @@ func TestNilEventerFlagError(t *testing.T) {
 }
 
 func TestNilSinkerFlagError(t *testing.T) {
-	sinkerFlagVar := ""
-	sinkerFlag = &sinkerFlagVar
+	sinkerFlags = new(pluginFlags)
 
-	// Set the eventerFlag to some non-empty value to avoid interfering with the test
-	eventerFlagVar := "test eventer flag"
-	eventerFlag = &eventerFlagVar
+	// Set the eventerFlags to some non-empty value to avoid interfering with the test
+	eventerFlags = new(pluginFlags)
+	eventerFlags.addPath("test eventer flag")
 	defer func() {
-		sinkerFlag = nil
-		eventerFlag = nil
+		sinkerFlags = nil
+		eventerFlags = nil
 	}()
 
 	err := checkFlags()
@@ -370,7 +435,10 @@ func TestEventerAndSinkerRegisteredWithCleaner(t *testing.T) {
 	mockPluginLoaderForEventer := newMockPluginLoader(mockEventerConstructorSymbol, nil)
 	mockPluginLoaderForSinker := newMockPluginLoader(mockSinkerConstructorSymbol, nil)
 	mockCleaner := new(mockCleaner)
-	_, _, err := initPlugins(mockPluginLoaderForEventer, mockPluginLoaderForSinker, mockCleaner)
+	_, err := initPlugins([]pluginSpec{{loader: mockPluginLoaderForEventer}},
+		nil,
+		[]pluginSpec{{loader: mockPluginLoaderForSinker}},
+		mockCleaner)
 	if err != nil {
 		t.Errorf("expected nil error, got %q (of type %T)", err, err)
 	}
@@ -384,6 +452,123 @@ func TestEventerAndSinkerRegisteredWithCleaner(t *testing.T) {
 	}
 }
 
+func TestMultipleEventersRegisteredWithCleaner(t *testing.T) {
+	mockEventerConstructorSymbol := func() (event.Eventer, error) {
+		return new(mockEventerCloser), nil
+	}
+
+	mockSinkerConstructorSymbol := func() (sink.Sinker, error) {
+		return nil, nil
+	}
+
+	mockPluginLoaderForEventer := newMockPluginLoader(mockEventerConstructorSymbol, nil)
+	mockPluginLoaderForSinker := newMockPluginLoader(mockSinkerConstructorSymbol, nil)
+	cleaner := new(closingCleaner)
+	plugins, err := initPlugins([]pluginSpec{{loader: mockPluginLoaderForEventer}, {loader: mockPluginLoaderForEventer}},
+		nil,
+		[]pluginSpec{{loader: mockPluginLoaderForSinker}},
+		cleaner)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(plugins.eventers) != 2 {
+		t.Errorf("expected 2 eventers, got %d", len(plugins.eventers))
+	}
+
+	if len(cleaner.eventers) != 2 {
+		t.Errorf("expected 2 eventers registered with cleaner, got %d", len(cleaner.eventers))
+	}
+}
+
+func TestMultipleSinkersRegisteredWithCleaner(t *testing.T) {
+	mockEventerConstructorSymbol := func() (event.Eventer, error) {
+		return nil, nil
+	}
+
+	mockSinkerConstructorSymbol := func() (sink.Sinker, error) {
+		return new(mockSinkerCloser), nil
+	}
+
+	mockPluginLoaderForEventer := newMockPluginLoader(mockEventerConstructorSymbol, nil)
+	mockPluginLoaderForSinker := newMockPluginLoader(mockSinkerConstructorSymbol, nil)
+	cleaner := new(closingCleaner)
+	plugins, err := initPlugins([]pluginSpec{{loader: mockPluginLoaderForEventer}},
+		nil,
+		[]pluginSpec{{loader: mockPluginLoaderForSinker}, {loader: mockPluginLoaderForSinker}},
+		cleaner)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(plugins.sinkers) != 2 {
+		t.Errorf("expected 2 sinkers, got %d", len(plugins.sinkers))
+	}
+
+	if len(cleaner.sinkers) != 2 {
+		t.Errorf("expected 2 sinkers registered with cleaner, got %d", len(cleaner.sinkers))
+	}
+}
+
+func TestTransformersRegisteredWithCleaner(t *testing.T) {
+	mockEventerConstructorSymbol := func() (event.Eventer, error) {
+		return nil, nil
+	}
+
+	mockTransformerConstructorSymbol := func() (transform.Transformer, error) {
+		return nil, nil
+	}
+
+	mockSinkerConstructorSymbol := func() (sink.Sinker, error) {
+		return nil, nil
+	}
+
+	mockPluginLoaderForEventer := newMockPluginLoader(mockEventerConstructorSymbol, nil)
+	mockPluginLoaderForTransformer := newMockPluginLoader(mockTransformerConstructorSymbol, nil)
+	mockPluginLoaderForSinker := newMockPluginLoader(mockSinkerConstructorSymbol, nil)
+	mockCleaner := new(mockCleaner)
+	plugins, err := initPlugins([]pluginSpec{{loader: mockPluginLoaderForEventer}},
+		[]pluginSpec{{loader: mockPluginLoaderForTransformer}, {loader: mockPluginLoaderForTransformer}},
+		[]pluginSpec{{loader: mockPluginLoaderForSinker}},
+		mockCleaner)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(plugins.transformers) != 2 {
+		t.Errorf("expected 2 transformers, got %d", len(plugins.transformers))
+	}
+
+	if !mockCleaner.registerTransformerCalled {
+		t.Error("expected Transformer to be registered with cleaner, but was not")
+	}
+}
+
+func TestEventerCleanedUpOnTransformerInitFailure(t *testing.T) {
+	mockEventerConstructorSymbol := func() (event.Eventer, error) {
+		return nil, nil
+	}
+
+	mockTransformerConstructorSymbol := func() {} // Deliberately wrong function signature
+
+	mockPluginLoaderForEventer := newMockPluginLoader(mockEventerConstructorSymbol, nil)
+	mockPluginLoaderForTransformer := newMockPluginLoader(mockTransformerConstructorSymbol, nil)
+	mockCleaner := new(mockCleaner)
+	_, err := initPlugins([]pluginSpec{{loader: mockPluginLoaderForEventer}},
+		[]pluginSpec{{loader: mockPluginLoaderForTransformer}},
+		nil,
+		mockCleaner)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !mockCleaner.cleanupEventerCalled {
+		t.Error("expected Eventer cleaned up, but was not")
+	}
+}
+
 func TestInitPluginErrorOnEventerInitFailure(t *testing.T) {
 	mockEventerConstructorSymbol := func() {} // Deliberately wrong function signature
 	mockSinkerConstructorSymbol := func() (sink.Sinker, error) {
@@ -393,7 +578,10 @@ func TestInitPluginErrorOnEventerInitFailure(t *testing.T) {
 	mockPluginLoaderForEventer := newMockPluginLoader(mockEventerConstructorSymbol, nil)
 	mockPluginLoaderForSinker := newMockPluginLoader(mockSinkerConstructorSymbol, nil)
 	mockCleaner := new(mockCleaner)
-	_, _, err := initPlugins(mockPluginLoaderForEventer, mockPluginLoaderForSinker, mockCleaner)
+	_, err := initPlugins([]pluginSpec{{loader: mockPluginLoaderForEventer}},
+		nil,
+		[]pluginSpec{{loader: mockPluginLoaderForSinker}},
+		mockCleaner)
 	if err == nil {
 		t.Error("expected error, got nil")
 	}
@@ -411,7 +599,10 @@ func TestEventerCleanedUpOnSinkerInitFailure(t *testing.T) {
 	mockPluginLoaderForEventer := newMockPluginLoader(mockEventerConstructorSymbol, nil)
 	mockPluginLoaderForSinker := newMockPluginLoader(mockSinkerConstructorSymbol, nil)
 	mockCleaner := new(mockCleaner)
-	_, _, err := initPlugins(mockPluginLoaderForEventer, mockPluginLoaderForSinker, mockCleaner)
+	_, err := initPlugins([]pluginSpec{{loader: mockPluginLoaderForEventer}},
+		nil,
+		[]pluginSpec{{loader: mockPluginLoaderForSinker}},
+		mockCleaner)
 	if err == nil {
 		t.Error("expected error, got nil")
 	}
@@ -422,3 +613,53 @@ func TestEventerCleanedUpOnSinkerInitFailure(t *testing.T) {
 		t.Error("expected Eventer cleaned up, but was not")
 	}
 }
+
+func TestEventerConfigPassedToConstructor(t *testing.T) {
+	var receivedConfig map[string]string
+	mockEventerConfigConstructorSymbol := func(config map[string]string) (event.Eventer, error) {
+		receivedConfig = config
+		return nil, nil
+	}
+
+	mockPluginLoader := &mockPluginLoader{
+		symbols: map[string]plugin.Symbol{
+			pluginconfig.ConfigConstructorSymbol: mockEventerConfigConstructorSymbol,
+		},
+	}
+	spec := pluginSpec{
+		loader: mockPluginLoader,
+		config: pluginconfig.Config{"test-key": "test-value"},
+	}
+	if _, err := initEventerPlugin(spec); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if receivedConfig["test-key"] != "test-value" {
+		t.Errorf("expected config to be passed to constructor, got %v", receivedConfig)
+	}
+}
+
+func TestPluginConfigFlagsOverrideFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "tcp-audit-opts")
+	if err != nil {
+		t.Fatalf("creating temporary file: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("# test options\nfile-key=file-value\noverridden-key=file-value\n")
+	file.Close()
+
+	opts := pluginconfig.Config{"overridden-key": "flag-value"}
+	config, err := pluginConfig(file.Name(), opts)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if config["file-key"] != "file-value" {
+		t.Errorf("expected file-key=file-value, got %q", config["file-key"])
+	}
+
+	if config["overridden-key"] != "flag-value" {
+		t.Errorf("expected overridden-key=flag-value, got %q", config["overridden-key"])
+	}
+}
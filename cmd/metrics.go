@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit/pkg/flow"
+	"github.com/jhwbarlow/tcp-audit/pkg/handshake"
+	"github.com/jhwbarlow/tcp-audit/pkg/metrics"
+)
+
+const (
+	metricsPath = "/metrics"
+
+	componentEventer     = "eventer"
+	componentTransformer = "transformer"
+	componentSinker      = "sinker"
+
+	dropReasonInvalid        = "invalid"
+	dropReasonTransformError = "transform-error"
+	dropReasonSinkError      = "sink-error"
+	dropReasonQueueFull      = "queue-full"
+
+	// Handshakes to listeners beyond this many are counted together, to bound the number of
+	// distinct label values
+	maxHandshakeListeners = 1000
+	otherListener         = "other"
+)
+
+// HandshakeBuckets are histogram buckets, in seconds, suitable for timing handshakes, from
+// those within a host to those which need SYN retransmissions.
+var handshakeBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 3, 7, 15}
+
+// ProcessorMetrics are the metrics updated by the processor as events pass through it.
+// The methods may be called on a nil *processorMetrics, in which case they do nothing,
+// so that the processor need not check whether metrics are enabled.
+type processorMetrics struct {
+	eventsReceived       *metrics.CounterVec
+	eventsSunk           *metrics.CounterVec
+	eventsDropped        *metrics.CounterVec
+	eventsDeadLettered   *metrics.Counter
+	eventerErrors        *metrics.CounterVec
+	transformerErrors    *metrics.Counter
+	sinkerErrors         *metrics.CounterVec
+	consecutiveErrors    *metrics.GaugeVec
+	maxConsecutiveErrors *metrics.Gauge
+	sinkDuration         *metrics.HistogramVec
+	stateTransitions     *metrics.CounterVec
+	flowsTracked         *metrics.Gauge
+	flowRecords          *metrics.CounterVec
+	flowSinkErrors       *metrics.Counter
+	handshakes           *metrics.CounterVec
+	handshakeDuration    *metrics.HistogramVec
+	handshakeSinkErrors  *metrics.Counter
+	handshakeListeners   map[string]bool // The listeners with their own label values
+	alerts               *metrics.CounterVec
+	alertNotifyErrors    *metrics.Counter
+	recordsDropped       *metrics.CounterVec
+}
+
+// NewProcessorMetrics creates the processor metrics and registers them with the registry.
+func newProcessorMetrics(registry *metrics.Registry, maxConsecutiveErrors int) (*processorMetrics, error) {
+	pm := &processorMetrics{
+		eventsReceived: metrics.NewCounterVec("tcp_audit_events_received_total",
+			"Number of events received from each eventer.",
+			"eventer"),
+		eventsSunk: metrics.NewCounterVec("tcp_audit_events_sunk_total",
+			"Number of events successfully sunk by each sinker.",
+			"sinker"),
+		eventsDropped: metrics.NewCounterVec("tcp_audit_events_dropped_total",
+			"Number of events dropped, by reason. An event dropped by several sinkers is counted once for each.",
+			"reason"),
+		eventsDeadLettered: metrics.NewCounter("tcp_audit_events_dead_lettered_total",
+			"Number of events sent to the dead-letter destination."),
+		eventerErrors: metrics.NewCounterVec("tcp_audit_eventer_errors_total",
+			"Number of errors returned by each eventer.",
+			"eventer"),
+		transformerErrors: metrics.NewCounter("tcp_audit_transformer_errors_total",
+			"Number of errors returned by the transformer chain."),
+		sinkerErrors: metrics.NewCounterVec("tcp_audit_sinker_errors_total",
+			"Number of errors returned by each sinker.",
+			"sinker"),
+		consecutiveErrors: metrics.NewGaugeVec("tcp_audit_consecutive_errors",
+			"Current number of consecutive errors for each component.",
+			"component",
+			"index"),
+		maxConsecutiveErrors: metrics.NewGauge("tcp_audit_max_consecutive_errors",
+			"Number of consecutive errors from any one component at which the processor stops."),
+		sinkDuration: metrics.NewHistogramVec("tcp_audit_sink_duration_seconds",
+			"Time taken by each sinker to sink an event, whether or not it succeeded.",
+			nil,
+			"sinker"),
+		stateTransitions: metrics.NewCounterVec("tcp_audit_state_transitions_total",
+			"Number of valid events for each TCP state transition, after transformation.",
+			"old_state",
+			"new_state"),
+		flowsTracked: metrics.NewGauge("tcp_audit_flows_tracked",
+			"Current number of connections tracked to assemble flow records."),
+		flowRecords: metrics.NewCounterVec("tcp_audit_flow_records_total",
+			"Number of flow records assembled, by how the connection was closed.",
+			"close_path"),
+		flowSinkErrors: metrics.NewCounter("tcp_audit_flow_sink_errors_total",
+			"Number of errors returned by the flow sinker."),
+		handshakes: metrics.NewCounterVec("tcp_audit_handshakes_total",
+			"Number of handshakes ended, by the address of the listening side and outcome.",
+			"listener",
+			"outcome"),
+		handshakeDuration: metrics.NewHistogramVec("tcp_audit_handshake_duration_seconds",
+			"Time taken by each outbound handshake, whether or not it succeeded, by the address of the listening side.",
+			handshakeBuckets,
+			"listener"),
+		handshakeSinkErrors: metrics.NewCounter("tcp_audit_handshake_sink_errors_total",
+			"Number of errors returned by the handshake sinker."),
+		handshakeListeners: make(map[string]bool),
+		alerts: metrics.NewCounterVec("tcp_audit_alerts_total",
+			"Number of alerts fired by each rule, not counting those suppressed by its cooldown.",
+			"rule"),
+		alertNotifyErrors: metrics.NewCounter("tcp_audit_alert_notify_errors_total",
+			"Number of errors returned by the alert notifiers."),
+		recordsDropped: metrics.NewCounterVec("tcp_audit_records_dropped_total",
+			"Number of records, other than events, dropped as their queue was full, by kind.",
+			"kind"),
+	}
+	pm.maxConsecutiveErrors.Set(int64(maxConsecutiveErrors))
+
+	if err := registry.Register(pm.eventsReceived,
+		pm.eventsSunk,
+		pm.eventsDropped,
+		pm.eventsDeadLettered,
+		pm.eventerErrors,
+		pm.transformerErrors,
+		pm.sinkerErrors,
+		pm.consecutiveErrors,
+		pm.maxConsecutiveErrors,
+		pm.sinkDuration,
+		pm.stateTransitions,
+		pm.flowsTracked,
+		pm.flowRecords,
+		pm.flowSinkErrors,
+		pm.handshakes,
+		pm.handshakeDuration,
+		pm.handshakeSinkErrors,
+		pm.alerts,
+		pm.alertNotifyErrors,
+		pm.recordsDropped); err != nil {
+		return nil, fmt.Errorf("registering processor metrics: %w", err)
+	}
+
+	return pm, nil
+}
+
+func (pm *processorMetrics) eventReceived(eventer int) {
+	if pm == nil {
+		return
+	}
+
+	pm.eventsReceived.WithLabelValues(strconv.Itoa(eventer)).Inc()
+}
+
+// StateTransition counts the state transition of an event. It must only be called for
+// validated events, so that the number of distinct label values is bounded.
+func (pm *processorMetrics) stateTransition(e *event.Event) {
+	if pm == nil {
+		return
+	}
+
+	pm.stateTransitions.WithLabelValues(e.OldState.String(), e.NewState.String()).Inc()
+}
+
+// FlowsClosed counts the flow records of the connections closed, and records the number
+// of connections still tracked.
+func (pm *processorMetrics) flowsClosed(records []*flow.Record, tracked int) {
+	if pm == nil {
+		return
+	}
+
+	for _, record := range records {
+		pm.flowRecords.WithLabelValues(record.ClosePath).Inc()
+	}
+	pm.flowsTracked.Set(int64(tracked))
+}
+
+func (pm *processorMetrics) flowSinkError() {
+	if pm == nil {
+		return
+	}
+
+	pm.flowSinkErrors.Inc()
+}
+
+// Handshake counts the result of the handshake, and observes its duration if it is known.
+// Once maxHandshakeListeners listeners have been seen, any others are counted together.
+// It must only be called from the processor's loop.
+func (pm *processorMetrics) handshake(result *handshake.Result) {
+	if pm == nil {
+		return
+	}
+
+	listener := result.Listener()
+	if !pm.handshakeListeners[listener] {
+		if len(pm.handshakeListeners) < maxHandshakeListeners {
+			pm.handshakeListeners[listener] = true
+		} else {
+			listener = otherListener
+		}
+	}
+
+	pm.handshakes.WithLabelValues(listener, result.Outcome).Inc()
+	if result.Timed() {
+		pm.handshakeDuration.WithLabelValues(listener).Observe(result.Duration)
+	}
+}
+
+func (pm *processorMetrics) handshakeSinkError() {
+	if pm == nil {
+		return
+	}
+
+	pm.handshakeSinkErrors.Inc()
+}
+
+func (pm *processorMetrics) recordDropped(kind string) {
+	if pm == nil {
+		return
+	}
+
+	pm.recordsDropped.WithLabelValues(kind).Inc()
+}
+
+func (pm *processorMetrics) alertFired(rule string) {
+	if pm == nil {
+		return
+	}
+
+	pm.alerts.WithLabelValues(rule).Inc()
+}
+
+func (pm *processorMetrics) alertNotifyError() {
+	if pm == nil {
+		return
+	}
+
+	pm.alertNotifyErrors.Inc()
+}
+
+func (pm *processorMetrics) eventSunk(sinker int, duration time.Duration) {
+	if pm == nil {
+		return
+	}
+
+	pm.eventsSunk.WithLabelValues(strconv.Itoa(sinker)).Inc()
+	pm.sinkDuration.WithLabelValues(strconv.Itoa(sinker)).Observe(duration.Seconds())
+}
+
+func (pm *processorMetrics) sinkerError(sinker int, duration time.Duration) {
+	if pm == nil {
+		return
+	}
+
+	pm.sinkerErrors.WithLabelValues(strconv.Itoa(sinker)).Inc()
+	pm.sinkDuration.WithLabelValues(strconv.Itoa(sinker)).Observe(duration.Seconds())
+}
+
+func (pm *processorMetrics) eventerError(eventer int) {
+	if pm == nil {
+		return
+	}
+
+	pm.eventerErrors.WithLabelValues(strconv.Itoa(eventer)).Inc()
+}
+
+func (pm *processorMetrics) transformerError() {
+	if pm == nil {
+		return
+	}
+
+	pm.transformerErrors.Inc()
+}
+
+func (pm *processorMetrics) eventsDroppedBy(reason string, count uint64) {
+	if pm == nil || count == 0 {
+		return
+	}
+
+	pm.eventsDropped.WithLabelValues(reason).Add(count)
+}
+
+func (pm *processorMetrics) eventDeadLettered() {
+	if pm == nil {
+		return
+	}
+
+	pm.eventsDeadLettered.Inc()
+}
+
+// SetConsecutiveErrors records the current consecutive error count of a component.
+func (pm *processorMetrics) setConsecutiveErrors(component string, index, count int) {
+	if pm == nil {
+		return
+	}
+
+	pm.consecutiveErrors.WithLabelValues(component, strconv.Itoa(index)).Set(int64(count))
+}
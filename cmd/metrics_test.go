@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/handshake"
+	"github.com/jhwbarlow/tcp-audit/pkg/metrics"
+)
+
+func writeMetrics(t *testing.T, registry *metrics.Registry) string {
+	buf := new(bytes.Buffer)
+	if _, err := registry.WriteTo(buf); err != nil {
+		t.Fatalf("writing metrics: %v", err)
+	}
+
+	return buf.String()
+}
+
+func expectMetrics(t *testing.T, got string, expected ...string) {
+	for _, sample := range expected {
+		if !strings.Contains(got, sample+"\n") {
+			t.Errorf("expected metrics to contain %q, but did not:\n%s", sample, got)
+		}
+	}
+}
+
+// TestProcessorMetricsEvent tests that the processor counts a received and sunk event
+func TestProcessorMetricsEvent(t *testing.T) {
+	mockEvent := &event.Event{
+		Time:         time.Now(),
+		PIDOnCPU:     7337,
+		CommandOnCPU: "test",
+		SourceIP:     net.ParseIP("1.2.3.4"),
+		DestIP:       net.ParseIP("7.3.3.7"),
+		SourcePort:   1234,
+		DestPort:     7337,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynReceived,
+	}
+	mockEventer := newMockEventer(mockEvent, nil, 1)
+	mockSinker := newMockSinker(nil, 0)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+
+	registry := metrics.NewRegistry()
+	processorMetrics, err := newProcessorMetrics(registry, maxErrors)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	processor.registerMetrics(processorMetrics)
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	<-mockSinker.receivedEventChan // The sinker has received the test event
+	close(done)
+	<-errChan // The processor has stopped, so the event has been fully processed
+
+	expectMetrics(t, writeMetrics(t, registry),
+		`tcp_audit_events_received_total{eventer="0"} 1`,
+		`tcp_audit_events_sunk_total{sinker="0"} 1`,
+		`tcp_audit_state_transitions_total{old_state="CLOSED",new_state="SYN-RECEIVED"} 1`,
+		`tcp_audit_sink_duration_seconds_count{sinker="0"} 1`,
+		`tcp_audit_consecutive_errors{component="sinker",index="0"} 0`,
+		`tcp_audit_max_consecutive_errors 5`)
+}
+
+// TestProcessorMetricsSinkerError tests that the processor counts sinker errors,
+// consecutive errors and dropped events
+func TestProcessorMetricsSinkerError(t *testing.T) {
+	mockEvent := &event.Event{
+		Time:         time.Now(),
+		PIDOnCPU:     7337,
+		CommandOnCPU: "test",
+		SourceIP:     net.ParseIP("1.2.3.4"),
+		DestIP:       net.ParseIP("7.3.3.7"),
+		SourcePort:   1234,
+		DestPort:     7337,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynReceived,
+	}
+	mockEventer := newMockEventer(mockEvent, nil, 3)
+	mockSinker := newMockSinker(errors.New("mock sinker error"), 3)
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, 3)
+	processor.registerDoneChannel(make(chan struct{}))
+
+	registry := metrics.NewRegistry()
+	processorMetrics, err := newProcessorMetrics(registry, 3)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	processor.registerMetrics(processorMetrics)
+
+	if err := processor.run(); err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	expectMetrics(t, writeMetrics(t, registry),
+		`tcp_audit_events_received_total{eventer="0"} 3`,
+		`tcp_audit_sinker_errors_total{sinker="0"} 3`,
+		`tcp_audit_events_dropped_total{reason="sink-error"} 3`,
+		`tcp_audit_consecutive_errors{component="sinker",index="0"} 3`,
+		`tcp_audit_max_consecutive_errors 3`)
+}
+
+// TestProcessorMetricsNil tests that recording to nil metrics does nothing
+func TestProcessorMetricsNil(t *testing.T) {
+	var processorMetrics *processorMetrics
+	processorMetrics.eventReceived(0)
+	processorMetrics.eventSunk(0, time.Second)
+	processorMetrics.setConsecutiveErrors(componentSinker, 0, 1)
+	processorMetrics.handshake(&handshake.Result{Outcome: handshake.OutcomeFailed})
+}
+
+// TestProcessorMetricsHandshake tests that handshakes are counted and timed by listener,
+// and that listeners beyond the limit are counted together
+func TestProcessorMetricsHandshake(t *testing.T) {
+	registry := metrics.NewRegistry()
+	processorMetrics, err := newProcessorMetrics(registry, maxErrors)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	start := time.Now()
+	processorMetrics.handshake(&handshake.Result{
+		SourceIP:  net.ParseIP("10.0.0.1"),
+		DestIP:    net.ParseIP("10.1.0.1"),
+		DestPort:  443,
+		Direction: handshake.DirectionOutbound,
+		StartTime: &start,
+		Duration:  0.02,
+		Outcome:   handshake.OutcomeEstablished,
+	})
+	processorMetrics.handshake(&handshake.Result{
+		SourceIP:   net.ParseIP("10.0.0.1"),
+		SourcePort: 8080,
+		DestIP:     net.ParseIP("10.1.0.1"),
+		Direction:  handshake.DirectionInbound,
+		Outcome:    handshake.OutcomeAborted,
+	})
+
+	for port := uint16(1); len(processorMetrics.handshakeListeners) < maxHandshakeListeners; port++ {
+		processorMetrics.handshake(&handshake.Result{DestIP: net.ParseIP("10.2.0.1"), DestPort: port, Outcome: handshake.OutcomeRefused})
+	}
+	processorMetrics.handshake(&handshake.Result{DestIP: net.ParseIP("10.3.0.1"), DestPort: 443, Outcome: handshake.OutcomeTimedOut})
+
+	expectMetrics(t, writeMetrics(t, registry),
+		`tcp_audit_handshakes_total{listener="10.1.0.1:443",outcome="established"} 1`,
+		`tcp_audit_handshake_duration_seconds_count{listener="10.1.0.1:443"} 1`,
+		`tcp_audit_handshakes_total{listener="10.0.0.1:8080",outcome="aborted"} 1`,
+		`tcp_audit_handshakes_total{listener="other",outcome="timed-out"} 1`)
+}
+
+// TestProcessorMetricsAlerts tests that alerts are counted by rule, along with the errors
+// notifying them
+func TestProcessorMetricsAlerts(t *testing.T) {
+	registry := metrics.NewRegistry()
+	processorMetrics, err := newProcessorMetrics(registry, maxErrors)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	processorMetrics.alertFired("syn-flood")
+	processorMetrics.alertFired("syn-flood")
+	processorMetrics.alertFired("unexpected-port")
+	processorMetrics.alertNotifyError()
+
+	expectMetrics(t, writeMetrics(t, registry),
+		`tcp_audit_alerts_total{rule="syn-flood"} 2`,
+		`tcp_audit_alerts_total{rule="unexpected-port"} 1`,
+		`tcp_audit_alert_notify_errors_total 1`)
+}
+
+// TestStartHTTPServerBadAddress tests that an unusable address is reported immediately
+func TestStartHTTPServerBadAddress(t *testing.T) {
+	err := startHTTPServer("not-an-address", nil, new(mockCleaner))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
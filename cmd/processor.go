@@ -1,11 +1,38 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/alert"
+	"github.com/jhwbarlow/tcp-audit/pkg/batch"
+	"github.com/jhwbarlow/tcp-audit/pkg/capture"
+	"github.com/jhwbarlow/tcp-audit/pkg/contextual"
+	"github.com/jhwbarlow/tcp-audit/pkg/deadletter"
+	"github.com/jhwbarlow/tcp-audit/pkg/flow"
+	"github.com/jhwbarlow/tcp-audit/pkg/handshake"
+	"github.com/jhwbarlow/tcp-audit/pkg/queue"
+	"github.com/jhwbarlow/tcp-audit/pkg/record"
+	"github.com/jhwbarlow/tcp-audit/pkg/retry"
+	"github.com/jhwbarlow/tcp-audit/pkg/transform"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultBatchInterval = time.Second
+
+	// Idle connections are evicted by the flow tracker at this interval
+	defaultFlowEvictInterval = time.Second
+
+	// The most records, other than events, waiting to be sunk to each record sinker
+	recordQueueSize = 1000
 )
 
 type eventProcessor interface {
@@ -13,47 +40,324 @@ type eventProcessor interface {
 	registerDoneChannel(<-chan struct{})
 }
 
-// PipingEventProcessor "pipes" events directly from the eventer to the sinker.
-// No modifications are performed. If the eventer or sinker returns an error,
-// the event is dropped.
-// If the number of consecutive errors reaches the maxConsecutiveErrors threshold,
-// the event processor returns an error.
+// PipingEventProcessor "pipes" events from the eventers, through the transformer, to each
+// of the sinkers. Events from all eventers are merged into a single stream.
+// The transformer may drop, modify or add events; the events it returns are sunk in its
+// place. If an eventer or the transformer returns an error, the event is dropped.
+// If a sinker returns an error, the event is dropped for that sinker only; it is still
+// delivered to the other sinkers.
+// Consecutive errors are counted separately for each eventer, the transformer and each
+// sinker. If any count reaches the maxConsecutiveErrors threshold, the event processor
+// returns an error.
+// If a queue is given, events are put on the queue and sunk from it in a separate
+// goroutine, so that a slow sinker does not stop events being received from the eventers.
+// What happens when the queue is full is determined by the queue's overflow policy.
+// Otherwise, events are sunk synchronously.
+// Events returned by the transformer which are not valid are not sunk.
+// By registering a dead-letterer, events which fail validation or cannot be sunk are
+// dead-lettered rather than dropped. A sinker's permanent error for an event which has been
+// dead-lettered does not count towards its consecutive errors, as the sinker is working.
+// By registering metrics, the processor records the progress of events through it.
+// By registering health, the processor reports that it is running and its loop is iterating.
+// By registering a tee, each event received from the eventers is also printed to it, in a
+// human-readable form, before it is transformed.
+// By registering a recorder, each event received from the eventers is also recorded to a
+// capture file, before it is transformed, so that it can be replayed. Failing to record an
+// event is logged, but does not stop it being processed.
+// By registering a flow tracker, each valid event is also tracked to assemble a flow record
+// of its connection, which is sunk to the flow sinker when the connection closes, or is
+// evicted when idle or to bound the connections tracked. Connections still open when the
+// processor stops are not recorded.
+// By registering a handshake tracker, each valid event is also tracked to time the
+// handshakes of connections and find how they ended, for the metrics. The results of failed
+// handshakes are also sunk to the handshake sinker, if one is registered.
+// Records other than events, such as flow records, are queued for each record sinker and
+// sunk in its own goroutine, with the sink timeout as the deadline, so that a slow record
+// sinker does not stop events being processed. Records put on a full queue are dropped.
+// Failing to sink a record is logged, but does not stop events being processed. Records
+// still queued when the processor stops are sunk before it returns.
+// By registering an alert engine, each valid event is also evaluated against its rules,
+// next to being sunk, and the alerts fired are sent to each of the notifiers. Alerts are
+// queued for each notifier as records are, and so are dropped if its queue is full.
+// Events for sinkers which sink batches are gathered until batchSize events are waiting or
+// the oldest has waited batchInterval, and then sunk together. The errors of the events in a
+// batch are handled event by event, as if each had been sunk alone. Batches still waiting
+// are flushed when the processor stops.
+// Eventers and sinkers which accept a context are given one which is cancelled when the
+// processor is asked to stop, so that a blocked eventer returns without being closed.
+// If a sink timeout is registered, each call to a sinker which accepts a context has that
+// deadline, so a hung sink is abandoned and counted as an error. Events still queued or
+// batched when the processor stops are sunk with a context that is not cancelled, but
+// still has the deadline, so they are not lost.
+// The sinkers can be replaced while the processor runs. Each event is delivered either to
+// all of the old sinkers or to all of the new sinkers.
 // By registering a done channel, the caller can cancel the execution of the processor.
 // Otherwise, it processes events indefinitely.
 type pipingEventProcessor struct {
-	eventer              event.Eventer
-	sinker               sink.Sinker
+	eventers             []event.Eventer
+	transformer          transform.Transformer
+	sinkMutex            sync.Mutex // Guards sinkers, sinkerErrCounts, batches and sinkCtx, so they can be replaced
+	sinkers              []sink.Sinker
+	sinkCtx              context.Context
+	sinkTimeout          time.Duration
+	sinkerErrCounts      []int
+	batches              []pendingBatch // Indexed by sinker, empty for sinkers which do not sink batches
+	batchSize            int
+	batchInterval        time.Duration
+	queue                *queue.Queue
+	deadLetterer         deadletter.DeadLetterer
+	metrics              *processorMetrics
+	health               *health
+	tee                  io.Writer
+	recorder             *capture.Writer
+	flowTracker          *flow.Tracker
+	flowSinker           record.Sinker
+	flowDispatcher       *record.Dispatcher
+	flowEvictInterval    time.Duration
+	handshakeTracker     *handshake.Tracker
+	handshakeSinker      record.Sinker // Nil if the results of failed handshakes are not sunk
+	handshakeDispatcher  *record.Dispatcher
+	alertEngine          *alert.Engine
+	alertNotifiers       []alert.Notifier
+	alertDispatchers     []*record.Dispatcher // One for each of the notifiers
 	maxConsecutiveErrors int
 	done                 <-chan struct{}
 }
 
-func newPipingEventProcessor(eventer event.Eventer, sinker sink.Sinker, maxConsecutiveErrors int) *pipingEventProcessor {
+// PendingBatch holds the events gathered for a sinker which sinks batches.
+type pendingBatch struct {
+	events   []*event.Event
+	deadline time.Time // When the batch must be flushed, however few events it holds
+}
+
+// SourcedEvent is an event tagged with the index of the eventer it came from.
+type sourcedEvent struct {
+	*event.Event
+	eventer int
+}
+
+// SourcedError is an error tagged with the index of the eventer it came from.
+type sourcedError struct {
+	error
+	eventer int
+}
+
+func newPipingEventProcessor(eventers []event.Eventer,
+	transformer transform.Transformer,
+	sinkers []sink.Sinker,
+	queue *queue.Queue,
+	maxConsecutiveErrors int) *pipingEventProcessor {
+	if transformer == nil {
+		transformer = transform.Chain(nil)
+	}
+
 	return &pipingEventProcessor{
-		eventer:              eventer,
-		sinker:               sinker,
+		eventers:             eventers,
+		transformer:          transformer,
+		sinkers:              sinkers,
+		sinkerErrCounts:      make([]int, len(sinkers)),
+		sinkCtx:              context.Background(),
+		batches:              make([]pendingBatch, len(sinkers)),
+		batchSize:            defaultBatchSize,
+		batchInterval:        defaultBatchInterval,
+		flowEvictInterval:    defaultFlowEvictInterval,
+		queue:                queue,
 		maxConsecutiveErrors: maxConsecutiveErrors,
 	}
 }
 
+// DoneChannelRegisterer is an optional interface which sinkers implement if they need to know
+// when the processor is asked to stop, for example to abandon waiting to retry.
+type doneChannelRegisterer interface {
+	RegisterDoneChannel(<-chan struct{})
+}
+
 // RegisterDoneChannel registers a done channel. Closing the channel will cause the run method
-// to return.
+// to return. The done channel is also registered with any sinkers which accept one.
 func (ep *pipingEventProcessor) registerDoneChannel(done <-chan struct{}) {
+	ep.sinkMutex.Lock()
+	defer ep.sinkMutex.Unlock()
+
 	ep.done = done
+
+	for _, sinker := range ep.sinkers {
+		if registerer, ok := sinker.(doneChannelRegisterer); ok {
+			registerer.RegisterDoneChannel(done)
+		}
+	}
+}
+
+// RegisterDeadLetterer registers a dead-letterer to which events which fail validation or
+// cannot be sunk are sent.
+func (ep *pipingEventProcessor) registerDeadLetterer(deadLetterer deadletter.DeadLetterer) {
+	ep.deadLetterer = deadLetterer
+}
+
+// RegisterMetrics registers the metrics which the processor updates.
+func (ep *pipingEventProcessor) registerMetrics(metrics *processorMetrics) {
+	ep.metrics = metrics
+}
+
+// RegisterHealth registers the health which the processor updates.
+func (ep *pipingEventProcessor) registerHealth(health *health) {
+	ep.health = health
+}
+
+// RegisterTee registers a writer to which each event received is printed.
+func (ep *pipingEventProcessor) registerTee(tee io.Writer) {
+	ep.tee = tee
+}
+
+// RegisterRecorder registers a capture file writer to which each event received is
+// recorded.
+func (ep *pipingEventProcessor) registerRecorder(recorder *capture.Writer) {
+	ep.recorder = recorder
+}
+
+// RegisterFlowTracker registers a flow tracker to which each valid event is given, and the
+// sinker to which the flow records it assembles are sunk.
+func (ep *pipingEventProcessor) registerFlowTracker(tracker *flow.Tracker, sinker record.Sinker) {
+	ep.flowTracker = tracker
+	ep.flowSinker = sinker
+}
+
+// RegisterHandshakeTracker registers a handshake tracker to which each valid event is
+// given, and the sinker, which may be nil, to which the results of failed handshakes are
+// sunk.
+func (ep *pipingEventProcessor) registerHandshakeTracker(tracker *handshake.Tracker, sinker record.Sinker) {
+	ep.handshakeTracker = tracker
+	ep.handshakeSinker = sinker
+}
+
+// RegisterAlertEngine registers an alert engine against whose rules each valid event is
+// evaluated, and the notifiers to which the alerts fired are sent.
+func (ep *pipingEventProcessor) registerAlertEngine(engine *alert.Engine, notifiers []alert.Notifier) {
+	ep.alertEngine = engine
+	ep.alertNotifiers = notifiers
+}
+
+// RegisterBatchLimits sets the maximum number of events in a batch and the longest an event
+// waits for its batch to be flushed.
+func (ep *pipingEventProcessor) registerBatchLimits(size int, interval time.Duration) {
+	ep.batchSize = size
+	ep.batchInterval = interval
+}
+
+// RegisterSinkTimeout sets the deadline of each call to a sinker which accepts a context.
+// A zero timeout means no deadline.
+func (ep *pipingEventProcessor) registerSinkTimeout(timeout time.Duration) {
+	ep.sinkTimeout = timeout
+}
+
+func (ep *pipingEventProcessor) setSinkContext(ctx context.Context) {
+	ep.sinkMutex.Lock()
+	defer ep.sinkMutex.Unlock()
+
+	ep.sinkCtx = ctx
+}
+
+// SinkCallContext returns the context for a single call to a sinker, with the sink timeout
+// as its deadline. The sinkMutex must be held.
+func (ep *pipingEventProcessor) sinkCallContext() (context.Context, context.CancelFunc) {
+	if ep.sinkTimeout <= 0 {
+		return ep.sinkCtx, func() {}
+	}
+
+	return context.WithTimeout(ep.sinkCtx, ep.sinkTimeout)
+}
+
+// SetConsecutiveErrors reports the consecutive error count of a component to the metrics
+// and health.
+func (ep *pipingEventProcessor) setConsecutiveErrors(component string, index, count int) {
+	ep.metrics.setConsecutiveErrors(component, index, count)
+	ep.health.setConsecutiveErrors(component, index, count)
 }
 
 // Run starts the processor. It will only return if the maxConsecutiveErrors is reached or
 // a done channel is registered and subsequently closed.
 func (ep *pipingEventProcessor) run() error {
-	done := make(chan struct{})
-	eventChan, errChan := ep.startGetEvents(done)
-	defer close(done)
+	// The context is cancelled when the processor is asked to stop, or returns for any
+	// other reason
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ep.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	eventChan, errChan := ep.startGetEvents(ctx)
+
+	// Deferred before stopping the queue, so that it runs after the queue has been drained
+	defer ep.flushBatches()
+
+	// Batches are checked several times per interval, so none waits much beyond its deadline
+	batchTicker := time.NewTicker(ep.batchInterval / 4)
+	defer batchTicker.Stop()
+
+	ep.setSinkContext(ctx)
+
+	var sinkErrChan <-chan error // Remains nil, and so is never selected, if there is no queue
+	if ep.queue != nil {
+		sinkErrChan = ep.startSinkQueued()
+		defer ep.stopSinkQueued(sinkErrChan)
+	}
+
+	// Deferred last, so that it runs first, before the queue is drained and the batches
+	// are flushed
+	defer ep.setSinkContext(context.Background())
+
+	// The heartbeat ensures the loop iterates, and so does not appear stalled, when there are
+	// no events
+	var heartbeatChan <-chan time.Time // Remains nil, and so is never selected, if there is no health
+	if ep.health != nil {
+		heartbeat := time.NewTicker(ep.health.heartbeatInterval())
+		defer heartbeat.Stop()
+		heartbeatChan = heartbeat.C
+	}
+
+	var flowEvictChan <-chan time.Time // Remains nil, and so is never selected, if there is no flow tracker
+	if ep.flowTracker != nil {
+		flowEvict := time.NewTicker(ep.flowEvictInterval)
+		defer flowEvict.Stop()
+		flowEvictChan = flowEvict.C
+
+		ep.flowDispatcher = ep.startRecordDispatcher(record.SinkerFunc(ep.flowSinker, flow.RecordKind),
+			func(_ interface{}, err error) {
+				log.Printf("Error: sinking flow record: %v", err)
+				ep.metrics.flowSinkError()
+			})
+		defer ep.stopRecordDispatcher(ep.flowDispatcher, flow.RecordKind)
+	}
+
+	if ep.handshakeSinker != nil {
+		ep.handshakeDispatcher = ep.startRecordDispatcher(record.SinkerFunc(ep.handshakeSinker, handshake.RecordKind),
+			func(_ interface{}, err error) {
+				log.Printf("Error: sinking handshake result: %v", err)
+				ep.metrics.handshakeSinkError()
+			})
+		defer ep.stopRecordDispatcher(ep.handshakeDispatcher, handshake.RecordKind)
+	}
+
+	if ep.alertEngine != nil {
+		ep.alertDispatchers = ep.startAlertDispatchers()
+		for _, dispatcher := range ep.alertDispatchers {
+			defer ep.stopRecordDispatcher(dispatcher, alert.RecordKind)
+		}
+	}
+
+	ep.health.setRunning(true)
+	defer ep.health.setRunning(false)
 
 	// Main loop
-	var lastErr error
-	errCount := 0
-	wasErr := false
+	eventerErrCounts := make([]int, len(ep.eventers))
+	transformerErrCount := 0
 loop:
 	for {
+		ep.health.markIteration()
+
 		select {
 		case <-ep.done:
 			// Ensure handling a done signal takes priority when both a signal is pending
@@ -72,74 +376,496 @@ loop:
 				// in order to catch a signal, but that is spinning.
 				break loop
 			case event := <-eventChan:
-				fmt.Printf("==> TCP state event: %v\n", event)
-				if err := ep.sinker.Sink(event); err != nil {
-					log.Printf("Error: sinking event: %v", err)
-					errCount++
-					wasErr = true
-					lastErr = err
+				eventerErrCounts[event.eventer] = 0
+				ep.setConsecutiveErrors(componentEventer, event.eventer, 0)
+				ep.metrics.eventReceived(event.eventer)
+				if ep.tee != nil {
+					fmt.Fprintf(ep.tee, "==> TCP state event (from eventer %d): %v\n", event.eventer, event.Event)
 				}
-			case err := <-errChan:
+				if ep.recorder != nil {
+					ep.record(event.Event)
+				}
+				transformed, err := ep.transformer.Transform(event.Event)
 				if err != nil {
-					log.Printf("Error: getting event: %v", err)
-					errCount++
-					wasErr = true
-					lastErr = err
+					log.Printf("Error: transforming event: %v", err)
+					transformerErrCount++
+					ep.metrics.transformerError()
+					ep.metrics.eventsDroppedBy(dropReasonTransformError, 1)
+					ep.setConsecutiveErrors(componentTransformer, 0, transformerErrCount)
+					if transformerErrCount == ep.maxConsecutiveErrors {
+						log.Println("too many consecutive transform errors")
+						return fmt.Errorf("too many consecutive transform errors: last error: %w", err)
+					}
+
+					continue
 				}
+				transformerErrCount = 0
+				ep.setConsecutiveErrors(componentTransformer, 0, 0)
+
+				for _, event := range transformed {
+					if err := validateEvent(event); err != nil {
+						if !ep.deadLetter(event, err, nil) {
+							log.Printf("Error: dropping invalid event: %v", err)
+							ep.metrics.eventsDroppedBy(dropReasonInvalid, 1)
+						}
+						continue
+					}
+					ep.metrics.stateTransition(event)
+					if ep.flowTracker != nil {
+						ep.sinkFlows(ep.flowTracker.Track(event))
+					}
+					if ep.handshakeTracker != nil {
+						ep.trackHandshake(event)
+					}
+					if ep.alertEngine != nil {
+						ep.alert(event)
+					}
+
+					if ep.queue != nil {
+						// Only this goroutine puts events on the queue, so the difference
+						// in the dropped count is due to this put alone
+						dropped := ep.queue.Dropped(ep.queue.Policy())
+						ep.queue.Put(event, ep.done)
+						ep.metrics.eventsDroppedBy(dropReasonQueueFull, ep.queue.Dropped(ep.queue.Policy())-dropped)
+						continue
+					}
+
+					if err := ep.sink(event); err != nil {
+						return err
+					}
+				}
+			case err := <-errChan:
+				log.Printf("Error: getting event from eventer %d: %v", err.eventer, err.error)
+				eventerErrCounts[err.eventer]++
+				ep.metrics.eventerError(err.eventer)
+				ep.setConsecutiveErrors(componentEventer, err.eventer, eventerErrCounts[err.eventer])
+				if eventerErrCounts[err.eventer] == ep.maxConsecutiveErrors {
+					log.Printf("too many consecutive event errors for eventer %d", err.eventer)
+					return fmt.Errorf("too many consecutive event errors for eventer %d: last error: %w",
+						err.eventer,
+						err.error)
+				}
+			case err := <-sinkErrChan:
+				return err
+			case now := <-batchTicker.C:
+				if err := ep.flushDueBatches(now); err != nil {
+					return err
+				}
+			case <-flowEvictChan:
+				ep.sinkFlows(ep.flowTracker.Evict())
+			case <-heartbeatChan:
 			}
 		}
+	}
+
+	// Only get here when the done channel is closed
+	return nil
+}
+
+// Record records the event, flushing it straight away so that the capture file is complete
+// up to the last event should tcp-audit crash.
+func (ep *pipingEventProcessor) record(event *event.Event) {
+	err := ep.recorder.Write(event)
+	if err == nil {
+		err = ep.recorder.Flush()
+	}
+
+	if err != nil {
+		log.Printf("Error: recording event: %v", err)
+	}
+}
+
+// StartRecordDispatcher starts a dispatcher which sinks records with the sink func, with
+// the sink timeout as the deadline of each, calling onError with those which fail.
+func (ep *pipingEventProcessor) startRecordDispatcher(sink record.SinkFunc, onError func(rec interface{}, err error)) *record.Dispatcher {
+	return record.NewDispatcher(recordQueueSize, ep.sinkTimeout, sink, func(rec interface{}, err error) {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("sink abandoned after %v: %w", ep.sinkTimeout, err)
+		}
+
+		onError(rec, err)
+	})
+}
+
+// StartAlertDispatchers starts a dispatcher for each of the alert notifiers.
+func (ep *pipingEventProcessor) startAlertDispatchers() []*record.Dispatcher {
+	dispatchers := make([]*record.Dispatcher, 0, len(ep.alertNotifiers))
+	for _, notifier := range ep.alertNotifiers {
+		notifier := notifier
+		notify := func(ctx context.Context, rec interface{}) error {
+			return notifier.Notify(ctx, rec.(*alert.Alert))
+		}
+
+		dispatchers = append(dispatchers, ep.startRecordDispatcher(notify, func(rec interface{}, err error) {
+			log.Printf("Error: notifying alert of rule %s: %v", rec.(*alert.Alert).Rule, err)
+			ep.metrics.alertNotifyError()
+		}))
+	}
+
+	return dispatchers
+}
+
+// StopRecordDispatcher waits for the records queued on the dispatcher to be sunk.
+func (ep *pipingEventProcessor) stopRecordDispatcher(dispatcher *record.Dispatcher, kind string) {
+	dispatcher.Close()
+
+	if dropped := dispatcher.Dropped(); dropped != 0 {
+		log.Printf("dropped %d %s records due to full queue", dropped, kind)
+	}
+}
+
+// Dispatch queues the record on the dispatcher, counting it if it is dropped.
+func (ep *pipingEventProcessor) dispatch(dispatcher *record.Dispatcher, kind string, rec interface{}) {
+	if !dispatcher.Put(rec) {
+		ep.metrics.recordDropped(kind)
+	}
+}
 
-		if wasErr {
-			if errCount == ep.maxConsecutiveErrors {
-				log.Println("too many consecutive event errors")
-				return fmt.Errorf("too many consecutive event errors: last error: %w", lastErr)
+// SinkFlows queues the flow records to be sunk to the flow sinker.
+func (ep *pipingEventProcessor) sinkFlows(records []*flow.Record) {
+	ep.metrics.flowsClosed(records, ep.flowTracker.Len())
+	for _, flowRecord := range records {
+		ep.dispatch(ep.flowDispatcher, flow.RecordKind, flowRecord)
+	}
+}
+
+// TrackHandshake tracks the handshake of the event's connection, counting its result if
+// the event ends it, and queueing the result to be sunk to the handshake sinker if it
+// failed.
+func (ep *pipingEventProcessor) trackHandshake(event *event.Event) {
+	result := ep.handshakeTracker.Track(event)
+	if result == nil {
+		return
+	}
+
+	ep.metrics.handshake(result)
+	if ep.handshakeSinker == nil || !result.Failed() {
+		return
+	}
+
+	ep.dispatch(ep.handshakeDispatcher, handshake.RecordKind, result)
+}
+
+// Alert evaluates the event against the alert engine's rules, queueing the alerts fired to
+// be sent to each of the notifiers.
+func (ep *pipingEventProcessor) alert(event *event.Event) {
+	for _, firedAlert := range ep.alertEngine.Evaluate(event) {
+		ep.metrics.alertFired(firedAlert.Rule)
+		for _, dispatcher := range ep.alertDispatchers {
+			ep.dispatch(dispatcher, alert.RecordKind, firedAlert)
+		}
+	}
+}
+
+// Sink delivers the event to each of the sinkers, updating their consecutive error counts.
+// For sinkers which sink batches, the event is added to the sinker's batch, which is only
+// sunk once it is full.
+// An error is only returned if a sinker has reached the maxConsecutiveErrors threshold.
+func (ep *pipingEventProcessor) sink(event *event.Event) error {
+	ep.sinkMutex.Lock()
+	defer ep.sinkMutex.Unlock()
+
+	for i, sinker := range ep.sinkers {
+		if batchSinker, ok := batch.AsSinker(sinker); ok {
+			pending := &ep.batches[i]
+			if len(pending.events) == 0 {
+				pending.deadline = time.Now().Add(ep.batchInterval)
 			}
+			pending.events = append(pending.events, event)
 
-			wasErr = false
+			if len(pending.events) >= ep.batchSize {
+				if err := ep.flushBatch(i, batchSinker); err != nil {
+					return err
+				}
+			}
 			continue
 		}
 
-		errCount = 0
+		ctx, cancel := ep.sinkCallContext()
+		start := time.Now()
+		err := contextual.Sink(ctx, sinker, event)
+		duration := time.Since(start)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("sink abandoned after %v: %w", ep.sinkTimeout, err)
+		}
+		cancel()
+
+		if err := ep.sinkResult(i, event, err, duration); err != nil {
+			return err
+		}
 	}
 
-	// Only get here when the done channel is closed
 	return nil
 }
 
-// StartGetEvents calls the eventer in a new goroutine, thus converting a blocking call
-// into event and error channels that can be selected upon.
-func (ep *pipingEventProcessor) startGetEvents(done <-chan struct{}) (<-chan *event.Event, <-chan error) {
-	eventChan := make(chan *event.Event)
-	errChan := make(chan error)
+// SinkResult handles the result of sinking an event to a sinker, updating its consecutive
+// error count. The sinkMutex must be held.
+// An error is only returned if the sinker has reached the maxConsecutiveErrors threshold.
+func (ep *pipingEventProcessor) sinkResult(i int, event *event.Event, err error, duration time.Duration) error {
+	if err != nil {
+		ep.metrics.sinkerError(i, duration)
+		log.Printf("Error: sinking event to sinker %d: %v", i, err)
+		sinkerIdx := i
+		deadLettered := ep.deadLetter(event, err, &sinkerIdx)
+		if !deadLettered {
+			ep.metrics.eventsDroppedBy(dropReasonSinkError, 1)
+		}
 
-	go func(chan<- *event.Event, chan<- error) {
-	loop:
-		for {
-			select {
-			case <-done:
-				break loop
-			default:
+		if deadLettered && retry.IsPermanent(err) {
+			ep.sinkerErrCounts[i] = 0
+			ep.setConsecutiveErrors(componentSinker, i, 0)
+			return nil
+		}
+
+		ep.sinkerErrCounts[i]++
+		ep.setConsecutiveErrors(componentSinker, i, ep.sinkerErrCounts[i])
+		if ep.sinkerErrCounts[i] == ep.maxConsecutiveErrors {
+			log.Printf("too many consecutive sink errors for sinker %d", i)
+			return fmt.Errorf("too many consecutive sink errors for sinker %d: last error: %w", i, err)
+		}
+
+		return nil
+	}
+	ep.metrics.eventSunk(i, duration)
+
+	ep.sinkerErrCounts[i] = 0
+	ep.setConsecutiveErrors(componentSinker, i, 0)
+	return nil
+}
+
+// FlushBatch sinks the events gathered for a sinker as a batch, handling the result for
+// each event in turn. The time taken by the batch is shared equally among its events.
+// The sink timeout is the deadline of the batch as a whole. The sinkMutex must be held.
+// An error is only returned if the sinker has reached the maxConsecutiveErrors threshold.
+func (ep *pipingEventProcessor) flushBatch(i int, batchSinker batch.Sinker) error {
+	events := ep.batches[i].events
+	ep.batches[i] = pendingBatch{}
+
+	ctx, cancel := ep.sinkCallContext()
+	start := time.Now()
+	errs := batch.EventErrors(batch.SinkBatchContext(ctx, batchSinker, events), len(events))
+	duration := time.Since(start) / time.Duration(len(events))
+	cancel()
+
+	var thresholdErr error
+	for j, event := range events {
+		err := errs[j]
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("sink abandoned after %v: %w", ep.sinkTimeout, err)
+		}
+
+		if err := ep.sinkResult(i, event, err, duration); err != nil && thresholdErr == nil {
+			thresholdErr = err
+		}
+	}
+
+	return thresholdErr
+}
+
+// FlushDueBatches flushes the batches whose deadline has passed.
+// An error is only returned if a sinker has reached the maxConsecutiveErrors threshold.
+func (ep *pipingEventProcessor) flushDueBatches(now time.Time) error {
+	ep.sinkMutex.Lock()
+	defer ep.sinkMutex.Unlock()
+
+	for i, pending := range ep.batches {
+		if len(pending.events) != 0 && !now.Before(pending.deadline) {
+			if err := ep.flushBatch(i, ep.sinkers[i].(batch.Sinker)); err != nil {
+				return err
 			}
+		}
+	}
 
-			event, err := ep.eventer.Event() // If this is blocked, it will unblock when the eventer is closed
+	return nil
+}
 
-			select {
-			case <-done: // Must be checked before potentially blocking on errChan or eventChan that will never be read
-				break loop
-			default:
+// FlushBatchesLocked flushes every batch still waiting. The sinkMutex must be held.
+// Errors are logged, as the processor is stopping or the sinkers are being replaced.
+func (ep *pipingEventProcessor) flushBatchesLocked() {
+	for i, pending := range ep.batches {
+		if len(pending.events) == 0 {
+			continue
+		}
+
+		log.Printf("flushing batch of %d events for sinker %d", len(pending.events), i)
+		if err := ep.flushBatch(i, ep.sinkers[i].(batch.Sinker)); err != nil {
+			log.Printf("Error: flushing batch: %v", err)
+		}
+	}
+}
+
+// FlushBatches flushes every batch still waiting.
+func (ep *pipingEventProcessor) flushBatches() {
+	ep.sinkMutex.Lock()
+	defer ep.sinkMutex.Unlock()
+
+	ep.flushBatchesLocked()
+}
+
+// ReplaceSinkers switches the processor over to the new sinkers, returning the old ones,
+// which the caller is responsible for closing. The switch happens between events, so no
+// event is delivered to only some of the sinkers, and events which are queued are delivered
+// to the new sinkers. The done channel, if registered, is registered with the new sinkers.
+// Batches waiting for the old sinkers are flushed to them first.
+// If the prepare func is not nil, it is called with the new sinkers once the batches are
+// flushed, while no events are being sunk, so that it can, for example, wrap the new
+// sinkers around state which the old sinkers share. If it fails, the old sinkers are kept
+// and its error is returned.
+// The consecutive error counts of the sinkers start again from zero.
+func (ep *pipingEventProcessor) replaceSinkers(sinkers []sink.Sinker, prepare func(sinkers []sink.Sinker) error) ([]sink.Sinker, error) {
+	ep.sinkMutex.Lock()
+	defer ep.sinkMutex.Unlock()
+
+	ep.flushBatchesLocked()
+
+	if prepare != nil {
+		if err := prepare(sinkers); err != nil {
+			return nil, err
+		}
+	}
+
+	if ep.done != nil {
+		for _, sinker := range sinkers {
+			if registerer, ok := sinker.(doneChannelRegisterer); ok {
+				registerer.RegisterDoneChannel(ep.done)
 			}
+		}
+	}
 
-			if err != nil {
-				errChan <- err
+	oldSinkers := ep.sinkers
+	for i := range oldSinkers {
+		ep.setConsecutiveErrors(componentSinker, i, 0)
+	}
+
+	ep.sinkers = sinkers
+	ep.sinkerErrCounts = make([]int, len(sinkers))
+	ep.batches = make([]pendingBatch, len(sinkers))
+
+	return oldSinkers, nil
+}
+
+// DeadLetter sends the event to the dead-letterer, if one is registered, returning true
+// if the event was dead-lettered. The sinker is nil if the event failed validation.
+func (ep *pipingEventProcessor) deadLetter(event *event.Event, err error, sinker *int) bool {
+	if ep.deadLetterer == nil {
+		return false
+	}
+
+	attempts := 1
+	var attemptsErr *retry.AttemptsError
+	if errors.As(err, &attemptsErr) {
+		attempts = attemptsErr.Attempts
+	}
+
+	if sinker == nil {
+		attempts = 0 // The event was never sunk
+	}
+
+	record := &deadletter.Record{
+		Time:     time.Now(),
+		Event:    event,
+		Error:    err.Error(),
+		Attempts: attempts,
+		Sinker:   sinker,
+	}
+	if dlErr := ep.deadLetterer.DeadLetter(record); dlErr != nil {
+		log.Printf("Error: dead-lettering event: %v", dlErr)
+		return false
+	}
+
+	log.Printf("dead-lettered event: %v", err)
+	ep.metrics.eventDeadLettered()
+	return true
+}
+
+// StartSinkQueued sinks events from the queue in a new goroutine.
+// If a sinker reaches the maxConsecutiveErrors threshold, the error is sent on the returned
+// channel and any further queued events are discarded, so that the producer is never blocked
+// on a queue that will not be drained. The channel is closed once the queue has been closed
+// and drained.
+func (ep *pipingEventProcessor) startSinkQueued() <-chan error {
+	errChan := make(chan error, 1)
+
+	go func(errChan chan<- error) {
+		defer close(errChan)
+
+		failed := false
+		for event := range ep.queue.Events() {
+			if failed {
 				continue
 			}
 
-			eventChan <- event
+			if err := ep.sink(event); err != nil {
+				errChan <- err
+				failed = true
+			}
 		}
+	}(errChan)
+
+	return errChan
+}
+
+// StopSinkQueued closes the queue and waits for the events remaining in it to be sunk.
+func (ep *pipingEventProcessor) stopSinkQueued(sinkErrChan <-chan error) {
+	ep.queue.Close()
+	for range sinkErrChan {
+	}
+
+	if dropped := ep.queue.Dropped(ep.queue.Policy()); dropped != 0 {
+		log.Printf("dropped %d events due to full queue (%v policy)", dropped, ep.queue.Policy())
+	}
+}
+
+// StartGetEvents calls each eventer in its own goroutine, thus converting blocking calls
+// into event and error channels that can be selected upon. Events and errors from all
+// eventers are merged onto the same channels, tagged with the eventer they came from.
+// Eventers which accept a context are given ctx, so they return once it is done.
+func (ep *pipingEventProcessor) startGetEvents(ctx context.Context) (<-chan sourcedEvent, <-chan sourcedError) {
+	done := ctx.Done()
+	eventChan := make(chan sourcedEvent)
+	errChan := make(chan sourcedError)
+
+	waitGroup := new(sync.WaitGroup)
+	waitGroup.Add(len(ep.eventers))
+	for i, eventer := range ep.eventers {
+		go func(eventerIdx int, eventer event.Eventer) {
+			defer waitGroup.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// If this is blocked, it will unblock when the context is done, if the eventer
+				// accepts one, otherwise when the eventer is closed
+				event, err := contextual.Event(ctx, eventer)
+
+				if err != nil {
+					select {
+					case errChan <- sourcedError{err, eventerIdx}:
+					case <-done: // Must not block on errChan that will never be read
+						return
+					}
+					continue
+				}
+
+				select {
+				case eventChan <- sourcedEvent{event, eventerIdx}:
+				case <-done: // Must not block on eventChan that will never be read
+					return
+				}
+			}
+		}(i, eventer)
+	}
 
+	// Close the channels only once every eventer goroutine has stopped writing to them
+	go func() {
+		waitGroup.Wait()
 		close(eventChan)
 		close(errChan)
-	}(eventChan, errChan)
+	}()
 
 	return eventChan, errChan
 }
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/alert"
+	"github.com/jhwbarlow/tcp-audit/pkg/batch"
+	"github.com/jhwbarlow/tcp-audit/pkg/capture"
+	"github.com/jhwbarlow/tcp-audit/pkg/deadletter"
+	"github.com/jhwbarlow/tcp-audit/pkg/flow"
+	"github.com/jhwbarlow/tcp-audit/pkg/handshake"
+	"github.com/jhwbarlow/tcp-audit/pkg/queue"
+	"github.com/jhwbarlow/tcp-audit/pkg/retry"
+	"github.com/jhwbarlow/tcp-audit/pkg/transform"
 )
 
 type mockEventer struct {
@@ -89,7 +103,7 @@ func TestProcessorEvent(t *testing.T) {
 	mockEventer := newMockEventer(mockEvent, nil, 1)
 	mockSinker := newMockSinker(nil, 0)
 	done := make(chan struct{})
-	processor := newPipingEventProcessor(mockEventer, mockSinker, maxErrors)
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
 	processor.registerDoneChannel(done)
 
 	defer close(done) // Close down the processor
@@ -120,6 +134,100 @@ func TestProcessorEvent(t *testing.T) {
 	t.Logf("received event %q", event)
 }
 
+type mockTransformer struct {
+	errToReturn error
+}
+
+// Transform duplicates the event, incrementing the PID of the duplicate
+func (mt *mockTransformer) Transform(e *event.Event) ([]*event.Event, error) {
+	if mt.errToReturn != nil {
+		return nil, mt.errToReturn
+	}
+
+	duplicate := *e
+	duplicate.PIDOnCPU++
+	return []*event.Event{e, &duplicate}, nil
+}
+
+// TestProcessorTransformer tests that the processor applies the transformer
+// and sinks every event it returns
+func TestProcessorTransformer(t *testing.T) {
+	mockEvent := &event.Event{
+		Time:         time.Now(),
+		PIDOnCPU:     7337,
+		CommandOnCPU: "test",
+		SourceIP:     net.ParseIP("1.2.3.4"),
+		DestIP:       net.ParseIP("7.3.3.7"),
+		SourcePort:   1234,
+		DestPort:     7337,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynReceived,
+	}
+	mockEventer := newMockEventer(mockEvent, nil, 1)
+	mockSinker := newMockSinker(nil, 0)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer},
+		transform.Chain{new(mockTransformer)},
+		[]sink.Sinker{mockSinker},
+		nil,
+		maxErrors)
+	processor.registerDoneChannel(done)
+
+	defer close(done) // Close down the processor
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	first := <-mockSinker.receivedEventChan
+	second := <-mockSinker.receivedEventChan
+	if !first.Equal(mockEvent) {
+		t.Error("expected first received event to be equal to sent event")
+	}
+
+	if second.PIDOnCPU != mockEvent.PIDOnCPU+1 {
+		t.Errorf("expected second received event to be the transformed duplicate, got %v", second)
+	}
+}
+
+// TestProcessorTransformerError tests that the processor successfully stops
+// and returns an error when the Transformer returns successive errors
+func TestProcessorTransformerError(t *testing.T) {
+	mockEvent := &event.Event{
+		Time:         time.Now(),
+		PIDOnCPU:     7337,
+		CommandOnCPU: "test",
+		SourceIP:     net.ParseIP("1.2.3.4"),
+		DestIP:       net.ParseIP("7.3.3.7"),
+		SourcePort:   1234,
+		DestPort:     7337,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynReceived,
+	}
+	mockError := errors.New("mock transformer error")
+	mockEventer := newMockEventer(mockEvent, nil, 3)
+	mockSinker := newMockSinker(nil, 0)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer},
+		&mockTransformer{errToReturn: mockError},
+		[]sink.Sinker{mockSinker},
+		nil,
+		3)
+	processor.registerDoneChannel(done)
+
+	err := processor.run()
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
 // TestProcessorEventerError tests that the processor successfully stops
 // and returns an error when the Eventer returns successive errors
 func TestProcessorEventerError(t *testing.T) {
@@ -127,7 +235,7 @@ func TestProcessorEventerError(t *testing.T) {
 	mockEventer := newMockEventer(nil, mockError, 3)
 	mockSinker := new(mockSinker)
 	done := make(chan struct{})
-	processor := newPipingEventProcessor(mockEventer, mockSinker, 3)
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, 3)
 	processor.registerDoneChannel(done)
 
 	// The processor runs in an infinite loop so we must run it in its
@@ -181,7 +289,7 @@ func TestProcessorSinkerError(t *testing.T) {
 	mockEventer := newMockEventer(mockEvent, nil, 3)
 	mockSinker := newMockSinker(mockError, 3)
 	done := make(chan struct{})
-	processor := newPipingEventProcessor(mockEventer, mockSinker, 3)
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, 3)
 	processor.registerDoneChannel(done)
 
 	// The processor runs in an infinite loop so we must run it in its
@@ -217,3 +325,969 @@ func TestProcessorSinkerError(t *testing.T) {
 		close(done) // Close down the processor as it will not have closed itself
 	}
 }
+
+// TestProcessorMultipleSinkers tests that an event is delivered to every sinker,
+// even when one of the sinkers returns an error
+func TestProcessorMultipleSinkers(t *testing.T) {
+	mockEvent := &event.Event{
+		Time:         time.Now(),
+		PIDOnCPU:     7337,
+		CommandOnCPU: "test",
+		SourceIP:     net.ParseIP("1.2.3.4"),
+		DestIP:       net.ParseIP("7.3.3.7"),
+		SourcePort:   1234,
+		DestPort:     7337,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynReceived,
+	}
+	mockEventer := newMockEventer(mockEvent, nil, 1)
+	mockErrorSinker := newMockSinker(errors.New("mock sinker error"), 1)
+	mockSinker := newMockSinker(nil, 0)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockErrorSinker, mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+
+	defer close(done) // Close down the processor
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	// The second sinker must receive the event despite the first returning an error
+	event := <-mockSinker.receivedEventChan
+	select {
+	case err := <-errChan:
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	default:
+	}
+
+	if !event.Equal(mockEvent) {
+		t.Error("expected received event to be equal to sent event")
+	}
+}
+
+// TestProcessorMultipleEventers tests that events from every eventer are merged
+// and sent to the sinker
+func TestProcessorMultipleEventers(t *testing.T) {
+	mockEvents := []*event.Event{
+		{
+			Time:         time.Now(),
+			PIDOnCPU:     1234,
+			CommandOnCPU: "test1",
+			SourceIP:     net.ParseIP("1.2.3.4"),
+			DestIP:       net.ParseIP("7.3.3.7"),
+			SourcePort:   1234,
+			DestPort:     7337,
+			OldState:     tcpstate.StateClosed,
+			NewState:     tcpstate.StateSynReceived,
+		},
+		{
+			Time:         time.Now(),
+			PIDOnCPU:     7337,
+			CommandOnCPU: "test2",
+			SourceIP:     net.ParseIP("4.3.2.1"),
+			DestIP:       net.ParseIP("7.3.3.7"),
+			SourcePort:   4321,
+			DestPort:     7337,
+			OldState:     tcpstate.StateSynSent,
+			NewState:     tcpstate.StateEstablished,
+		},
+	}
+	mockEventers := []event.Eventer{
+		newMockEventer(mockEvents[0], nil, 1),
+		newMockEventer(mockEvents[1], nil, 1),
+	}
+	mockSinker := newMockSinker(nil, 0)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor(mockEventers, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+
+	defer close(done) // Close down the processor
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	// The events may arrive in any order
+	received := make([]bool, len(mockEvents))
+	for range mockEvents {
+		event := <-mockSinker.receivedEventChan
+		for i, mockEvent := range mockEvents {
+			if event.Equal(mockEvent) {
+				received[i] = true
+			}
+		}
+	}
+
+	for i := range received {
+		if !received[i] {
+			t.Errorf("expected event from eventer %d to be received, but was not", i)
+		}
+	}
+
+	select {
+	case err := <-errChan:
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	default:
+	}
+}
+
+// TestProcessorQueued tests that the processor sinks events via the queue
+func TestProcessorQueued(t *testing.T) {
+	mockEvent := &event.Event{
+		Time:         time.Now(),
+		PIDOnCPU:     7337,
+		CommandOnCPU: "test",
+		SourceIP:     net.ParseIP("1.2.3.4"),
+		DestIP:       net.ParseIP("7.3.3.7"),
+		SourcePort:   1234,
+		DestPort:     7337,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynReceived,
+	}
+	mockEventer := newMockEventer(mockEvent, nil, 2)
+	mockSinker := newMockSinker(nil, 0)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer},
+		nil,
+		[]sink.Sinker{mockSinker},
+		queue.New(2, queue.Block),
+		maxErrors)
+	processor.registerDoneChannel(done)
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	for i := 0; i < 2; i++ {
+		event := <-mockSinker.receivedEventChan
+		if !event.Equal(mockEvent) {
+			t.Error("expected received event to be equal to sent event")
+		}
+	}
+
+	close(done)
+	if err := <-errChan; err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+// TestProcessorQueuedSinkerError tests that the processor successfully stops
+// and returns an error when the Sinker returns successive errors while sinking
+// from the queue
+func TestProcessorQueuedSinkerError(t *testing.T) {
+	mockEvent := &event.Event{
+		Time:         time.Now(),
+		PIDOnCPU:     7337,
+		CommandOnCPU: "test",
+		SourceIP:     net.ParseIP("1.2.3.4"),
+		DestIP:       net.ParseIP("7.3.3.7"),
+		SourcePort:   1234,
+		DestPort:     7337,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynReceived,
+	}
+	mockError := errors.New("mock sinker error")
+	mockEventer := newMockEventer(mockEvent, nil, 3)
+	mockSinker := newMockSinker(mockError, 3)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer},
+		nil,
+		[]sink.Sinker{mockSinker},
+		queue.New(1, queue.Block),
+		3)
+	processor.registerDoneChannel(done)
+
+	err := processor.run()
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+type mockDoneChannelSinker struct {
+	mockSinker
+	done <-chan struct{}
+}
+
+func (mdcs *mockDoneChannelSinker) RegisterDoneChannel(done <-chan struct{}) {
+	mdcs.done = done
+}
+
+// TestProcessorRegistersDoneChannelWithSinkers tests that the processor passes
+// its done channel on to sinkers which accept one
+func TestProcessorRegistersDoneChannelWithSinkers(t *testing.T) {
+	mockSinker := new(mockDoneChannelSinker)
+	processor := newPipingEventProcessor(nil, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+
+	done := make(chan struct{})
+	processor.registerDoneChannel(done)
+
+	if mockSinker.done != done {
+		t.Error("expected done channel to be registered with sinker, but was not")
+	}
+}
+
+type mockDeadLetterer struct {
+	recordChan chan *deadletter.Record
+}
+
+func newMockDeadLetterer() *mockDeadLetterer {
+	return &mockDeadLetterer{recordChan: make(chan *deadletter.Record)}
+}
+
+func (mdl *mockDeadLetterer) DeadLetter(record *deadletter.Record) error {
+	mdl.recordChan <- record
+	return nil
+}
+
+// TestProcessorDeadLettersInvalidEvent tests that an event which fails validation
+// is dead-lettered rather than sunk
+func TestProcessorDeadLettersInvalidEvent(t *testing.T) {
+	mockEvent := &event.Event{
+		Time:         time.Now(),
+		PIDOnCPU:     7337,
+		CommandOnCPU: "test",
+		DestIP:       net.ParseIP("7.3.3.7"),
+		SourcePort:   1234,
+		DestPort:     7337,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynReceived,
+	}
+	mockEventer := newMockEventer(mockEvent, nil, 1)
+	mockSinker := newMockSinker(nil, 0)
+	mockDeadLetterer := newMockDeadLetterer()
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerDeadLetterer(mockDeadLetterer)
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	select {
+	case record := <-mockDeadLetterer.recordChan:
+		if record.Event != mockEvent {
+			t.Error("expected dead-lettered event to be the invalid event")
+		}
+
+		if record.Sinker != nil {
+			t.Errorf("expected nil sinker, got %d", *record.Sinker)
+		}
+
+		if record.Attempts != 0 {
+			t.Errorf("expected 0 attempts, got %d", record.Attempts)
+		}
+	case <-mockSinker.receivedEventChan:
+		t.Error("expected invalid event not to be sunk")
+	}
+}
+
+// TestProcessorDeadLettersPermanentSinkerError tests that an event which a sinker
+// permanently fails to sink is dead-lettered, and that the error does not count
+// towards the sinker's consecutive errors
+func TestProcessorDeadLettersPermanentSinkerError(t *testing.T) {
+	mockEvent := &event.Event{
+		Time:         time.Now(),
+		PIDOnCPU:     7337,
+		CommandOnCPU: "test",
+		SourceIP:     net.ParseIP("1.2.3.4"),
+		DestIP:       net.ParseIP("7.3.3.7"),
+		SourcePort:   1234,
+		DestPort:     7337,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynReceived,
+	}
+	mockError := retry.Permanent(errors.New("mock permanent sinker error"))
+	mockEventer := newMockEventer(mockEvent, nil, 3)
+	mockSinker := newMockSinker(mockError, 3)
+	mockDeadLetterer := newMockDeadLetterer()
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, 3)
+	processor.registerDoneChannel(done)
+	processor.registerDeadLetterer(mockDeadLetterer)
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	for i := 0; i < 3; i++ {
+		record := <-mockDeadLetterer.recordChan
+		if record.Sinker == nil || *record.Sinker != 0 {
+			t.Error("expected dead-lettered record to name sinker 0")
+		}
+
+		if record.Attempts != 1 {
+			t.Errorf("expected 1 attempt, got %d", record.Attempts)
+		}
+
+		if record.Error != mockError.Error() {
+			t.Errorf("expected error text %q, got %q", mockError.Error(), record.Error)
+		}
+	}
+
+	close(done)
+	if err := <-errChan; err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+}
+
+// TestProcessorReplaceSinkers tests that events are sent to the new sinkers once
+// the sinkers are replaced, and that the new sinkers are given the done channel
+func TestProcessorReplaceSinkers(t *testing.T) {
+	mockEvent := &event.Event{
+		Time:     time.Now(),
+		SourceIP: net.ParseIP("1.2.3.4"),
+		DestIP:   net.ParseIP("7.3.3.7"),
+		OldState: tcpstate.StateClosed,
+		NewState: tcpstate.StateSynReceived,
+	}
+	eventChan := make(chan *event.Event, 1)
+	mockEventer := &mockEventer{eventChan: eventChan}
+	oldSinker := newMockSinker(nil, 0)
+	newSinker := &mockDoneChannelSinker{mockSinker: *newMockSinker(nil, 0)}
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{oldSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	eventChan <- mockEvent
+	<-oldSinker.receivedEventChan
+
+	replaced, err := processor.replaceSinkers([]sink.Sinker{newSinker}, nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(replaced) != 1 || replaced[0] != oldSinker {
+		t.Errorf("expected old sinker to be returned, got %v", replaced)
+	}
+
+	if newSinker.done != done {
+		t.Error("expected done channel to be registered with new sinker, but was not")
+	}
+
+	eventChan <- mockEvent
+	if event := <-newSinker.receivedEventChan; !event.Equal(mockEvent) {
+		t.Error("expected event received by new sinker to be equal to sent event")
+	}
+}
+
+// mockBatchSinker sends each batch it receives on batchChan, and fails the events
+// at the given positions in the batch.
+type mockBatchSinker struct {
+	mockSinker
+	batchChan chan []*event.Event
+	failAt    map[int]error
+}
+
+func newMockBatchSinker(failAt map[int]error) *mockBatchSinker {
+	return &mockBatchSinker{batchChan: make(chan []*event.Event, 10), failAt: failAt}
+}
+
+func (mbs *mockBatchSinker) SinkBatch(events []*event.Event) error {
+	mbs.batchChan <- events
+
+	errs := make([]error, len(events))
+	for i, err := range mbs.failAt {
+		if i < len(errs) {
+			errs[i] = err
+		}
+	}
+
+	return batch.NewError(errs)
+}
+
+func newValidMockEvent() *event.Event {
+	return &event.Event{
+		Time:     time.Now(),
+		SourceIP: net.ParseIP("1.2.3.4"),
+		DestIP:   net.ParseIP("7.3.3.7"),
+		OldState: tcpstate.StateClosed,
+		NewState: tcpstate.StateSynReceived,
+	}
+}
+
+// TestProcessorSinksFullBatch tests that events for a sinker which sinks batches are
+// gathered and sunk together once the batch is full
+func TestProcessorSinksFullBatch(t *testing.T) {
+	mockEventer := newMockEventer(newValidMockEvent(), nil, 3)
+	mockBatchSinker := newMockBatchSinker(nil)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockBatchSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerBatchLimits(3, time.Hour)
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	if events := <-mockBatchSinker.batchChan; len(events) != 3 {
+		t.Errorf("expected batch of 3 events, got %d", len(events))
+	}
+}
+
+// TestProcessorFlushesBatchAfterInterval tests that a batch which is not full is sunk
+// once its oldest event has waited for the batch interval
+func TestProcessorFlushesBatchAfterInterval(t *testing.T) {
+	mockEventer := newMockEventer(newValidMockEvent(), nil, 2)
+	mockBatchSinker := newMockBatchSinker(nil)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockBatchSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerBatchLimits(100, 20*time.Millisecond)
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	select {
+	case events := <-mockBatchSinker.batchChan:
+		if len(events) != 2 {
+			t.Errorf("expected batch of 2 events, got %d", len(events))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected batch to be flushed after interval, but was not")
+	}
+}
+
+// TestProcessorFlushesBatchOnStop tests that a batch which is waiting is sunk before
+// the processor returns
+func TestProcessorFlushesBatchOnStop(t *testing.T) {
+	mockEvent := newValidMockEvent()
+	eventChan := make(chan *event.Event)
+	mockEventer := &mockEventer{eventChan: eventChan}
+	mockBatchSinker := newMockBatchSinker(nil)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockBatchSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerBatchLimits(100, time.Hour)
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	eventChan <- mockEvent
+	eventChan <- mockEvent // Not taken by the processor until the first has been added to the batch
+
+	close(done)
+	if err := <-errChan; err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	select {
+	case events := <-mockBatchSinker.batchChan:
+		if len(events) == 0 {
+			t.Error("expected flushed batch to hold events, but was empty")
+		}
+	default:
+		t.Error("expected batch to be flushed when processor stopped, but was not")
+	}
+}
+
+// TestProcessorBatchPartialFailure tests that the events which fail in a batch are
+// handled one by one, each counting towards the sinker's consecutive errors
+func TestProcessorBatchPartialFailure(t *testing.T) {
+	mockError := errors.New("mock sinker error")
+	mockEventer := newMockEventer(newValidMockEvent(), nil, 4)
+	mockBatchSinker := newMockBatchSinker(map[int]error{2: mockError, 3: mockError})
+	mockDeadLetterer := newMockDeadLetterer()
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockBatchSinker}, nil, 2)
+	processor.registerDoneChannel(done)
+	processor.registerDeadLetterer(mockDeadLetterer)
+	processor.registerBatchLimits(4, time.Hour)
+
+	defer close(done)
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	for i := 0; i < 2; i++ {
+		record := <-mockDeadLetterer.recordChan
+		if record.Sinker == nil || *record.Sinker != 0 {
+			t.Error("expected dead-lettered record to name sinker 0")
+		}
+	}
+
+	err := <-errChan
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, got %v", mockError, err)
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+// mockHungSinker blocks in SinkContext until its context is done.
+type mockHungSinker struct {
+	mockSinker
+}
+
+func (*mockHungSinker) SinkContext(ctx context.Context, e *event.Event) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// TestProcessorAbandonsHungSink tests that a sink to a sinker which accepts a context
+// is abandoned at the sink timeout and counted as an error
+func TestProcessorAbandonsHungSink(t *testing.T) {
+	mockEventer := newMockEventer(newValidMockEvent(), nil, 2)
+	mockSinker := new(mockHungSinker)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, 2)
+	processor.registerDoneChannel(done)
+	processor.registerSinkTimeout(10 * time.Millisecond)
+
+	defer close(done)
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected error chain to include %q, got %v", context.DeadlineExceeded, err)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	case <-time.After(5 * time.Second):
+		t.Error("expected hung sinks to be abandoned, but were not")
+	}
+}
+
+// mockHungBatchSinker blocks in SinkBatchContext until its context is done.
+type mockHungBatchSinker struct {
+	mockBatchSinker
+}
+
+func (*mockHungBatchSinker) SinkBatchContext(ctx context.Context, events []*event.Event) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// TestProcessorAbandonsHungBatch tests that a batch sunk to a sinker which accepts a
+// context is abandoned at the sink timeout, and each of its events counted as an error
+func TestProcessorAbandonsHungBatch(t *testing.T) {
+	mockEventer := newMockEventer(newValidMockEvent(), nil, 2)
+	mockSinker := new(mockHungBatchSinker)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, 2)
+	processor.registerDoneChannel(done)
+	processor.registerBatchLimits(2, time.Hour)
+	processor.registerSinkTimeout(10 * time.Millisecond)
+
+	defer close(done)
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected error chain to include %q, got %v", context.DeadlineExceeded, err)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	case <-time.After(5 * time.Second):
+		t.Error("expected hung batch to be abandoned, but was not")
+	}
+}
+
+// mockContextEventer blocks in EventContext until its context is done, reporting
+// when it has been called and when it has returned.
+type mockContextEventer struct {
+	mockEventer
+	calledChan   chan struct{}
+	returnedChan chan struct{}
+}
+
+func (mce *mockContextEventer) EventContext(ctx context.Context) (*event.Event, error) {
+	close(mce.calledChan)
+	<-ctx.Done()
+	close(mce.returnedChan)
+	return nil, ctx.Err()
+}
+
+// TestProcessorCancelsEventerContext tests that an eventer which accepts a context
+// is unblocked when the processor is asked to stop, without being closed
+func TestProcessorCancelsEventerContext(t *testing.T) {
+	mockEventer := &mockContextEventer{calledChan: make(chan struct{}), returnedChan: make(chan struct{})}
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{newMockSinker(nil, 0)}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+
+	errChan := make(chan error, 1)
+	go func(errChan chan<- error) {
+		errChan <- processor.run()
+	}(errChan)
+
+	<-mockEventer.calledChan
+	close(done)
+	if err := <-errChan; err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	select {
+	case <-mockEventer.returnedChan:
+	case <-time.After(5 * time.Second):
+		t.Error("expected eventer to return when processor stopped, but did not")
+	}
+}
+
+// TestProcessorTee tests that each event received is printed to the tee, if registered
+func TestProcessorTee(t *testing.T) {
+	mockEventer := newMockEventer(newValidMockEvent(), nil, 1)
+	mockSinker := newMockSinker(nil, 0)
+	tee := new(bytes.Buffer)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerTee(tee)
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	<-mockSinker.receivedEventChan // The tee is written before the event is sunk
+	if !strings.HasPrefix(tee.String(), "==> TCP state event (from eventer 0): ") {
+		t.Errorf("expected event to be printed to tee, got %q", tee.String())
+	}
+}
+
+// TestProcessorRecorder tests that each event received is recorded, if a recorder is
+// registered
+func TestProcessorRecorder(t *testing.T) {
+	mockEvent := newValidMockEvent()
+	mockEventer := newMockEventer(mockEvent, nil, 1)
+	mockSinker := newMockSinker(nil, 0)
+	captured := new(bytes.Buffer)
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerRecorder(capture.NewWriter(captured))
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	<-mockSinker.receivedEventChan // The event is recorded before it is sunk
+	reader, err := capture.NewReader(bytes.NewReader(captured.Bytes()))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	recorded, err := reader.Read()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !recorded.SourceIP.Equal(mockEvent.SourceIP) || recorded.NewState != mockEvent.NewState {
+		t.Errorf("expected event %v to be recorded, got %v", mockEvent, recorded)
+	}
+}
+
+type mockFlowSinker struct {
+	recordChan chan *flow.Record
+}
+
+func (mfs *mockFlowSinker) SinkRecord(kind string, record interface{}) error {
+	if kind != flow.RecordKind {
+		return fmt.Errorf("unexpected kind of record %q", kind)
+	}
+
+	mfs.recordChan <- record.(*flow.Record)
+	return nil
+}
+
+func newTestFlowTracker(t *testing.T, idleTimeout time.Duration) *flow.Tracker {
+	tracker, err := flow.NewTracker(flow.Options{IdleTimeout: idleTimeout, MaxFlows: 10})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return tracker
+}
+
+// TestProcessorFlowTracker tests that the flow record of a connection is sunk to the flow
+// sinker when the connection closes
+func TestProcessorFlowTracker(t *testing.T) {
+	mockEvent := newValidMockEvent()
+	mockEvent.OldState, mockEvent.NewState = tcpstate.StateSynSent, tcpstate.StateClosed
+	mockEventer := newMockEventer(mockEvent, nil, 1)
+	mockSinker := newMockSinker(nil, 0)
+	mockFlowSinker := &mockFlowSinker{recordChan: make(chan *flow.Record, 1)}
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerFlowTracker(newTestFlowTracker(t, time.Hour), mockFlowSinker)
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	<-mockSinker.receivedEventChan
+	select {
+	case record := <-mockFlowSinker.recordChan:
+		if record.ClosePath != flow.ClosePathHandshakeFailed || !record.SourceIP.Equal(mockEvent.SourceIP) {
+			t.Errorf("expected handshake-failed flow record of event %v, got %+v", mockEvent, record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected flow record to be sunk")
+	}
+}
+
+type mockHungFlowSinker struct {
+	calledChan chan struct{}
+}
+
+func (mhfs *mockHungFlowSinker) SinkRecord(kind string, record interface{}) error {
+	return errors.New("expected SinkRecordContext to be called")
+}
+
+func (mhfs *mockHungFlowSinker) SinkRecordContext(ctx context.Context, kind string, record interface{}) error {
+	mhfs.calledChan <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// TestProcessorFlowSinkerDoesNotBlockEvents tests that events continue to be sunk while the
+// flow sinker is hung, and that the flow sinker is abandoned at the sink timeout
+func TestProcessorFlowSinkerDoesNotBlockEvents(t *testing.T) {
+	closed := newValidMockEvent()
+	closed.OldState, closed.NewState = tcpstate.StateSynSent, tcpstate.StateClosed
+	mockEventChan := make(chan *event.Event, 2)
+	mockEventChan <- closed
+	mockEventChan <- newValidMockEvent()
+	mockEventer := &mockEventer{eventChan: mockEventChan}
+	mockSinker := newMockSinker(nil, 0)
+	mockFlowSinker := &mockHungFlowSinker{calledChan: make(chan struct{}, 1)}
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerFlowTracker(newTestFlowTracker(t, time.Hour), mockFlowSinker)
+	processor.registerSinkTimeout(100 * time.Millisecond)
+
+	go processor.run()
+
+	<-mockFlowSinker.calledChan
+	for i := 0; i < 2; i++ {
+		select {
+		case <-mockSinker.receivedEventChan:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected events to be sunk while the flow sinker is hung")
+		}
+	}
+
+	close(done) // Close down the processor, which waits for the flow sinker to be abandoned
+}
+
+// TestProcessorFlowTrackerEvicts tests that the flow record of an idle connection is sunk
+// to the flow sinker when it is evicted
+func TestProcessorFlowTrackerEvicts(t *testing.T) {
+	mockEventer := newMockEventer(newValidMockEvent(), nil, 1)
+	mockSinker := newMockSinker(nil, 0)
+	mockFlowSinker := &mockFlowSinker{recordChan: make(chan *flow.Record, 1)}
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerFlowTracker(newTestFlowTracker(t, time.Millisecond), mockFlowSinker)
+	processor.flowEvictInterval = time.Millisecond
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	<-mockSinker.receivedEventChan
+	select {
+	case record := <-mockFlowSinker.recordChan:
+		if record.ClosePath != flow.ClosePathTimeout || record.Direction != flow.DirectionInbound {
+			t.Errorf("expected inbound flow record closed by timeout, got %+v", record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected idle flow record to be sunk")
+	}
+}
+
+type mockHandshakeSinker struct {
+	resultChan chan *handshake.Result
+}
+
+func (mhs *mockHandshakeSinker) SinkRecord(kind string, record interface{}) error {
+	if kind != handshake.RecordKind {
+		return fmt.Errorf("unexpected kind of record %q", kind)
+	}
+
+	mhs.resultChan <- record.(*handshake.Result)
+	return nil
+}
+
+// TestProcessorHandshakeTracker tests that the results of failed handshakes are sunk to the
+// handshake sinker, and those of successful handshakes are not
+func TestProcessorHandshakeTracker(t *testing.T) {
+	established := newValidMockEvent()
+	established.OldState, established.NewState = tcpstate.StateSynReceived, tcpstate.StateEstablished
+	aborted := newValidMockEvent()
+	aborted.OldState, aborted.NewState = tcpstate.StateSynReceived, tcpstate.StateClosed
+	mockEventChan := make(chan *event.Event, 2)
+	mockEventChan <- established
+	mockEventChan <- aborted
+	mockEventer := &mockEventer{eventChan: mockEventChan}
+	mockSinker := newMockSinker(nil, 0)
+	mockHandshakeSinker := &mockHandshakeSinker{resultChan: make(chan *handshake.Result, 2)}
+	tracker, err := handshake.NewTracker(handshake.Options{TimeoutThreshold: time.Second, MaxPending: 10})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerHandshakeTracker(tracker, mockHandshakeSinker)
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	<-mockSinker.receivedEventChan
+	<-mockSinker.receivedEventChan
+	select {
+	case result := <-mockHandshakeSinker.resultChan:
+		if result.Outcome != handshake.OutcomeAborted {
+			t.Errorf("expected result of aborted handshake, got %+v", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected result of failed handshake to be sunk")
+	}
+
+	if len(mockHandshakeSinker.resultChan) != 0 {
+		t.Errorf("expected only the failed handshake to be sunk, got %+v", <-mockHandshakeSinker.resultChan)
+	}
+}
+
+type mockHungNotifier struct {
+	errChan chan error
+}
+
+func (mhn *mockHungNotifier) Notify(ctx context.Context, alert *alert.Alert) error {
+	<-ctx.Done()
+	mhn.errChan <- ctx.Err()
+	return ctx.Err()
+}
+
+// TestProcessorAlertNotifierDoesNotBlockEvents tests that events continue to be sunk while
+// an alert notifier is hung, and that the notifier is given the sink timeout as a deadline
+func TestProcessorAlertNotifierDoesNotBlockEvents(t *testing.T) {
+	mockEventChan := make(chan *event.Event, 2)
+	mockEventChan <- newValidMockEvent()
+	mockEventChan <- newValidMockEvent()
+	mockEventer := &mockEventer{eventChan: mockEventChan}
+	mockSinker := newMockSinker(nil, 0)
+	hungNotifier := &mockHungNotifier{errChan: make(chan error, 2)}
+	engine, err := alert.NewEngine([]alert.Rule{{Name: "any"}})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerAlertEngine(engine, []alert.Notifier{hungNotifier})
+	processor.registerSinkTimeout(50 * time.Millisecond)
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-mockSinker.receivedEventChan:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected events to be sunk while the notifier is hung")
+		}
+	}
+
+	select {
+	case err := <-hungNotifier.errChan:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected notify to be abandoned at the deadline, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected notify to be abandoned at the deadline")
+	}
+}
+
+type mockNotifier struct {
+	alertChan chan *alert.Alert
+	err       error
+}
+
+func (mn *mockNotifier) Notify(ctx context.Context, alert *alert.Alert) error {
+	mn.alertChan <- alert
+	return mn.err
+}
+
+// TestProcessorAlertEngine tests that the alerts fired by events are sent to every
+// notifier, even if an earlier notifier fails
+func TestProcessorAlertEngine(t *testing.T) {
+	established := newValidMockEvent()
+	established.OldState, established.NewState = tcpstate.StateSynReceived, tcpstate.StateEstablished
+	aborted := newValidMockEvent()
+	aborted.OldState, aborted.NewState = tcpstate.StateSynReceived, tcpstate.StateClosed
+	mockEventChan := make(chan *event.Event, 2)
+	mockEventChan <- established
+	mockEventChan <- aborted
+	mockEventer := &mockEventer{eventChan: mockEventChan}
+	mockSinker := newMockSinker(nil, 0)
+	failingNotifier := &mockNotifier{alertChan: make(chan *alert.Alert, 2), err: errors.New("mock notify error")}
+	succeedingNotifier := &mockNotifier{alertChan: make(chan *alert.Alert, 2)}
+	engine, err := alert.NewEngine([]alert.Rule{{
+		Name:  "aborted",
+		Match: alert.Match{OldState: "SYN-RECEIVED", NewState: "CLOSED"},
+	}})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	done := make(chan struct{})
+	processor := newPipingEventProcessor([]event.Eventer{mockEventer}, nil, []sink.Sinker{mockSinker}, nil, maxErrors)
+	processor.registerDoneChannel(done)
+	processor.registerAlertEngine(engine, []alert.Notifier{failingNotifier, succeedingNotifier})
+
+	defer close(done) // Close down the processor
+
+	go processor.run()
+
+	<-mockSinker.receivedEventChan
+	<-mockSinker.receivedEventChan
+	for _, notifier := range []*mockNotifier{failingNotifier, succeedingNotifier} {
+		select {
+		case alert := <-notifier.alertChan:
+			if alert.Rule != "aborted" {
+				t.Errorf("expected alert of rule aborted, got %+v", alert)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected alert to be notified")
+		}
+
+		if len(notifier.alertChan) != 0 {
+			t.Errorf("expected only the aborted handshake to fire an alert, got %+v", <-notifier.alertChan)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/spool"
+)
+
+// SinkerReloader re-reads the sinker configuration, from the same sources as at startup,
+// builds new sinkers from it and switches the processor over to them. The old sinkers are
+// then closed through the cleaner. If any step fails, the new sinkers are closed and the
+// processor keeps the old ones.
+// Only the sinkers and their options are reloaded; other settings need a restart.
+type sinkerReloader struct {
+	mutex      sync.Mutex
+	processor  *pipingEventProcessor
+	cleaner    cleaner
+	health     *health
+	args       []string
+	lookupEnv  func(string) (string, bool)
+	rawSinkers []sink.Sinker           // As initialised, and registered with the cleaner
+	spools     map[string]*spool.Spool // By name, kept open across reloads
+}
+
+// Reopener is an optional interface which sinkers that write to files implement, to close
+// and reopen their files so that they can be rotated by an external tool such as logrotate.
+type reopener interface {
+	Reopen() error
+}
+
+// Handle reloads the sinkers each time a signal is received. If the reload fails, the
+// previous sinkers are kept, but those which write to files are asked to reopen them, so
+// that the signal still has the effect that log rotation tools expect. Sinkers which
+// are reloaded open their files afresh.
+func (sr *sinkerReloader) handle(signalChan <-chan os.Signal) {
+	for signal := range signalChan {
+		log.Printf("reloading sinkers on signal %q", signal)
+		if err := sr.reload(); err != nil {
+			log.Printf("Error: reloading sinkers, keeping previous sinkers: %v", err)
+			sr.reopen()
+		}
+	}
+}
+
+// Reopen asks the current sinkers which write to files to reopen them.
+func (sr *sinkerReloader) reopen() {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	for i, sinker := range sr.rawSinkers {
+		if reopener, ok := sinker.(reopener); ok {
+			if err := reopener.Reopen(); err != nil {
+				log.Printf("Error: reopening file of sinker %d: %v", i, err)
+			}
+		}
+	}
+}
+
+func (sr *sinkerReloader) reload() error {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	specs, err := reloadSinkerSpecs(sr.args, sr.lookupEnv)
+	if err != nil {
+		return err
+	}
+
+	if len(specs) == 0 {
+		return errors.New(sinkerFlagStr + " not supplied")
+	}
+
+	rawSinkers := make([]sink.Sinker, 0, len(specs))
+	closeRawSinkers := func() {
+		for _, sinker := range rawSinkers {
+			closeSinker(sinker)
+		}
+	}
+
+	for i, spec := range specs {
+		sinker, err := initSinkerPlugin(spec)
+		if err != nil {
+			closeRawSinkers()
+			return fmt.Errorf("initialising sinker %d (%s): %w", i, spec.name, err)
+		}
+		rawSinkers = append(rawSinkers, sinker)
+	}
+
+	sinkers := append([]sink.Sinker(nil), rawSinkers...)
+	if *retryAttemptsFlag > 1 {
+		if err := retrySinkers(sinkers); err != nil {
+			closeRawSinkers()
+			return err
+		}
+	}
+
+	// The spools may be in use by the old sinkers, so the new sinkers are only wrapped
+	// around them once the processor has stopped sinking to the old sinkers
+	var prepare func(sinkers []sink.Sinker) error
+	if *spoolDirFlag != "" {
+		// Spools newly opened are kept even if the reload fails, as they are registered
+		// with the cleaner and may be used by a later reload
+		names := spoolNames(specs)
+		if sr.spools, err = openSpools(sinkers, names, sr.spools, sr.cleaner); err != nil {
+			closeRawSinkers()
+			return err
+		}
+
+		spools := sr.spools
+		prepare = func(sinkers []sink.Sinker) error {
+			return spoolSinkers(sinkers, names, spools)
+		}
+	}
+
+	for _, sinker := range rawSinkers {
+		sr.cleaner.registerSinker(sinker)
+	}
+
+	if _, err := sr.processor.replaceSinkers(sinkers, prepare); err != nil {
+		sr.cleaner.releaseSinkers(rawSinkers)
+		return err
+	}
+	sr.health.setSinkerCheckers(rawSinkers)
+	sr.cleaner.releaseSinkers(sr.rawSinkers)
+	sr.rawSinkers = rawSinkers
+
+	log.Printf("reloaded %d sinkers", len(sinkers))
+	return nil
+}
+
+// ReloadSinkerSpecs returns the specifications of the sinkers given by the configuration
+// file, the environment and the command-line, applied in the same way as at startup.
+// The other flags are parsed, so that the command-line is understood, but ignored.
+func reloadSinkerSpecs(args []string, lookupEnv func(string) (string, bool)) ([]pluginSpec, error) {
+	flags := flag.NewFlagSet(flag.CommandLine.Name(), flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	sinkers := registerPluginFlags(flags, sinkerFlagStr, sinkerOptFlagStr, sinkerOptFileFlagStr, "sinker")
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if flags.Lookup(f.Name) == nil {
+			flags.Var(ignoredValue{f.Value}, f.Name, f.Usage)
+		}
+	})
+
+	if _, err := loadConfig(flags, args, lookupEnv, []*pluginFlags{sinkers}); err != nil {
+		return nil, fmt.Errorf("configuration: %w", err)
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, fmt.Errorf("command-line flags: %w", err)
+	}
+
+	return sinkers.specs()
+}
+
+// IgnoredValue is a flag value which accepts, and discards, any value. It is a boolean
+// flag if the value it stands in for is, so that the command-line is parsed in the same way.
+type ignoredValue struct {
+	flag.Value
+}
+
+func (ignoredValue) String() string {
+	return ""
+}
+
+func (ignoredValue) Set(string) error {
+	return nil
+}
+
+func (iv ignoredValue) IsBoolFlag() bool {
+	boolFlag, ok := iv.Value.(interface{ IsBoolFlag() bool })
+	return ok && boolFlag.IsBoolFlag()
+}
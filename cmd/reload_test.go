@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/spool"
+	"golang.org/x/sys/unix"
+)
+
+func TestReloadSinkerSpecs(t *testing.T) {
+	path := writeConfigFile(t, `
+queue:
+  size: 10
+sinkers:
+  - path: file-sink.so
+    options:
+      file: /tmp/events
+`)
+	args := []string{"--" + configFlagStr, path, "--" + queueSizeFlagStr, "20", "--" + spoolDirFlagStr + "=/tmp"}
+
+	specs, err := reloadSinkerSpecs(args, func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(specs) != 1 || specs[0].name != "file-sink.so" {
+		t.Fatalf("expected sinker file-sink.so from configuration file, got %v", specs)
+	}
+
+	if specs[0].config["file"] != "/tmp/events" {
+		t.Errorf("expected option file=/tmp/events, got %v", specs[0].config)
+	}
+}
+
+func TestReloadSinkerSpecsOverriddenByFlags(t *testing.T) {
+	path := writeConfigFile(t, `
+sinkers:
+  - file-sink.so
+`)
+	env := map[string]string{envVarName(sinkerFlagStr): "env-sink.so"}
+	args := []string{"--" + configFlagStr, path, "--" + sinkerFlagStr, "flag-sink.so"}
+
+	specs, err := reloadSinkerSpecs(args, func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(specs) != 1 || specs[0].name != "flag-sink.so" {
+		t.Errorf("expected only sinker flag-sink.so from command-line, got %v", specs)
+	}
+}
+
+// TestReloadFailureKeepsSinkers tests that the processor keeps its sinkers, and they
+// are not released, if the new sinkers cannot be initialised
+func TestReloadFailureKeepsSinkers(t *testing.T) {
+	oldSinker := newMockSinker(nil, 0)
+	processor := newPipingEventProcessor([]event.Eventer{}, nil, []sink.Sinker{oldSinker}, nil, maxErrors)
+	cleaner := new(mockCleaner)
+	reloader := &sinkerReloader{
+		processor:  processor,
+		cleaner:    cleaner,
+		args:       []string{"--" + sinkerFlagStr, "/nonexistent/sink.so"},
+		lookupEnv:  func(string) (string, bool) { return "", false },
+		rawSinkers: []sink.Sinker{oldSinker},
+	}
+
+	err := reloader.reload()
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	if len(processor.sinkers) != 1 || processor.sinkers[0] != oldSinker {
+		t.Error("expected processor to keep old sinker, but did not")
+	}
+
+	if len(cleaner.releasedSinkers) != 0 {
+		t.Errorf("expected no sinkers to be released, got %v", cleaner.releasedSinkers)
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestReloadNoSinkersError(t *testing.T) {
+	reloader := &sinkerReloader{
+		processor: newPipingEventProcessor(nil, nil, nil, nil, maxErrors),
+		cleaner:   new(mockCleaner),
+		lookupEnv: func(string) (string, bool) { return "", false },
+	}
+
+	err := reloader.reload()
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+type mockReopenSinker struct {
+	mockSinker
+	reopenCalled bool
+}
+
+func (mrs *mockReopenSinker) Reopen() error {
+	mrs.reopenCalled = true
+	return nil
+}
+
+// TestReloadFailureReopensFiles tests that sinkers which write to files are asked to
+// reopen them if the reload fails
+func TestReloadFailureReopensFiles(t *testing.T) {
+	oldSinker := new(mockReopenSinker)
+	reloader := &sinkerReloader{
+		processor:  newPipingEventProcessor(nil, nil, []sink.Sinker{oldSinker}, nil, maxErrors),
+		cleaner:    new(mockCleaner),
+		args:       []string{"--" + sinkerFlagStr, "/nonexistent/sink.so"},
+		lookupEnv:  func(string) (string, bool) { return "", false },
+		rawSinkers: []sink.Sinker{oldSinker},
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signalChan <- unix.SIGHUP
+	close(signalChan)
+	reloader.handle(signalChan)
+
+	if !oldSinker.reopenCalled {
+		t.Error("expected sinker to be reopened, but was not")
+	}
+}
+
+// mockDownSinker fails every event, and every batch, so that they are spooled.
+type mockDownSinker struct{}
+
+func (mockDownSinker) Sink(*event.Event) error {
+	return errors.New("mock sinker down")
+}
+
+func (mockDownSinker) SinkBatch([]*event.Event) error {
+	return errors.New("mock sinker down")
+}
+
+// NewSpooledProcessor returns a processor with a sinker, which is down, in place of each
+// of the sinkers given by the command-line, spooling to the spool of that sinker. The
+// spool directory is set for the duration of the test. The spools are returned by name,
+// along with the name of the spool of each sinker.
+func newSpooledProcessor(t *testing.T, args []string) (*pipingEventProcessor, []string, map[string]*spool.Spool) {
+	oldSpoolDir := *spoolDirFlag
+	*spoolDirFlag = t.TempDir()
+	t.Cleanup(func() { *spoolDirFlag = oldSpoolDir })
+
+	specs, err := reloadSinkerSpecs(args, func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	sinkers := make([]sink.Sinker, len(specs))
+	for i := range sinkers {
+		sinkers[i] = mockDownSinker{}
+	}
+
+	cleaner := new(closingCleaner)
+	t.Cleanup(cleaner.cleanupAll)
+	names := spoolNames(specs)
+	spools, err := openSpools(sinkers, names, nil, cleaner)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if err := spoolSinkers(sinkers, names, spools); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return newPipingEventProcessor(nil, nil, sinkers, nil, maxErrors), names, spools
+}
+
+// TestReloadWhileSinkingSpooledEvents tests that the sinkers can be reloaded, alternately
+// removing the second sinker and adding it back, while events are being spooled by the old
+// sinkers, and that every event for the first sinker is either sunk by the new sinkers or
+// left in its spool. Run with -race.
+func TestReloadWhileSinkingSpooledEvents(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.jsonl")
+	oneSinker := []string{"--" + sinkerFlagStr, "builtin:jsonl", "--" + sinkerOptFlagStr, "file=" + file}
+	twoSinkers := append(oneSinker, "--"+sinkerFlagStr, "builtin:jsonl", "--"+sinkerOptFlagStr, "file="+filepath.Join(dir, "b.jsonl"))
+
+	processor, names, spools := newSpooledProcessor(t, twoSinkers)
+	reloader := &sinkerReloader{
+		processor: processor,
+		cleaner:   new(mockCleaner),
+		lookupEnv: func(string) (string, bool) { return "", false },
+		spools:    spools,
+	}
+
+	// Events are sunk until the reloads are done
+	stop := make(chan struct{})
+	sunk := make(chan error, 1)
+	events := 0
+	go func() {
+		for {
+			select {
+			case <-stop:
+				sunk <- nil
+				return
+			default:
+			}
+
+			if err := processor.sink(newValidMockEvent()); err != nil {
+				sunk <- err
+				return
+			}
+			events++
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		reloader.args = twoSinkers
+		if err := reloader.reload(); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		// Refused if the second sinker's spool still holds events
+		reloader.args = oneSinker
+		if err := reloader.reload(); err != nil {
+			t.Logf("got error %q (of type %T)", err, err)
+		}
+	}
+	close(stop)
+
+	if err := <-sunk; err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if total := bytes.Count(content, []byte("\n")) + spools[names[0]].Len(); total != events {
+		t.Errorf("expected %d events sunk or spooled for the first sinker, got %d", events, total)
+	}
+}
+
+// TestReloadRefusesToRemoveSpooledSinker tests that a reload which would remove a sinker
+// whose spool holds events fails, keeping the old sinkers. The event is still waiting in
+// a batch when the reload starts, so is only spooled as the batch is flushed to the old
+// sinkers, and so must not be missed.
+func TestReloadRefusesToRemoveSpooledSinker(t *testing.T) {
+	dir := t.TempDir()
+	oneSinker := []string{"--" + sinkerFlagStr, "builtin:jsonl", "--" + sinkerOptFlagStr, "file=" + filepath.Join(dir, "a.jsonl")}
+	twoSinkers := append(oneSinker, "--"+sinkerFlagStr, "builtin:jsonl", "--"+sinkerOptFlagStr, "file="+filepath.Join(dir, "b.jsonl"))
+
+	processor, names, spools := newSpooledProcessor(t, twoSinkers)
+	oldSinkers := append([]sink.Sinker(nil), processor.sinkers...)
+	if err := processor.sink(newValidMockEvent()); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	cleaner := new(mockCleaner)
+	reloader := &sinkerReloader{
+		processor: processor,
+		cleaner:   cleaner,
+		args:      oneSinker,
+		lookupEnv: func(string) (string, bool) { return "", false },
+		spools:    spools,
+	}
+
+	err := reloader.reload()
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if len(processor.sinkers) != 2 || processor.sinkers[0] != oldSinkers[0] || processor.sinkers[1] != oldSinkers[1] {
+		t.Error("expected processor to keep old sinkers, but did not")
+	}
+
+	if spools[names[1]].Len() != 1 {
+		t.Errorf("expected the batched event to be spooled for the second sinker, got %d events", spools[names[1]].Len())
+	}
+
+	if len(cleaner.releasedSinkers) != 1 {
+		t.Errorf("expected the new sinker to be released, got %v", cleaner.releasedSinkers)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/spool"
+)
+
+// The pattern of the names of spool files in the spool directory
+const spoolFilePattern = "sinker-*.spool"
+
+// SpoolNames returns the name of the spool file of each of the sinkers. A spool is named
+// after its sinker's plugin and options, so that it stays with the sinker if the sinkers
+// are reordered, and is not replayed to a different sinker which takes its place. Sinkers
+// which are given more than once, with the same options, are told apart by the order in
+// which they are given.
+func spoolNames(specs []pluginSpec) []string {
+	names := make([]string, len(specs))
+	occurrences := make(map[string]int, len(specs))
+	for i, spec := range specs {
+		keys := make([]string, 0, len(spec.config))
+		for key := range spec.config {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%q\n", spec.name)
+		for _, key := range keys {
+			fmt.Fprintf(hash, "%q=%q\n", key, spec.config[key])
+		}
+		identity := string(hash.Sum(nil))
+
+		// The first occurrence is hashed alone, so that adding a duplicate does not rename it
+		if occurrence := occurrences[identity]; occurrence != 0 {
+			fmt.Fprintf(hash, "%d\n", occurrence)
+		}
+		occurrences[identity]++
+
+		names[i] = fmt.Sprintf("sinker-%x.spool", hash.Sum(nil)[:8])
+	}
+
+	return names
+}
+
+// OpenSpools opens the spool of each of the sinkers, named by names, which is not already
+// open. Events left in a spool newly opened by a previous run are replayed to its sinker
+// immediately, before the sinker is in use. If spools is nil, as at startup, every spool
+// left in the spool directory is opened too, so that the spools of sinkers which are no
+// longer given are found by spoolSinkers.
+// The spools, including those newly opened, are returned, by name.
+func openSpools(sinkers []sink.Sinker, names []string, spools map[string]*spool.Spool, cleaner cleaner) (map[string]*spool.Spool, error) {
+	syncPolicy, err := spool.ParseSyncPolicy(*spoolFsyncFlag)
+	if err != nil {
+		return spools, err
+	}
+
+	opened := make(map[string]bool)
+	if spools == nil {
+		spools = make(map[string]*spool.Spool)
+
+		paths, err := filepath.Glob(filepath.Join(*spoolDirFlag, spoolFilePattern))
+		if err != nil {
+			return spools, fmt.Errorf("listing spools: %w", err)
+		}
+
+		for _, path := range paths {
+			if _, err := openSpool(path, syncPolicy, spools, cleaner); err != nil {
+				return spools, err
+			}
+			opened[filepath.Base(path)] = true
+		}
+	}
+
+	for i, name := range names {
+		sinkerSpool, ok := spools[name]
+		if !ok {
+			if sinkerSpool, err = openSpool(filepath.Join(*spoolDirFlag, name), syncPolicy, spools, cleaner); err != nil {
+				return spools, fmt.Errorf("opening spool for sinker %d: %w", i, err)
+			}
+			opened[name] = true
+		}
+
+		if !opened[name] {
+			continue // Already in use
+		}
+
+		if pending := sinkerSpool.Len(); pending != 0 {
+			log.Printf("replaying %d events spooled by a previous run for sinker %d", pending, i)
+			if err := spool.NewSinker(sinkers[i], sinkerSpool, *spoolReplayFlag).Replay(); err != nil {
+				log.Printf("Warning: replaying spool for sinker %d: %v", i, err)
+			}
+		}
+	}
+
+	return spools, nil
+}
+
+// OpenSpool opens the spool at the path, adding it to the spools and registering it with
+// the cleaner.
+func openSpool(path string, syncPolicy spool.SyncPolicy, spools map[string]*spool.Spool, cleaner cleaner) (*spool.Spool, error) {
+	sinkerSpool, err := spool.Open(path, *spoolMaxBytesFlag, syncPolicy)
+	if err != nil {
+		return nil, err
+	}
+	cleaner.registerCloser(sinkerSpool)
+	spools[filepath.Base(path)] = sinkerSpool
+
+	if discarded := sinkerSpool.Discarded(); discarded != 0 {
+		log.Printf("Warning: discarded %d bytes of corrupt records from spool %s", discarded, path)
+	}
+
+	return sinkerSpool, nil
+}
+
+// SpoolSinkers wraps each sinker so that events it fails to sink are spooled to its spool,
+// named by names, and replayed later. As the events in a spool which is not the spool of
+// any of the sinkers could not be replayed, none of those spools may hold events. As the
+// spools are not safe for concurrent use, they must not be in use by other sinkers, so
+// when sinkers are replaced it must be called while no events are being sunk.
+func spoolSinkers(sinkers []sink.Sinker, names []string, spools map[string]*spool.Spool) error {
+	used := make(map[string]bool, len(names))
+	for _, name := range names {
+		used[name] = true
+	}
+
+	var orphans []string
+	for name := range spools {
+		if !used[name] && spools[name].Len() != 0 {
+			orphans = append(orphans, name)
+		}
+	}
+
+	if len(orphans) != 0 {
+		sort.Strings(orphans)
+		return fmt.Errorf("spool %s holds %d events, but is not the spool of any sinker, so they could not be replayed: give its sinker again until they are, or remove the spool",
+			filepath.Join(*spoolDirFlag, orphans[0]),
+			spools[orphans[0]].Len())
+	}
+
+	for i, sinker := range sinkers {
+		sinkers[i] = spool.NewSinker(sinker, spools[names[i]], *spoolReplayFlag)
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+	"github.com/jhwbarlow/tcp-audit/pkg/spool"
+)
+
+// TestSpoolNames tests that each spool is named after its sinker, not its position
+func TestSpoolNames(t *testing.T) {
+	a := pluginSpec{name: "builtin:jsonl", config: pluginconfig.Config{"file": "/tmp/a"}}
+	b := pluginSpec{name: "builtin:jsonl", config: pluginconfig.Config{"file": "/tmp/b"}}
+	c := pluginSpec{name: "builtin:file", config: pluginconfig.Config{"file": "/tmp/a"}}
+
+	names := spoolNames([]pluginSpec{a, b, c, a})
+	reordered := spoolNames([]pluginSpec{c, a, b})
+
+	if names[0] != reordered[1] || names[1] != reordered[2] || names[2] != reordered[0] {
+		t.Errorf("expected spools to follow their sinkers when reordered, got %v and %v", names, reordered)
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			t.Errorf("expected a spool for each sinker, got %v", names)
+		}
+		seen[name] = true
+	}
+}
+
+// SpoolAt opens the spool at the path, appending the given number of events to it.
+func spoolAt(t *testing.T, path string, events int) *spool.Spool {
+	sinkerSpool, err := spool.Open(path, 0, spool.SyncNever)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	t.Cleanup(func() { sinkerSpool.Close() })
+
+	for i := 0; i < events; i++ {
+		if err := sinkerSpool.Append(newValidMockEvent()); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	return sinkerSpool
+}
+
+// TestSpoolSinkersRefusesOrphanedSpool tests that the sinkers cannot be wrapped while the
+// spool of a sinker which is not among them holds events, as they could not be replayed
+func TestSpoolSinkersRefusesOrphanedSpool(t *testing.T) {
+	dir := t.TempDir()
+	spools := map[string]*spool.Spool{
+		"a.spool": spoolAt(t, filepath.Join(dir, "a.spool"), 0),
+		"b.spool": spoolAt(t, filepath.Join(dir, "b.spool"), 0),
+	}
+
+	if err := spoolSinkers([]sink.Sinker{newMockSinker(nil, 0)}, []string{"a.spool"}, spools); err != nil {
+		t.Fatalf("expected nil error removing sinker with empty spool, got %v (of type %T)", err, err)
+	}
+
+	if err := spools["b.spool"].Append(newValidMockEvent()); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	err := spoolSinkers([]sink.Sinker{newMockSinker(nil, 0)}, []string{"a.spool"}, spools)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+// mockCountingSinker counts the events it sinks.
+type mockCountingSinker struct {
+	sunk int
+}
+
+func (mcs *mockCountingSinker) Sink(*event.Event) error {
+	mcs.sunk++
+	return nil
+}
+
+// TestOpenSpoolsAtStartup tests that events left by a previous run are replayed to the
+// sinker whose spool holds them, wherever it is given, and that startup is refused if
+// they were left for a sinker which is no longer given
+func TestOpenSpoolsAtStartup(t *testing.T) {
+	oldSpoolDir := *spoolDirFlag
+	*spoolDirFlag = t.TempDir()
+	defer func() { *spoolDirFlag = oldSpoolDir }()
+
+	a := pluginSpec{name: "builtin:jsonl", config: pluginconfig.Config{"file": "/tmp/a"}}
+	b := pluginSpec{name: "builtin:jsonl", config: pluginconfig.Config{"file": "/tmp/b"}}
+	c := pluginSpec{name: "builtin:jsonl", config: pluginconfig.Config{"file": "/tmp/c"}}
+	previous := spoolNames([]pluginSpec{a, b})
+	spoolAt(t, filepath.Join(*spoolDirFlag, previous[0]), 0).Close()
+	spoolAt(t, filepath.Join(*spoolDirFlag, previous[1]), 2).Close()
+
+	// The sinker given second before is given first now, so its events are replayed to it
+	names := spoolNames([]pluginSpec{b, a})
+	sinkers := []sink.Sinker{new(mockCountingSinker), new(mockCountingSinker)}
+	spools, err := openSpools(sinkers, names, nil, new(mockCleaner))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	for _, sinkerSpool := range spools {
+		defer sinkerSpool.Close()
+	}
+
+	if sunk := sinkers[0].(*mockCountingSinker).sunk; sunk != 2 {
+		t.Errorf("expected the 2 events to be replayed to the sinker now given first, got %d", sunk)
+	}
+
+	if err := spoolSinkers(sinkers, names, spools); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// The events left for a sinker which is no longer given cannot be replayed
+	if err := spools[names[0]].Append(newValidMockEvent()); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	spools[names[0]].Close()
+
+	names = spoolNames([]pluginSpec{a, c})
+	sinkers = []sink.Sinker{new(mockCountingSinker), new(mockCountingSinker)}
+	spools, err = openSpools(sinkers, names, nil, new(mockCleaner))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	for _, sinkerSpool := range spools {
+		defer sinkerSpool.Close()
+	}
+
+	err = spoolSinkers(sinkers, names, spools)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// ValidateEvent checks that an event has the fields which sinkers rely upon.
+func validateEvent(e *event.Event) error {
+	if e == nil {
+		return errors.New("event is nil")
+	}
+
+	if e.SourceIP == nil {
+		return errors.New("event has no source IP")
+	}
+
+	if e.DestIP == nil {
+		return errors.New("event has no destination IP")
+	}
+
+	if _, err := tcpstate.FromString(string(e.OldState)); err != nil {
+		return fmt.Errorf("event old state: %w", err)
+	}
+
+	if _, err := tcpstate.FromString(string(e.NewState)); err != nil {
+		return fmt.Errorf("event new state: %w", err)
+	}
+
+	return nil
+}
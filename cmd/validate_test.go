@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func newValidEvent() *event.Event {
+	return &event.Event{
+		SourceIP: net.ParseIP("1.2.3.4"),
+		DestIP:   net.ParseIP("7.3.3.7"),
+		OldState: tcpstate.StateClosed,
+		NewState: tcpstate.StateSynReceived,
+	}
+}
+
+func TestValidateEvent(t *testing.T) {
+	if err := validateEvent(newValidEvent()); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestValidateEventInvalid(t *testing.T) {
+	noSourceIP := newValidEvent()
+	noSourceIP.SourceIP = nil
+	noDestIP := newValidEvent()
+	noDestIP.DestIP = nil
+	badOldState := newValidEvent()
+	badOldState.OldState = "BOGUS"
+	badNewState := newValidEvent()
+	badNewState.NewState = ""
+
+	for _, e := range []*event.Event{nil, noSourceIP, noDestIP, badOldState, badNewState} {
+		err := validateEvent(e)
+		if err == nil {
+			t.Errorf("expected error for event %v, got nil", e)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
@@ -6,5 +6,8 @@ go 1.15
 
 require (
 	github.com/jhwbarlow/tcp-audit-common v0.0.0-20210928211236-5e6841819533
+	github.com/klauspost/compress v1.13.6
+	github.com/pelletier/go-toml v1.9.5
 	golang.org/x/sys v0.0.0-20211001092434-39dca1131b70
+	gopkg.in/yaml.v3 v3.0.1
 )
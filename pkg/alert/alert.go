@@ -0,0 +1,412 @@
+package alert
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/config"
+	"github.com/jhwbarlow/tcp-audit/pkg/jsonl"
+	"gopkg.in/yaml.v3"
+)
+
+// The fields by which the events matched by a rule may be grouped, as given in a Rule's
+// GroupBy.
+const (
+	GroupBySourceIP   = "source-ip"
+	GroupBySourcePort = "source-port"
+	GroupByDestIP     = "dest-ip"
+	GroupByDestPort   = "dest-port"
+	GroupByCommand    = "command"
+)
+
+const defaultMaxGroups = 10000
+
+// Rules is the content of a rules file.
+type Rules struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule describes the events which fire an alert: more than Threshold events which match,
+// within Window of each other, in the same group. A Threshold of zero fires an alert for
+// every event which matches, and needs no Window. Once an alert has fired for a group,
+// those which would fire for it again within Cooldown are suppressed, and counted in the
+// next alert which is not.
+type Rule struct {
+	Name        string        `yaml:"name"`
+	Description string        `yaml:"description"`
+	Match       Match         `yaml:"match"`
+	GroupBy     []string      `yaml:"group-by"` // If empty, every event which matches is in one group
+	Window      time.Duration `yaml:"window"`
+	Threshold   int           `yaml:"threshold"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+	MaxGroups   int           `yaml:"max-groups"` // The most groups counted, beyond which the least recently seen is forgotten (default 10000)
+}
+
+// Match describes the events which a rule counts. An event matches if it matches every
+// field which is given.
+type Match struct {
+	OldState     string   `yaml:"old-state"`
+	NewState     string   `yaml:"new-state"`
+	SourceCIDR   string   `yaml:"source-cidr"`
+	DestCIDR     string   `yaml:"dest-cidr"`
+	DestPorts    []uint16 `yaml:"dest-ports"`     // The destination port must be one of these
+	NotDestPorts []uint16 `yaml:"not-dest-ports"` // The destination port must not be one of these
+	Command      string   `yaml:"command"`
+}
+
+// Alert is an alert fired by a rule, with the event which fired it.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Description string            `json:"description,omitempty"`
+	Group       map[string]string `json:"group,omitempty"` // The values of the rule's group-by fields
+	Threshold   int               `json:"threshold"`
+	Window      float64           `json:"window_seconds"`
+	Time        time.Time         `json:"time"`                 // The time of the event which fired the alert
+	Suppressed  int               `json:"suppressed,omitempty"` // The alerts for the group suppressed since the last
+	Event       *jsonl.Record     `json:"event"`                // The event which fired the alert
+
+	event *event.Event
+}
+
+func (a *Alert) String() string {
+	var what string
+	if a.Threshold == 0 {
+		what = "matched"
+	} else {
+		what = fmt.Sprintf("more than %d events in %v", a.Threshold, time.Duration(a.Window*float64(time.Second)))
+	}
+
+	var group string
+	if len(a.Group) != 0 {
+		fields := make([]string, 0, len(a.Group))
+		for field, value := range a.Group {
+			fields = append(fields, field+"="+value)
+		}
+		sort.Strings(fields)
+		group = " for " + strings.Join(fields, ",")
+	}
+
+	var suppressed string
+	if a.Suppressed != 0 {
+		suppressed = fmt.Sprintf(" (%d suppressed)", a.Suppressed)
+	}
+
+	return fmt.Sprintf("rule %s fired%s: %s, last event %v%s", a.Rule, group, what, a.event, suppressed)
+}
+
+// Engine evaluates rules against events, firing alerts.
+// An Engine is not safe for concurrent use.
+type Engine struct {
+	rules []*ruleState
+}
+
+// RuleState is a rule with its parsed match and the groups it is counting.
+type ruleState struct {
+	Rule
+	oldState, newState      tcpstate.State
+	sourceNet, destNet      *net.IPNet
+	destPorts, notDestPorts map[uint16]bool
+	groups                  map[string]*list.Element
+	seen                    *list.List // Of the *groups, least recently seen first
+}
+
+// Group is the state of a group of a rule.
+type group struct {
+	key        string
+	values     []string    // Of the rule's group-by fields
+	times      []time.Time // Of the latest events, oldest first, at most threshold+1 of them
+	lastSeen   time.Time
+	lastAlert  time.Time
+	alerted    bool
+	suppressed int
+}
+
+// LoadRules reads the rules file at the path.
+func LoadRules(path string) ([]Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening rules file: %w", err)
+	}
+	defer file.Close()
+
+	rules, err := ParseRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("rules file %s: %w", path, err)
+	}
+
+	return rules, nil
+}
+
+// ParseRules reads the rules from a YAML document. Unknown keys are errors.
+func ParseRules(reader io.Reader) ([]Rule, error) {
+	decoder := yaml.NewDecoder(reader)
+	decoder.KnownFields(true)
+
+	var rules Rules
+	if err := decoder.Decode(&rules); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return rules.Rules, nil
+}
+
+// NewEngine returns an Engine evaluating the rules, after checking them. Every error
+// found is returned.
+func NewEngine(rules []Rule) (*Engine, error) {
+	var errs config.Errors
+	names := make(map[string]bool)
+	engine := new(Engine)
+	for i, rule := range rules {
+		if rule.Name == "" {
+			errs = append(errs, fmt.Errorf("rule %d: name not supplied", i+1))
+			continue
+		}
+
+		if names[rule.Name] {
+			errs = append(errs, fmt.Errorf("rule %s: name not unique", rule.Name))
+			continue
+		}
+		names[rule.Name] = true
+
+		state, err := newRuleState(rule)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.Name, err))
+			continue
+		}
+		engine.rules = append(engine.rules, state)
+	}
+
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+
+	return engine, nil
+}
+
+func newRuleState(rule Rule) (*ruleState, error) {
+	state := &ruleState{
+		Rule:   rule,
+		groups: make(map[string]*list.Element),
+		seen:   list.New(),
+	}
+
+	var err error
+	if rule.Match.OldState != "" {
+		if state.oldState, err = tcpstate.FromString(rule.Match.OldState); err != nil {
+			return nil, fmt.Errorf("old-state: %w", err)
+		}
+	}
+
+	if rule.Match.NewState != "" {
+		if state.newState, err = tcpstate.FromString(rule.Match.NewState); err != nil {
+			return nil, fmt.Errorf("new-state: %w", err)
+		}
+	}
+
+	if rule.Match.SourceCIDR != "" {
+		if _, state.sourceNet, err = net.ParseCIDR(rule.Match.SourceCIDR); err != nil {
+			return nil, fmt.Errorf("source-cidr: %w", err)
+		}
+	}
+
+	if rule.Match.DestCIDR != "" {
+		if _, state.destNet, err = net.ParseCIDR(rule.Match.DestCIDR); err != nil {
+			return nil, fmt.Errorf("dest-cidr: %w", err)
+		}
+	}
+
+	state.destPorts = portSet(rule.Match.DestPorts)
+	state.notDestPorts = portSet(rule.Match.NotDestPorts)
+
+	for _, field := range rule.GroupBy {
+		switch field {
+		case GroupBySourceIP, GroupBySourcePort, GroupByDestIP, GroupByDestPort, GroupByCommand:
+		default:
+			return nil, fmt.Errorf("group-by: unknown field %q", field)
+		}
+	}
+
+	switch {
+	case rule.Threshold < 0:
+		return nil, fmt.Errorf("threshold %d must not be negative", rule.Threshold)
+	case rule.Threshold > 0 && rule.Window <= 0:
+		return nil, errors.New("window must be positive when there is a threshold")
+	case rule.Window < 0:
+		return nil, fmt.Errorf("window %v must not be negative", rule.Window)
+	case rule.Cooldown < 0:
+		return nil, fmt.Errorf("cooldown %v must not be negative", rule.Cooldown)
+	case rule.MaxGroups < 0:
+		return nil, fmt.Errorf("max-groups %d must not be negative", rule.MaxGroups)
+	case rule.MaxGroups == 0:
+		state.MaxGroups = defaultMaxGroups
+	}
+
+	return state, nil
+}
+
+func portSet(ports []uint16) map[uint16]bool {
+	if len(ports) == 0 {
+		return nil
+	}
+
+	set := make(map[uint16]bool, len(ports))
+	for _, port := range ports {
+		set[port] = true
+	}
+
+	return set
+}
+
+// Evaluate counts the event against each rule it matches, returning the alerts it fires.
+// Windows and cooldowns are measured by the times of the events, so that replayed events
+// fire the alerts they would have fired when they happened.
+func (e *Engine) Evaluate(ev *event.Event) []*Alert {
+	var alerts []*Alert
+	for _, rule := range e.rules {
+		if alert := rule.evaluate(ev); alert != nil {
+			alerts = append(alerts, alert)
+		}
+	}
+
+	return alerts
+}
+
+func (rs *ruleState) evaluate(e *event.Event) *Alert {
+	if !rs.matches(e) {
+		return nil
+	}
+
+	rs.expire(e.Time)
+	g := rs.group(e)
+	g.lastSeen = e.Time
+
+	// Only the latest threshold+1 events are needed to know if more than threshold are
+	// within the window
+	if len(g.times) > rs.Threshold {
+		g.times = g.times[1:]
+	}
+	g.times = append(g.times, e.Time)
+	for len(g.times) != 0 && rs.Threshold > 0 && e.Time.Sub(g.times[0]) >= rs.Window {
+		g.times = g.times[1:]
+	}
+
+	if len(g.times) <= rs.Threshold {
+		return nil
+	}
+	g.times = g.times[:0] // The events which fire an alert do not count towards the next
+
+	if g.alerted && e.Time.Sub(g.lastAlert) < rs.Cooldown {
+		g.suppressed++
+		return nil
+	}
+
+	alert := &Alert{
+		Rule:        rs.Name,
+		Description: rs.Description,
+		Threshold:   rs.Threshold,
+		Window:      rs.Window.Seconds(),
+		Time:        e.Time,
+		Suppressed:  g.suppressed,
+		Event:       jsonl.NewRecord(e),
+		event:       e,
+	}
+
+	if len(rs.GroupBy) != 0 {
+		alert.Group = make(map[string]string, len(rs.GroupBy))
+		for i, field := range rs.GroupBy {
+			alert.Group[field] = g.values[i]
+		}
+	}
+
+	g.lastAlert, g.alerted, g.suppressed = e.Time, true, 0
+	return alert
+}
+
+func (rs *ruleState) matches(e *event.Event) bool {
+	switch {
+	case rs.oldState != "" && e.OldState != rs.oldState:
+		return false
+	case rs.newState != "" && e.NewState != rs.newState:
+		return false
+	case rs.sourceNet != nil && !rs.sourceNet.Contains(e.SourceIP):
+		return false
+	case rs.destNet != nil && !rs.destNet.Contains(e.DestIP):
+		return false
+	case rs.destPorts != nil && !rs.destPorts[e.DestPort]:
+		return false
+	case rs.notDestPorts[e.DestPort]:
+		return false
+	case rs.Match.Command != "" && e.CommandOnCPU != rs.Match.Command:
+		return false
+	default:
+		return true
+	}
+}
+
+// Group returns the group of the event, creating it if it is new, and forgetting the
+// least recently seen group if there are too many.
+func (rs *ruleState) group(e *event.Event) *group {
+	values := make([]string, len(rs.GroupBy))
+	for i, field := range rs.GroupBy {
+		switch field {
+		case GroupBySourceIP:
+			values[i] = e.SourceIP.String()
+		case GroupBySourcePort:
+			values[i] = strconv.Itoa(int(e.SourcePort))
+		case GroupByDestIP:
+			values[i] = e.DestIP.String()
+		case GroupByDestPort:
+			values[i] = strconv.Itoa(int(e.DestPort))
+		case GroupByCommand:
+			values[i] = e.CommandOnCPU
+		}
+	}
+	key := strings.Join(values, "\x00")
+
+	if element, ok := rs.groups[key]; ok {
+		rs.seen.MoveToBack(element)
+		return element.Value.(*group)
+	}
+
+	g := &group{key: key, values: values}
+	rs.groups[key] = rs.seen.PushBack(g)
+	if len(rs.groups) > rs.MaxGroups {
+		rs.forget(rs.seen.Front())
+	}
+
+	return g
+}
+
+// Expire forgets the groups which can neither fire an alert with their events already
+// counted, nor suppress one, as of the time. Groups with suppressed alerts are kept, so
+// that they are counted in the next alert, unless there are too many groups. The groups
+// kept are passed over, so that they do not keep those seen after them from expiring.
+func (rs *ruleState) expire(now time.Time) {
+	for element := rs.seen.Front(); element != nil; {
+		g := element.Value.(*group)
+		if now.Sub(g.lastSeen) < rs.Window {
+			return // The groups after this were seen later, so are within the window too
+		}
+
+		next := element.Next()
+		if !(g.alerted && now.Sub(g.lastAlert) < rs.Cooldown) && g.suppressed == 0 {
+			rs.forget(element)
+		}
+		element = next
+	}
+}
+
+func (rs *ruleState) forget(element *list.Element) {
+	rs.seen.Remove(element)
+	delete(rs.groups, element.Value.(*group).key)
+}
@@ -0,0 +1,377 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+var testStart = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestEngine(t *testing.T, rules ...Rule) *Engine {
+	engine, err := NewEngine(rules)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return engine
+}
+
+// NewTestEvent returns an event from the source IP to the destination port, at the offset
+// from the start of the test.
+func newTestEvent(sourceIP string, destPort uint16, offset time.Duration, oldState, newState tcpstate.State) *event.Event {
+	return &event.Event{
+		Time:         testStart.Add(offset),
+		PIDOnCPU:     100,
+		CommandOnCPU: "nginx",
+		SourceIP:     net.ParseIP(sourceIP),
+		SourcePort:   40000,
+		DestIP:       net.ParseIP("10.1.0.1"),
+		DestPort:     destPort,
+		OldState:     oldState,
+		NewState:     newState,
+	}
+}
+
+func synFloodRule() Rule {
+	return Rule{
+		Name:      "syn-flood",
+		Match:     Match{OldState: "SYN-RECEIVED", NewState: "CLOSED"},
+		GroupBy:   []string{GroupBySourceIP},
+		Window:    10 * time.Second,
+		Threshold: 2,
+		Cooldown:  time.Minute,
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+rules:
+  - name: syn-flood
+    description: Many aborted inbound handshakes from one source
+    match:
+      old-state: SYN-RECEIVED
+      new-state: CLOSED
+    group-by: [source-ip]
+    window: 10s
+    threshold: 100
+    cooldown: 5m
+  - name: unexpected-port
+    match:
+      new-state: ESTABLISHED
+      dest-cidr: 10.0.0.0/8
+      not-dest-ports: [22, 443]
+    group-by: [dest-ip, dest-port]
+`))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+
+	if rules[0].Window != 10*time.Second || rules[0].Threshold != 100 || rules[0].Cooldown != 5*time.Minute {
+		t.Errorf("expected window, threshold and cooldown of 10s, 100 and 5m, got %+v", rules[0])
+	}
+
+	if len(rules[1].Match.NotDestPorts) != 2 || rules[1].Match.NotDestPorts[1] != 443 {
+		t.Errorf("expected not-dest-ports of 22 and 443, got %v", rules[1].Match.NotDestPorts)
+	}
+
+	if _, err := NewEngine(rules); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	for _, document := range []string{
+		"rules:\n  - name: x\n    thresold: 1\n",
+		"rules:\n  - name: x\n    window: soon\n",
+		"rules: x\n",
+	} {
+		_, err := ParseRules(strings.NewReader(document))
+		if err == nil {
+			t.Errorf("expected error for document %q, got nil", document)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestEngineThreshold(t *testing.T) {
+	engine := newTestEngine(t, synFloodRule())
+	aborted := func(sourceIP string, offset time.Duration) *event.Event {
+		return newTestEvent(sourceIP, 443, offset, tcpstate.StateSynReceived, tcpstate.StateClosed)
+	}
+
+	for _, e := range []*event.Event{
+		aborted("192.0.2.1", 0),
+		aborted("192.0.2.1", time.Second),
+		aborted("192.0.2.2", 2*time.Second), // Another group
+		newTestEvent("192.0.2.1", 443, 2*time.Second, tcpstate.StateSynReceived, tcpstate.StateEstablished), // Does not match
+		aborted("192.0.2.1", 12*time.Second), // The first two have left the window
+		aborted("192.0.2.1", 13*time.Second),
+	} {
+		if alerts := engine.Evaluate(e); len(alerts) != 0 {
+			t.Fatalf("expected no alerts for event %v, got %v", e, alerts)
+		}
+	}
+
+	alerts := engine.Evaluate(aborted("192.0.2.1", 14*time.Second))
+	if len(alerts) != 1 {
+		t.Fatalf("expected 1 alert, got %d", len(alerts))
+	}
+
+	alert := alerts[0]
+	if alert.Rule != "syn-flood" || alert.Group[GroupBySourceIP] != "192.0.2.1" || !alert.Time.Equal(testStart.Add(14*time.Second)) {
+		t.Errorf("expected syn-flood alert for 192.0.2.1, got %+v", alert)
+	}
+}
+
+func TestEngineCooldown(t *testing.T) {
+	engine := newTestEngine(t, synFloodRule())
+	fired := 0
+	var last *Alert
+	for i := 0; i < 12; i++ {
+		// Three events fire the rule, and there are enough for four alerts, within the cooldown
+		e := newTestEvent("192.0.2.1", 443, time.Duration(i)*time.Second, tcpstate.StateSynReceived, tcpstate.StateClosed)
+		if alerts := engine.Evaluate(e); len(alerts) != 0 {
+			fired++
+			last = alerts[0]
+		}
+	}
+
+	if fired != 1 {
+		t.Fatalf("expected 1 alert within the cooldown, got %d", fired)
+	}
+
+	// Once the cooldown has passed, the next alert counts those suppressed
+	for i := 0; i < 3; i++ {
+		e := newTestEvent("192.0.2.1", 443, time.Minute+time.Duration(i)*time.Second, tcpstate.StateSynReceived, tcpstate.StateClosed)
+		if alerts := engine.Evaluate(e); len(alerts) != 0 {
+			last = alerts[0]
+			fired++
+		}
+	}
+
+	if fired != 2 || last.Suppressed != 3 {
+		t.Errorf("expected a second alert with 3 suppressed, got %d alerts, the last %+v", fired, last)
+	}
+}
+
+func TestEngineEveryMatch(t *testing.T) {
+	engine := newTestEngine(t, Rule{
+		Name:    "unexpected-port",
+		Match:   Match{NewState: "ESTABLISHED", NotDestPorts: []uint16{22, 443}},
+		GroupBy: []string{GroupByDestPort},
+	})
+
+	if alerts := engine.Evaluate(newTestEvent("192.0.2.1", 443, 0, tcpstate.StateSynSent, tcpstate.StateEstablished)); len(alerts) != 0 {
+		t.Errorf("expected no alert for an allowed port, got %v", alerts)
+	}
+
+	for i := 0; i < 2; i++ {
+		alerts := engine.Evaluate(newTestEvent("192.0.2.1", 6379, time.Duration(i)*time.Second, tcpstate.StateSynSent, tcpstate.StateEstablished))
+		if len(alerts) != 1 || alerts[0].Group[GroupByDestPort] != "6379" {
+			t.Errorf("expected alert for port 6379, got %v", alerts)
+		}
+	}
+}
+
+func TestEngineMatch(t *testing.T) {
+	engine := newTestEngine(t, Rule{
+		Name: "match",
+		Match: Match{
+			OldState:   "SYN-SENT",
+			NewState:   "CLOSED",
+			SourceCIDR: "192.0.2.0/24",
+			DestCIDR:   "10.1.0.0/16",
+			DestPorts:  []uint16{443},
+			Command:    "nginx",
+		},
+	})
+
+	matching := newTestEvent("192.0.2.1", 443, 0, tcpstate.StateSynSent, tcpstate.StateClosed)
+	if alerts := engine.Evaluate(matching); len(alerts) != 1 {
+		t.Errorf("expected alert for matching event, got %v", alerts)
+	}
+
+	for _, modify := range []func(e *event.Event){
+		func(e *event.Event) { e.OldState = tcpstate.StateSynReceived },
+		func(e *event.Event) { e.NewState = tcpstate.StateEstablished },
+		func(e *event.Event) { e.SourceIP = net.ParseIP("198.51.100.1") },
+		func(e *event.Event) { e.DestIP = net.ParseIP("10.2.0.1") },
+		func(e *event.Event) { e.DestPort = 80 },
+		func(e *event.Event) { e.CommandOnCPU = "curl" },
+	} {
+		e := newTestEvent("192.0.2.1", 443, 0, tcpstate.StateSynSent, tcpstate.StateClosed)
+		modify(e)
+		if alerts := engine.Evaluate(e); len(alerts) != 0 {
+			t.Errorf("expected no alert for event %v, got %v", e, alerts)
+		}
+	}
+}
+
+func TestEngineMaxGroups(t *testing.T) {
+	rule := synFloodRule()
+	rule.MaxGroups = 2
+	engine := newTestEngine(t, rule)
+
+	for i, sourceIP := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		engine.Evaluate(newTestEvent(sourceIP, 443, time.Duration(i)*time.Millisecond, tcpstate.StateSynReceived, tcpstate.StateClosed))
+	}
+
+	// The group of 192.0.2.1 was forgotten, so its events are counted afresh
+	if alerts := engine.Evaluate(newTestEvent("192.0.2.1", 443, 5*time.Millisecond, tcpstate.StateSynReceived, tcpstate.StateClosed)); len(alerts) != 0 {
+		t.Errorf("expected no alert for a forgotten group, got %v", alerts)
+	}
+
+	if groups := len(engine.rules[0].groups); groups != 2 {
+		t.Errorf("expected 2 groups, got %d", groups)
+	}
+}
+
+func TestEngineExpiresGroups(t *testing.T) {
+	engine := newTestEngine(t, synFloodRule())
+	engine.Evaluate(newTestEvent("192.0.2.1", 443, 0, tcpstate.StateSynReceived, tcpstate.StateClosed))
+	engine.Evaluate(newTestEvent("192.0.2.2", 443, time.Hour, tcpstate.StateSynReceived, tcpstate.StateClosed))
+
+	if groups := len(engine.rules[0].groups); groups != 1 {
+		t.Errorf("expected the idle group to be forgotten, got %d groups", groups)
+	}
+}
+
+// TestEngineExpiresGroupsBehindSuppressed tests that a group kept as it has suppressed
+// alerts does not keep the idle groups seen after it from being forgotten
+func TestEngineExpiresGroupsBehindSuppressed(t *testing.T) {
+	engine := newTestEngine(t, synFloodRule())
+	for i := 0; i < 6; i++ {
+		// Three events fire the rule, and three more suppress an alert within the cooldown
+		engine.Evaluate(newTestEvent("192.0.2.1", 443, time.Duration(i)*time.Second, tcpstate.StateSynReceived, tcpstate.StateClosed))
+	}
+	engine.Evaluate(newTestEvent("192.0.2.2", 443, 6*time.Second, tcpstate.StateSynReceived, tcpstate.StateClosed))
+	engine.Evaluate(newTestEvent("192.0.2.3", 443, 7*time.Second, tcpstate.StateSynReceived, tcpstate.StateClosed))
+	engine.Evaluate(newTestEvent("192.0.2.4", 443, time.Hour, tcpstate.StateSynReceived, tcpstate.StateClosed))
+
+	groups := engine.rules[0].groups
+	if len(groups) != 2 {
+		t.Fatalf("expected the idle groups to be forgotten, got %d groups", len(groups))
+	}
+
+	if _, ok := groups["192.0.2.1"]; !ok {
+		t.Error("expected the group with suppressed alerts to be kept")
+	}
+}
+
+func TestAlertJSON(t *testing.T) {
+	engine := newTestEngine(t, Rule{
+		Name:        "unexpected-port",
+		Description: "Connection to a port not allowed",
+		Match:       Match{NotDestPorts: []uint16{443}},
+		GroupBy:     []string{GroupByDestPort},
+	})
+	alerts := engine.Evaluate(newTestEvent("192.0.2.1", 6379, 0, tcpstate.StateSynSent, tcpstate.StateEstablished))
+
+	encoded, err := json.Marshal(alerts[0])
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	expected := `{"rule":"unexpected-port","description":"Connection to a port not allowed",` +
+		`"group":{"dest-port":"6379"},"threshold":0,"window_seconds":0,"time":"2021-03-01T12:00:00Z",` +
+		`"event":{"time":"2021-03-01T12:00:00Z","pid_on_cpu":100,"command_on_cpu":"nginx",` +
+		`"source_ip":"192.0.2.1","source_port":40000,"dest_ip":"10.1.0.1","dest_port":6379,` +
+		`"old_state":"SYN-SENT","new_state":"ESTABLISHED"}}`
+	if string(encoded) != expected {
+		t.Errorf("expected %s, got %s", expected, encoded)
+	}
+}
+
+func TestNewEngineErrors(t *testing.T) {
+	valid := synFloodRule()
+	for _, modify := range []func(r *Rule){
+		func(r *Rule) { r.Name = "" },
+		func(r *Rule) { r.Match.OldState = "SYN_RECV" },
+		func(r *Rule) { r.Match.NewState = "CLOSE" },
+		func(r *Rule) { r.Match.SourceCIDR = "192.0.2.1" },
+		func(r *Rule) { r.Match.DestCIDR = "10.0.0.0/33" },
+		func(r *Rule) { r.GroupBy = []string{"source"} },
+		func(r *Rule) { r.Threshold = -1 },
+		func(r *Rule) { r.Window = 0 },
+		func(r *Rule) { r.Cooldown = -time.Second },
+		func(r *Rule) { r.MaxGroups = -1 },
+	} {
+		rule := valid
+		modify(&rule)
+		_, err := NewEngine([]Rule{rule})
+		if err == nil {
+			t.Errorf("expected error for rule %+v, got nil", rule)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+
+	// Every error is reported
+	_, err := NewEngine([]Rule{valid, valid, {Name: "bad", Threshold: -1}})
+	if err == nil || strings.Count(err.Error(), "\n") != 1 {
+		t.Errorf("expected 2 errors, got %v", err)
+	}
+}
+
+type mockSinker struct {
+	events []*event.Event
+	alerts []*Alert
+}
+
+func (ms *mockSinker) Sink(e *event.Event) error {
+	ms.events = append(ms.events, e)
+	return nil
+}
+
+type mockRecordSinker struct {
+	mockSinker
+}
+
+func (mrs *mockRecordSinker) SinkRecord(kind string, record interface{}) error {
+	if alert, ok := record.(*Alert); ok && kind == RecordKind {
+		mrs.alerts = append(mrs.alerts, alert)
+	}
+	return errors.New("mock record sink error")
+}
+
+func TestSinkerNotifier(t *testing.T) {
+	e := newTestEvent("192.0.2.1", 443, 0, tcpstate.StateSynSent, tcpstate.StateEstablished)
+	alert := &Alert{Rule: "test", event: e}
+
+	// A sinker which only sinks events is sent the event which fired the alert
+	sinker := new(mockSinker)
+	if err := NewSinkerNotifier(sinker).Notify(context.Background(), alert); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(sinker.events) != 1 || sinker.events[0] != e {
+		t.Errorf("expected the event to be sunk, got %v", sinker.events)
+	}
+
+	alertSinker := new(mockRecordSinker)
+	err := NewSinkerNotifier(alertSinker).Notify(context.Background(), alert)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if len(alertSinker.alerts) != 1 || len(alertSinker.events) != 0 {
+		t.Errorf("expected only the alert to be sunk, got %d alerts and %d events",
+			len(alertSinker.alerts), len(alertSinker.events))
+	}
+}
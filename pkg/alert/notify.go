@@ -0,0 +1,47 @@
+package alert
+
+import (
+	"context"
+	"log"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/contextual"
+	"github.com/jhwbarlow/tcp-audit/pkg/record"
+)
+
+// Notifier is sent the alerts fired. A Notifier should give up sending an alert once the
+// context is done.
+type Notifier interface {
+	Notify(ctx context.Context, alert *Alert) error
+}
+
+// RecordKind is the kind of record, as given to a record.Sinker, of an alert.
+const RecordKind = "alert"
+
+// LogNotifier logs each alert.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(_ context.Context, alert *Alert) error {
+	log.Printf("Alert: %v", alert)
+	return nil
+}
+
+// SinkerNotifier sends each alert to a sinker. If the sinker sinks records, the alert is
+// sunk. Otherwise, the event which fired the alert is sunk, so that any sinker can be
+// used to gather the events of interest.
+type SinkerNotifier struct {
+	sinker sink.Sinker
+}
+
+// NewSinkerNotifier returns a SinkerNotifier which sends alerts to the sinker.
+func NewSinkerNotifier(sinker sink.Sinker) *SinkerNotifier {
+	return &SinkerNotifier{sinker: sinker}
+}
+
+func (sn *SinkerNotifier) Notify(ctx context.Context, alert *Alert) error {
+	if recordSinker, ok := record.AsSinker(sn.sinker); ok {
+		return record.Sink(ctx, recordSinker, RecordKind, alert)
+	}
+
+	return contextual.Sink(ctx, sn.sinker, alert.event)
+}
@@ -0,0 +1,140 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/contextual"
+)
+
+// Sinker is an optional interface which sinkers implement to sink several events in one
+// call, for example in a single database transaction, rather than one call per event.
+// If only some of the events fail, SinkBatch should return an *Error reporting the error
+// for each event. Any other error is taken to apply to every event in the batch.
+type Sinker interface {
+	SinkBatch(events []*event.Event) error
+}
+
+// ContextSinker is an optional interface which batch sinkers implement to accept a context
+// when sinking a batch, as contextual.Sinker is for events.
+type ContextSinker interface {
+	SinkBatchContext(ctx context.Context, events []*event.Event) error
+}
+
+// Wrapper is an optional interface which sinkers that wrap another sinker implement if they
+// implement SinkBatch whether or not the wrapped sinker does. It reports whether the
+// wrapped sinker sinks batches, and so whether batches should be gathered for it.
+type Wrapper interface {
+	SinksBatches() bool
+}
+
+// AsSinker returns the sinker as a Sinker if it sinks batches.
+func AsSinker(sinker sink.Sinker) (Sinker, bool) {
+	batchSinker, ok := sinker.(Sinker)
+	if !ok {
+		return nil, false
+	}
+
+	if wrapper, ok := sinker.(Wrapper); ok && !wrapper.SinksBatches() {
+		return nil, false
+	}
+
+	return batchSinker, true
+}
+
+// Sink sinks the events as a batch if the sinker sinks batches, otherwise it sinks each
+// event in turn, returning an *Error if any fail.
+func Sink(sinker sink.Sinker, events []*event.Event) error {
+	if batchSinker, ok := AsSinker(sinker); ok {
+		return batchSinker.SinkBatch(events)
+	}
+
+	errs := make([]error, len(events))
+	for i, e := range events {
+		errs[i] = sinker.Sink(e)
+	}
+
+	return NewError(errs)
+}
+
+// SinkContext sinks the events as Sink does, passing the context on to the sinker if it
+// accepts one.
+func SinkContext(ctx context.Context, sinker sink.Sinker, events []*event.Event) error {
+	if batchSinker, ok := AsSinker(sinker); ok {
+		return SinkBatchContext(ctx, batchSinker, events)
+	}
+
+	errs := make([]error, len(events))
+	for i, e := range events {
+		errs[i] = contextual.Sink(ctx, sinker, e)
+	}
+
+	return NewError(errs)
+}
+
+// SinkBatchContext sinks the events as a batch, with the context if the sinker accepts one.
+func SinkBatchContext(ctx context.Context, sinker Sinker, events []*event.Event) error {
+	if contextSinker, ok := sinker.(ContextSinker); ok {
+		return contextSinker.SinkBatchContext(ctx, events)
+	}
+
+	return sinker.SinkBatch(events)
+}
+
+// Error reports which events of a batch failed to be sunk. Errs has an entry for each event
+// in the batch, in the same order, which is nil if the event was sunk.
+type Error struct {
+	Errs []error
+}
+
+// NewError returns an *Error for the errors of each event in a batch, or nil if every
+// event was sunk.
+func NewError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return &Error{errs}
+		}
+	}
+
+	return nil
+}
+
+func (e *Error) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+
+	return fmt.Sprintf("%d of %d events in batch failed: first error: %v", failed, len(e.Errs), first)
+}
+
+// EventErrors returns the error for each of the count events in a batch, given the error
+// returned by SinkBatch. An *Error for a batch of a different size is taken, like any other
+// error, to apply to every event.
+func EventErrors(err error, count int) []error {
+	errs := make([]error, count)
+	if err == nil {
+		return errs
+	}
+
+	var batchErr *Error
+	if errors.As(err, &batchErr) && len(batchErr.Errs) == count {
+		copy(errs, batchErr.Errs)
+		return errs
+	}
+
+	for i := range errs {
+		errs[i] = err
+	}
+
+	return errs
+}
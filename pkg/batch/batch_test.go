@@ -0,0 +1,177 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+type mockSinker struct {
+	errToReturn error
+	received    []*event.Event
+}
+
+func (ms *mockSinker) Sink(e *event.Event) error {
+	if ms.errToReturn != nil && e.PIDOnCPU%2 == 0 {
+		return ms.errToReturn
+	}
+
+	ms.received = append(ms.received, e)
+	return nil
+}
+
+type mockBatchSinker struct {
+	mockSinker
+	batches [][]*event.Event
+}
+
+func (mbs *mockBatchSinker) SinkBatch(events []*event.Event) error {
+	mbs.batches = append(mbs.batches, events)
+	return nil
+}
+
+type mockWrapper struct {
+	mockBatchSinker
+	sinksBatches bool
+}
+
+func (mw *mockWrapper) SinksBatches() bool {
+	return mw.sinksBatches
+}
+
+type mockContextBatchSinker struct {
+	mockBatchSinker
+	ctx context.Context
+}
+
+func (mcbs *mockContextBatchSinker) SinkBatchContext(ctx context.Context, events []*event.Event) error {
+	mcbs.ctx = ctx
+	return mcbs.SinkBatch(events)
+}
+
+type mockContextSinker struct {
+	mockSinker
+	ctxs []context.Context
+}
+
+func (mcs *mockContextSinker) SinkContext(ctx context.Context, e *event.Event) error {
+	mcs.ctxs = append(mcs.ctxs, ctx)
+	return mcs.Sink(e)
+}
+
+func TestAsSinker(t *testing.T) {
+	if _, ok := AsSinker(new(mockSinker)); ok {
+		t.Error("expected sinker without SinkBatch not to sink batches")
+	}
+
+	if _, ok := AsSinker(new(mockBatchSinker)); !ok {
+		t.Error("expected sinker with SinkBatch to sink batches")
+	}
+
+	if _, ok := AsSinker(&mockWrapper{sinksBatches: false}); ok {
+		t.Error("expected wrapper of sinker without SinkBatch not to sink batches")
+	}
+
+	if _, ok := AsSinker(&mockWrapper{sinksBatches: true}); !ok {
+		t.Error("expected wrapper of sinker with SinkBatch to sink batches")
+	}
+}
+
+func TestSinkBatch(t *testing.T) {
+	mockBatchSinker := new(mockBatchSinker)
+	events := []*event.Event{{PIDOnCPU: 1}, {PIDOnCPU: 2}}
+
+	if err := Sink(mockBatchSinker, events); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mockBatchSinker.batches) != 1 || len(mockBatchSinker.received) != 0 {
+		t.Errorf("expected events to be sunk as one batch, got %d batches and %d single events",
+			len(mockBatchSinker.batches),
+			len(mockBatchSinker.received))
+	}
+}
+
+func TestSinkContextPassedOn(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	events := []*event.Event{{PIDOnCPU: 1}, {PIDOnCPU: 3}}
+
+	mockContextBatchSinker := new(mockContextBatchSinker)
+	if err := SinkContext(ctx, mockContextBatchSinker, events); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mockContextBatchSinker.ctx == nil || mockContextBatchSinker.ctx.Value(ctxKey{}) != true {
+		t.Error("expected context to be passed on to batch sinker, but was not")
+	}
+
+	mockContextSinker := new(mockContextSinker)
+	if err := SinkContext(ctx, mockContextSinker, events); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mockContextSinker.ctxs) != len(events) || mockContextSinker.ctxs[0].Value(ctxKey{}) != true {
+		t.Error("expected context to be passed on to sinker for each event, but was not")
+	}
+}
+
+func TestSinkBatchContextWithoutContext(t *testing.T) {
+	mockBatchSinker := new(mockBatchSinker)
+	if err := SinkBatchContext(context.Background(), mockBatchSinker, []*event.Event{{}}); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mockBatchSinker.batches) != 1 {
+		t.Errorf("expected events to be sunk as one batch, got %d batches", len(mockBatchSinker.batches))
+	}
+}
+
+func TestSinkEachReportsFailedEvents(t *testing.T) {
+	mockErr := errors.New("mock sinker error")
+	mockSinker := &mockSinker{errToReturn: mockErr}
+	events := []*event.Event{{PIDOnCPU: 1}, {PIDOnCPU: 2}, {PIDOnCPU: 3}}
+
+	err := Sink(mockSinker, events)
+	var batchErr *Error
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected *Error, got %v (of type %T)", err, err)
+	}
+
+	errs := EventErrors(err, len(events))
+	if errs[0] != nil || !errors.Is(errs[1], mockErr) || errs[2] != nil {
+		t.Errorf("expected only the second event to fail, got %v", errs)
+	}
+
+	if len(mockSinker.received) != 2 {
+		t.Errorf("expected 2 events to be sunk, got %d", len(mockSinker.received))
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestEventErrorsWholeBatch(t *testing.T) {
+	mockErr := errors.New("mock sinker error")
+
+	for _, err := range []error{mockErr, &Error{[]error{mockErr}}} {
+		for i, eventErr := range EventErrors(err, 2) {
+			if eventErr != err {
+				t.Errorf("expected error for event %d to be %q, got %v", i, err, eventErr)
+			}
+		}
+	}
+
+	for i, eventErr := range EventErrors(nil, 2) {
+		if eventErr != nil {
+			t.Errorf("expected nil error for event %d, got %v", i, eventErr)
+		}
+	}
+}
+
+func TestNewErrorAllSunk(t *testing.T) {
+	if err := NewError(make([]error, 2)); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
@@ -0,0 +1,388 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// Version is the version of the capture file format written.
+const Version = 1
+
+const (
+	magic           = "TCPACAP"
+	headerLen       = len(magic) + 1 // The magic followed by the version
+	maxRecordLength = 1 << 16
+
+	flagSocketInfo = 1 << 0
+)
+
+var (
+	// ErrNotCapture is returned when a file does not start with the capture file magic.
+	ErrNotCapture = errors.New("not a capture file")
+
+	// ErrUnsupportedVersion is returned when a capture file is of a version which cannot
+	// be read.
+	ErrUnsupportedVersion = errors.New("unsupported capture file version")
+
+	// ErrCorrupt is returned if a record cannot be decoded.
+	ErrCorrupt = errors.New("capture record corrupt")
+)
+
+// A capture file is a header, of the magic and the version, followed by a record for each
+// event. Each record is its length, as a uvarint, followed by the event's fields:
+//
+//	time        varint nanoseconds since the previous record's time (since the epoch for the first)
+//	PID         varint
+//	command     string
+//	source IP   IP
+//	source port uvarint
+//	dest IP     IP
+//	dest port   uvarint
+//	old state   string
+//	new state   string
+//	flags       byte, with flagSocketInfo set if the socket info follows
+//	ID          string
+//	inode       uvarint
+//	UID         uvarint
+//	GID         uvarint
+//	state       byte
+//
+// Strings are their length, as a uvarint, followed by their bytes, and IPs are their
+// length, as a byte, followed by their bytes. Readers ignore any bytes following the
+// fields they know of in a record, so fields may be added to the end of a record without
+// changing the version.
+
+// Writer writes events to a capture file.
+// A Writer is not safe for concurrent use.
+type Writer struct {
+	writer   *bufio.Writer
+	closer   io.Closer
+	record   []byte
+	previous int64 // The time of the previous record
+}
+
+// NewWriter returns a Writer which writes a capture file to the writer. The header is
+// written along with the first record.
+func NewWriter(writer io.Writer) *Writer {
+	w := &Writer{writer: bufio.NewWriter(writer)}
+	w.writer.WriteString(magic)
+	w.writer.WriteByte(Version)
+
+	return w
+}
+
+// Create creates the capture file at the path, truncating it if it exists, and returns a
+// Writer for it.
+func Create(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("creating capture file: %w", err)
+	}
+
+	w := NewWriter(file)
+	w.closer = file
+	return w, nil
+}
+
+// Write writes a record of the event. It is buffered until Flush is called.
+func (w *Writer) Write(e *event.Event) error {
+	record := w.record[:0]
+	now := e.Time.UnixNano()
+	record = appendVarint(record, now-w.previous)
+	record = appendVarint(record, int64(e.PIDOnCPU))
+	record = appendString(record, e.CommandOnCPU)
+	record = appendIP(record, e.SourceIP)
+	record = appendUvarint(record, uint64(e.SourcePort))
+	record = appendIP(record, e.DestIP)
+	record = appendUvarint(record, uint64(e.DestPort))
+	record = appendString(record, string(e.OldState))
+	record = appendString(record, string(e.NewState))
+
+	if e.SocketInfo == nil {
+		record = append(record, 0)
+	} else {
+		record = append(record, flagSocketInfo)
+		record = appendString(record, e.SocketInfo.ID)
+		record = appendUvarint(record, uint64(e.SocketInfo.INode))
+		record = appendUvarint(record, uint64(e.SocketInfo.UID))
+		record = appendUvarint(record, uint64(e.SocketInfo.GID))
+		record = append(record, byte(e.SocketInfo.SocketState))
+	}
+	w.record = record
+
+	if len(record) > maxRecordLength {
+		return fmt.Errorf("encoded event too large (%d bytes)", len(record))
+	}
+
+	if _, err := w.writer.Write(appendUvarint(nil, uint64(len(record)))); err != nil {
+		return fmt.Errorf("writing capture record: %w", err)
+	}
+
+	if _, err := w.writer.Write(record); err != nil {
+		return fmt.Errorf("writing capture record: %w", err)
+	}
+	w.previous = now
+
+	return nil
+}
+
+// Flush writes any buffered records.
+func (w *Writer) Flush() error {
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("flushing capture records: %w", err)
+	}
+
+	return nil
+}
+
+// Close flushes any buffered records and, if the Writer was created by Create, closes the
+// file.
+func (w *Writer) Close() error {
+	err := w.Flush()
+	if w.closer != nil {
+		if closeErr := w.closer.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("closing capture file: %w", closeErr)
+		}
+	}
+
+	return err
+}
+
+func appendVarint(record []byte, i int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(record, buf[:binary.PutVarint(buf[:], i)]...)
+}
+
+func appendUvarint(record []byte, i uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(record, buf[:binary.PutUvarint(buf[:], i)]...)
+}
+
+func appendString(record []byte, s string) []byte {
+	record = appendUvarint(record, uint64(len(s)))
+	return append(record, s...)
+}
+
+func appendIP(record []byte, ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	record = append(record, byte(len(ip)))
+	return append(record, ip...)
+}
+
+// Reader reads the events of a capture file.
+// A Reader is not safe for concurrent use.
+type Reader struct {
+	reader   *bufio.Reader
+	closer   io.Closer
+	version  int
+	record   []byte
+	previous int64
+}
+
+// NewReader returns a Reader of the capture file read from the reader, having checked its
+// header.
+func NewReader(reader io.Reader) (*Reader, error) {
+	r := &Reader{reader: bufio.NewReader(reader)}
+
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotCapture
+		}
+		return nil, fmt.Errorf("reading capture file header: %w", err)
+	}
+
+	if string(header[:len(magic)]) != magic {
+		return nil, ErrNotCapture
+	}
+
+	r.version = int(header[len(magic)])
+	if r.version < 1 || r.version > Version {
+		return nil, fmt.Errorf("%w %d (at most %d is supported)", ErrUnsupportedVersion, r.version, Version)
+	}
+
+	return r, nil
+}
+
+// Open opens the capture file at the path and returns a Reader for it.
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening capture file: %w", err)
+	}
+
+	r, err := NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r.closer = file
+
+	return r, nil
+}
+
+// Version returns the version of the capture file.
+func (r *Reader) Version() int {
+	return r.version
+}
+
+// Read returns the next event, or io.EOF when there are no more events. A record cut
+// short, as by a crash while it was written, is reported as corrupt.
+func (r *Reader) Read() (*event.Event, error) {
+	length, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("%w: reading record length: %v", ErrCorrupt, err)
+	}
+
+	if length > maxRecordLength {
+		return nil, fmt.Errorf("%w: implausible record length %d", ErrCorrupt, length)
+	}
+
+	if uint64(cap(r.record)) < length {
+		r.record = make([]byte, length)
+	}
+	record := r.record[:length]
+	if _, err := io.ReadFull(r.reader, record); err != nil {
+		return nil, fmt.Errorf("%w: reading record: %v", ErrCorrupt, err)
+	}
+
+	e, now, err := decode(bytes.NewReader(record), r.previous)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	r.previous = now
+
+	return e, nil
+}
+
+// Close closes the file, if the Reader was returned by Open.
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+
+	return r.closer.Close()
+}
+
+// Decode decodes the fields of a record, returning the event and its time in nanoseconds
+// since the epoch.
+func decode(record *bytes.Reader, previous int64) (*event.Event, int64, error) {
+	d := &decoder{record: record}
+	e := new(event.Event)
+
+	now := previous + d.varint()
+	e.Time = time.Unix(0, now)
+	e.PIDOnCPU = int(d.varint())
+	e.CommandOnCPU = d.string()
+	e.SourceIP = d.ip()
+	e.SourcePort = uint16(d.uvarint())
+	e.DestIP = d.ip()
+	e.DestPort = uint16(d.uvarint())
+	e.OldState = tcpstate.State(d.string())
+	e.NewState = tcpstate.State(d.string())
+
+	if d.byte()&flagSocketInfo != 0 {
+		e.SocketInfo = &event.SocketInfo{
+			ID:          d.string(),
+			INode:       uint32(d.uvarint()),
+			UID:         uint32(d.uvarint()),
+			GID:         uint32(d.uvarint()),
+			SocketState: socketstate.State(d.byte()),
+		}
+	}
+
+	if d.err != nil {
+		return nil, 0, d.err
+	}
+
+	return e, now, nil
+}
+
+// Decoder reads the fields of a record, remembering the first error so that it need only
+// be checked once all of the fields have been read.
+type decoder struct {
+	record *bytes.Reader
+	err    error
+}
+
+func (d *decoder) fail(field string, err error) {
+	if d.err == nil {
+		d.err = fmt.Errorf("reading %s: %v", field, err)
+	}
+}
+
+func (d *decoder) varint() int64 {
+	i, err := binary.ReadVarint(d.record)
+	if err != nil {
+		d.fail("integer", err)
+	}
+
+	return i
+}
+
+func (d *decoder) uvarint() uint64 {
+	i, err := binary.ReadUvarint(d.record)
+	if err != nil {
+		d.fail("integer", err)
+	}
+
+	return i
+}
+
+func (d *decoder) byte() byte {
+	b, err := d.record.ReadByte()
+	if err != nil {
+		d.fail("byte", err)
+	}
+
+	return b
+}
+
+func (d *decoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n > uint64(d.record.Len()) {
+		d.fail("bytes", io.ErrUnexpectedEOF)
+		return nil
+	}
+
+	b := make([]byte, n)
+	d.record.Read(b)
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.uvarint()))
+}
+
+func (d *decoder) ip() net.IP {
+	n := d.byte()
+	if d.err == nil && n != 0 && n != net.IPv4len && n != net.IPv6len {
+		d.fail("IP address", fmt.Errorf("length %d", n))
+	}
+
+	if ip := d.bytes(uint64(n)); len(ip) != 0 {
+		return net.IP(ip)
+	}
+
+	return nil
+}
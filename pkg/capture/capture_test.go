@@ -0,0 +1,215 @@
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func newEvents() []*event.Event {
+	start := time.Date(2021, 10, 1, 12, 0, 0, 123456789, time.UTC)
+	return []*event.Event{
+		{
+			Time:         start,
+			PIDOnCPU:     1234,
+			CommandOnCPU: "curl",
+			SourceIP:     net.ParseIP("10.0.0.1"),
+			SourcePort:   53712,
+			DestIP:       net.ParseIP("10.0.0.2"),
+			DestPort:     443,
+			OldState:     tcpstate.StateClosed,
+			NewState:     tcpstate.StateSynSent,
+			SocketInfo: &event.SocketInfo{
+				ID:          "ffff8880",
+				INode:       4242,
+				UID:         1000,
+				GID:         1000,
+				SocketState: socketstate.StateConnecting,
+			},
+		},
+		{
+			Time:         start.Add(1500 * time.Millisecond),
+			CommandOnCPU: "swapper/0",
+			SourceIP:     net.ParseIP("2001:db8::1"),
+			SourcePort:   8080,
+			DestIP:       net.ParseIP("2001:db8::2"),
+			DestPort:     40000,
+			OldState:     tcpstate.StateSynReceived,
+			NewState:     tcpstate.StateEstablished,
+		},
+		{
+			// Out of order, as events from several eventers may be
+			Time:         start.Add(-time.Second),
+			PIDOnCPU:     1,
+			CommandOnCPU: "",
+			SourceIP:     net.ParseIP("127.0.0.1"),
+			DestIP:       net.ParseIP("127.0.0.1"),
+			OldState:     tcpstate.StateListen,
+			NewState:     tcpstate.StateClosed,
+		},
+	}
+}
+
+func checkEvent(t *testing.T, expected, got *event.Event) {
+	if !got.Time.Equal(expected.Time) {
+		t.Errorf("expected time %v, got %v", expected.Time, got.Time)
+	}
+
+	if got.PIDOnCPU != expected.PIDOnCPU ||
+		got.CommandOnCPU != expected.CommandOnCPU ||
+		!got.SourceIP.Equal(expected.SourceIP) ||
+		got.SourcePort != expected.SourcePort ||
+		!got.DestIP.Equal(expected.DestIP) ||
+		got.DestPort != expected.DestPort ||
+		got.OldState != expected.OldState ||
+		got.NewState != expected.NewState {
+		t.Errorf("expected event %v, got %v", expected, got)
+	}
+
+	if (expected.SocketInfo == nil) != (got.SocketInfo == nil) ||
+		(expected.SocketInfo != nil && !got.SocketInfo.Equal(expected.SocketInfo)) {
+		t.Errorf("expected socket info %v, got %v", expected.SocketInfo, got.SocketInfo)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.cap")
+	writer, err := Create(path)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	events := newEvents()
+	for _, e := range events {
+		if err := writer.Write(e); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	reader, err := Open(path)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	defer reader.Close()
+
+	if reader.Version() != Version {
+		t.Errorf("expected version %d, got %d", Version, reader.Version())
+	}
+
+	for _, expected := range events {
+		got, err := reader.Read()
+		if err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+		checkEvent(t, expected, got)
+	}
+
+	if _, err := reader.Read(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v (of type %T)", err, err)
+	}
+}
+
+func TestWriterBuffersUntilFlush(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writer := NewWriter(buf)
+	if err := writer.Write(newEvents()[0]); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing written before flush, got %d bytes", buf.Len())
+	}
+
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// The header, length and record
+	if buf.Len() <= headerLen+1 {
+		t.Errorf("expected header and record to be written, got %d bytes", buf.Len())
+	}
+}
+
+func TestReaderIgnoresTrailingFields(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writer := NewWriter(buf)
+	writer.Write(newEvents()[0])
+	writer.Flush()
+
+	// Rewrite the record as if by a later writer which added a field
+	data := buf.Bytes()
+	record := append(append([]byte(nil), data[headerLen+1:]...), 0x2a, 0x2a)
+	data = append(append(data[:headerLen:headerLen], byte(len(record))), record...)
+
+	reader, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	got, err := reader.Read()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	checkEvent(t, newEvents()[0], got)
+}
+
+func TestNewReaderHeaderErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		data     []byte
+		expected error
+	}{
+		"empty":          {nil, ErrNotCapture},
+		"bad magic":      {[]byte("TCPAUDIT"), ErrNotCapture},
+		"future version": {append([]byte(magic), Version+1), ErrUnsupportedVersion},
+		"version zero":   {append([]byte(magic), 0), ErrUnsupportedVersion},
+	} {
+		_, err := NewReader(bytes.NewReader(test.data))
+		if !errors.Is(err, test.expected) {
+			t.Errorf("expected %v for %s, got %v (of type %T)", test.expected, name, err, err)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestReadCorrupt(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writer := NewWriter(buf)
+	writer.Write(newEvents()[0])
+	writer.Flush()
+	data := buf.Bytes()
+
+	for name, corrupt := range map[string][]byte{
+		"truncated record": data[:len(data)-4],
+		"truncated length": append(append([]byte(nil), data[:headerLen]...), 0x80),
+		"short record":     append(append([]byte(nil), data[:headerLen]...), 2, 0, 0),
+		"bad IP length":    append(append([]byte(nil), data[:headerLen]...), 5, 0, 0, 0, 3, 1),
+		"huge record":      append(append([]byte(nil), data[:headerLen]...), 0xff, 0xff, 0xff, 0x0f),
+	} {
+		reader, err := NewReader(bytes.NewReader(corrupt))
+		if err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		_, err = reader.Read()
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("expected ErrCorrupt for %s, got %v (of type %T)", name, err, err)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
@@ -0,0 +1,351 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Position is a location in a configuration file.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	if p.Line == 0 {
+		return p.File
+	}
+
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// Error is an error at a position in a configuration file.
+type Error struct {
+	Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Position.String() + ": " + e.Msg
+}
+
+// Errors is a list of errors, all of which are reported.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// Err returns the errors as an error, or nil if there are none.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// Value is a scalar setting, kept as a string along with its position.
+type Value struct {
+	Value string
+	Position
+}
+
+// Plugin is a plugin to load, with its options.
+type Plugin struct {
+	Path        Value
+	Options     []Option // In the order given
+	OptionsFile *Value
+	Position
+}
+
+// Option is a plugin option.
+type Option struct {
+	Key   string
+	Value Value
+}
+
+// Schema describes the keys which are allowed in a configuration file. Keys of nested
+// mappings are joined with a dot, for example "queue.size".
+type Schema struct {
+	Settings    []string // Scalar settings
+	Plugins     []string // Single plugins
+	PluginLists []string // Sequences of plugins
+}
+
+// File is a parsed configuration file. Only the keys present in the file are set.
+type File struct {
+	Settings    map[string]Value
+	Plugins     map[string]Plugin
+	PluginLists map[string][]Plugin
+}
+
+// ParseFile parses the configuration file at the given path, which is TOML if it has a
+// .toml extension and YAML otherwise.
+func ParseFile(path string, schema *Schema) (*File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening configuration file: %w", err)
+	}
+	defer file.Close()
+
+	if isTOML(path) {
+		return ParseTOML(file, path, schema)
+	}
+
+	return Parse(file, path, schema)
+}
+
+// Parse parses a YAML configuration, checking it against the schema. All the errors found
+// are returned together, as Errors, each with its position. The name is used as the file
+// name in positions.
+func Parse(reader io.Reader, name string, schema *Schema) (*File, error) {
+	root := new(yaml.Node)
+	if err := yaml.NewDecoder(reader).Decode(root); err != nil {
+		if err == io.EOF { // Empty file
+			return newFile(), nil
+		}
+
+		return nil, &Error{Position{File: name}, err.Error()}
+	}
+
+	return parseDocument(root, name, schema)
+}
+
+func parseDocument(root *yaml.Node, name string, schema *Schema) (*File, error) {
+	p := &parser{
+		name:        name,
+		settings:    toSet(schema.Settings),
+		plugins:     toSet(schema.Plugins),
+		pluginLists: toSet(schema.PluginLists),
+		mappings:    prefixes(schema.Settings, schema.Plugins, schema.PluginLists),
+		file:        newFile(),
+	}
+	p.parseDocument(root)
+
+	if err := p.errs.Err(); err != nil {
+		return nil, err
+	}
+
+	return p.file, nil
+}
+
+func newFile() *File {
+	return &File{
+		Settings:    make(map[string]Value),
+		Plugins:     make(map[string]Plugin),
+		PluginLists: make(map[string][]Plugin),
+	}
+}
+
+func toSet(keys []string) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[key] = true
+	}
+
+	return set
+}
+
+// Prefixes returns the set of the prefixes of the keys, each with a trailing dot. These are
+// the keys of nested mappings.
+func prefixes(keyLists ...[]string) map[string]bool {
+	set := make(map[string]bool)
+	for _, keys := range keyLists {
+		for _, key := range keys {
+			for i, r := range key {
+				if r == '.' {
+					set[key[:i+1]] = true
+				}
+			}
+		}
+	}
+
+	return set
+}
+
+type parser struct {
+	name        string
+	settings    map[string]bool
+	plugins     map[string]bool
+	pluginLists map[string]bool
+	mappings    map[string]bool
+	file        *File
+	errs        Errors
+}
+
+func (p *parser) position(node *yaml.Node) Position {
+	return Position{p.name, node.Line, node.Column}
+}
+
+func (p *parser) errorf(node *yaml.Node, format string, args ...interface{}) {
+	p.errs = append(p.errs, &Error{p.position(node), fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) parseDocument(root *yaml.Node) {
+	if root.Kind != yaml.DocumentNode || len(root.Content) != 1 {
+		p.errorf(root, "expected a single document")
+		return
+	}
+
+	p.parseMapping(root.Content[0], "")
+}
+
+// ParseMapping parses a mapping whose keys are prefixed with the given prefix.
+func (p *parser) parseMapping(node *yaml.Node, prefix string) {
+	if node.Kind != yaml.MappingNode {
+		p.errorf(node, "expected a mapping")
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		key := prefix + keyNode.Value
+
+		if seen[key] {
+			p.errorf(keyNode, "duplicate key %q", key)
+			continue
+		}
+		seen[key] = true
+
+		switch {
+		case p.settings[key]:
+			if value, ok := p.parseScalar(valueNode, key); ok {
+				p.file.Settings[key] = value
+			}
+		case p.plugins[key]:
+			if plugin, ok := p.parsePlugin(valueNode, key); ok {
+				p.file.Plugins[key] = plugin
+			}
+		case p.pluginLists[key]:
+			p.parsePluginList(valueNode, key)
+		case p.mappings[key+"."]:
+			p.parseMapping(valueNode, key+".")
+		default:
+			p.errorf(keyNode, "unknown key %q", key)
+		}
+	}
+}
+
+func (p *parser) parseScalar(node *yaml.Node, key string) (Value, bool) {
+	if node.Kind != yaml.ScalarNode {
+		p.errorf(node, "%s: expected a single value", key)
+		return Value{}, false
+	}
+
+	return Value{node.Value, p.position(node)}, true
+}
+
+func (p *parser) parsePluginList(node *yaml.Node, key string) {
+	if node.Kind != yaml.SequenceNode {
+		p.errorf(node, "%s: expected a list of plugins", key)
+		return
+	}
+
+	plugins := make([]Plugin, 0, len(node.Content))
+	for _, pluginNode := range node.Content {
+		if plugin, ok := p.parsePlugin(pluginNode, key); ok {
+			plugins = append(plugins, plugin)
+		}
+	}
+	p.file.PluginLists[key] = plugins
+}
+
+// ParsePlugin parses a plugin, which is either a path alone or a mapping with a path,
+// options and an options file.
+func (p *parser) parsePlugin(node *yaml.Node, key string) (Plugin, bool) {
+	plugin := Plugin{Position: p.position(node)}
+
+	if node.Kind == yaml.ScalarNode {
+		plugin.Path = Value{node.Value, p.position(node)}
+		return plugin, true
+	}
+
+	if node.Kind != yaml.MappingNode {
+		p.errorf(node, "%s: expected a plugin path or a mapping", key)
+		return plugin, false
+	}
+
+	ok := true
+	hasPath := false
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		switch keyNode.Value {
+		case "path":
+			hasPath = true
+			if value, valueOK := p.parseScalar(valueNode, key+".path"); valueOK {
+				plugin.Path = value
+			} else {
+				ok = false
+			}
+		case "options":
+			if options, optionsOK := p.parseOptions(valueNode, key); optionsOK {
+				plugin.Options = options
+			} else {
+				ok = false
+			}
+		case "options-file":
+			if value, valueOK := p.parseScalar(valueNode, key+".options-file"); valueOK {
+				plugin.OptionsFile = &value
+			} else {
+				ok = false
+			}
+		default:
+			p.errorf(keyNode, "%s: unknown plugin key %q", key, keyNode.Value)
+			ok = false
+		}
+	}
+
+	if !hasPath {
+		p.errorf(node, "%s: plugin path not given", key)
+		return plugin, false
+	}
+
+	return plugin, ok
+}
+
+func (p *parser) parseOptions(node *yaml.Node, key string) ([]Option, bool) {
+	if node.Kind != yaml.MappingNode {
+		p.errorf(node, "%s.options: expected a mapping", key)
+		return nil, false
+	}
+
+	ok := true
+	options := make([]Option, 0, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		value, valueOK := p.parseScalar(valueNode, key+".options."+keyNode.Value)
+		if !valueOK {
+			ok = false
+			continue
+		}
+
+		options = append(options, Option{keyNode.Value, value})
+	}
+
+	return options, ok
+}
+
+// SortedSettings returns the keys of the settings in the file, sorted so that settings are
+// applied in a predictable order.
+func (f *File) SortedSettings() []string {
+	keys := make([]string, 0, len(f.Settings))
+	for key := range f.Settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
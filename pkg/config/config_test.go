@@ -0,0 +1,286 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testSchema = &Schema{
+	Settings:    []string{"max-errors", "queue.size", "queue.policy"},
+	Plugins:     []string{"dead-letter.sink"},
+	PluginLists: []string{"sinkers"},
+}
+
+func TestParse(t *testing.T) {
+	input := `
+max-errors: 3
+queue:
+  size: 100
+  policy: drop-oldest
+sinkers:
+  - a.so
+  - path: b.so
+    options:
+      host: db.example.com
+      port: 5432
+    options-file: b.conf
+dead-letter:
+  sink: c.so
+`
+	file, err := Parse(strings.NewReader(input), "test.yaml", testSchema)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if value := file.Settings["queue.size"]; value.Value != "100" || value.Line != 4 || value.Column != 9 {
+		t.Errorf("expected queue.size of 100 at 4:9, got %q at %d:%d", value.Value, value.Line, value.Column)
+	}
+
+	if value := file.Settings["queue.policy"]; value.Value != "drop-oldest" {
+		t.Errorf("expected queue.policy of drop-oldest, got %q", value.Value)
+	}
+
+	sinkers := file.PluginLists["sinkers"]
+	if len(sinkers) != 2 {
+		t.Fatalf("expected 2 sinkers, got %d", len(sinkers))
+	}
+
+	if sinkers[0].Path.Value != "a.so" || len(sinkers[0].Options) != 0 {
+		t.Errorf("expected first sinker to be a.so without options, got %+v", sinkers[0])
+	}
+
+	if sinkers[1].Path.Value != "b.so" {
+		t.Errorf("expected second sinker to be b.so, got %q", sinkers[1].Path.Value)
+	}
+
+	if len(sinkers[1].Options) != 2 ||
+		sinkers[1].Options[0].Key != "host" ||
+		sinkers[1].Options[0].Value.Value != "db.example.com" ||
+		sinkers[1].Options[1].Key != "port" ||
+		sinkers[1].Options[1].Value.Value != "5432" {
+		t.Errorf("expected second sinker options in order given, got %+v", sinkers[1].Options)
+	}
+
+	if sinkers[1].OptionsFile == nil || sinkers[1].OptionsFile.Value != "b.conf" {
+		t.Errorf("expected second sinker options file of b.conf, got %+v", sinkers[1].OptionsFile)
+	}
+
+	if plugin, ok := file.Plugins["dead-letter.sink"]; !ok || plugin.Path.Value != "c.so" {
+		t.Errorf("expected dead-letter sink of c.so, got %+v", plugin)
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	file, err := Parse(strings.NewReader(""), "test.yaml", testSchema)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(file.Settings) != 0 {
+		t.Errorf("expected no settings, got %v", file.Settings)
+	}
+}
+
+// TestParseErrors tests that every error in the file is reported, each at its position
+func TestParseErrors(t *testing.T) {
+	input := `
+unknown: 1
+queue:
+  size: [1, 2]
+  colour: red
+sinkers:
+  - options:
+      host: db.example.com
+  - path: a.so
+    bogus: true
+queue: {}
+`
+	_, err := Parse(strings.NewReader(input), "test.yaml", testSchema)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected error of type %T, got %T", errs, err)
+	}
+
+	expected := []string{
+		`test.yaml:2:1: unknown key "unknown"`,
+		`test.yaml:4:9: queue.size: expected a single value`,
+		`test.yaml:5:3: unknown key "queue.colour"`,
+		`test.yaml:7:5: sinkers: plugin path not given`,
+		`test.yaml:10:5: sinkers: unknown plugin key "bogus"`,
+		`test.yaml:11:1: duplicate key "queue"`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("expected error %q, got %q", expected[i], err.Error())
+		}
+	}
+}
+
+func TestParseSyntaxError(t *testing.T) {
+	_, err := Parse(strings.NewReader("queue: [\n"), "test.yaml", testSchema)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestParseTOML(t *testing.T) {
+	input := `
+max-errors = 3
+
+[queue]
+size = 100
+policy = "drop-oldest"
+
+[[sinkers]]
+path = "a.so"
+
+[[sinkers]]
+path = "b.so"
+options-file = "b.conf"
+
+[sinkers.options]
+port = 5432
+host = "db.example.com"
+
+[dead-letter]
+sink = "c.so"
+`
+	file, err := ParseTOML(strings.NewReader(input), "test.toml", testSchema)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if value := file.Settings["max-errors"]; value.Value != "3" || value.File != "test.toml" {
+		t.Errorf("expected max-errors of 3 in test.toml, got %q in %s", value.Value, value.File)
+	}
+
+	if value := file.Settings["queue.size"]; value.Value != "100" || value.Line != 5 || value.Column != 1 {
+		t.Errorf("expected queue.size of 100 at 5:1, got %q at %d:%d", value.Value, value.Line, value.Column)
+	}
+
+	if value := file.Settings["queue.policy"]; value.Value != "drop-oldest" {
+		t.Errorf("expected queue.policy of drop-oldest, got %q", value.Value)
+	}
+
+	sinkers := file.PluginLists["sinkers"]
+	if len(sinkers) != 2 {
+		t.Fatalf("expected 2 sinkers, got %d", len(sinkers))
+	}
+
+	if sinkers[0].Path.Value != "a.so" || len(sinkers[0].Options) != 0 {
+		t.Errorf("expected first sinker to be a.so without options, got %+v", sinkers[0])
+	}
+
+	if sinkers[1].Line != 11 {
+		t.Errorf("expected second sinker at its header on line 11, got line %d", sinkers[1].Line)
+	}
+
+	if len(sinkers[1].Options) != 2 ||
+		sinkers[1].Options[0].Key != "port" ||
+		sinkers[1].Options[0].Value.Value != "5432" ||
+		sinkers[1].Options[1].Key != "host" ||
+		sinkers[1].Options[1].Value.Value != "db.example.com" {
+		t.Errorf("expected second sinker options in order given, got %+v", sinkers[1].Options)
+	}
+
+	if sinkers[1].OptionsFile == nil || sinkers[1].OptionsFile.Value != "b.conf" {
+		t.Errorf("expected second sinker options file of b.conf, got %+v", sinkers[1].OptionsFile)
+	}
+
+	if plugin, ok := file.Plugins["dead-letter.sink"]; !ok || plugin.Path.Value != "c.so" {
+		t.Errorf("expected dead-letter sink of c.so, got %+v", plugin)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	input := `
+unknown = 1
+sinkers = ["a.so", { options = { host = "db.example.com" } }]
+
+[queue]
+size = [1, 2]
+`
+	_, err := ParseTOML(strings.NewReader(input), "test.toml", testSchema)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected error of type %T, got %T", errs, err)
+	}
+
+	expected := []string{
+		`test.toml:2:1: unknown key "unknown"`,
+		`test.toml:3:1: sinkers: plugin path not given`,
+		`test.toml:6:1: queue.size: expected a single value`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("expected error %q, got %q", expected[i], err.Error())
+		}
+	}
+}
+
+func TestParseTOMLSyntaxError(t *testing.T) {
+	_, err := ParseTOML(strings.NewReader("max-errors = 3\n[queue\n"), "test.toml", testSchema)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	var configErr *Error
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected error of type %T, got %T", configErr, err)
+	}
+
+	if configErr.Line != 2 {
+		t.Errorf("expected error on line 2, got line %d", configErr.Line)
+	}
+}
+
+// TestParseFileTOML tests that a file with the .toml extension is parsed as TOML
+func TestParseFileTOML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tcp-audit.TOML")
+	if err := ioutil.WriteFile(path, []byte("[queue]\nsize = 100\n"), 0600); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	file, err := ParseFile(path, testSchema)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if value := file.Settings["queue.size"]; value.Value != "100" {
+		t.Errorf("expected queue.size of 100, got %q", value.Value)
+	}
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+)
+
+// The position at the start of the message of a TOML syntax error.
+var tomlErrorPosition = regexp.MustCompile(`^\((\d+), (\d+)\): `)
+
+// ParseTOML parses a TOML configuration, checking it against the schema, as Parse does for
+// YAML. TOML tables are YAML mappings and arrays of tables are YAML sequences, so the keys
+// are the same in either format. Errors are positioned at the key of the value in error,
+// or at the header of its table.
+func ParseTOML(reader io.Reader, name string, schema *Schema) (*File, error) {
+	tree, err := toml.LoadReader(reader)
+	if err != nil {
+		return nil, tomlSyntaxError(err, name)
+	}
+
+	root := &yaml.Node{
+		Kind:    yaml.DocumentNode,
+		Content: []*yaml.Node{tomlTableNode(tree, tree.Position())},
+	}
+
+	return parseDocument(root, name, schema)
+}
+
+// TomlSyntaxError returns the TOML syntax error as an Error, with the position given at
+// the start of its message.
+func tomlSyntaxError(err error, name string) *Error {
+	msg := err.Error()
+	match := tomlErrorPosition.FindStringSubmatch(msg)
+	if match == nil {
+		return &Error{Position{File: name}, msg}
+	}
+
+	line, _ := strconv.Atoi(match[1])
+	column, _ := strconv.Atoi(match[2])
+	return &Error{Position{name, line, column}, msg[len(match[0]):]}
+}
+
+// TomlTableNode converts the table to the equivalent YAML mapping, positioned at the
+// given position. Its keys are in the order given.
+func tomlTableNode(tree *toml.Tree, position toml.Position) *yaml.Node {
+	keys := tree.Keys()
+	positions := make(map[string]toml.Position, len(keys))
+	for _, key := range keys {
+		positions[key] = tree.GetPositionPath([]string{key})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		iPosition, jPosition := positions[keys[i]], positions[keys[j]]
+		if iPosition.Line != jPosition.Line {
+			return iPosition.Line < jPosition.Line
+		}
+
+		return iPosition.Col < jPosition.Col
+	})
+
+	node := tomlNode(yaml.MappingNode, position)
+	for _, key := range keys {
+		keyNode := tomlNode(yaml.ScalarNode, positions[key])
+		keyNode.Value = key
+		node.Content = append(node.Content,
+			keyNode,
+			tomlValueNode(tree.GetPath([]string{key}), positions[key]))
+	}
+
+	return node
+}
+
+// TomlValueNode converts the value to the equivalent YAML node, positioned at the given
+// position.
+func tomlValueNode(value interface{}, position toml.Position) *yaml.Node {
+	switch value := value.(type) {
+	case *toml.Tree:
+		return tomlTableNode(value, tomlTablePosition(value, position))
+	case []*toml.Tree:
+		node := tomlNode(yaml.SequenceNode, position)
+		for _, tree := range value {
+			node.Content = append(node.Content, tomlTableNode(tree, tomlTablePosition(tree, position)))
+		}
+		return node
+	case []interface{}:
+		// The elements of an array have no positions of their own
+		node := tomlNode(yaml.SequenceNode, position)
+		for _, element := range value {
+			node.Content = append(node.Content, tomlValueNode(element, position))
+		}
+		return node
+	default:
+		node := tomlNode(yaml.ScalarNode, position)
+		node.Value = tomlScalar(value)
+		return node
+	}
+}
+
+// TomlTablePosition returns the position of the header of the table, or, if it is an
+// inline table, which has no header, the given position of its key.
+func tomlTablePosition(tree *toml.Tree, position toml.Position) toml.Position {
+	if tree.Position().Invalid() {
+		return position
+	}
+
+	return tree.Position()
+}
+
+func tomlNode(kind yaml.Kind, position toml.Position) *yaml.Node {
+	return &yaml.Node{Kind: kind, Line: position.Line, Column: position.Col}
+}
+
+func tomlScalar(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case uint64:
+		return strconv.FormatUint(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// IsTOML reports whether the configuration file at the path is TOML rather than YAML, as
+// told by its extension.
+func isTOML(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".toml")
+}
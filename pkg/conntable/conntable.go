@@ -0,0 +1,103 @@
+package conntable
+
+import (
+	"container/list"
+	"net"
+	"strconv"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// Key identifies a connection by the addresses of its ends.
+type Key struct {
+	Source, Dest string
+}
+
+// KeyOf returns the key of the event's connection.
+func KeyOf(e *event.Event) Key {
+	return Key{
+		Source: net.JoinHostPort(e.SourceIP.String(), strconv.Itoa(int(e.SourcePort))),
+		Dest:   net.JoinHostPort(e.DestIP.String(), strconv.Itoa(int(e.DestPort))),
+	}
+}
+
+// Table holds a value for each of the connections put in it, in the order in which they
+// were put or last touched, so that the least recently used connection can be found, for
+// example to evict it.
+// A Table is not safe for concurrent use.
+type Table struct {
+	elements map[Key]*list.Element
+	order    *list.List // Of the *entries, least recently used first
+}
+
+type entry struct {
+	key   Key
+	value interface{}
+}
+
+// New returns an empty Table.
+func New() *Table {
+	return &Table{
+		elements: make(map[Key]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Len returns the number of connections in the table.
+func (t *Table) Len() int {
+	return len(t.elements)
+}
+
+// Get returns the value of the connection, if it is in the table.
+func (t *Table) Get(key Key) (interface{}, bool) {
+	element, ok := t.elements[key]
+	if !ok {
+		return nil, false
+	}
+
+	return element.Value.(*entry).value, true
+}
+
+// Put puts the connection in the table with the value, as the most recently used,
+// replacing any value it already has.
+func (t *Table) Put(key Key, value interface{}) {
+	if element, ok := t.elements[key]; ok {
+		element.Value.(*entry).value = value
+		t.order.MoveToBack(element)
+		return
+	}
+
+	t.elements[key] = t.order.PushBack(&entry{key: key, value: value})
+}
+
+// Touch makes the connection, if it is in the table, the most recently used.
+func (t *Table) Touch(key Key) {
+	if element, ok := t.elements[key]; ok {
+		t.order.MoveToBack(element)
+	}
+}
+
+// Remove removes the connection from the table, returning its value, if it was in the
+// table.
+func (t *Table) Remove(key Key) (interface{}, bool) {
+	element, ok := t.elements[key]
+	if !ok {
+		return nil, false
+	}
+
+	t.order.Remove(element)
+	delete(t.elements, key)
+	return element.Value.(*entry).value, true
+}
+
+// Oldest returns the least recently used connection and its value, if the table is not
+// empty.
+func (t *Table) Oldest() (Key, interface{}, bool) {
+	element := t.order.Front()
+	if element == nil {
+		return Key{}, nil, false
+	}
+
+	e := element.Value.(*entry)
+	return e.key, e.value, true
+}
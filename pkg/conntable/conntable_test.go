@@ -0,0 +1,78 @@
+package conntable
+
+import (
+	"net"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+func TestKeyOf(t *testing.T) {
+	e := &event.Event{
+		SourceIP:   net.ParseIP("2001:db8::1"),
+		SourcePort: 40000,
+		DestIP:     net.ParseIP("192.0.2.1"),
+		DestPort:   443,
+	}
+
+	expected := Key{Source: "[2001:db8::1]:40000", Dest: "192.0.2.1:443"}
+	if key := KeyOf(e); key != expected {
+		t.Errorf("expected key %+v, got %+v", expected, key)
+	}
+}
+
+func TestTableOrder(t *testing.T) {
+	table := New()
+	first, second, third := Key{Source: "a"}, Key{Source: "b"}, Key{Source: "c"}
+	table.Put(first, 1)
+	table.Put(second, 2)
+	table.Put(third, 3)
+
+	// Touching and replacing both make a connection the most recently used
+	table.Touch(first)
+	table.Put(second, 20)
+
+	for _, expected := range []struct {
+		key   Key
+		value int
+	}{{third, 3}, {first, 1}, {second, 20}} {
+		key, value, ok := table.Oldest()
+		if !ok || key != expected.key || value != expected.value {
+			t.Fatalf("expected oldest %+v with value %d, got %+v with value %v", expected.key, expected.value, key, value)
+		}
+
+		if _, ok := table.Remove(key); !ok {
+			t.Fatalf("expected %+v to be removed", key)
+		}
+	}
+
+	if table.Len() != 0 {
+		t.Errorf("expected empty table, got %d connections", table.Len())
+	}
+
+	if _, _, ok := table.Oldest(); ok {
+		t.Error("expected no oldest connection of empty table")
+	}
+}
+
+func TestTableGetAndRemoveMissing(t *testing.T) {
+	table := New()
+	table.Put(Key{Source: "a"}, 1)
+	table.Touch(Key{Source: "b"}) // Does not add the connection
+
+	if _, ok := table.Get(Key{Source: "b"}); ok {
+		t.Error("expected missing connection not to be found")
+	}
+
+	if _, ok := table.Remove(Key{Source: "b"}); ok {
+		t.Error("expected missing connection not to be removed")
+	}
+
+	if value, ok := table.Get(Key{Source: "a"}); !ok || value != 1 {
+		t.Errorf("expected value 1, got %v", value)
+	}
+
+	if table.Len() != 1 {
+		t.Errorf("expected 1 connection, got %d", table.Len())
+	}
+}
@@ -0,0 +1,40 @@
+package contextual
+
+import (
+	"context"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+)
+
+// Eventer is an optional interface which eventers implement to accept a context when
+// waiting for an event. EventContext should return promptly, with the context's error,
+// once the context is done, so that the eventer need not be closed to unblock it.
+type Eventer interface {
+	EventContext(ctx context.Context) (*event.Event, error)
+}
+
+// Sinker is an optional interface which sinkers implement to accept a context when sinking
+// an event. SinkContext should abandon the sink, returning the context's error, once the
+// context is done, for example because its deadline has passed.
+type Sinker interface {
+	SinkContext(ctx context.Context, e *event.Event) error
+}
+
+// Event gets an event from the eventer, with the context if the eventer accepts one.
+func Event(ctx context.Context, eventer event.Eventer) (*event.Event, error) {
+	if contextEventer, ok := eventer.(Eventer); ok {
+		return contextEventer.EventContext(ctx)
+	}
+
+	return eventer.Event()
+}
+
+// Sink sinks the event to the sinker, with the context if the sinker accepts one.
+func Sink(ctx context.Context, sinker sink.Sinker, e *event.Event) error {
+	if contextSinker, ok := sinker.(Sinker); ok {
+		return contextSinker.SinkContext(ctx, e)
+	}
+
+	return sinker.Sink(e)
+}
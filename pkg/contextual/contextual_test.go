@@ -0,0 +1,99 @@
+package contextual
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+type mockEventer struct {
+	eventCalled bool
+}
+
+func (me *mockEventer) Event() (*event.Event, error) {
+	me.eventCalled = true
+	return new(event.Event), nil
+}
+
+type mockContextEventer struct {
+	mockEventer
+}
+
+func (*mockContextEventer) EventContext(ctx context.Context) (*event.Event, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type mockSinker struct {
+	sinkCalled bool
+}
+
+func (ms *mockSinker) Sink(*event.Event) error {
+	ms.sinkCalled = true
+	return nil
+}
+
+type mockContextSinker struct {
+	mockSinker
+}
+
+func (*mockContextSinker) SinkContext(ctx context.Context, e *event.Event) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestEventWithoutContext(t *testing.T) {
+	mockEventer := new(mockEventer)
+
+	if _, err := Event(context.Background(), mockEventer); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !mockEventer.eventCalled {
+		t.Error("expected Event to be called, but was not")
+	}
+}
+
+func TestEventContextCancelled(t *testing.T) {
+	mockEventer := new(mockContextEventer)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := Event(ctx, mockEventer)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error chain to include %q, got %v", context.Canceled, err)
+	}
+
+	if mockEventer.eventCalled {
+		t.Error("expected Event not to be called, but was")
+	}
+}
+
+func TestSinkWithoutContext(t *testing.T) {
+	mockSinker := new(mockSinker)
+
+	if err := Sink(context.Background(), mockSinker, new(event.Event)); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !mockSinker.sinkCalled {
+		t.Error("expected Sink to be called, but was not")
+	}
+}
+
+func TestSinkContextDeadline(t *testing.T) {
+	mockSinker := new(mockContextSinker)
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	err := Sink(ctx, mockSinker, new(event.Event))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error chain to include %q, got %v", context.DeadlineExceeded, err)
+	}
+
+	if mockSinker.sinkCalled {
+		t.Error("expected Sink not to be called, but was")
+	}
+}
@@ -0,0 +1,137 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit/pkg/record"
+)
+
+// Record is an event which could not be sunk, along with why.
+type Record struct {
+	Time     time.Time    `json:"time"`
+	Event    *event.Event `json:"event"`
+	Error    string       `json:"error"`
+	Attempts int          `json:"attempts"`
+	Sinker   *int         `json:"sinker,omitempty"` // Index of the failed sinker, nil if the event failed validation
+}
+
+// DeadLetterer is an interface which describes objects which store dead-lettered events.
+type DeadLetterer interface {
+	DeadLetter(*Record) error
+}
+
+// FileDeadLetterer appends records to a file as newline-delimited JSON.
+// It is safe for concurrent use.
+type FileDeadLetterer struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewFileDeadLetterer opens the file at the given path for appending, creating it if it
+// does not exist.
+func NewFileDeadLetterer(path string) (*FileDeadLetterer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening dead-letter file: %w", err)
+	}
+
+	return &FileDeadLetterer{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// DeadLetter appends the record to the file. Each record is written with a single write,
+// so records are not interleaved.
+func (fdl *FileDeadLetterer) DeadLetter(record *Record) error {
+	fdl.mutex.Lock()
+	defer fdl.mutex.Unlock()
+
+	if err := fdl.encoder.Encode(record); err != nil {
+		return fmt.Errorf("writing dead-letter record: %w", err)
+	}
+
+	return nil
+}
+
+func (fdl *FileDeadLetterer) Close() error {
+	fdl.mutex.Lock()
+	defer fdl.mutex.Unlock()
+
+	return fdl.file.Close()
+}
+
+// RecordKind is the kind of record, as given to a record.Sinker, of a dead-letter record.
+const RecordKind = "dead-letter"
+
+// SinkerDeadLetterer sends dead-lettered records, with the error, attempts, time and sinker
+// as well as the event, to a secondary sinker which sinks records.
+// It is safe for concurrent use, as calls to the secondary sinker are serialised.
+type SinkerDeadLetterer struct {
+	mutex  sync.Mutex
+	sinker record.Sinker
+}
+
+func NewSinkerDeadLetterer(sinker record.Sinker) *SinkerDeadLetterer {
+	return &SinkerDeadLetterer{sinker: sinker}
+}
+
+func (sdl *SinkerDeadLetterer) DeadLetter(deadLetterRecord *Record) error {
+	sdl.mutex.Lock()
+	defer sdl.mutex.Unlock()
+
+	if err := sdl.sinker.SinkRecord(RecordKind, deadLetterRecord); err != nil {
+		return fmt.Errorf("sinking dead-letter record: %w", err)
+	}
+
+	return nil
+}
+
+// Reader reads records written by a FileDeadLetterer.
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	return &Reader{scanner: scanner}
+}
+
+// Next returns the next record, or io.EOF when there are no more records.
+func (r *Reader) Next() (*Record, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		record := new(Record)
+		if err := json.Unmarshal(line, record); err != nil {
+			return nil, fmt.Errorf("line %d: decoding dead-letter record: %w", r.line, err)
+		}
+
+		if record.Event == nil {
+			return nil, fmt.Errorf("line %d: dead-letter record has no event", r.line)
+		}
+
+		return record, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading dead-letter records: %w", err)
+	}
+
+	return nil, io.EOF
+}
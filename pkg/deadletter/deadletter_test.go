@@ -0,0 +1,139 @@
+package deadletter
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func TestFileDeadLettererRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.ndjson")
+	deadLetterer, err := NewFileDeadLetterer(path)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	sinkerIdx := 1
+	mockRecord := &Record{
+		Time: time.Now(),
+		Event: &event.Event{
+			PIDOnCPU:     7337,
+			CommandOnCPU: "test",
+			SourceIP:     net.ParseIP("1.2.3.4"),
+			DestIP:       net.ParseIP("7.3.3.7"),
+			SourcePort:   1234,
+			DestPort:     7337,
+			OldState:     tcpstate.StateClosed,
+			NewState:     tcpstate.StateSynReceived,
+		},
+		Error:    "mock error",
+		Attempts: 3,
+		Sinker:   &sinkerIdx,
+	}
+	if err := deadLetterer.DeadLetter(mockRecord); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	deadLetterer.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening dead-letter file: %v", err)
+	}
+	defer file.Close()
+
+	reader := NewReader(file)
+	record, err := reader.Next()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if record.Error != mockRecord.Error || record.Attempts != mockRecord.Attempts || *record.Sinker != sinkerIdx {
+		t.Errorf("expected record %+v, got %+v", mockRecord, record)
+	}
+
+	if !record.Event.SourceIP.Equal(mockRecord.Event.SourceIP) || record.Event.NewState != mockRecord.Event.NewState {
+		t.Errorf("expected event %v, got %v", mockRecord.Event, record.Event)
+	}
+
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestReaderMalformedError(t *testing.T) {
+	reader := NewReader(strings.NewReader("{\"event\":{}}\nnot json\n"))
+
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	_, err := reader.Next()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %v (of type %T)", err, err)
+}
+
+type mockRecordSinker struct {
+	errToReturn error
+	kind        string
+	received    interface{}
+}
+
+func (mrs *mockRecordSinker) SinkRecord(kind string, record interface{}) error {
+	mrs.kind, mrs.received = kind, record
+	return mrs.errToReturn
+}
+
+func TestSinkerDeadLetterer(t *testing.T) {
+	mockSinker := new(mockRecordSinker)
+	mockEvent := new(event.Event)
+	sinkerIdx := 1
+	mockTime := time.Date(2021, 10, 2, 12, 0, 0, 0, time.UTC)
+
+	deadLetterer := NewSinkerDeadLetterer(mockSinker)
+	err := deadLetterer.DeadLetter(&Record{
+		Time:     mockTime,
+		Event:    mockEvent,
+		Error:    "mock sinker error",
+		Attempts: 3,
+		Sinker:   &sinkerIdx,
+	})
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// The whole record is sunk, not only its event
+	received, ok := mockSinker.received.(*Record)
+	if mockSinker.kind != RecordKind || !ok {
+		t.Fatalf("expected dead-letter record to be sunk to secondary sinker, got %s record %v",
+			mockSinker.kind, mockSinker.received)
+	}
+
+	if received.Event != mockEvent ||
+		!received.Time.Equal(mockTime) ||
+		received.Error != "mock sinker error" ||
+		received.Attempts != 3 ||
+		received.Sinker == nil || *received.Sinker != 1 {
+		t.Errorf("expected dead-letter record fields to be sunk, got %+v", received)
+	}
+}
+
+func TestSinkerDeadLettererError(t *testing.T) {
+	mockErr := errors.New("mock sinker error")
+	deadLetterer := NewSinkerDeadLetterer(&mockRecordSinker{errToReturn: mockErr})
+
+	err := deadLetterer.DeadLetter(&Record{Event: new(event.Event)})
+	if !errors.Is(err, mockErr) {
+		t.Errorf("expected error chain to include %q, got %v", mockErr, err)
+	}
+}
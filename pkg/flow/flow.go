@@ -0,0 +1,223 @@
+package flow
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/conntable"
+)
+
+// The ways a connection is closed, as given by a Record's ClosePath.
+const (
+	// ClosePathFIN is of a connection closed in an orderly way, with FINs, from FIN-WAIT-2,
+	// TIME-WAIT, CLOSING or LAST-ACK.
+	ClosePathFIN = "fin"
+
+	// ClosePathRST is of a connection aborted once established, such as by a reset or
+	// retransmissions timing out, from ESTABLISHED, FIN-WAIT-1 or CLOSE-WAIT.
+	ClosePathRST = "rst"
+
+	// ClosePathHandshakeFailed is of a connection closed before it was established, such as
+	// when it is refused or the handshake times out.
+	ClosePathHandshakeFailed = "handshake-failed"
+
+	// ClosePathTimeout is of a connection not seen to close, but which was idle for the idle
+	// timeout, or whose addresses were taken by a new connection.
+	ClosePathTimeout = "timeout"
+
+	// ClosePathEvicted is of a connection not seen to close, but which was evicted to keep
+	// within the most flows tracked.
+	ClosePathEvicted = "evicted"
+)
+
+// The directions of a connection, as given by a Record's Direction.
+const (
+	DirectionOutbound = "outbound"
+	DirectionInbound  = "inbound"
+)
+
+// Record is the record of a connection from when it was opened until it was closed.
+type Record struct {
+	SourceIP      net.IP     `json:"source_ip"`
+	SourcePort    uint16     `json:"source_port"`
+	DestIP        net.IP     `json:"dest_ip"`
+	DestPort      uint16     `json:"dest_port"`
+	Direction     string     `json:"direction,omitempty"` // Omitted if the connection was first seen once established
+	PIDOnCPU      int        `json:"pid_on_cpu"`          // Of the first event of the connection
+	CommandOnCPU  string     `json:"command_on_cpu"`      // Of the first event of the connection
+	OpenTime      time.Time  `json:"open_time"`
+	EstablishTime *time.Time `json:"establish_time,omitempty"` // Omitted if the connection was not seen to be established
+	CloseTime     time.Time  `json:"close_time"`               // The time of the last event if the connection was not seen to close
+	ClosePath     string     `json:"close_path"`
+	Duration      float64    `json:"duration_seconds"`
+	Partial       bool       `json:"partial,omitempty"` // Whether the connection was open when first seen, so its open time is when it was first seen
+}
+
+// RecordKind is the kind of record, as given to a record.Sinker, of a flow record.
+const RecordKind = "flow"
+
+// Options configure a Tracker.
+type Options struct {
+	IdleTimeout time.Duration // How long a connection may go without an event before it is evicted
+	MaxFlows    int           // The most connections tracked, beyond which the least recently seen is evicted
+}
+
+// Tracker tracks the connections seen in the events given to it, keyed on their source
+// and destination addresses, to assemble a Record of each. A connection is tracked from its
+// first event, other than those of listening sockets, until it moves to CLOSED, or it is
+// evicted when idle or to keep within the most flows tracked.
+// A Tracker is not safe for concurrent use.
+type Tracker struct {
+	options Options
+	flows   *conntable.Table // Of the *flows, least recently seen first
+	now     func() time.Time
+}
+
+// Flow is a connection being tracked.
+type flow struct {
+	key       conntable.Key
+	record    *Record
+	lastEvent time.Time // The time of the connection's last event
+	seen      time.Time // When the connection's last event was tracked, for idle eviction
+}
+
+// NewTracker returns a Tracker as given by the options.
+func NewTracker(options Options) (*Tracker, error) {
+	switch {
+	case options.IdleTimeout <= 0:
+		return nil, fmt.Errorf("idle timeout %v must be positive", options.IdleTimeout)
+	case options.MaxFlows < 1:
+		return nil, fmt.Errorf("most flows %d must be at least 1", options.MaxFlows)
+	}
+
+	return &Tracker{
+		options: options,
+		flows:   conntable.New(),
+		now:     time.Now,
+	}, nil
+}
+
+// Len returns the number of connections being tracked.
+func (t *Tracker) Len() int {
+	return t.flows.Len()
+}
+
+// Track updates the connection of the event, returning the records of any connections
+// which are closed or evicted as a result.
+func (t *Tracker) Track(e *event.Event) []*Record {
+	if e.OldState == tcpstate.StateListen || e.NewState == tcpstate.StateListen {
+		return nil // Listening sockets are not connections
+	}
+
+	key := conntable.KeyOf(e)
+
+	var records []*Record
+	value, ok := t.flows.Get(key)
+	if ok && e.OldState == tcpstate.StateClosed {
+		// The connection's close was missed, and its addresses have been reused
+		records = append(records, t.close(value.(*flow), ClosePathTimeout, value.(*flow).lastEvent))
+		ok = false
+	}
+
+	var f *flow
+	if ok {
+		f = value.(*flow)
+		t.flows.Touch(key)
+	} else {
+		f = t.open(key, e)
+		if t.flows.Len() > t.options.MaxFlows {
+			_, oldest, _ := t.flows.Oldest()
+			records = append(records, t.close(oldest.(*flow), ClosePathEvicted, oldest.(*flow).lastEvent))
+		}
+	}
+
+	f.lastEvent, f.seen = e.Time, t.now()
+
+	if e.NewState == tcpstate.StateEstablished && f.record.EstablishTime == nil {
+		establishTime := e.Time
+		f.record.EstablishTime = &establishTime
+	}
+
+	if e.NewState == tcpstate.StateClosed {
+		records = append(records, t.close(f, closePath(e.OldState), e.Time))
+	}
+
+	return records
+}
+
+// Evict evicts the connections which have been idle for the idle timeout, returning their
+// records.
+func (t *Tracker) Evict() []*Record {
+	var records []*Record
+	now := t.now()
+	for _, value, ok := t.flows.Oldest(); ok; _, value, ok = t.flows.Oldest() {
+		f := value.(*flow)
+		if now.Sub(f.seen) < t.options.IdleTimeout {
+			break
+		}
+
+		records = append(records, t.close(f, ClosePathTimeout, f.lastEvent))
+	}
+
+	return records
+}
+
+// Open starts tracking the connection of the event, its first.
+func (t *Tracker) open(key conntable.Key, e *event.Event) *flow {
+	record := &Record{
+		SourceIP:     e.SourceIP,
+		SourcePort:   e.SourcePort,
+		DestIP:       e.DestIP,
+		DestPort:     e.DestPort,
+		PIDOnCPU:     e.PIDOnCPU,
+		CommandOnCPU: e.CommandOnCPU,
+		OpenTime:     e.Time,
+	}
+
+	// A passively opened connection may first be seen as it moves from SYN-RECEIVED, as
+	// the kernel need not report its move to SYN-RECEIVED
+	switch e.OldState {
+	case tcpstate.StateClosed:
+		if e.NewState == tcpstate.StateSynSent {
+			record.Direction = DirectionOutbound
+		} else if e.NewState == tcpstate.StateSynReceived {
+			record.Direction = DirectionInbound
+		}
+	case tcpstate.StateSynSent:
+		record.Direction = DirectionOutbound
+		record.Partial = true
+	case tcpstate.StateSynReceived:
+		record.Direction = DirectionInbound
+	default:
+		record.Partial = true
+	}
+
+	f := &flow{key: key, record: record}
+	t.flows.Put(key, f)
+	return f
+}
+
+// Close stops tracking the connection, returning its record.
+func (t *Tracker) close(f *flow, path string, closeTime time.Time) *Record {
+	t.flows.Remove(f.key)
+
+	f.record.ClosePath = path
+	f.record.CloseTime = closeTime
+	f.record.Duration = closeTime.Sub(f.record.OpenTime).Seconds()
+	return f.record
+}
+
+// ClosePath returns how a connection moving to CLOSED from the state was closed.
+func closePath(from tcpstate.State) string {
+	switch from {
+	case tcpstate.StateSynSent, tcpstate.StateSynReceived:
+		return ClosePathHandshakeFailed
+	case tcpstate.StateEstablished, tcpstate.StateFinWait1, tcpstate.StateCloseWait:
+		return ClosePathRST
+	default:
+		return ClosePathFIN
+	}
+}
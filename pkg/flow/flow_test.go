@@ -0,0 +1,282 @@
+package flow
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+var testStart = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestTracker(t *testing.T, maxFlows int) *Tracker {
+	tracker, err := NewTracker(Options{IdleTimeout: time.Minute, MaxFlows: maxFlows})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return tracker
+}
+
+// NewTestEvent returns an event of the connection from source port to port 443, at the
+// offset from the start of the test.
+func newTestEvent(sourcePort uint16, offset time.Duration, oldState, newState tcpstate.State) *event.Event {
+	return &event.Event{
+		Time:         testStart.Add(offset),
+		PIDOnCPU:     100,
+		CommandOnCPU: "curl",
+		SourceIP:     net.ParseIP("10.0.0.1"),
+		SourcePort:   sourcePort,
+		DestIP:       net.ParseIP("10.1.0.1"),
+		DestPort:     443,
+		OldState:     oldState,
+		NewState:     newState,
+	}
+}
+
+// TrackAll tracks the events, returning the records of the connections closed.
+func trackAll(tracker *Tracker, events ...*event.Event) []*Record {
+	var records []*Record
+	for _, e := range events {
+		records = append(records, tracker.Track(e)...)
+	}
+
+	return records
+}
+
+func TestTrackerClosePaths(t *testing.T) {
+	second := time.Second
+	tests := []struct {
+		name      string
+		events    []*event.Event
+		direction string
+		path      string
+		partial   bool
+		duration  float64
+	}{
+		{
+			name: "fin",
+			events: []*event.Event{
+				newTestEvent(1000, 0, tcpstate.StateClosed, tcpstate.StateSynSent),
+				newTestEvent(1000, second, tcpstate.StateSynSent, tcpstate.StateEstablished),
+				newTestEvent(1000, 2*second, tcpstate.StateEstablished, tcpstate.StateFinWait1),
+				newTestEvent(1000, 3*second, tcpstate.StateFinWait1, tcpstate.StateFinWait2),
+				newTestEvent(1000, 4*second, tcpstate.StateFinWait2, tcpstate.StateClosed),
+			},
+			direction: DirectionOutbound,
+			path:      ClosePathFIN,
+			duration:  4,
+		},
+		{
+			name: "rst",
+			events: []*event.Event{
+				newTestEvent(1000, 0, tcpstate.StateSynReceived, tcpstate.StateEstablished),
+				newTestEvent(1000, 2*second, tcpstate.StateEstablished, tcpstate.StateClosed),
+			},
+			direction: DirectionInbound,
+			path:      ClosePathRST,
+			duration:  2,
+		},
+		{
+			name: "handshake failed",
+			events: []*event.Event{
+				newTestEvent(1000, 0, tcpstate.StateClosed, tcpstate.StateSynSent),
+				newTestEvent(1000, 3*second, tcpstate.StateSynSent, tcpstate.StateClosed),
+			},
+			direction: DirectionOutbound,
+			path:      ClosePathHandshakeFailed,
+			duration:  3,
+		},
+		{
+			name: "partial",
+			events: []*event.Event{
+				newTestEvent(1000, 0, tcpstate.StateEstablished, tcpstate.StateCloseWait),
+				newTestEvent(1000, second, tcpstate.StateCloseWait, tcpstate.StateLastAck),
+				newTestEvent(1000, 2*second, tcpstate.StateLastAck, tcpstate.StateClosed),
+			},
+			path:     ClosePathFIN,
+			partial:  true,
+			duration: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newTestTracker(t, 10)
+			records := trackAll(tracker, test.events...)
+			if len(records) != 1 {
+				t.Fatalf("expected 1 record, got %d", len(records))
+			}
+
+			record := records[0]
+			if record.ClosePath != test.path || record.Direction != test.direction || record.Partial != test.partial {
+				t.Errorf("expected close path %q, direction %q and partial %v, got %+v",
+					test.path, test.direction, test.partial, record)
+			}
+
+			if record.Duration != test.duration || !record.OpenTime.Equal(testStart) {
+				t.Errorf("expected duration %v from %v, got %+v", test.duration, testStart, record)
+			}
+
+			if tracker.Len() != 0 {
+				t.Errorf("expected no connections tracked, got %d", tracker.Len())
+			}
+		})
+	}
+}
+
+func TestTrackerEstablishTime(t *testing.T) {
+	tracker := newTestTracker(t, 10)
+	records := trackAll(tracker,
+		newTestEvent(1000, 0, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newTestEvent(1000, time.Second, tcpstate.StateSynSent, tcpstate.StateEstablished),
+		newTestEvent(1000, 2*time.Second, tcpstate.StateEstablished, tcpstate.StateClosed))
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+
+	if records[0].EstablishTime == nil || !records[0].EstablishTime.Equal(testStart.Add(time.Second)) {
+		t.Errorf("expected establish time of %v, got %v", testStart.Add(time.Second), records[0].EstablishTime)
+	}
+
+	records = trackAll(tracker,
+		newTestEvent(1000, 0, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newTestEvent(1000, time.Second, tcpstate.StateSynSent, tcpstate.StateClosed))
+	if len(records) != 1 || records[0].EstablishTime != nil {
+		t.Errorf("expected no establish time, got %+v", records)
+	}
+}
+
+func TestTrackerListenIgnored(t *testing.T) {
+	tracker := newTestTracker(t, 10)
+	records := trackAll(tracker,
+		newTestEvent(1000, 0, tcpstate.StateClosed, tcpstate.StateListen),
+		newTestEvent(1000, time.Second, tcpstate.StateListen, tcpstate.StateClosed))
+	if len(records) != 0 || tracker.Len() != 0 {
+		t.Errorf("expected listening sockets to be ignored, got %d records and %d tracked", len(records), tracker.Len())
+	}
+}
+
+func TestTrackerAddressesReused(t *testing.T) {
+	tracker := newTestTracker(t, 10)
+	records := trackAll(tracker,
+		newTestEvent(1000, 0, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newTestEvent(1000, time.Second, tcpstate.StateSynSent, tcpstate.StateEstablished),
+		// The close of the first connection is missed
+		newTestEvent(1000, 5*time.Second, tcpstate.StateClosed, tcpstate.StateSynSent))
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+
+	if records[0].ClosePath != ClosePathTimeout || !records[0].CloseTime.Equal(testStart.Add(time.Second)) {
+		t.Errorf("expected timeout closed at the last event, got %+v", records[0])
+	}
+
+	if tracker.Len() != 1 {
+		t.Errorf("expected the new connection to be tracked, got %d tracked", tracker.Len())
+	}
+}
+
+func TestTrackerMaxFlows(t *testing.T) {
+	tracker := newTestTracker(t, 2)
+	records := trackAll(tracker,
+		newTestEvent(1000, 0, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newTestEvent(1001, time.Second, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newTestEvent(1000, 2*time.Second, tcpstate.StateSynSent, tcpstate.StateEstablished),
+		newTestEvent(1002, 3*time.Second, tcpstate.StateClosed, tcpstate.StateSynSent))
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+
+	// The least recently seen connection is evicted, not the first opened
+	if records[0].ClosePath != ClosePathEvicted || records[0].SourcePort != 1001 {
+		t.Errorf("expected connection from port 1001 to be evicted, got %+v", records[0])
+	}
+
+	if tracker.Len() != 2 {
+		t.Errorf("expected 2 connections tracked, got %d", tracker.Len())
+	}
+}
+
+func TestTrackerEvict(t *testing.T) {
+	tracker := newTestTracker(t, 10)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+
+	trackAll(tracker, newTestEvent(1000, 0, tcpstate.StateClosed, tcpstate.StateSynSent))
+	now = now.Add(30 * time.Second)
+	trackAll(tracker, newTestEvent(1001, 0, tcpstate.StateClosed, tcpstate.StateSynSent))
+
+	if records := tracker.Evict(); len(records) != 0 {
+		t.Fatalf("expected no records before the idle timeout, got %d", len(records))
+	}
+
+	now = now.Add(30 * time.Second)
+	records := tracker.Evict()
+	if len(records) != 1 || records[0].SourcePort != 1000 || records[0].ClosePath != ClosePathTimeout {
+		t.Fatalf("expected connection from port 1000 to time out, got %+v", records)
+	}
+
+	now = now.Add(30 * time.Second)
+	if records := tracker.Evict(); len(records) != 1 || tracker.Len() != 0 {
+		t.Errorf("expected the last connection to time out, got %d records and %d tracked", len(records), tracker.Len())
+	}
+}
+
+func TestRecordJSON(t *testing.T) {
+	tracker := newTestTracker(t, 10)
+	records := trackAll(tracker,
+		newTestEvent(1000, 0, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newTestEvent(1000, time.Second, tcpstate.StateSynSent, tcpstate.StateEstablished),
+		newTestEvent(1000, 1500*time.Millisecond, tcpstate.StateEstablished, tcpstate.StateClosed))
+
+	encoded, err := json.Marshal(records[0])
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	for name, expected := range map[string]interface{}{
+		"source_ip":        "10.0.0.1",
+		"source_port":      1000.0,
+		"dest_ip":          "10.1.0.1",
+		"dest_port":        443.0,
+		"direction":        DirectionOutbound,
+		"command_on_cpu":   "curl",
+		"open_time":        "2021-03-01T12:00:00Z",
+		"establish_time":   "2021-03-01T12:00:01Z",
+		"close_time":       "2021-03-01T12:00:01.5Z",
+		"close_path":       ClosePathRST,
+		"duration_seconds": 1.5,
+	} {
+		if fields[name] != expected {
+			t.Errorf("expected %s of %v, got %v", name, expected, fields[name])
+		}
+	}
+
+	if _, ok := fields["partial"]; ok {
+		t.Errorf("expected partial to be omitted, got %s", encoded)
+	}
+}
+
+func TestNewTrackerErrors(t *testing.T) {
+	for _, options := range []Options{
+		{IdleTimeout: 0, MaxFlows: 1},
+		{IdleTimeout: time.Minute, MaxFlows: 0},
+	} {
+		_, err := NewTracker(options)
+		if err == nil {
+			t.Errorf("expected error for options %+v, got nil", options)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
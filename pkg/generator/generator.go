@@ -0,0 +1,467 @@
+package generator
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+)
+
+// The plugin options.
+const (
+	RateOption             = "rate"
+	ConcurrencyOption      = "concurrency"
+	SourceCIDROption       = "source-cidr"
+	DestCIDROption         = "dest-cidr"
+	DestPortsOption        = "dest-ports"
+	FailedHandshakesOption = "failed-handshakes"
+	ConnectionsOption      = "connections"
+	SeedOption             = "seed"
+)
+
+const (
+	defaultRate             = 100
+	defaultConcurrency      = 10
+	defaultSourceCIDR       = "10.0.0.0/16"
+	defaultDestCIDR         = "10.1.0.0/24"
+	defaultDestPorts        = "443"
+	defaultFailedHandshakes = 0.05
+
+	firstEphemeralPort = 32768
+	lastEphemeralPort  = 60999
+	firstINode         = 100000
+)
+
+// ErrClosed is returned by Event once the Eventer has been closed.
+var ErrClosed = errors.New("eventer closed")
+
+// The states each connection passes through, from and back to CLOSED.
+var (
+	establishedLifecycle = []tcpstate.State{
+		tcpstate.StateClosed,
+		tcpstate.StateSynSent,
+		tcpstate.StateEstablished,
+		tcpstate.StateFinWait1,
+		tcpstate.StateFinWait2,
+		tcpstate.StateTimeWait,
+		tcpstate.StateClosed,
+	}
+
+	failedLifecycle = []tcpstate.State{
+		tcpstate.StateClosed,
+		tcpstate.StateSynSent,
+		tcpstate.StateClosed,
+	}
+)
+
+var commands = []string{"curl", "wget", "java", "python3", "node", "nginx"}
+
+// Options configure an Eventer.
+type Options struct {
+	Rate             float64 // Connections started per second, or 0 for as fast as possible
+	Concurrency      int     // The most connections open at once
+	SourceNet        *net.IPNet
+	DestNet          *net.IPNet
+	DestPorts        []uint16
+	FailedHandshakes float64 // The share, from 0 to 1, of connections whose handshake fails
+	Connections      int64   // How many connections to generate, or 0 for no limit
+	Seed             int64
+}
+
+// Eventer is an event.Eventer which generates the events of synthetic outbound
+// connections, for load testing. Each connection goes from CLOSED to SYN-SENT and then
+// either, if its handshake fails, back to CLOSED or through ESTABLISHED, FIN-WAIT-1,
+// FIN-WAIT-2 and TIME-WAIT to CLOSED.
+// Connections are started at the rate and each lasts for as long as keeps the concurrency
+// open on average, so the events of concurrent connections are interleaved. Every event
+// has the time it was generated. Events into TIME-WAIT and out of it have no socket info,
+// as the socket is no longer owned by a user space socket.
+// Once the number of connections has been generated, Event blocks until the context is
+// done or the Eventer is closed.
+// Event may be called concurrently with Close, but not with itself.
+type Eventer struct {
+	options  Options
+	random   *rand.Rand
+	interval float64 // The virtual time between connection starts
+	step     float64 // The virtual time between the transitions of a connection
+	after    func(time.Duration) <-chan time.Time
+	now      func() time.Time
+
+	open      transitions // The open connections, by the virtual time of their next transition
+	pending   *connection // The connection whose transition is waited for, kept should the wait be cut short
+	clock     float64     // The virtual time of the last event
+	nextStart float64
+	started   int64
+	seq       uint64
+	inode     uint32
+	start     time.Time // When the first event was generated
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Connection is an open synthetic connection.
+type connection struct {
+	sourceIP, destIP     net.IP
+	sourcePort, destPort uint16
+	pid                  int
+	command              string
+	id                   string
+	inode                uint32
+	lifecycle            []tcpstate.State
+	next                 int     // The index in the lifecycle of the state it moves to next
+	due                  float64 // The virtual time of its next transition
+	seq                  uint64  // Orders connections with the same due time
+}
+
+// Transitions is a heap of the open connections, implementing heap.Interface.
+type transitions []*connection
+
+func (t transitions) Len() int { return len(t) }
+
+func (t transitions) Less(i, j int) bool {
+	if t[i].due != t[j].due {
+		return t[i].due < t[j].due
+	}
+	return t[i].seq < t[j].seq
+}
+
+func (t transitions) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
+func (t *transitions) Push(x interface{}) { *t = append(*t, x.(*connection)) }
+
+func (t *transitions) Pop() interface{} {
+	old := *t
+	c := old[len(old)-1]
+	*t = old[:len(old)-1]
+	return c
+}
+
+// New returns an Eventer which generates connections as given by the options.
+func New(options Options) (*Eventer, error) {
+	switch {
+	case options.Rate < 0:
+		return nil, fmt.Errorf("rate %v must not be negative", options.Rate)
+	case options.Concurrency < 1:
+		return nil, fmt.Errorf("concurrency %d must be at least 1", options.Concurrency)
+	case options.SourceNet == nil || options.DestNet == nil:
+		return nil, errors.New("source and destination networks are required")
+	case len(options.DestPorts) == 0:
+		return nil, errors.New("at least one destination port is required")
+	case options.FailedHandshakes < 0 || options.FailedHandshakes > 1:
+		return nil, fmt.Errorf("failed handshakes %v must be between 0 and 1", options.FailedHandshakes)
+	case options.Connections < 0:
+		return nil, fmt.Errorf("connections %d must not be negative", options.Connections)
+	}
+
+	// Virtual time is in seconds when pacing, and otherwise in connection starts
+	interval := 1.0
+	if options.Rate > 0 {
+		interval = 1 / options.Rate
+	}
+
+	// By Little's law, connections lasting the concurrency's worth of intervals keep the
+	// concurrency open on average
+	lifetime := float64(options.Concurrency) * interval
+
+	return &Eventer{
+		options:  options,
+		random:   rand.New(rand.NewSource(options.Seed)),
+		interval: interval,
+		step:     lifetime / float64(len(establishedLifecycle)-2),
+		after:    time.After,
+		now:      time.Now,
+		inode:    firstINode,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// NewWithConfig is the plugin constructor.
+func NewWithConfig(config map[string]string) (event.Eventer, error) {
+	options, err := ParseOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(options)
+}
+
+// ParseOptions parses the plugin options. Without a seed, one is taken from the time.
+func ParseOptions(config map[string]string) (Options, error) {
+	c := pluginconfig.Config(config)
+	if err := c.CheckKeys(RateOption,
+		ConcurrencyOption,
+		SourceCIDROption,
+		DestCIDROption,
+		DestPortsOption,
+		FailedHandshakesOption,
+		ConnectionsOption,
+		SeedOption); err != nil {
+		return Options{}, err
+	}
+
+	var options Options
+	var err error
+	if options.Rate, err = c.Float64(RateOption, defaultRate); err != nil {
+		return Options{}, err
+	}
+
+	concurrency, err := c.Int64(ConcurrencyOption, defaultConcurrency)
+	if err != nil {
+		return Options{}, err
+	}
+	options.Concurrency = int(concurrency)
+
+	if options.SourceNet, err = parseCIDR(c, SourceCIDROption, defaultSourceCIDR); err != nil {
+		return Options{}, err
+	}
+
+	if options.DestNet, err = parseCIDR(c, DestCIDROption, defaultDestCIDR); err != nil {
+		return Options{}, err
+	}
+
+	if options.DestPorts, err = parsePorts(c, DestPortsOption, defaultDestPorts); err != nil {
+		return Options{}, err
+	}
+
+	if options.FailedHandshakes, err = c.Float64(FailedHandshakesOption, defaultFailedHandshakes); err != nil {
+		return Options{}, err
+	}
+
+	if options.Connections, err = c.Int64(ConnectionsOption, 0); err != nil {
+		return Options{}, err
+	}
+
+	if options.Seed, err = c.Int64(SeedOption, time.Now().UnixNano()); err != nil {
+		return Options{}, err
+	}
+
+	return options, nil
+}
+
+func parseCIDR(c pluginconfig.Config, key, def string) (*net.IPNet, error) {
+	value, ok := c[key]
+	if !ok {
+		value = def
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("option %s: %w", key, err)
+	}
+
+	return network, nil
+}
+
+// ParsePorts parses a comma-separated list of ports.
+func parsePorts(c pluginconfig.Config, key, def string) ([]uint16, error) {
+	value, ok := c[key]
+	if !ok {
+		value = def
+	}
+
+	var ports []uint16
+	for _, field := range strings.Split(value, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("option %s: malformed port %q", key, field)
+		}
+		ports = append(ports, uint16(port))
+	}
+
+	return ports, nil
+}
+
+func (e *Eventer) Event() (*event.Event, error) {
+	return e.EventContext(context.Background())
+}
+
+// EventContext returns the next event, having waited until it is due if there is a rate.
+func (e *Eventer) EventContext(ctx context.Context) (*event.Event, error) {
+	select {
+	case <-e.done:
+		return nil, ErrClosed
+	default:
+	}
+
+	if e.pending == nil {
+		e.pending = e.next()
+	}
+
+	c := e.pending
+	if c == nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-e.done:
+			return nil, ErrClosed
+		}
+	}
+
+	if err := e.wait(ctx, c.due); err != nil {
+		return nil, err
+	}
+
+	e.pending = nil
+	return e.transition(c), nil
+}
+
+// Next returns the connection with the next transition, which may be a new connection.
+// It returns nil once every connection has been generated and closed.
+func (e *Eventer) next() *connection {
+	canStart := len(e.open) < e.options.Concurrency &&
+		(e.options.Connections == 0 || e.started < e.options.Connections)
+	if canStart && (len(e.open) == 0 || e.nextStart < e.open[0].due) {
+		c := e.newConnection(e.nextStart)
+		heap.Push(&e.open, c)
+		return c
+	}
+
+	if len(e.open) == 0 {
+		return nil
+	}
+
+	return e.open[0]
+}
+
+// Transition moves the connection to the next state of its lifecycle, returning the event.
+func (e *Eventer) transition(c *connection) *event.Event {
+	if c.next == 1 {
+		// The connection has just been started
+		e.started++
+		e.nextStart = c.due + e.interval
+	}
+
+	old, new := c.lifecycle[c.next-1], c.lifecycle[c.next]
+	ev := &event.Event{
+		Time:         e.now(),
+		PIDOnCPU:     c.pid,
+		CommandOnCPU: c.command,
+		SourceIP:     c.sourceIP,
+		SourcePort:   c.sourcePort,
+		DestIP:       c.destIP,
+		DestPort:     c.destPort,
+		OldState:     old,
+		NewState:     new,
+	}
+
+	if old != tcpstate.StateTimeWait && new != tcpstate.StateTimeWait {
+		ev.SocketInfo = &event.SocketInfo{
+			ID:          c.id,
+			INode:       c.inode,
+			UID:         1000,
+			GID:         1000,
+			SocketState: socketState(new),
+		}
+	}
+
+	e.clock = c.due
+	c.next++
+	if c.next == len(c.lifecycle) {
+		heap.Pop(&e.open)
+	} else {
+		c.due += e.step
+		e.seq++
+		c.seq = e.seq
+		heap.Fix(&e.open, 0)
+	}
+
+	return ev
+}
+
+// NewConnection returns a new connection, starting at the virtual time or, if it is
+// overdue as the concurrency was reached, now.
+func (e *Eventer) newConnection(due float64) *connection {
+	if due < e.clock {
+		due = e.clock
+	}
+
+	lifecycle := establishedLifecycle
+	if e.random.Float64() < e.options.FailedHandshakes {
+		lifecycle = failedLifecycle
+	}
+
+	e.inode++
+	e.seq++
+	return &connection{
+		sourceIP:   e.randomIP(e.options.SourceNet),
+		sourcePort: uint16(firstEphemeralPort + e.random.Intn(lastEphemeralPort-firstEphemeralPort+1)),
+		destIP:     e.randomIP(e.options.DestNet),
+		destPort:   e.options.DestPorts[e.random.Intn(len(e.options.DestPorts))],
+		pid:        1000 + e.random.Intn(31000),
+		command:    commands[e.random.Intn(len(commands))],
+		id:         strconv.FormatUint(0xffff888000000000|uint64(e.random.Uint32())<<6, 16),
+		inode:      e.inode,
+		lifecycle:  lifecycle,
+		next:       1,
+		due:        due,
+		seq:        e.seq,
+	}
+}
+
+func (e *Eventer) randomIP(network *net.IPNet) net.IP {
+	ip := make(net.IP, len(network.IP))
+	for i := range ip {
+		ip[i] = network.IP[i] | byte(e.random.Intn(256))&^network.Mask[i]
+	}
+
+	return ip
+}
+
+// Wait waits until the virtual time is due, if there is a rate. Times are relative to the
+// first event, so that the time taken to process the events does not accumulate into drift.
+func (e *Eventer) wait(ctx context.Context, due float64) error {
+	if e.options.Rate == 0 {
+		return nil
+	}
+
+	if e.start.IsZero() {
+		e.start = e.now()
+	}
+
+	delay := e.start.Add(time.Duration(due * float64(time.Second))).Sub(e.now())
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-e.after(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.done:
+		return ErrClosed
+	}
+}
+
+func (e *Eventer) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+	})
+
+	return nil
+}
+
+// SocketState returns the state of the user space socket of a connection in the TCP state.
+func socketState(state tcpstate.State) socketstate.State {
+	switch state {
+	case tcpstate.StateSynSent:
+		return socketstate.StateConnecting
+	case tcpstate.StateEstablished:
+		return socketstate.StateConnected
+	case tcpstate.StateFinWait1, tcpstate.StateFinWait2:
+		return socketstate.StateDisconnecting
+	default:
+		return socketstate.StateUnconnected
+	}
+}
@@ -0,0 +1,265 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+var _ event.EventerCloser = new(Eventer)
+
+func newTestOptions(t *testing.T, config map[string]string) Options {
+	if _, ok := config[SeedOption]; !ok {
+		config[SeedOption] = "1"
+	}
+
+	options, err := ParseOptions(config)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return options
+}
+
+func newTestEventer(t *testing.T, config map[string]string) *Eventer {
+	eventer, err := New(newTestOptions(t, config))
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return eventer
+}
+
+func generate(t *testing.T, eventer *Eventer, n int) []*event.Event {
+	events := make([]*event.Event, 0, n)
+	for i := 0; i < n; i++ {
+		e, err := eventer.Event()
+		if err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+		events = append(events, e)
+	}
+
+	return events
+}
+
+// ConnectionKey identifies a synthetic connection by its addresses.
+func connectionKey(e *event.Event) string {
+	return net.JoinHostPort(e.SourceIP.String(), strconv.Itoa(int(e.SourcePort))) + " " +
+		net.JoinHostPort(e.DestIP.String(), strconv.Itoa(int(e.DestPort)))
+}
+
+func TestEventerLifecycles(t *testing.T) {
+	eventer := newTestEventer(t, map[string]string{
+		RateOption:             "0",
+		ConcurrencyOption:      "4",
+		ConnectionsOption:      "50",
+		FailedHandshakesOption: "0.3",
+	})
+	defer eventer.Close()
+
+	// Follow each connection's states, checking each event continues from the last
+	states := make(map[string][]tcpstate.State)
+	var order []string
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		e, err := eventer.EventContext(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			break // Every connection has been generated and closed
+		}
+		if err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		key := connectionKey(e)
+		previous, ok := states[key]
+		if !ok {
+			order = append(order, key)
+			previous = []tcpstate.State{tcpstate.StateClosed}
+		}
+
+		if last := previous[len(previous)-1]; e.OldState != last {
+			t.Fatalf("expected connection %s to move from %v, got %v", key, last, e)
+		}
+		states[key] = append(previous, e.NewState)
+
+		if !eventer.options.SourceNet.Contains(e.SourceIP) || !eventer.options.DestNet.Contains(e.DestIP) {
+			t.Errorf("expected addresses in the configured networks, got %v", e)
+		}
+
+		if (e.OldState == tcpstate.StateTimeWait || e.NewState == tcpstate.StateTimeWait) != (e.SocketInfo == nil) {
+			t.Errorf("expected socket info only outside TIME-WAIT, got %v", e)
+		}
+	}
+
+	if len(order) != 50 {
+		t.Fatalf("expected 50 connections, got %d", len(order))
+	}
+
+	established, failed := 0, 0
+	for _, key := range order {
+		switch len(states[key]) {
+		case len(establishedLifecycle):
+			established++
+		case len(failedLifecycle):
+			failed++
+		default:
+			t.Errorf("expected connection %s to complete a lifecycle, got %v", key, states[key])
+		}
+	}
+
+	if failed == 0 || established == 0 {
+		t.Errorf("expected both established and failed connections, got %d and %d", established, failed)
+	}
+}
+
+func TestEventerConcurrency(t *testing.T) {
+	eventer := newTestEventer(t, map[string]string{RateOption: "0", ConcurrencyOption: "8", FailedHandshakesOption: "0"})
+	defer eventer.Close()
+
+	open := make(map[string]bool)
+	interleaved := false
+	for _, e := range generate(t, eventer, 2000) {
+		key := connectionKey(e)
+		if e.NewState == tcpstate.StateClosed {
+			delete(open, key)
+			continue
+		}
+		open[key] = true
+
+		if len(open) > 8 {
+			t.Fatalf("expected at most 8 open connections, got %d", len(open))
+		}
+
+		if len(open) > 1 {
+			interleaved = true
+		}
+	}
+
+	if !interleaved {
+		t.Error("expected events of concurrent connections to be interleaved")
+	}
+}
+
+func TestEventerSeed(t *testing.T) {
+	config := map[string]string{RateOption: "0", SeedOption: "42"}
+	first := generate(t, newTestEventer(t, config), 100)
+	second := generate(t, newTestEventer(t, config), 100)
+
+	for i := range first {
+		if connectionKey(first[i]) != connectionKey(second[i]) || first[i].NewState != second[i].NewState {
+			t.Fatalf("expected the same events from the same seed, got %v and %v", first[i], second[i])
+		}
+	}
+}
+
+func TestEventerRate(t *testing.T) {
+	eventer := newTestEventer(t, map[string]string{RateOption: "10", ConcurrencyOption: "1", FailedHandshakesOption: "0"})
+	defer eventer.Close()
+
+	now := time.Now()
+	var waits []time.Duration
+	eventer.now = func() time.Time { return now }
+	eventer.after = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		now = now.Add(d)
+		c := make(chan time.Time, 1)
+		c <- now
+		return c
+	}
+
+	// A connection starts every 100ms, and each of its five later transitions is 20ms apart,
+	// so the second connection starts as the first closes
+	generate(t, eventer, 8)
+	if len(waits) != 6 {
+		t.Fatalf("expected 6 waits, got %v", waits)
+	}
+
+	for _, wait := range waits {
+		if wait != 20*time.Millisecond {
+			t.Errorf("expected waits of 20ms, got %v", waits)
+			break
+		}
+	}
+}
+
+func TestEventerContextDone(t *testing.T) {
+	eventer := newTestEventer(t, map[string]string{RateOption: "1", ConcurrencyOption: "1", FailedHandshakesOption: "0"})
+	defer eventer.Close()
+	eventer.after = func(time.Duration) <-chan time.Time { return nil }
+
+	first := generate(t, eventer, 1)[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := eventer.EventContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context cancelled error, got %v (of type %T)", err, err)
+	}
+
+	// The transition cut short is not lost or duplicated
+	eventer.after = time.After
+	eventer.options.Rate = 0
+	second := generate(t, eventer, 1)[0]
+	if connectionKey(second) != connectionKey(first) || second.OldState != tcpstate.StateSynSent {
+		t.Errorf("expected the first connection's second transition, got %v", second)
+	}
+}
+
+func TestEventerClose(t *testing.T) {
+	eventer := newTestEventer(t, map[string]string{ConnectionsOption: "1", RateOption: "0"})
+	generate(t, eventer, 2)
+
+	errChan := make(chan error)
+	go func() {
+		for {
+			if _, err := eventer.Event(); err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+
+	if err := eventer.Close(); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("expected ErrClosed, got %v (of type %T)", err, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event did not return after Close")
+	}
+}
+
+func TestNewWithConfigErrors(t *testing.T) {
+	for _, config := range []map[string]string{
+		{RateOption: "-1"},
+		{RateOption: "fast"},
+		{ConcurrencyOption: "0"},
+		{SourceCIDROption: "10.0.0.0"},
+		{DestCIDROption: "10.0.0.0/33"},
+		{DestPortsOption: "443,http"},
+		{DestPortsOption: "0"},
+		{FailedHandshakesOption: "1.5"},
+		{ConnectionsOption: "-1"},
+		{SeedOption: "random"},
+		{"duration": "1m"},
+	} {
+		_, err := NewWithConfig(config)
+		if err == nil {
+			t.Errorf("expected error for options %v, got nil", config)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
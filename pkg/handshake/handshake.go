@@ -0,0 +1,223 @@
+package handshake
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/conntable"
+)
+
+// The outcomes of a handshake, as given by a Result's Outcome.
+const (
+	// OutcomeEstablished is of a handshake which completed, so that the connection was
+	// established.
+	OutcomeEstablished = "established"
+
+	// OutcomeRefused is of an outbound handshake which failed in less than the timeout
+	// threshold, as it would if the SYN was answered with a reset.
+	OutcomeRefused = "refused"
+
+	// OutcomeTimedOut is of an outbound handshake which failed after at least the timeout
+	// threshold, as it would if the SYN was retransmitted without an answer.
+	OutcomeTimedOut = "timed-out"
+
+	// OutcomeFailed is of an outbound handshake which failed, but whose start was not seen,
+	// so it is not known whether it was refused or timed out.
+	OutcomeFailed = "failed"
+
+	// OutcomeAborted is of an inbound handshake which failed, such as by a reset from the
+	// client or the SYN-ACK retransmissions timing out, so the connection was never
+	// accepted.
+	OutcomeAborted = "aborted"
+)
+
+// The directions of a handshake, as given by a Result's Direction.
+const (
+	DirectionOutbound = "outbound"
+	DirectionInbound  = "inbound"
+)
+
+// PendingExpiry is how long, by the times of the events, an outbound handshake is waited
+// for before it is forgotten. It is well beyond the time taken by the kernel, with its
+// default settings, to give up retransmitting a SYN.
+const pendingExpiry = 10 * time.Minute
+
+// Result is the result of a handshake, giving how it ended and how long it took.
+type Result struct {
+	SourceIP     net.IP     `json:"source_ip"`
+	SourcePort   uint16     `json:"source_port"`
+	DestIP       net.IP     `json:"dest_ip"`
+	DestPort     uint16     `json:"dest_port"`
+	Direction    string     `json:"direction"`
+	PIDOnCPU     int        `json:"pid_on_cpu"`           // Of the event ending the handshake
+	CommandOnCPU string     `json:"command_on_cpu"`       // Of the event ending the handshake
+	StartTime    *time.Time `json:"start_time,omitempty"` // Omitted if the start of the handshake was not seen
+	EndTime      time.Time  `json:"end_time"`
+	Duration     float64    `json:"duration_seconds,omitempty"` // Omitted if the start of the handshake was not seen
+	Outcome      string     `json:"outcome"`
+}
+
+// Failed returns whether the handshake failed.
+func (r *Result) Failed() bool {
+	return r.Outcome != OutcomeEstablished
+}
+
+// Listener returns the address of the listening side of the handshake, to which the SYN
+// was sent. This is the destination of an outbound handshake, and the source of an inbound
+// one, as the source of an event is always the local side.
+func (r *Result) Listener() string {
+	if r.Direction == DirectionInbound {
+		return net.JoinHostPort(r.SourceIP.String(), strconv.Itoa(int(r.SourcePort)))
+	}
+
+	return net.JoinHostPort(r.DestIP.String(), strconv.Itoa(int(r.DestPort)))
+}
+
+// Timed returns whether the start of the handshake was seen, so that its duration is
+// known.
+func (r *Result) Timed() bool {
+	return r.StartTime != nil
+}
+
+// RecordKind is the kind of record, as given to a record.Sinker, of a handshake result.
+const RecordKind = "handshake"
+
+// Options configure a Tracker.
+type Options struct {
+	TimeoutThreshold time.Duration // How long an outbound handshake must take to fail for it to have timed out, rather than been refused
+	MaxPending       int           // The most outbound handshakes waited for, beyond which the oldest is forgotten
+}
+
+// Tracker times the handshakes seen in the events given to it, and finds how they ended.
+// Outbound handshakes are timed from their move to SYN-SENT until they are established or
+// closed. Inbound handshakes are not timed, as the kernel does not report their move to
+// SYN-RECEIVED, but those which fail are found by their move from SYN-RECEIVED to CLOSED.
+// A Tracker is not safe for concurrent use.
+type Tracker struct {
+	options Options
+	pending *conntable.Table // Of the start times of the handshakes, oldest first
+}
+
+// NewTracker returns a Tracker as given by the options.
+func NewTracker(options Options) (*Tracker, error) {
+	switch {
+	case options.TimeoutThreshold <= 0:
+		return nil, fmt.Errorf("timeout threshold %v must be positive", options.TimeoutThreshold)
+	case options.MaxPending < 1:
+		return nil, fmt.Errorf("most pending handshakes %d must be at least 1", options.MaxPending)
+	}
+
+	return &Tracker{
+		options: options,
+		pending: conntable.New(),
+	}, nil
+}
+
+// Len returns the number of outbound handshakes being waited for.
+func (t *Tracker) Len() int {
+	return t.pending.Len()
+}
+
+// Track updates the handshake of the event's connection, returning its result if the
+// event ends it, or nil otherwise.
+func (t *Tracker) Track(e *event.Event) *Result {
+	t.expire(e.Time)
+
+	key := conntable.KeyOf(e)
+
+	switch e.OldState {
+	case tcpstate.StateClosed:
+		if e.NewState == tcpstate.StateSynSent {
+			t.start(key, e.Time)
+		}
+		return nil
+	case tcpstate.StateSynSent:
+		start, started := t.finish(key)
+		switch e.NewState {
+		case tcpstate.StateEstablished:
+			return newResult(e, DirectionOutbound, OutcomeEstablished, start, started)
+		case tcpstate.StateClosed:
+			outcome := OutcomeFailed
+			if started {
+				outcome = OutcomeRefused
+				if e.Time.Sub(start) >= t.options.TimeoutThreshold {
+					outcome = OutcomeTimedOut
+				}
+			}
+			return newResult(e, DirectionOutbound, outcome, start, started)
+		default:
+			return nil
+		}
+	case tcpstate.StateSynReceived:
+		switch e.NewState {
+		case tcpstate.StateEstablished:
+			return newResult(e, DirectionInbound, OutcomeEstablished, time.Time{}, false)
+		case tcpstate.StateClosed:
+			return newResult(e, DirectionInbound, OutcomeAborted, time.Time{}, false)
+		default:
+			return nil
+		}
+	default:
+		return nil
+	}
+}
+
+// Start starts waiting for the outbound handshake, forgetting the oldest if too many are
+// being waited for.
+func (t *Tracker) start(key conntable.Key, start time.Time) {
+	// If the end of a previous handshake was missed, and the addresses have been reused,
+	// the previous handshake is replaced
+	t.pending.Put(key, start)
+	if t.pending.Len() > t.options.MaxPending {
+		oldest, _, _ := t.pending.Oldest()
+		t.pending.Remove(oldest)
+	}
+}
+
+// Finish stops waiting for the outbound handshake, returning when it started, if it was
+// being waited for.
+func (t *Tracker) finish(key conntable.Key) (time.Time, bool) {
+	start, ok := t.pending.Remove(key)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return start.(time.Time), true
+}
+
+// Expire forgets the outbound handshakes which started more than the pending expiry
+// before the time.
+func (t *Tracker) expire(now time.Time) {
+	for key, start, ok := t.pending.Oldest(); ok; key, start, ok = t.pending.Oldest() {
+		if now.Sub(start.(time.Time)) < pendingExpiry {
+			return
+		}
+
+		t.pending.Remove(key)
+	}
+}
+
+func newResult(e *event.Event, direction, outcome string, start time.Time, started bool) *Result {
+	result := &Result{
+		SourceIP:     e.SourceIP,
+		SourcePort:   e.SourcePort,
+		DestIP:       e.DestIP,
+		DestPort:     e.DestPort,
+		Direction:    direction,
+		PIDOnCPU:     e.PIDOnCPU,
+		CommandOnCPU: e.CommandOnCPU,
+		EndTime:      e.Time,
+		Outcome:      outcome,
+	}
+
+	if started {
+		result.StartTime = &start
+		result.Duration = e.Time.Sub(start).Seconds()
+	}
+
+	return result
+}
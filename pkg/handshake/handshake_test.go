@@ -0,0 +1,247 @@
+package handshake
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// The time from which the handshakes of the tests are timed
+var epoch = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTracker(t *testing.T, maxPending int) *Tracker {
+	tracker, err := NewTracker(Options{TimeoutThreshold: time.Second, MaxPending: maxPending})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return tracker
+}
+
+// Transition returns the event of the connection between the client port of 10.0.0.1 and
+// the listener at 10.1.0.1:443 moving between the states, the given time after the epoch.
+func transition(clientPort uint16, after time.Duration, from, to tcpstate.State) *event.Event {
+	return &event.Event{
+		Time:         epoch.Add(after),
+		PIDOnCPU:     100,
+		CommandOnCPU: "curl",
+		SourceIP:     net.ParseIP("10.0.0.1"),
+		SourcePort:   clientPort,
+		DestIP:       net.ParseIP("10.1.0.1"),
+		DestPort:     443,
+		OldState:     from,
+		NewState:     to,
+	}
+}
+
+// Dial returns the event of an outbound handshake from the client port starting.
+func dial(clientPort uint16, after time.Duration) *event.Event {
+	return transition(clientPort, after, tcpstate.StateClosed, tcpstate.StateSynSent)
+}
+
+// LastResult tracks the events, returning the result of the last.
+func lastResult(tracker *Tracker, events ...*event.Event) *Result {
+	var result *Result
+	for _, e := range events {
+		result = tracker.Track(e)
+	}
+
+	return result
+}
+
+func TestTrackerOutcomes(t *testing.T) {
+	tests := []struct {
+		name      string
+		events    []*event.Event
+		direction string
+		outcome   string
+		duration  float64
+		listener  string
+	}{
+		{
+			name: "established",
+			events: []*event.Event{
+				dial(1000, 0),
+				transition(1000, 20*time.Millisecond, tcpstate.StateSynSent, tcpstate.StateEstablished),
+			},
+			direction: DirectionOutbound,
+			outcome:   OutcomeEstablished,
+			duration:  0.02,
+			listener:  "10.1.0.1:443",
+		},
+		{
+			name: "refused",
+			events: []*event.Event{
+				dial(1000, 0),
+				transition(1000, 5*time.Millisecond, tcpstate.StateSynSent, tcpstate.StateClosed),
+			},
+			direction: DirectionOutbound,
+			outcome:   OutcomeRefused,
+			duration:  0.005,
+			listener:  "10.1.0.1:443",
+		},
+		{
+			name: "timed out",
+			events: []*event.Event{
+				dial(1000, 0),
+				transition(1000, 127*time.Second, tcpstate.StateSynSent, tcpstate.StateClosed),
+			},
+			direction: DirectionOutbound,
+			outcome:   OutcomeTimedOut,
+			duration:  127,
+			listener:  "10.1.0.1:443",
+		},
+		{
+			name: "start not seen",
+			events: []*event.Event{
+				transition(1000, 0, tcpstate.StateSynSent, tcpstate.StateClosed),
+			},
+			direction: DirectionOutbound,
+			outcome:   OutcomeFailed,
+			listener:  "10.1.0.1:443",
+		},
+		{
+			name: "inbound established",
+			events: []*event.Event{
+				transition(1000, 0, tcpstate.StateSynReceived, tcpstate.StateEstablished),
+			},
+			direction: DirectionInbound,
+			outcome:   OutcomeEstablished,
+			listener:  "10.0.0.1:1000",
+		},
+		{
+			name: "inbound aborted",
+			events: []*event.Event{
+				transition(1000, 0, tcpstate.StateSynReceived, tcpstate.StateClosed),
+			},
+			direction: DirectionInbound,
+			outcome:   OutcomeAborted,
+			listener:  "10.0.0.1:1000",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newTracker(t, 10)
+			result := lastResult(tracker, test.events...)
+			if result == nil {
+				t.Fatal("expected result, got nil")
+			}
+
+			if result.Direction != test.direction || result.Outcome != test.outcome || result.Listener() != test.listener {
+				t.Errorf("expected %s handshake to %s with outcome %q, got %+v",
+					test.direction, test.listener, test.outcome, result)
+			}
+
+			if result.Duration != test.duration || result.Timed() != (test.duration != 0) {
+				t.Errorf("expected duration %v, got %+v", test.duration, result)
+			}
+
+			if result.Failed() != (test.outcome != OutcomeEstablished) {
+				t.Errorf("expected failed to be %v, got %v", test.outcome != OutcomeEstablished, result.Failed())
+			}
+
+			if tracker.Len() != 0 {
+				t.Errorf("expected no handshakes pending, got %d", tracker.Len())
+			}
+		})
+	}
+}
+
+func TestTrackerIgnoresOtherTransitions(t *testing.T) {
+	tracker := newTracker(t, 10)
+	for _, e := range []*event.Event{
+		transition(1000, 0, tcpstate.StateClosed, tcpstate.StateListen),
+		dial(1001, 0),
+		transition(1002, 0, tcpstate.StateEstablished, tcpstate.StateFinWait1),
+		transition(1002, 0, tcpstate.StateFinWait1, tcpstate.StateClosed),
+	} {
+		if result := tracker.Track(e); result != nil {
+			t.Errorf("expected no result for event %v, got %+v", e, result)
+		}
+	}
+
+	if tracker.Len() != 1 {
+		t.Errorf("expected 1 handshake pending, got %d", tracker.Len())
+	}
+}
+
+func TestTrackerAddressesReused(t *testing.T) {
+	tracker := newTracker(t, 10)
+	result := lastResult(tracker,
+		dial(1000, 0),
+		// The end of the first handshake is missed
+		dial(1000, 5*time.Second),
+		transition(1000, 5*time.Second+10*time.Millisecond, tcpstate.StateSynSent, tcpstate.StateEstablished))
+	if result == nil || result.Duration != 0.01 {
+		t.Errorf("expected the second handshake to be timed, got %+v", result)
+	}
+}
+
+func TestTrackerMaxPending(t *testing.T) {
+	tracker := newTracker(t, 2)
+	result := lastResult(tracker,
+		dial(1000, 0),
+		dial(1001, 0),
+		dial(1002, 0),
+		transition(1000, 2*time.Second, tcpstate.StateSynSent, tcpstate.StateClosed))
+	if tracker.Len() != 2 {
+		t.Errorf("expected 2 handshakes pending, got %d", tracker.Len())
+	}
+
+	// The oldest handshake was forgotten, so its outcome is not known
+	if result == nil || result.Outcome != OutcomeFailed || result.Timed() {
+		t.Errorf("expected untimed failure of the oldest handshake, got %+v", result)
+	}
+}
+
+func TestTrackerExpires(t *testing.T) {
+	tracker := newTracker(t, 10)
+	lastResult(tracker,
+		dial(1000, 0),
+		dial(1001, time.Minute))
+
+	tracker.Track(transition(1002, pendingExpiry, tcpstate.StateEstablished, tcpstate.StateFinWait1))
+	if tracker.Len() != 1 {
+		t.Errorf("expected 1 handshake pending, got %d", tracker.Len())
+	}
+}
+
+func TestResultJSON(t *testing.T) {
+	tracker := newTracker(t, 10)
+	result := lastResult(tracker,
+		dial(1000, 0),
+		transition(1000, 1500*time.Millisecond, tcpstate.StateSynSent, tcpstate.StateClosed))
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	expected := `{"source_ip":"10.0.0.1","source_port":1000,"dest_ip":"10.1.0.1","dest_port":443,` +
+		`"direction":"outbound","pid_on_cpu":100,"command_on_cpu":"curl",` +
+		`"start_time":"2021-03-01T12:00:00Z","end_time":"2021-03-01T12:00:01.5Z",` +
+		`"duration_seconds":1.5,"outcome":"timed-out"}`
+	if string(encoded) != expected {
+		t.Errorf("expected %s, got %s", expected, encoded)
+	}
+}
+
+func TestNewTrackerErrors(t *testing.T) {
+	for _, options := range []Options{
+		{TimeoutThreshold: 0, MaxPending: 1},
+		{TimeoutThreshold: time.Second, MaxPending: 0},
+	} {
+		_, err := NewTracker(options)
+		if err == nil {
+			t.Errorf("expected error for options %+v, got nil", options)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
@@ -0,0 +1,131 @@
+package jsonl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+)
+
+const (
+	// FileOption is the option naming the file to which events are appended. If it is not
+	// given, or is "-", events are written to stdout.
+	FileOption = "file"
+
+	stdoutPath = "-"
+)
+
+// Record is the JSON representation of an event. Its fields, and their names, are stable,
+// so that the output can be consumed by other programs.
+type Record struct {
+	Time         string      `json:"time"` // RFC 3339, with nanoseconds
+	PIDOnCPU     int         `json:"pid_on_cpu"`
+	CommandOnCPU string      `json:"command_on_cpu"`
+	SourceIP     string      `json:"source_ip"`
+	SourcePort   uint16      `json:"source_port"`
+	DestIP       string      `json:"dest_ip"`
+	DestPort     uint16      `json:"dest_port"`
+	OldState     string      `json:"old_state"`
+	NewState     string      `json:"new_state"`
+	SocketInfo   *SocketInfo `json:"socket_info,omitempty"` // Omitted if the eventer cannot provide it
+}
+
+// SocketInfo is the JSON representation of an event's socket info.
+type SocketInfo struct {
+	ID          string `json:"id"`
+	INode       uint32 `json:"inode"`
+	UID         uint32 `json:"uid"`
+	GID         uint32 `json:"gid"`
+	SocketState string `json:"socket_state"`
+}
+
+// NewRecord returns the JSON representation of the event.
+func NewRecord(e *event.Event) *Record {
+	record := &Record{
+		Time:         e.Time.Format(time.RFC3339Nano),
+		PIDOnCPU:     e.PIDOnCPU,
+		CommandOnCPU: e.CommandOnCPU,
+		SourceIP:     e.SourceIP.String(),
+		SourcePort:   e.SourcePort,
+		DestIP:       e.DestIP.String(),
+		DestPort:     e.DestPort,
+		OldState:     e.OldState.String(),
+		NewState:     e.NewState.String(),
+	}
+
+	if e.SocketInfo != nil {
+		record.SocketInfo = &SocketInfo{
+			ID:          e.SocketInfo.ID,
+			INode:       e.SocketInfo.INode,
+			UID:         e.SocketInfo.UID,
+			GID:         e.SocketInfo.GID,
+			SocketState: e.SocketInfo.SocketState.String(),
+		}
+	}
+
+	return record
+}
+
+// Sinker is a sink.Sinker which writes each event as a JSON object on its own line
+// (JSON Lines).
+// A Sinker is not safe for concurrent use.
+type Sinker struct {
+	encoder *json.Encoder
+	closer  io.Closer // Nil if the writer is not to be closed
+}
+
+// NewSinker returns a Sinker which writes to the writer. The writer is not closed by Close.
+func NewSinker(writer io.Writer) *Sinker {
+	return &Sinker{encoder: json.NewEncoder(writer)}
+}
+
+// NewWithConfig is the plugin constructor. The only option is FileOption.
+func NewWithConfig(config map[string]string) (sink.Sinker, error) {
+	if err := pluginconfig.Config(config).CheckKeys(FileOption); err != nil {
+		return nil, err
+	}
+
+	path := config[FileOption]
+	if path == "" || path == stdoutPath {
+		return NewSinker(os.Stdout), nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("opening events file: %w", err)
+	}
+
+	return &Sinker{encoder: json.NewEncoder(file), closer: file}, nil
+}
+
+func (s *Sinker) Sink(e *event.Event) error {
+	if err := s.encoder.Encode(NewRecord(e)); err != nil {
+		return fmt.Errorf("writing event: %w", err)
+	}
+
+	return nil
+}
+
+// SinkRecord writes the record as a line, so that a Sinker may be used to sink records,
+// such as flow records and alerts, as well as events.
+func (s *Sinker) SinkRecord(kind string, record interface{}) error {
+	if err := s.encoder.Encode(record); err != nil {
+		return fmt.Errorf("writing %s record: %w", kind, err)
+	}
+
+	return nil
+}
+
+// Close closes the file, if the Sinker opened one.
+func (s *Sinker) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+
+	return s.closer.Close()
+}
@@ -0,0 +1,159 @@
+package jsonl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/flow"
+	"github.com/jhwbarlow/tcp-audit/pkg/handshake"
+)
+
+func newTestEvent() *event.Event {
+	return &event.Event{
+		Time:         time.Date(2021, 9, 28, 21, 12, 36, 123456789, time.UTC),
+		PIDOnCPU:     7337,
+		CommandOnCPU: "curl",
+		SourceIP:     net.ParseIP("1.2.3.4"),
+		DestIP:       net.ParseIP("::1"),
+		SourcePort:   1234,
+		DestPort:     443,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynSent,
+	}
+}
+
+func TestSinkerWritesStableSchema(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sinker := NewSinker(buf)
+
+	mockEvent := newTestEvent()
+	if err := sinker.Sink(mockEvent); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	mockEvent.SocketInfo = &event.SocketInfo{
+		ID:          "ffff8880",
+		INode:       42,
+		UID:         1000,
+		GID:         1000,
+		SocketState: socketstate.StateConnecting,
+	}
+	if err := sinker.Sink(mockEvent); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	expected := `{"time":"2021-09-28T21:12:36.123456789Z","pid_on_cpu":7337,"command_on_cpu":"curl",` +
+		`"source_ip":"1.2.3.4","source_port":1234,"dest_ip":"::1","dest_port":443,` +
+		`"old_state":"CLOSED","new_state":"SYN-SENT"}` + "\n" +
+		`{"time":"2021-09-28T21:12:36.123456789Z","pid_on_cpu":7337,"command_on_cpu":"curl",` +
+		`"source_ip":"1.2.3.4","source_port":1234,"dest_ip":"::1","dest_port":443,` +
+		`"old_state":"CLOSED","new_state":"SYN-SENT",` +
+		`"socket_info":{"id":"ffff8880","inode":42,"uid":1000,"gid":1000,"socket_state":"CONNECTING"}}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected output:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestSinkerSinkRecord(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sinker := NewSinker(buf)
+
+	mockEvent := newTestEvent()
+	record := &flow.Record{
+		SourceIP:     mockEvent.SourceIP,
+		SourcePort:   mockEvent.SourcePort,
+		DestIP:       mockEvent.DestIP,
+		DestPort:     mockEvent.DestPort,
+		Direction:    flow.DirectionOutbound,
+		PIDOnCPU:     mockEvent.PIDOnCPU,
+		CommandOnCPU: mockEvent.CommandOnCPU,
+		OpenTime:     mockEvent.Time,
+		CloseTime:    mockEvent.Time.Add(2 * time.Second),
+		ClosePath:    flow.ClosePathHandshakeFailed,
+		Duration:     2,
+	}
+	if err := sinker.SinkRecord(flow.RecordKind, record); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	expected := `{"source_ip":"1.2.3.4","source_port":1234,"dest_ip":"::1","dest_port":443,` +
+		`"direction":"outbound","pid_on_cpu":7337,"command_on_cpu":"curl",` +
+		`"open_time":"2021-09-28T21:12:36.123456789Z","close_time":"2021-09-28T21:12:38.123456789Z",` +
+		`"close_path":"handshake-failed","duration_seconds":2}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected output:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestSinkerSinkHandshakeRecord(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sinker := NewSinker(buf)
+
+	mockEvent := newTestEvent()
+	result := &handshake.Result{
+		SourceIP:     mockEvent.SourceIP,
+		SourcePort:   mockEvent.SourcePort,
+		DestIP:       mockEvent.DestIP,
+		DestPort:     mockEvent.DestPort,
+		Direction:    handshake.DirectionOutbound,
+		PIDOnCPU:     mockEvent.PIDOnCPU,
+		CommandOnCPU: mockEvent.CommandOnCPU,
+		EndTime:      mockEvent.Time,
+		Outcome:      handshake.OutcomeFailed,
+	}
+	if err := sinker.SinkRecord(handshake.RecordKind, result); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	expected := `{"source_ip":"1.2.3.4","source_port":1234,"dest_ip":"::1","dest_port":443,` +
+		`"direction":"outbound","pid_on_cpu":7337,"command_on_cpu":"curl",` +
+		`"end_time":"2021-09-28T21:12:36.123456789Z","outcome":"failed"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected output:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestNewWithConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	for i := 0; i < 2; i++ { // The file is appended to, not truncated, when reopened
+		sinker, err := NewWithConfig(map[string]string{FileOption: path})
+		if err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		if err := sinker.Sink(newTestEvent()); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		if err := sinker.(*Sinker).Close(); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading events file: %v", err)
+	}
+
+	if lines := strings.Count(string(content), "\n"); lines != 2 {
+		t.Errorf("expected 2 lines, got %d", lines)
+	}
+}
+
+func TestNewWithConfigUnknownOption(t *testing.T) {
+	_, err := NewWithConfig(map[string]string{"fiel": "/tmp/events.jsonl"})
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
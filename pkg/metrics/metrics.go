@@ -0,0 +1,423 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric is a named metric, or family of labelled metrics, which can be written in the
+// Prometheus text exposition format.
+type Metric interface {
+	Name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds a set of metrics and serves them over HTTP.
+// It is safe for concurrent use.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []Metric
+	names   map[string]struct{}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]struct{})}
+}
+
+// Register adds metrics to the registry. It is an error to register two metrics with
+// the same name.
+func (r *Registry) Register(metrics ...Metric) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, metric := range metrics {
+		if _, ok := r.names[metric.Name()]; ok {
+			return fmt.Errorf("metric %q already registered", metric.Name())
+		}
+
+		r.names[metric.Name()] = struct{}{}
+		r.metrics = append(r.metrics, metric)
+	}
+
+	return nil
+}
+
+// WriteTo writes every registered metric in the Prometheus text exposition format,
+// in the order they were registered.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	metrics := make([]Metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mutex.Unlock()
+
+	counter := &countingWriter{w: w}
+	buffered := bufio.NewWriter(counter)
+	for _, metric := range metrics {
+		metric.write(buffered)
+	}
+
+	err := buffered.Flush()
+	return counter.n, err
+}
+
+// ServeHTTP implements http.Handler.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (d *desc) Name() string {
+	return d.name
+}
+
+func (d *desc) writeHeader(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, typ)
+}
+
+// Counter is a value which only increases.
+type Counter struct {
+	value uint64 // Accessed atomically, so must be 64-bit aligned
+	desc
+}
+
+func NewCounter(name, help string) *Counter {
+	return &Counter{desc: desc{name: name, help: help}}
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(delta uint64) {
+	atomic.AddUint64(&c.value, delta)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+	writeSample(w, c.name, nil, nil, strconv.FormatUint(c.Value(), 10))
+}
+
+// Gauge is a value which may increase and decrease.
+type Gauge struct {
+	value int64 // Accessed atomically, so must be 64-bit aligned
+	desc
+}
+
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{desc: desc{name: name, help: help}}
+}
+
+func (g *Gauge) Set(value int64) {
+	atomic.StoreInt64(&g.value, value)
+}
+
+func (g *Gauge) Add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.writeHeader(w, "gauge")
+	writeSample(w, g.name, nil, nil, strconv.FormatInt(g.Value(), 10))
+}
+
+// CounterFunc is a counter whose value is read from a function when the metric is written.
+// It is intended for exposing counts which are already kept elsewhere.
+type CounterFunc struct {
+	desc
+	fn func() uint64
+}
+
+func NewCounterFunc(name, help string, fn func() uint64) *CounterFunc {
+	return &CounterFunc{desc: desc{name: name, help: help}, fn: fn}
+}
+
+func (cf *CounterFunc) write(w *bufio.Writer) {
+	cf.writeHeader(w, "counter")
+	writeSample(w, cf.name, nil, nil, strconv.FormatUint(cf.fn(), 10))
+}
+
+// DefaultBuckets are histogram buckets, in seconds, suitable for timing calls to
+// local or remote stores.
+var DefaultBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets of cumulative upper bounds.
+type Histogram struct {
+	desc
+	upperBounds []float64
+
+	mutex  sync.Mutex
+	counts []uint64 // Not cumulative; the final count is for observations above every bound
+	sum    float64
+}
+
+// NewHistogram returns a histogram with the given bucket upper bounds, which must be sorted
+// in increasing order. If nil, DefaultBuckets are used.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return &Histogram{
+		desc:        desc{name: name, help: help},
+		upperBounds: bucketsOrDefault(buckets),
+		counts:      make([]uint64, len(bucketsOrDefault(buckets))+1),
+	}
+}
+
+func bucketsOrDefault(buckets []float64) []float64 {
+	if buckets == nil {
+		return DefaultBuckets
+	}
+
+	return buckets
+}
+
+func (h *Histogram) Observe(value float64) {
+	idx := sort.SearchFloat64s(h.upperBounds, value) // First bound >= value
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.counts[idx]++
+	h.sum += value
+}
+
+// Count returns the total number of observations.
+func (h *Histogram) Count() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var count uint64
+	for _, c := range h.counts {
+		count += c
+	}
+
+	return count
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w, "histogram")
+	h.writeSamples(w, nil, nil)
+}
+
+func (h *Histogram) writeSamples(w *bufio.Writer, labelNames, labelValues []string) {
+	h.mutex.Lock()
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	sum := h.sum
+	h.mutex.Unlock()
+
+	bucketLabelNames := append(append([]string(nil), labelNames...), "le")
+	var cumulative uint64
+	for i, bound := range h.upperBounds {
+		cumulative += counts[i]
+		bucketLabelValues := append(append([]string(nil), labelValues...), formatFloat(bound))
+		writeSample(w, h.name+"_bucket", bucketLabelNames, bucketLabelValues, strconv.FormatUint(cumulative, 10))
+	}
+	cumulative += counts[len(counts)-1]
+	bucketLabelValues := append(append([]string(nil), labelValues...), "+Inf")
+	writeSample(w, h.name+"_bucket", bucketLabelNames, bucketLabelValues, strconv.FormatUint(cumulative, 10))
+	writeSample(w, h.name+"_sum", labelNames, labelValues, formatFloat(sum))
+	writeSample(w, h.name+"_count", labelNames, labelValues, strconv.FormatUint(cumulative, 10))
+}
+
+// Vec holds the children of a labelled metric family, one per distinct set of label values.
+type vec struct {
+	desc
+	mutex    sync.Mutex
+	children map[string]interface{}
+	values   map[string][]string
+	newChild func() interface{}
+}
+
+func newVec(name, help string, labelNames []string, newChild func() interface{}) vec {
+	return vec{
+		desc:     desc{name: name, help: help, labelNames: labelNames},
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+		newChild: newChild,
+	}
+}
+
+func (v *vec) child(labelValues []string) interface{} {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %q has %d labels, but %d values were given",
+			v.name,
+			len(v.labelNames),
+			len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	child, ok := v.children[key]
+	if !ok {
+		child = v.newChild()
+		v.children[key] = child
+		v.values[key] = append([]string(nil), labelValues...)
+	}
+
+	return child
+}
+
+// Each calls fn for each child, in order of label values, so that output is stable.
+func (v *vec) each(fn func(labelValues []string, child interface{})) {
+	v.mutex.Lock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	children := make(map[string]interface{}, len(v.children))
+	values := make(map[string][]string, len(v.values))
+	for key, child := range v.children {
+		children[key] = child
+		values[key] = v.values[key]
+	}
+	v.mutex.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		fn(values[key], children[key])
+	}
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, labelNames, func() interface{} { return new(Counter) })}
+}
+
+// WithLabelValues returns the counter for the given label values, creating it if this is
+// the first use of those values. The values must be given in the order of the label names.
+func (cv *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return cv.child(labelValues).(*Counter)
+}
+
+func (cv *CounterVec) write(w *bufio.Writer) {
+	cv.writeHeader(w, "counter")
+	cv.each(func(labelValues []string, child interface{}) {
+		writeSample(w, cv.name, cv.labelNames, labelValues, strconv.FormatUint(child.(*Counter).Value(), 10))
+	})
+}
+
+// GaugeVec is a family of gauges partitioned by label values.
+type GaugeVec struct {
+	vec
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, labelNames, func() interface{} { return new(Gauge) })}
+}
+
+// WithLabelValues returns the gauge for the given label values, creating it if this is
+// the first use of those values. The values must be given in the order of the label names.
+func (gv *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return gv.child(labelValues).(*Gauge)
+}
+
+func (gv *GaugeVec) write(w *bufio.Writer) {
+	gv.writeHeader(w, "gauge")
+	gv.each(func(labelValues []string, child interface{}) {
+		writeSample(w, gv.name, gv.labelNames, labelValues, strconv.FormatInt(child.(*Gauge).Value(), 10))
+	})
+}
+
+// HistogramVec is a family of histograms, with the same buckets, partitioned by label values.
+type HistogramVec struct {
+	vec
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{newVec(name, help, labelNames, func() interface{} {
+		return NewHistogram(name, help, buckets)
+	})}
+}
+
+// WithLabelValues returns the histogram for the given label values, creating it if this is
+// the first use of those values. The values must be given in the order of the label names.
+func (hv *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return hv.child(labelValues).(*Histogram)
+}
+
+func (hv *HistogramVec) write(w *bufio.Writer) {
+	hv.writeHeader(w, "histogram")
+	hv.each(func(labelValues []string, child interface{}) {
+		child.(*Histogram).writeSamples(w, hv.labelNames, labelValues)
+	})
+}
+
+func writeSample(w *bufio.Writer, name string, labelNames, labelValues []string, value string) {
+	w.WriteString(name)
+	if len(labelNames) != 0 {
+		w.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labelName)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabelValue(labelValues[i]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, +1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
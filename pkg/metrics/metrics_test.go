@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func writeRegistry(t *testing.T, registry *Registry) string {
+	buf := new(bytes.Buffer)
+	if _, err := registry.WriteTo(buf); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	return buf.String()
+}
+
+func TestCounter(t *testing.T) {
+	counter := NewCounter("test_total", "A test counter.")
+	counter.Inc()
+	counter.Add(2)
+
+	registry := NewRegistry()
+	if err := registry.Register(counter); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expected := "# HELP test_total A test counter.\n" +
+		"# TYPE test_total counter\n" +
+		"test_total 3\n"
+	if got := writeRegistry(t, registry); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestGaugeVec(t *testing.T) {
+	gauge := NewGaugeVec("test_gauge", "A test gauge.", "component", "index")
+	gauge.WithLabelValues("sinker", "1").Set(4)
+	gauge.WithLabelValues("eventer", "0").Add(2)
+	gauge.WithLabelValues("eventer", "0").Add(-1)
+
+	registry := NewRegistry()
+	registry.Register(gauge)
+
+	expected := "# HELP test_gauge A test gauge.\n" +
+		"# TYPE test_gauge gauge\n" +
+		"test_gauge{component=\"eventer\",index=\"0\"} 1\n" +
+		"test_gauge{component=\"sinker\",index=\"1\"} 4\n"
+	if got := writeRegistry(t, registry); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestCounterVecEscapesLabelValues(t *testing.T) {
+	counter := NewCounterVec("test_total", "A test counter.", "label")
+	counter.WithLabelValues("a\"b\\c\nd").Inc()
+
+	registry := NewRegistry()
+	registry.Register(counter)
+
+	expected := `test_total{label="a\"b\\c\nd"} 1`
+	if got := writeRegistry(t, registry); !strings.Contains(got, expected) {
+		t.Errorf("expected output to contain %q, got %q", expected, got)
+	}
+}
+
+func TestCounterVecWrongLabelValues(t *testing.T) {
+	counter := NewCounterVec("test_total", "A test counter.", "label")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic, got none")
+		}
+	}()
+
+	counter.WithLabelValues("a", "b")
+}
+
+func TestCounterFunc(t *testing.T) {
+	counter := NewCounterFunc("test_total", "A test counter.", func() uint64 { return 7 })
+
+	registry := NewRegistry()
+	registry.Register(counter)
+
+	if got := writeRegistry(t, registry); !strings.Contains(got, "test_total 7\n") {
+		t.Errorf("expected output to contain value from function, got %q", got)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	histogram := NewHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1}, "sinker")
+	histogram.WithLabelValues("0").Observe(0.05)
+	histogram.WithLabelValues("0").Observe(0.1)
+	histogram.WithLabelValues("0").Observe(0.5)
+	histogram.WithLabelValues("0").Observe(2)
+
+	registry := NewRegistry()
+	registry.Register(histogram)
+
+	expected := "# HELP test_seconds A test histogram.\n" +
+		"# TYPE test_seconds histogram\n" +
+		"test_seconds_bucket{sinker=\"0\",le=\"0.1\"} 2\n" +
+		"test_seconds_bucket{sinker=\"0\",le=\"1\"} 3\n" +
+		"test_seconds_bucket{sinker=\"0\",le=\"+Inf\"} 4\n" +
+		"test_seconds_sum{sinker=\"0\"} 2.65\n" +
+		"test_seconds_count{sinker=\"0\"} 4\n"
+	if got := writeRegistry(t, registry); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if count := histogram.WithLabelValues("0").Count(); count != 4 {
+		t.Errorf("expected count of 4, got %d", count)
+	}
+}
+
+func TestRegistryDuplicateName(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(NewCounter("test_total", "A test counter."))
+
+	err := registry.Register(NewGauge("test_total", "A test gauge."))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(NewCounter("test_total", "A test counter."))
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("expected text/plain content type, got %q", contentType)
+	}
+
+	if body := recorder.Body.String(); !strings.Contains(body, "test_total 0\n") {
+		t.Errorf("expected body to contain counter, got %q", body)
+	}
+}
@@ -0,0 +1,196 @@
+package pluginconfig
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the set of key/value options passed to a plugin's configuration-accepting
+// constructor.
+type Config map[string]string
+
+// Copy returns a copy of the config, so a plugin cannot modify the processor's
+// view of its options.
+func (c Config) Copy() Config {
+	cp := make(Config, len(c))
+	for k, v := range c {
+		cp[k] = v
+	}
+
+	return cp
+}
+
+// Merge sets all options in other on this config, overwriting any existing values.
+func (c Config) Merge(other Config) {
+	for k, v := range other {
+		c[k] = v
+	}
+}
+
+func (c Config) String() string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+c[k])
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// Set parses an option of the form key=value and adds it to the config.
+// This allows a Config to be used as a repeatable command-line flag.
+func (c Config) Set(option string) error {
+	key, value, err := parseOption(option)
+	if err != nil {
+		return err
+	}
+
+	c[key] = value
+	return nil
+}
+
+// CheckKeys returns an error naming any options whose keys are not among those known.
+// It is intended for use by plugins, so that a misspelt option is not silently ignored.
+func (c Config) CheckKeys(known ...string) error {
+	var unknown []string
+	for key := range c {
+		found := false
+		for _, knownKey := range known {
+			if key == knownKey {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown options: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// Int64 returns the option as an integer, or the default if it is not set.
+func (c Config) Int64(key string, def int64) (int64, error) {
+	value, ok := c[key]
+	if !ok {
+		return def, nil
+	}
+
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %w", key, err)
+	}
+
+	return i, nil
+}
+
+// Duration returns the option as a duration, such as "1m30s", or the default if it is
+// not set.
+func (c Config) Duration(key string, def time.Duration) (time.Duration, error) {
+	value, ok := c[key]
+	if !ok {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %w", key, err)
+	}
+
+	return d, nil
+}
+
+// Float64 returns the option as a floating point number, or the default if it is not set.
+func (c Config) Float64(key string, def float64) (float64, error) {
+	value, ok := c[key]
+	if !ok {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %w", key, err)
+	}
+
+	return f, nil
+}
+
+// Bool returns the option as a boolean, or the default if it is not set.
+func (c Config) Bool(key string, def bool) (bool, error) {
+	value, ok := c[key]
+	if !ok {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("option %s: %w", key, err)
+	}
+
+	return b, nil
+}
+
+// ParseFile reads options from the file at the given path. Each non-empty line
+// not starting with a '#' must be of the form key=value.
+func ParseFile(path string) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening options file: %w", err)
+	}
+	defer file.Close()
+
+	config := make(Config)
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, err := parseOption(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+
+		config[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading options file: %w", err)
+	}
+
+	return config, nil
+}
+
+func parseOption(option string) (key, value string, err error) {
+	idx := strings.Index(option, "=")
+	if idx == -1 {
+		return "", "", fmt.Errorf("option %q not of the form key=value", option)
+	}
+
+	key = strings.TrimSpace(option[:idx])
+	if key == "" {
+		return "", "", errors.New("option key is empty")
+	}
+
+	return key, strings.TrimSpace(option[idx+1:]), nil
+}
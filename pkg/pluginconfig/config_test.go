@@ -0,0 +1,113 @@
+package pluginconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigSet(t *testing.T) {
+	config := make(Config)
+	if err := config.Set("key = some=value"); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if config["key"] != "some=value" {
+		t.Errorf("expected key=some=value, got %v", config)
+	}
+}
+
+func TestConfigSetMalformedError(t *testing.T) {
+	config := make(Config)
+	for _, option := range []string{"no-equals", "=no-key"} {
+		err := config.Set(option)
+		if err == nil {
+			t.Errorf("expected error for option %q, got nil", option)
+		}
+
+		t.Logf("got error %v (of type %T)", err, err)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "pluginconfig")
+	if err != nil {
+		t.Fatalf("creating temporary file: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("# comment\n\nkey1=value1\n  key2 = value2\n")
+	file.Close()
+
+	config, err := ParseFile(file.Name())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(config) != 2 || config["key1"] != "value1" || config["key2"] != "value2" {
+		t.Errorf("expected key1=value1,key2=value2, got %v", config)
+	}
+}
+
+func TestParseFileMalformedError(t *testing.T) {
+	file, err := ioutil.TempFile("", "pluginconfig")
+	if err != nil {
+		t.Fatalf("creating temporary file: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("key1=value1\nmalformed\n")
+	file.Close()
+
+	_, err = ParseFile(file.Name())
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %v (of type %T)", err, err)
+}
+
+func TestConfigCheckKeys(t *testing.T) {
+	config := Config{"file": "/tmp/events", "mxa-age": "1h", "apend": "true"}
+
+	err := config.CheckKeys("file", "max-age")
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	if !strings.Contains(err.Error(), "apend, mxa-age") {
+		t.Errorf("expected error to name the unknown options, got %q", err)
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestConfigTypedOptions(t *testing.T) {
+	config := Config{"size": "1024", "interval": "1m", "compress": "false", "speed": "2.5"}
+
+	if size, err := config.Int64("size", 0); err != nil || size != 1024 {
+		t.Errorf("expected size 1024, got %d (error %v)", size, err)
+	}
+
+	if interval, err := config.Duration("interval", 0); err != nil || interval != time.Minute {
+		t.Errorf("expected interval 1m, got %v (error %v)", interval, err)
+	}
+
+	if compress, err := config.Bool("compress", true); err != nil || compress {
+		t.Errorf("expected compress false, got %v (error %v)", compress, err)
+	}
+
+	if speed, err := config.Float64("speed", 1); err != nil || speed != 2.5 {
+		t.Errorf("expected speed 2.5, got %v (error %v)", speed, err)
+	}
+
+	if def, err := config.Int64("missing", 7); err != nil || def != 7 {
+		t.Errorf("expected default 7, got %d (error %v)", def, err)
+	}
+
+	if _, err := (Config{"size": "big"}).Int64("size", 0); err == nil {
+		t.Error("expected error for malformed integer, got nil")
+	}
+}
@@ -0,0 +1,237 @@
+package pluginconfig
+
+import (
+	"errors"
+	"fmt"
+	"plugin"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/pluginload"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/transform"
+)
+
+const (
+	// ConfigConstructorSymbol is the name of the constructor which accepts configuration.
+	// Its signature must be func(map[string]string) (event.Eventer, error) for Eventers,
+	// func(map[string]string) (sink.Sinker, error) for Sinkers and
+	// func(map[string]string) (transform.Transformer, error) for Transformers.
+	ConfigConstructorSymbol = "NewWithConfig"
+
+	// LegacyConstructorSymbol is the name of the zero-argument constructor which is used
+	// if the plugin does not provide a ConfigConstructorSymbol.
+	LegacyConstructorSymbol = "New"
+)
+
+// ErrSymbolNotFound is returned by a SymbolLoader when the plugin does not export
+// the requested symbol.
+var ErrSymbolNotFound = errors.New("symbol not found")
+
+// SymbolLoader is an interface describing objects which look up named symbols in a plugin.
+// It extends pluginload.PluginLoader, which only loads the legacy constructor, so that the
+// configuration constructor can be looked up too. A pluginload.PluginLoader is used as a
+// SymbolLoader through a PluginLoaderSymbolLoader.
+type SymbolLoader interface {
+	Lookup(name string) (plugin.Symbol, error)
+}
+
+// PluginLoaderSymbolLoader looks up the legacy constructor of a plugin with a
+// pluginload.PluginLoader. As a pluginload.PluginLoader loads nothing else, any other
+// symbol is not found, so plugins loaded by it are always constructed without
+// configuration.
+type PluginLoaderSymbolLoader struct {
+	loader pluginload.PluginLoader
+}
+
+func NewPluginLoaderSymbolLoader(loader pluginload.PluginLoader) *PluginLoaderSymbolLoader {
+	return &PluginLoaderSymbolLoader{loader}
+}
+
+func (pl *PluginLoaderSymbolLoader) Lookup(name string) (plugin.Symbol, error) {
+	if name != LegacyConstructorSymbol {
+		return nil, fmt.Errorf("%w: %s", ErrSymbolNotFound, name)
+	}
+
+	return pl.loader.Load()
+}
+
+// FilesystemSharedObjectSymbolLoader looks up symbols in a shared object plugin file. The
+// legacy constructor is loaded by a pluginload.FilesystemSharedObjectPluginLoader, as it
+// was before plugins accepted configuration.
+type FilesystemSharedObjectSymbolLoader struct {
+	path   string
+	legacy *PluginLoaderSymbolLoader
+}
+
+func NewFilesystemSharedObjectSymbolLoader(path string) *FilesystemSharedObjectSymbolLoader {
+	return &FilesystemSharedObjectSymbolLoader{
+		path:   path,
+		legacy: NewPluginLoaderSymbolLoader(pluginload.NewFilesystemSharedObjectPluginLoader(path)),
+	}
+}
+
+// Lookup opens the plugin and looks up the named symbol. Opening the same plugin
+// more than once is cheap, as the plugin package caches opened plugins.
+func (fl *FilesystemSharedObjectSymbolLoader) Lookup(name string) (plugin.Symbol, error) {
+	if name == LegacyConstructorSymbol {
+		return fl.legacy.Lookup(name)
+	}
+
+	plugin, err := plugin.Open(fl.path)
+	if err != nil {
+		return nil, fmt.Errorf("opening plugin: %w", err)
+	}
+
+	symbol, err := plugin.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrSymbolNotFound, name, err)
+	}
+
+	return symbol, nil
+}
+
+// BuiltinSymbolLoader looks up symbols in a plugin which is compiled into the program,
+// rather than loaded from a shared object file.
+type BuiltinSymbolLoader struct {
+	symbols map[string]plugin.Symbol
+}
+
+func NewBuiltinSymbolLoader(symbols map[string]plugin.Symbol) *BuiltinSymbolLoader {
+	return &BuiltinSymbolLoader{symbols}
+}
+
+func (bl *BuiltinSymbolLoader) Lookup(name string) (plugin.Symbol, error) {
+	symbol, ok := bl.symbols[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSymbolNotFound, name)
+	}
+
+	return symbol, nil
+}
+
+// PluginEventerLoader loads an Eventer from a plugin, passing it the given config
+// if the plugin has a configuration-accepting constructor.
+type PluginEventerLoader struct {
+	loader SymbolLoader
+	config Config
+}
+
+func NewPluginEventerLoader(loader SymbolLoader, config Config) *PluginEventerLoader {
+	return &PluginEventerLoader{loader, config}
+}
+
+func (pl *PluginEventerLoader) Load() (event.Eventer, error) {
+	symbol, legacy, err := lookupConstructor(pl.loader, pl.config)
+	if err != nil {
+		return nil, fmt.Errorf("loading eventer plugin: %w", err)
+	}
+
+	if legacy {
+		constructor, ok := symbol.(func() (event.Eventer, error))
+		if !ok {
+			return nil, errors.New("eventer plugin constructor has incorrect signature")
+		}
+
+		return constructor()
+	}
+
+	constructor, ok := symbol.(func(map[string]string) (event.Eventer, error))
+	if !ok {
+		return nil, errors.New("eventer plugin configuration constructor has incorrect signature")
+	}
+
+	return constructor(pl.config.Copy())
+}
+
+// PluginSinkerLoader loads a Sinker from a plugin, passing it the given config
+// if the plugin has a configuration-accepting constructor.
+type PluginSinkerLoader struct {
+	loader SymbolLoader
+	config Config
+}
+
+func NewPluginSinkerLoader(loader SymbolLoader, config Config) *PluginSinkerLoader {
+	return &PluginSinkerLoader{loader, config}
+}
+
+func (pl *PluginSinkerLoader) Load() (sink.Sinker, error) {
+	symbol, legacy, err := lookupConstructor(pl.loader, pl.config)
+	if err != nil {
+		return nil, fmt.Errorf("loading sinker plugin: %w", err)
+	}
+
+	if legacy {
+		constructor, ok := symbol.(func() (sink.Sinker, error))
+		if !ok {
+			return nil, errors.New("sinker plugin constructor has incorrect signature")
+		}
+
+		return constructor()
+	}
+
+	constructor, ok := symbol.(func(map[string]string) (sink.Sinker, error))
+	if !ok {
+		return nil, errors.New("sinker plugin configuration constructor has incorrect signature")
+	}
+
+	return constructor(pl.config.Copy())
+}
+
+// PluginTransformerLoader loads a Transformer from a plugin, passing it the given config
+// if the plugin has a configuration-accepting constructor.
+type PluginTransformerLoader struct {
+	loader SymbolLoader
+	config Config
+}
+
+func NewPluginTransformerLoader(loader SymbolLoader, config Config) *PluginTransformerLoader {
+	return &PluginTransformerLoader{loader, config}
+}
+
+func (pl *PluginTransformerLoader) Load() (transform.Transformer, error) {
+	symbol, legacy, err := lookupConstructor(pl.loader, pl.config)
+	if err != nil {
+		return nil, fmt.Errorf("loading transformer plugin: %w", err)
+	}
+
+	if legacy {
+		constructor, ok := symbol.(func() (transform.Transformer, error))
+		if !ok {
+			return nil, errors.New("transformer plugin constructor has incorrect signature")
+		}
+
+		return constructor()
+	}
+
+	constructor, ok := symbol.(func(map[string]string) (transform.Transformer, error))
+	if !ok {
+		return nil, errors.New("transformer plugin configuration constructor has incorrect signature")
+	}
+
+	return constructor(pl.config.Copy())
+}
+
+// LookupConstructor looks up the configuration-accepting constructor, falling back to
+// the legacy constructor if it does not exist. It is an error to supply configuration to
+// a plugin which only has a legacy constructor, as the configuration would be silently ignored.
+func lookupConstructor(loader SymbolLoader, config Config) (symbol plugin.Symbol, legacy bool, err error) {
+	symbol, err = loader.Lookup(ConfigConstructorSymbol)
+	if err == nil {
+		return symbol, false, nil
+	}
+
+	if !errors.Is(err, ErrSymbolNotFound) {
+		return nil, false, err
+	}
+
+	if len(config) != 0 {
+		return nil, false, fmt.Errorf("options supplied but plugin has no %s constructor", ConfigConstructorSymbol)
+	}
+
+	symbol, err = loader.Lookup(LegacyConstructorSymbol)
+	if err != nil {
+		return nil, false, fmt.Errorf("plugin has no constructor: %w", err)
+	}
+
+	return symbol, true, nil
+}
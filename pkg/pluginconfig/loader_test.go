@@ -0,0 +1,290 @@
+package pluginconfig
+
+import (
+	"errors"
+	"plugin"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/transform"
+)
+
+type mockSymbolLoader struct {
+	errorToReturn error
+	symbols       map[string]plugin.Symbol
+}
+
+func (msl *mockSymbolLoader) Lookup(name string) (plugin.Symbol, error) {
+	if msl.errorToReturn != nil {
+		return nil, msl.errorToReturn
+	}
+
+	symbol, ok := msl.symbols[name]
+	if !ok {
+		return nil, ErrSymbolNotFound
+	}
+
+	return symbol, nil
+}
+
+// mockPluginLoader is a pluginload.PluginLoader, which loads only the legacy constructor.
+type mockPluginLoader struct {
+	symbolToReturn plugin.Symbol
+	errorToReturn  error
+	loadCalled     bool
+}
+
+func (mpl *mockPluginLoader) Load() (plugin.Symbol, error) {
+	mpl.loadCalled = true
+	return mpl.symbolToReturn, mpl.errorToReturn
+}
+
+func TestPluginLoaderSymbolLoader(t *testing.T) {
+	called := false
+	mockConstructorSymbol := func() (sink.Sinker, error) {
+		called = true
+		return nil, nil
+	}
+	mockPluginLoader := &mockPluginLoader{symbolToReturn: mockConstructorSymbol}
+
+	loader := NewPluginSinkerLoader(NewPluginLoaderSymbolLoader(mockPluginLoader), nil)
+	if _, err := loader.Load(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !mockPluginLoader.loadCalled || !called {
+		t.Error("expected legacy constructor to be loaded and called, but was not")
+	}
+}
+
+func TestPluginLoaderSymbolLoaderOnlyLoadsLegacyConstructor(t *testing.T) {
+	mockPluginLoader := &mockPluginLoader{symbolToReturn: func() (sink.Sinker, error) { return nil, nil }}
+
+	_, err := NewPluginLoaderSymbolLoader(mockPluginLoader).Lookup(ConfigConstructorSymbol)
+	if !errors.Is(err, ErrSymbolNotFound) {
+		t.Errorf("expected error chain to include %q, got %v", ErrSymbolNotFound, err)
+	}
+
+	if mockPluginLoader.loadCalled {
+		t.Error("expected plugin loader not to be called, but was")
+	}
+
+	// Options cannot be given to a plugin without a configuration constructor
+	loader := NewPluginSinkerLoader(NewPluginLoaderSymbolLoader(mockPluginLoader), Config{"key": "value"})
+	if _, err := loader.Load(); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestPluginLoaderSymbolLoaderError(t *testing.T) {
+	mockErr := errors.New("mock plugin loader error")
+	mockPluginLoader := &mockPluginLoader{errorToReturn: mockErr}
+
+	loader := NewPluginEventerLoader(NewPluginLoaderSymbolLoader(mockPluginLoader), nil)
+	_, err := loader.Load()
+	if !errors.Is(err, mockErr) {
+		t.Errorf("expected error chain to include %q, got %v", mockErr, err)
+	}
+
+	t.Logf("got error %v (of type %T)", err, err)
+}
+
+func TestLoadEventerWithConfig(t *testing.T) {
+	var receivedConfig map[string]string
+	mockConstructorSymbol := func(config map[string]string) (event.Eventer, error) {
+		receivedConfig = config
+		return nil, nil
+	}
+
+	mockSymbolLoader := &mockSymbolLoader{
+		symbols: map[string]plugin.Symbol{ConfigConstructorSymbol: mockConstructorSymbol},
+	}
+	loader := NewPluginEventerLoader(mockSymbolLoader, Config{"key": "value"})
+	if _, err := loader.Load(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if receivedConfig["key"] != "value" {
+		t.Errorf("expected config key=value, got %v", receivedConfig)
+	}
+}
+
+func TestLoadEventerLegacyFallback(t *testing.T) {
+	called := false
+	mockConstructorSymbol := func() (event.Eventer, error) {
+		called = true
+		return nil, nil
+	}
+
+	mockSymbolLoader := &mockSymbolLoader{
+		symbols: map[string]plugin.Symbol{LegacyConstructorSymbol: mockConstructorSymbol},
+	}
+	loader := NewPluginEventerLoader(mockSymbolLoader, nil)
+	if _, err := loader.Load(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !called {
+		t.Error("expected legacy constructor to be called, but was not")
+	}
+}
+
+func TestLoadEventerLegacyWithConfigError(t *testing.T) {
+	mockConstructorSymbol := func() (event.Eventer, error) {
+		return nil, nil
+	}
+
+	mockSymbolLoader := &mockSymbolLoader{
+		symbols: map[string]plugin.Symbol{LegacyConstructorSymbol: mockConstructorSymbol},
+	}
+	loader := NewPluginEventerLoader(mockSymbolLoader, Config{"key": "value"})
+	_, err := loader.Load()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %v (of type %T)", err, err)
+}
+
+func TestLoadEventerBadConfigConstructorSignature(t *testing.T) {
+	mockConstructorSymbol := func() (event.Eventer, error) {
+		return nil, nil
+	}
+
+	mockSymbolLoader := &mockSymbolLoader{
+		symbols: map[string]plugin.Symbol{ConfigConstructorSymbol: mockConstructorSymbol},
+	}
+	loader := NewPluginEventerLoader(mockSymbolLoader, nil)
+	_, err := loader.Load()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %v (of type %T)", err, err)
+}
+
+func TestLoadSinkerWithConfig(t *testing.T) {
+	var receivedConfig map[string]string
+	mockConstructorSymbol := func(config map[string]string) (sink.Sinker, error) {
+		receivedConfig = config
+		return nil, nil
+	}
+
+	mockSymbolLoader := &mockSymbolLoader{
+		symbols: map[string]plugin.Symbol{ConfigConstructorSymbol: mockConstructorSymbol},
+	}
+	loader := NewPluginSinkerLoader(mockSymbolLoader, Config{"key": "value"})
+	if _, err := loader.Load(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if receivedConfig["key"] != "value" {
+		t.Errorf("expected config key=value, got %v", receivedConfig)
+	}
+}
+
+func TestLoadSinkerLegacyFallback(t *testing.T) {
+	called := false
+	mockConstructorSymbol := func() (sink.Sinker, error) {
+		called = true
+		return nil, nil
+	}
+
+	mockSymbolLoader := &mockSymbolLoader{
+		symbols: map[string]plugin.Symbol{LegacyConstructorSymbol: mockConstructorSymbol},
+	}
+	loader := NewPluginSinkerLoader(mockSymbolLoader, nil)
+	if _, err := loader.Load(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !called {
+		t.Error("expected legacy constructor to be called, but was not")
+	}
+}
+
+func TestLoadSinkerSymbolLoaderError(t *testing.T) {
+	mockErr := errors.New("mock symbol loader error")
+	mockSymbolLoader := &mockSymbolLoader{errorToReturn: mockErr}
+
+	loader := NewPluginSinkerLoader(mockSymbolLoader, nil)
+	_, err := loader.Load()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	// The sinker loader should return an error with the symbol loader
+	// error in the chain
+	if !errors.Is(err, mockErr) {
+		t.Errorf("expected error %v (of type %T), got error %v (of type %T)",
+			mockErr,
+			mockErr,
+			err,
+			err)
+	}
+
+	t.Logf("got error %v (of type %T)", err, err)
+}
+
+func TestLoadTransformerWithConfig(t *testing.T) {
+	var receivedConfig map[string]string
+	mockConstructorSymbol := func(config map[string]string) (transform.Transformer, error) {
+		receivedConfig = config
+		return nil, nil
+	}
+
+	mockSymbolLoader := &mockSymbolLoader{
+		symbols: map[string]plugin.Symbol{ConfigConstructorSymbol: mockConstructorSymbol},
+	}
+	loader := NewPluginTransformerLoader(mockSymbolLoader, Config{"key": "value"})
+	if _, err := loader.Load(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if receivedConfig["key"] != "value" {
+		t.Errorf("expected config key=value, got %v", receivedConfig)
+	}
+}
+
+func TestLoadTransformerBadConstructorSignature(t *testing.T) {
+	mockConstructorSymbol := func() {}
+
+	mockSymbolLoader := &mockSymbolLoader{
+		symbols: map[string]plugin.Symbol{LegacyConstructorSymbol: mockConstructorSymbol},
+	}
+	loader := NewPluginTransformerLoader(mockSymbolLoader, nil)
+	_, err := loader.Load()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %v (of type %T)", err, err)
+}
+
+func TestLoadSinkerBuiltin(t *testing.T) {
+	called := false
+	mockConstructorSymbol := func(config map[string]string) (sink.Sinker, error) {
+		called = true
+		return nil, nil
+	}
+
+	symbolLoader := NewBuiltinSymbolLoader(map[string]plugin.Symbol{ConfigConstructorSymbol: mockConstructorSymbol})
+	loader := NewPluginSinkerLoader(symbolLoader, nil)
+	if _, err := loader.Load(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !called {
+		t.Error("expected built-in constructor to be called, but was not")
+	}
+}
+
+func TestBuiltinSymbolLoaderSymbolNotFound(t *testing.T) {
+	symbolLoader := NewBuiltinSymbolLoader(nil)
+
+	_, err := symbolLoader.Lookup(ConfigConstructorSymbol)
+	if !errors.Is(err, ErrSymbolNotFound) {
+		t.Errorf("expected error chain to include %q, got %v", ErrSymbolNotFound, err)
+	}
+}
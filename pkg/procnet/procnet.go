@@ -0,0 +1,190 @@
+package procnet
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+	"github.com/jhwbarlow/tcp-audit/pkg/snapshot"
+)
+
+// The plugin options.
+const (
+	ProcOption         = "proc"
+	IntervalOption     = "interval"
+	EmitExistingOption = "emit-existing"
+)
+
+const (
+	defaultProcPath = "/proc"
+	defaultInterval = time.Second
+)
+
+// Options configure an Eventer.
+type Options struct {
+	ProcPath     string // The mount point of procfs, which may be the host's mounted in a container
+	Interval     time.Duration
+	EmitExisting bool // Whether to emit events for the sockets found by the first poll
+}
+
+// New returns an Eventer which polls /proc/net/tcp and /proc/net/tcp6, as given by the
+// options. It needs no privileges, but only sees the sockets in the network namespace of
+// the process which opened procfs.
+// The socket info ID is the kernel's (possibly obscured) address of the socket.
+func New(options Options) (*snapshot.Eventer, error) {
+	return snapshot.New(Lister(options.ProcPath), snapshot.Options{
+		Interval:     options.Interval,
+		EmitExisting: options.EmitExisting,
+	})
+}
+
+// NewWithConfig is the plugin constructor.
+func NewWithConfig(config map[string]string) (event.Eventer, error) {
+	c := pluginconfig.Config(config)
+	if err := c.CheckKeys(ProcOption, IntervalOption, EmitExistingOption); err != nil {
+		return nil, err
+	}
+
+	options := Options{ProcPath: c[ProcOption]}
+	if options.ProcPath == "" {
+		options.ProcPath = defaultProcPath
+	}
+
+	var err error
+	if options.Interval, err = c.Duration(IntervalOption, defaultInterval); err != nil {
+		return nil, err
+	}
+
+	if options.EmitExisting, err = c.Bool(EmitExistingOption, false); err != nil {
+		return nil, err
+	}
+
+	return New(options)
+}
+
+// Lister returns a snapshot.Lister which lists the sockets in the tcp and tcp6 files of
+// the procfs mounted at the path.
+func Lister(procPath string) snapshot.Lister {
+	return func() ([]*snapshot.Socket, error) {
+		var sockets []*snapshot.Socket
+		for _, file := range []string{"tcp", "tcp6"} {
+			fileSockets, err := readSockets(filepath.Join(procPath, "net", file))
+			if err != nil {
+				return nil, err
+			}
+			sockets = append(sockets, fileSockets...)
+		}
+
+		return sockets, nil
+	}
+}
+
+// ReadSockets reads the sockets listed in the file, in the format of /proc/net/tcp.
+// A missing file, such as tcp6 when IPv6 is disabled, lists no sockets.
+func readSockets(path string) ([]*snapshot.Socket, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading sockets: %w", err)
+	}
+
+	var sockets []*snapshot.Socket
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner.Scan() // Skip the header
+	for line := 2; scanner.Scan(); line++ {
+		s, err := parseSocket(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s line %d: %w", path, line, err)
+		}
+		sockets = append(sockets, s)
+	}
+
+	return sockets, scanner.Err()
+}
+
+// ParseSocket parses a line of /proc/net/tcp, such as:
+//
+//	0: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 4242 1 0000000012345678 100 0 0 10 0
+func parseSocket(line string) (*snapshot.Socket, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 12 {
+		return nil, fmt.Errorf("expected at least 12 fields, got %d", len(fields))
+	}
+
+	s := new(snapshot.Socket)
+	var err error
+	if s.LocalIP, s.LocalPort, err = parseAddress(fields[1]); err != nil {
+		return nil, fmt.Errorf("local address: %w", err)
+	}
+
+	if s.RemoteIP, s.RemotePort, err = parseAddress(fields[2]); err != nil {
+		return nil, fmt.Errorf("remote address: %w", err)
+	}
+
+	st, err := strconv.ParseUint(fields[3], 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("state: %w", err)
+	}
+
+	var ok bool
+	if s.State, ok = snapshot.KernelState(uint8(st)); !ok {
+		return nil, fmt.Errorf("unknown state %#x", st)
+	}
+
+	uid, err := strconv.ParseUint(fields[7], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("uid: %w", err)
+	}
+	s.UID = uint32(uid)
+
+	inode, err := strconv.ParseUint(fields[9], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("inode: %w", err)
+	}
+	s.INode = uint32(inode)
+	s.ID = fields[11]
+
+	return s, nil
+}
+
+// ParseAddress parses an address such as "0100007F:0CEA". The IP address is printed as
+// 32-bit host integers, each holding four bytes of the address in network byte order,
+// and the port as a plain integer.
+func parseAddress(address string) (net.IP, uint16, error) {
+	parts := strings.Split(address, ":")
+	if len(parts) != 2 || (len(parts[0]) != 8 && len(parts[0]) != 32) {
+		return nil, 0, fmt.Errorf("malformed address %q", address)
+	}
+
+	ip := make(net.IP, len(parts[0])/2)
+	for i := 0; i < len(ip); i += 4 {
+		word, err := strconv.ParseUint(parts[0][i*2:i*2+8], 16, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("malformed address %q: %w", address, err)
+		}
+		snapshot.NativeEndian.PutUint32(ip[i:], uint32(word))
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed port in address %q: %w", address, err)
+	}
+
+	// Present IPv4-mapped IPv6 addresses, as used by dual-stack sockets, as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return ip, uint16(port), nil
+}
@@ -0,0 +1,212 @@
+package procnet
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/snapshot"
+)
+
+const header = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+// Lines as the kernel would print them on a little-endian host.
+const (
+	listenLine      = "   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 4242 1 00000000aabbccdd 100 0 0 10 0\n"
+	synSentLine     = "   1: 0100007F:D1D0 0200007F:01BB 02 00000000:00000000 00:00000000 00000000  1000        0 4243 1 00000000aabbccde 100 0 0 10 0\n"
+	establishedLine = "   1: 0100007F:D1D0 0200007F:01BB 01 00000000:00000000 00:00000000 00000000  1000        0 4243 1 00000000aabbccde 100 0 0 10 0\n"
+	timeWaitLine    = "   1: 0100007F:D1D0 0200007F:01BB 06 00000000:00000000 03:000009CF 00000000     0        0 0 3 00000000aabbccdf\n"
+	ipv6Line        = "   0: 00000000000000000000000001000000:0016 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 4244 1 00000000aabbcce0 100 0 0 10 0\n"
+)
+
+func writeProc(t *testing.T, procPath string, tcpLines, tcp6Lines string) {
+	for file, lines := range map[string]string{"tcp": tcpLines, "tcp6": tcp6Lines} {
+		if err := ioutil.WriteFile(filepath.Join(procPath, "net", file), []byte(header+lines), 0644); err != nil {
+			t.Fatalf("writing %s: %v", file, err)
+		}
+	}
+}
+
+func newTestProc(t *testing.T, tcpLines, tcp6Lines string) string {
+	if snapshot.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("test data is for little-endian hosts")
+	}
+
+	procPath := t.TempDir()
+	if err := os.Mkdir(filepath.Join(procPath, "net"), 0755); err != nil {
+		t.Fatalf("creating net directory: %v", err)
+	}
+	writeProc(t, procPath, tcpLines, tcp6Lines)
+
+	return procPath
+}
+
+func TestLister(t *testing.T) {
+	procPath := newTestProc(t, listenLine+synSentLine+timeWaitLine, ipv6Line)
+
+	sockets, err := Lister(procPath)()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	expected := []*snapshot.Socket{
+		{
+			LocalIP:   net.ParseIP("127.0.0.1").To4(),
+			RemoteIP:  net.IPv4zero.To4(),
+			LocalPort: 8080,
+			State:     tcpstate.StateListen,
+			UID:       1000,
+			INode:     4242,
+			ID:        "00000000aabbccdd",
+		},
+		{
+			LocalIP:    net.ParseIP("127.0.0.1").To4(),
+			RemoteIP:   net.ParseIP("127.0.0.2").To4(),
+			LocalPort:  53712,
+			RemotePort: 443,
+			State:      tcpstate.StateSynSent,
+			UID:        1000,
+			INode:      4243,
+			ID:         "00000000aabbccde",
+		},
+		{
+			LocalIP:    net.ParseIP("127.0.0.1").To4(),
+			RemoteIP:   net.ParseIP("127.0.0.2").To4(),
+			LocalPort:  53712,
+			RemotePort: 443,
+			State:      tcpstate.StateTimeWait,
+			ID:         "00000000aabbccdf",
+		},
+		{
+			LocalIP:   net.IPv6loopback,
+			RemoteIP:  net.IPv6zero,
+			LocalPort: 22,
+			State:     tcpstate.StateListen,
+			INode:     4244,
+			ID:        "00000000aabbcce0",
+		},
+	}
+
+	if !reflect.DeepEqual(sockets, expected) {
+		t.Errorf("expected sockets:")
+		for _, s := range expected {
+			t.Errorf("  %+v", s)
+		}
+		t.Errorf("got:")
+		for _, s := range sockets {
+			t.Errorf("  %+v", s)
+		}
+	}
+}
+
+func TestListerMissingFile(t *testing.T) {
+	procPath := newTestProc(t, listenLine, "")
+	if err := os.Remove(filepath.Join(procPath, "net", "tcp6")); err != nil {
+		t.Fatalf("removing tcp6: %v", err)
+	}
+
+	sockets, err := Lister(procPath)()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(sockets) != 1 {
+		t.Errorf("expected 1 socket, got %d", len(sockets))
+	}
+}
+
+func TestListerParseError(t *testing.T) {
+	for _, line := range []string{
+		"   0: garbage\n",
+		strings.Replace(listenLine, " 0A ", " 0F ", 1),
+		strings.Replace(listenLine, " 1000 ", " root ", 1),
+	} {
+		procPath := newTestProc(t, line, "")
+
+		_, err := Lister(procPath)()
+		if err == nil {
+			t.Errorf("expected error for line %q, got nil", line)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestNewWithConfigEmitExisting(t *testing.T) {
+	procPath := newTestProc(t, listenLine, "")
+
+	eventer, err := NewWithConfig(map[string]string{ProcOption: procPath, EmitExistingOption: "true"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	defer eventer.(event.EventerCloser).Close()
+
+	e, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if e.SourcePort != 8080 || e.OldState != tcpstate.StateClosed || e.NewState != tcpstate.StateListen {
+		t.Errorf("unexpected event %v", e)
+	}
+
+	if e.CommandOnCPU != snapshot.PolledCommand {
+		t.Errorf("expected event to be marked as polled, got %v", e)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	if snapshot.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("test data is for little-endian hosts")
+	}
+
+	for address, expected := range map[string]string{
+		"0100007F:0050":                         "127.0.0.1:80",
+		"0000000000000000FFFF00000100007F:01BB": "127.0.0.1:443",
+		"B80D0120000000000000000001000000:0016": "[2001:db8::1]:22",
+	} {
+		ip, port, err := parseAddress(address)
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %v (of type %T)", address, err, err)
+			continue
+		}
+
+		if actual := (&net.TCPAddr{IP: ip, Port: int(port)}).String(); actual != expected {
+			t.Errorf("expected %s for %q, got %s", expected, address, actual)
+		}
+	}
+
+	for _, address := range []string{"0100007F", "0100007:0050", "0100007F:XYZ", "0100007F:10000"} {
+		_, _, err := parseAddress(address)
+		if err == nil {
+			t.Errorf("expected error for %q, got nil", address)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestNewWithConfigErrors(t *testing.T) {
+	for _, config := range []map[string]string{
+		{IntervalOption: "0s"},
+		{IntervalOption: "often"},
+		{EmitExistingOption: "maybe"},
+		{"period": "1s"},
+	} {
+		_, err := NewWithConfig(config)
+		if err == nil {
+			t.Errorf("expected error for options %v, got nil", config)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
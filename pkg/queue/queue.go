@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// Policy determines what happens when an event is put on a full queue.
+type Policy int
+
+const (
+	// Block waits until there is space in the queue.
+	Block Policy = iota
+	// DropNewest discards the event being put on the queue.
+	DropNewest
+	// DropOldest discards the event at the head of the queue to make space.
+	DropOldest
+)
+
+var policyNames = map[Policy]string{
+	Block:      "block",
+	DropNewest: "drop-newest",
+	DropOldest: "drop-oldest",
+}
+
+func (p Policy) String() string {
+	if name, ok := policyNames[p]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// ParsePolicy returns the policy with the given name.
+func ParsePolicy(name string) (Policy, error) {
+	for policy, policyName := range policyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// Queue is a bounded FIFO queue of events, with a policy determining what happens when
+// the queue is full. It is safe for one producer and one consumer to use concurrently.
+type Queue struct {
+	// Accessed atomically, so must be 64-bit aligned
+	droppedNewest uint64
+	droppedOldest uint64
+
+	events chan *event.Event
+	policy Policy
+}
+
+func New(size int, policy Policy) *Queue {
+	return &Queue{
+		events: make(chan *event.Event, size),
+		policy: policy,
+	}
+}
+
+// Put adds an event to the queue, applying the overflow policy if the queue is full.
+// It returns false if the policy is Block and the done channel was closed while
+// waiting for space in the queue.
+func (q *Queue) Put(e *event.Event, done <-chan struct{}) bool {
+	switch q.policy {
+	case DropNewest:
+		select {
+		case q.events <- e:
+		default:
+			atomic.AddUint64(&q.droppedNewest, 1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case q.events <- e:
+				return true
+			default:
+			}
+
+			// The consumer may have emptied the queue since the send was attempted,
+			// so the receive must not block
+			select {
+			case <-q.events:
+				atomic.AddUint64(&q.droppedOldest, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case q.events <- e:
+		case <-done:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Events returns the channel from which the consumer receives queued events.
+// The channel is closed, once drained, after the queue is closed.
+func (q *Queue) Events() <-chan *event.Event {
+	return q.events
+}
+
+// Close closes the queue. It must only be called by the producer, and Put must not
+// be called afterwards.
+func (q *Queue) Close() {
+	close(q.events)
+}
+
+// Len returns the number of events currently in the queue.
+func (q *Queue) Len() int {
+	return len(q.events)
+}
+
+// Cap returns the maximum number of events the queue can hold.
+func (q *Queue) Cap() int {
+	return cap(q.events)
+}
+
+// Policy returns the overflow policy of the queue.
+func (q *Queue) Policy() Policy {
+	return q.policy
+}
+
+// Dropped returns the number of events dropped by the given overflow policy.
+func (q *Queue) Dropped(policy Policy) uint64 {
+	switch policy {
+	case DropNewest:
+		return atomic.LoadUint64(&q.droppedNewest)
+	case DropOldest:
+		return atomic.LoadUint64(&q.droppedOldest)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{Block, DropNewest, DropOldest} {
+		parsed, err := ParsePolicy(policy.String())
+		if err != nil {
+			t.Errorf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		if parsed != policy {
+			t.Errorf("expected policy %v, got %v", policy, parsed)
+		}
+	}
+}
+
+func TestParsePolicyUnknownError(t *testing.T) {
+	_, err := ParsePolicy("drop-everything")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %v (of type %T)", err, err)
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	first, second := &event.Event{PIDOnCPU: 1}, &event.Event{PIDOnCPU: 2}
+	queue := New(1, DropNewest)
+
+	queue.Put(first, nil)
+	queue.Put(second, nil)
+
+	if dropped := queue.Dropped(DropNewest); dropped != 1 {
+		t.Errorf("expected 1 dropped event, got %d", dropped)
+	}
+
+	if e := <-queue.Events(); e != first {
+		t.Errorf("expected oldest event to be kept, got %v", e)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	first, second := &event.Event{PIDOnCPU: 1}, &event.Event{PIDOnCPU: 2}
+	queue := New(1, DropOldest)
+
+	queue.Put(first, nil)
+	queue.Put(second, nil)
+
+	if dropped := queue.Dropped(DropOldest); dropped != 1 {
+		t.Errorf("expected 1 dropped event, got %d", dropped)
+	}
+
+	if e := <-queue.Events(); e != second {
+		t.Errorf("expected newest event to be kept, got %v", e)
+	}
+}
+
+func TestQueueBlockUnblocksOnDone(t *testing.T) {
+	queue := New(1, Block)
+	done := make(chan struct{})
+
+	queue.Put(new(event.Event), done)
+	close(done)
+
+	if queue.Put(new(event.Event), done) {
+		t.Error("expected Put on full queue to return false when done, but returned true")
+	}
+
+	if queue.Len() != 1 {
+		t.Errorf("expected queue length 1, got %d", queue.Len())
+	}
+}
+
+func TestQueueCloseDrains(t *testing.T) {
+	queue := New(2, Block)
+	queue.Put(new(event.Event), nil)
+	queue.Put(new(event.Event), nil)
+	queue.Close()
+
+	count := 0
+	for range queue.Events() {
+		count++
+	}
+
+	if count != 2 {
+		t.Errorf("expected 2 events drained from closed queue, got %d", count)
+	}
+}
@@ -0,0 +1,95 @@
+package record
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// SinkFunc sinks a record, abandoning it once the context is done.
+type SinkFunc func(ctx context.Context, record interface{}) error
+
+// SinkerFunc returns a SinkFunc which sinks records of the kind to the sinker.
+func SinkerFunc(sinker Sinker, kind string) SinkFunc {
+	return func(ctx context.Context, record interface{}) error {
+		return Sink(ctx, sinker, kind, record)
+	}
+}
+
+// Dispatcher sinks records from a bounded queue in its own goroutine, so that a slow or
+// hung sinker does not hold up whatever produces the records. A record put on a full queue
+// is dropped, rather than waiting for space. If the timeout is positive, each record is
+// sunk with a context having it as the deadline.
+// Put may be called by several goroutines at once.
+type Dispatcher struct {
+	// Accessed atomically, so must be 64-bit aligned
+	dropped uint64
+
+	records chan interface{}
+	sink    SinkFunc
+	timeout time.Duration
+	onError func(record interface{}, err error)
+	stopped chan struct{}
+}
+
+// NewDispatcher starts a Dispatcher which queues up to size records, sinking each with the
+// sink func. The onError func is called, from the Dispatcher's goroutine, with each record
+// which fails to sink.
+func NewDispatcher(size int, timeout time.Duration, sink SinkFunc, onError func(record interface{}, err error)) *Dispatcher {
+	d := &Dispatcher{
+		records: make(chan interface{}, size),
+		sink:    sink,
+		timeout: timeout,
+		onError: onError,
+		stopped: make(chan struct{}),
+	}
+
+	go d.run()
+
+	return d
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.stopped)
+
+	for record := range d.records {
+		if err := d.sinkOne(record); err != nil {
+			d.onError(record, err)
+		}
+	}
+}
+
+func (d *Dispatcher) sinkOne(record interface{}) error {
+	ctx := context.Background()
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	return d.sink(ctx, record)
+}
+
+// Put queues the record to be sunk, returning false if the queue is full, so the record
+// was dropped.
+func (d *Dispatcher) Put(record interface{}) bool {
+	select {
+	case d.records <- record:
+		return true
+	default:
+		atomic.AddUint64(&d.dropped, 1)
+		return false
+	}
+}
+
+// Close waits for the queued records to be sunk, and then stops the Dispatcher. Put must
+// not be called afterwards.
+func (d *Dispatcher) Close() {
+	close(d.records)
+	<-d.stopped
+}
+
+// Dropped returns the number of records dropped as the queue was full.
+func (d *Dispatcher) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
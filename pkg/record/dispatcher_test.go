@@ -0,0 +1,75 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDispatcherSinks(t *testing.T) {
+	mockSinker := new(mockSinker)
+	var failed []interface{}
+	dispatcher := NewDispatcher(10, 0, SinkerFunc(mockSinker, "flow"), func(record interface{}, err error) {
+		failed = append(failed, record)
+	})
+
+	if !dispatcher.Put(42) {
+		t.Fatal("expected record to be queued, but was dropped")
+	}
+	dispatcher.Close()
+
+	if mockSinker.kind != "flow" || mockSinker.record != 42 {
+		t.Errorf("expected flow record 42 to be sunk, got %s record %v", mockSinker.kind, mockSinker.record)
+	}
+
+	if len(failed) != 0 {
+		t.Errorf("expected no records to fail, got %v", failed)
+	}
+}
+
+func TestDispatcherDropsWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	sink := func(ctx context.Context, record interface{}) error {
+		started <- struct{}{}
+		<-block
+		return nil
+	}
+	dispatcher := NewDispatcher(1, 0, sink, func(interface{}, error) {})
+
+	dispatcher.Put(1)
+	<-started // The first record is being sunk, so no longer queued
+	dispatcher.Put(2)
+
+	// The queue is full, so the record is dropped rather than the caller blocking
+	if dispatcher.Put(3) {
+		t.Error("expected record to be dropped, but was queued")
+	}
+
+	if dropped := dispatcher.Dropped(); dropped != 1 {
+		t.Errorf("expected 1 record dropped, got %d", dropped)
+	}
+
+	close(block)
+	dispatcher.Close()
+}
+
+func TestDispatcherTimeout(t *testing.T) {
+	mockSinker := new(mockContextSinker)
+	errChan := make(chan error, 1)
+	dispatcher := NewDispatcher(1, 10*time.Millisecond, SinkerFunc(mockSinker, "alert"), func(record interface{}, err error) {
+		errChan <- err
+	})
+	defer dispatcher.Close()
+
+	dispatcher.Put(42)
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected error chain to include %q, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected hung sink to be abandoned, but was not")
+	}
+}
@@ -0,0 +1,40 @@
+package record
+
+import (
+	"context"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+)
+
+// Sinker is an optional interface which sinkers implement if they can sink records other
+// than events, such as flow records, handshake results, alerts and dead-letter records.
+// The kind names what the record is, so that a sinker sinking several kinds can tell them
+// apart. Each record marshals to a JSON object whose fields, and their names, are stable,
+// so that the output can be consumed by other programs, and so that a sinker need know
+// nothing more about a record to sink it.
+// A plugin implements Sinker simply by having a SinkRecord method of this signature; it
+// need not import this package.
+type Sinker interface {
+	SinkRecord(kind string, record interface{}) error
+}
+
+// ContextSinker is an optional interface which record sinkers implement to accept a
+// context when sinking a record, as contextual.Sinker is for events.
+type ContextSinker interface {
+	SinkRecordContext(ctx context.Context, kind string, record interface{}) error
+}
+
+// AsSinker returns the sinker as a Sinker if it sinks records.
+func AsSinker(sinker sink.Sinker) (Sinker, bool) {
+	recordSinker, ok := sinker.(Sinker)
+	return recordSinker, ok
+}
+
+// Sink sinks the record to the sinker, with the context if the sinker accepts one.
+func Sink(ctx context.Context, sinker Sinker, kind string, record interface{}) error {
+	if contextSinker, ok := sinker.(ContextSinker); ok {
+		return contextSinker.SinkRecordContext(ctx, kind, record)
+	}
+
+	return sinker.SinkRecord(kind, record)
+}
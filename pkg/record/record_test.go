@@ -0,0 +1,52 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type mockSinker struct {
+	kind   string
+	record interface{}
+}
+
+func (ms *mockSinker) SinkRecord(kind string, record interface{}) error {
+	ms.kind, ms.record = kind, record
+	return nil
+}
+
+type mockContextSinker struct {
+	mockSinker
+}
+
+func (*mockContextSinker) SinkRecordContext(ctx context.Context, kind string, record interface{}) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestSinkWithoutContext(t *testing.T) {
+	mockSinker := new(mockSinker)
+	if err := Sink(context.Background(), mockSinker, "flow", 42); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mockSinker.kind != "flow" || mockSinker.record != 42 {
+		t.Errorf("expected flow record 42 to be sunk, got %s record %v", mockSinker.kind, mockSinker.record)
+	}
+}
+
+func TestSinkContextDeadline(t *testing.T) {
+	mockSinker := new(mockContextSinker)
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	err := Sink(ctx, mockSinker, "flow", 42)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error chain to include %q, got %v", context.DeadlineExceeded, err)
+	}
+
+	if mockSinker.record != nil {
+		t.Error("expected SinkRecord not to be called, but was")
+	}
+}
@@ -0,0 +1,200 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit/pkg/capture"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+)
+
+// The plugin options.
+const (
+	FileOption  = "file"
+	PaceOption  = "pace"
+	SpeedOption = "speed"
+)
+
+// ErrClosed is returned by Event once the Eventer has been closed.
+var ErrClosed = errors.New("eventer closed")
+
+// Options configure an Eventer.
+type Options struct {
+	Pace  bool    // Whether to keep to the original timing between events, rather than replay them as fast as possible
+	Speed float64 // How many times faster than the original timing to replay, when pacing
+}
+
+// Eventer is an event.Eventer which replays the events of a capture file, such as one
+// written by the --record flag, with their original times.
+// Once every event has been replayed, Event blocks until the context is done or the
+// Eventer is closed, as tcp-audit has no notion of an eventer finishing.
+// Event may be called concurrently with Close, but not with itself.
+type Eventer struct {
+	reader  *capture.Reader
+	path    string
+	options Options
+	after   func(time.Duration) <-chan time.Time
+	now     func() time.Time
+
+	pending   *event.Event // The event read but not yet returned
+	replayed  int
+	err       error     // The error which ended the replay, or io.EOF
+	first     time.Time // The time of the first event
+	started   time.Time // When the first event was replayed
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// New returns an Eventer which replays the capture file at the path as given by the
+// options.
+func New(path string, options Options) (*Eventer, error) {
+	if options.Pace && options.Speed <= 0 {
+		return nil, fmt.Errorf("speed %v must be positive", options.Speed)
+	}
+
+	reader, err := capture.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Eventer{
+		reader:  reader,
+		path:    path,
+		options: options,
+		after:   time.After,
+		now:     time.Now,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// NewWithConfig is the plugin constructor.
+func NewWithConfig(config map[string]string) (event.Eventer, error) {
+	c := pluginconfig.Config(config)
+	if err := c.CheckKeys(FileOption, PaceOption, SpeedOption); err != nil {
+		return nil, err
+	}
+
+	path := c[FileOption]
+	if path == "" {
+		return nil, fmt.Errorf("option %s is required", FileOption)
+	}
+
+	var options Options
+	var err error
+	if options.Pace, err = c.Bool(PaceOption, false); err != nil {
+		return nil, err
+	}
+
+	if options.Speed, err = c.Float64(SpeedOption, 1); err != nil {
+		return nil, err
+	}
+
+	if _, ok := c[SpeedOption]; ok && !options.Pace {
+		return nil, fmt.Errorf("option %s requires option %s", SpeedOption, PaceOption)
+	}
+
+	return New(path, options)
+}
+
+func (e *Eventer) Event() (*event.Event, error) {
+	return e.EventContext(context.Background())
+}
+
+// EventContext returns the next event of the capture file, having waited until it is due
+// if pacing. A corrupt record ends the replay, and its error is returned from then on.
+func (e *Eventer) EventContext(ctx context.Context) (*event.Event, error) {
+	if e.err == nil {
+		next, err := e.next()
+		if err == nil {
+			// An event whose wait is cut short is kept, to be returned by the next call
+			if err := e.wait(ctx, next.Time); err != nil {
+				return nil, err
+			}
+
+			e.pending = nil
+			e.replayed++
+			return next, nil
+		}
+
+		select {
+		case <-e.done:
+			return nil, ErrClosed
+		default:
+		}
+
+		e.err = err
+		if errors.Is(err, io.EOF) {
+			log.Printf("replayed %d events from %s, replay finished", e.replayed, e.path)
+		} else {
+			e.err = fmt.Errorf("replaying %s: %w", e.path, err)
+		}
+	}
+
+	if !errors.Is(e.err, io.EOF) {
+		return nil, e.err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-e.done:
+		return nil, ErrClosed
+	}
+}
+
+// Next returns the pending event, first reading it if there is none.
+func (e *Eventer) next() (*event.Event, error) {
+	if e.pending == nil {
+		var err error
+		if e.pending, err = e.reader.Read(); err != nil {
+			return nil, err
+		}
+	}
+
+	return e.pending, nil
+}
+
+// Wait waits until the event with the original time is due, if pacing. Events are due
+// relative to the first event, rather than the previous one, so that the time taken to
+// process them does not accumulate into drift.
+func (e *Eventer) wait(ctx context.Context, t time.Time) error {
+	if !e.options.Pace {
+		return nil
+	}
+
+	if e.started.IsZero() {
+		e.first, e.started = t, e.now()
+		return nil
+	}
+
+	offset := time.Duration(float64(t.Sub(e.first)) / e.options.Speed)
+	delay := e.started.Add(offset).Sub(e.now())
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-e.after(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.done:
+		return ErrClosed
+	}
+}
+
+func (e *Eventer) Close() error {
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.done)
+		err = e.reader.Close()
+	})
+
+	return err
+}
@@ -0,0 +1,247 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/capture"
+)
+
+var _ event.EventerCloser = new(Eventer)
+
+var start = time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// WriteCapture writes a capture file of events at the offsets from the start.
+func writeCapture(t *testing.T, offsets ...time.Duration) string {
+	path := filepath.Join(t.TempDir(), "events.cap")
+	writer, err := capture.Create(path)
+	if err != nil {
+		t.Fatalf("creating capture file: %v", err)
+	}
+
+	for i, offset := range offsets {
+		writer.Write(&event.Event{
+			Time:         start.Add(offset),
+			CommandOnCPU: "curl",
+			SourceIP:     net.ParseIP("10.0.0.1"),
+			SourcePort:   uint16(50000 + i),
+			DestIP:       net.ParseIP("10.0.0.2"),
+			DestPort:     443,
+			OldState:     tcpstate.StateClosed,
+			NewState:     tcpstate.StateSynSent,
+		})
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("closing capture file: %v", err)
+	}
+
+	return path
+}
+
+// MockClock records the waits of an Eventer, advancing its time by each wait rather than
+// sleeping.
+type mockClock struct {
+	now   time.Time
+	waits []time.Duration
+}
+
+func (mc *mockClock) after(d time.Duration) <-chan time.Time {
+	mc.waits = append(mc.waits, d)
+	mc.now = mc.now.Add(d)
+
+	c := make(chan time.Time, 1)
+	c <- mc.now
+	return c
+}
+
+func newTestEventer(t *testing.T, path string, options Options) (*Eventer, *mockClock) {
+	eventer, err := New(path, options)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	clock := &mockClock{now: time.Now()}
+	eventer.after = clock.after
+	eventer.now = func() time.Time { return clock.now }
+
+	return eventer, clock
+}
+
+func replayAll(t *testing.T, eventer *Eventer, n int) []*event.Event {
+	var events []*event.Event
+	for i := 0; i < n; i++ {
+		e, err := eventer.Event()
+		if err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+		events = append(events, e)
+	}
+
+	return events
+}
+
+func TestEventerAsFastAsPossible(t *testing.T) {
+	eventer, clock := newTestEventer(t, writeCapture(t, 0, time.Minute, 2*time.Minute), Options{})
+	defer eventer.Close()
+
+	events := replayAll(t, eventer, 3)
+	for i, e := range events {
+		if e.SourcePort != uint16(50000+i) {
+			t.Errorf("expected event %d to have source port %d, got %v", i, 50000+i, e)
+		}
+	}
+
+	if !events[1].Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected original time to be kept, got %v", events[1].Time)
+	}
+
+	if len(clock.waits) != 0 {
+		t.Errorf("expected no waits, got %v", clock.waits)
+	}
+}
+
+func TestEventerPaced(t *testing.T) {
+	eventer, clock := newTestEventer(t, writeCapture(t, 0, time.Second, 3*time.Second, 3*time.Second),
+		Options{Pace: true, Speed: 2})
+	defer eventer.Close()
+
+	replayAll(t, eventer, 4)
+
+	expected := []time.Duration{500 * time.Millisecond, time.Second}
+	if len(clock.waits) != len(expected) || clock.waits[0] != expected[0] || clock.waits[1] != expected[1] {
+		t.Errorf("expected waits %v, got %v", expected, clock.waits)
+	}
+}
+
+func TestEventerPacedDoesNotDrift(t *testing.T) {
+	eventer, clock := newTestEventer(t, writeCapture(t, 0, time.Second, 2*time.Second),
+		Options{Pace: true, Speed: 1})
+	defer eventer.Close()
+
+	replayAll(t, eventer, 2)
+
+	// The sinkers take a while with the second event, so the third is due sooner
+	clock.now = clock.now.Add(300 * time.Millisecond)
+	replayAll(t, eventer, 1)
+
+	if clock.waits[len(clock.waits)-1] != 700*time.Millisecond {
+		t.Errorf("expected last wait of 700ms, got %v", clock.waits)
+	}
+}
+
+func TestEventerPacedContextDone(t *testing.T) {
+	eventer, clock := newTestEventer(t, writeCapture(t, 0, time.Second), Options{Pace: true, Speed: 1})
+	defer eventer.Close()
+	eventer.after = func(time.Duration) <-chan time.Time { return nil }
+
+	replayAll(t, eventer, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := eventer.EventContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context cancelled error, got %v (of type %T)", err, err)
+	}
+
+	// The event cut short is not lost
+	eventer.after = clock.after
+	e, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if e.SourcePort != 50001 {
+		t.Errorf("expected second event, got %v", e)
+	}
+}
+
+func TestEventerFinished(t *testing.T) {
+	eventer, _ := newTestEventer(t, writeCapture(t, 0), Options{})
+	replayAll(t, eventer, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := eventer.EventContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected replay to block once finished, got %v (of type %T)", err, err)
+	}
+
+	errChan := make(chan error)
+	go func() {
+		_, err := eventer.Event()
+		errChan <- err
+	}()
+
+	if err := eventer.Close(); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("expected ErrClosed, got %v (of type %T)", err, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event did not return after Close")
+	}
+}
+
+func TestEventerCorrupt(t *testing.T) {
+	path := writeCapture(t, 0, time.Second)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat capture file: %v", err)
+	}
+
+	if err := os.Truncate(path, info.Size()-4); err != nil {
+		t.Fatalf("truncating capture file: %v", err)
+	}
+
+	eventer, _ := newTestEventer(t, path, Options{})
+	defer eventer.Close()
+	replayAll(t, eventer, 1)
+
+	// The error is sticky, rather than the replay continuing from a corrupt record
+	for i := 0; i < 2; i++ {
+		_, err := eventer.Event()
+		if !errors.Is(err, capture.ErrCorrupt) {
+			t.Fatalf("expected ErrCorrupt, got %v (of type %T)", err, err)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestNewWithConfigErrors(t *testing.T) {
+	path := writeCapture(t, 0)
+	notCapture := filepath.Join(t.TempDir(), "events.jsonl")
+	if err := ioutil.WriteFile(notCapture, []byte("{}\n"), 0600); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+
+	for _, config := range []map[string]string{
+		{},
+		{FileOption: filepath.Join(t.TempDir(), "missing.cap")},
+		{FileOption: notCapture},
+		{FileOption: path, PaceOption: "maybe"},
+		{FileOption: path, PaceOption: "true", SpeedOption: "fast"},
+		{FileOption: path, PaceOption: "true", SpeedOption: "0"},
+		{FileOption: path, SpeedOption: "2"},
+		{FileOption: path, "loop": "true"},
+	} {
+		_, err := NewWithConfig(config)
+		if err == nil {
+			t.Errorf("expected error for options %v, got nil", config)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
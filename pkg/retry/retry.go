@@ -0,0 +1,141 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// PermanentError is an optional interface which errors returned by plugins may implement
+// to indicate that retrying the operation cannot succeed, so should not be attempted.
+type PermanentError interface {
+	error
+	Permanent() bool
+}
+
+type permanentError struct {
+	err error
+}
+
+func (pe *permanentError) Error() string {
+	return pe.err.Error()
+}
+
+func (pe *permanentError) Unwrap() error {
+	return pe.err
+}
+
+func (*permanentError) Permanent() bool {
+	return true
+}
+
+// Permanent wraps the error so that it is reported as permanent by IsPermanent.
+// It is intended for use by plugins which do not wish to define their own error types.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err}
+}
+
+// IsPermanent returns true if any error in the chain implements PermanentError and
+// reports itself as permanent.
+func IsPermanent(err error) bool {
+	var permanentErr PermanentError
+	return errors.As(err, &permanentErr) && permanentErr.Permanent()
+}
+
+// Policy determines how many times an operation is attempted and how long to wait
+// between attempts.
+// The wait doubles after each attempt, starting at InitialBackoff and capped at MaxBackoff.
+// Jitter is the fraction, between 0 and 1, by which each wait is randomly varied either way
+// so that many retrying clients do not synchronise.
+type Policy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+}
+
+// Validate checks the policy is usable.
+func (p Policy) Validate() error {
+	switch {
+	case p.MaxAttempts < 1:
+		return errors.New("maximum attempts must be at least 1")
+	case p.InitialBackoff < 0:
+		return errors.New("initial backoff must not be negative")
+	case p.MaxBackoff < p.InitialBackoff:
+		return errors.New("maximum backoff must not be less than initial backoff")
+	case p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("jitter %v not between 0 and 1", p.Jitter)
+	}
+
+	return nil
+}
+
+// Backoff returns the time to wait after the given (1-based) failed attempt.
+func (p Policy) Backoff(attempt int, rnd *rand.Rand) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if p.Jitter > 0 && rnd != nil {
+		backoff = time.Duration(float64(backoff) * (1 + p.Jitter*(2*rnd.Float64()-1)))
+	}
+
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	return backoff
+}
+
+// ErrCancelled is returned by Do if the done channel is closed while waiting to retry.
+var ErrCancelled = errors.New("retry cancelled")
+
+// CancelledError is the last error of an operation whose retries were cancelled. It is
+// ErrCancelled, as reported by errors.Is, and unwraps to the last error, so that the
+// cause can still be inspected.
+type CancelledError struct {
+	Err error
+}
+
+func (ce *CancelledError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrCancelled, ce.Err)
+}
+
+func (ce *CancelledError) Is(target error) bool {
+	return target == ErrCancelled
+}
+
+func (ce *CancelledError) Unwrap() error {
+	return ce.Err
+}
+
+// Do calls op until it succeeds, returns a permanent error or the maximum number of attempts
+// is reached, waiting between attempts according to the policy. If the done channel is
+// closed while waiting, Do stops immediately, returning the last error from op wrapped
+// in a CancelledError. The number of attempts made is returned along with the last error.
+func Do(policy Policy, rnd *rand.Rand, done <-chan struct{}, op func() error) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return attempt, nil
+		}
+
+		if attempt >= policy.MaxAttempts || IsPermanent(err) {
+			return attempt, err
+		}
+
+		timer := time.NewTimer(policy.Backoff(attempt, rnd))
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return attempt, &CancelledError{err}
+		}
+	}
+}
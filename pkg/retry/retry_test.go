@@ -0,0 +1,154 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	policy := Policy{
+		MaxAttempts:    10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, expectedBackoff := range expected {
+		if backoff := policy.Backoff(i+1, nil); backoff != expectedBackoff {
+			t.Errorf("expected backoff %v after attempt %d, got %v", expectedBackoff, i+1, backoff)
+		}
+	}
+}
+
+func TestBackoffJitterWithinBounds(t *testing.T) {
+	policy := Policy{
+		MaxAttempts:    10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		Jitter:         0.5,
+	}
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(1, rnd)
+		if backoff < 500*time.Millisecond || backoff > 1500*time.Millisecond {
+			t.Errorf("expected backoff within 50%% of 1s, got %v", backoff)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	policies := []Policy{
+		{MaxAttempts: 0},
+		{MaxAttempts: 1, InitialBackoff: time.Second, MaxBackoff: time.Millisecond},
+		{MaxAttempts: 1, Jitter: 1.5},
+	}
+
+	for _, policy := range policies {
+		err := policy.Validate()
+		if err == nil {
+			t.Errorf("expected error for policy %+v, got nil", policy)
+		}
+
+		t.Logf("got error %v (of type %T)", err, err)
+	}
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	policy := Policy{MaxAttempts: 3}
+	calls := 0
+
+	attempts, err := Do(policy, nil, nil, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("mock error")
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestDoStopsAtMaxAttempts(t *testing.T) {
+	policy := Policy{MaxAttempts: 3}
+	mockErr := errors.New("mock error")
+
+	attempts, err := Do(policy, nil, nil, func() error {
+		return mockErr
+	})
+	if !errors.Is(err, mockErr) {
+		t.Errorf("expected error chain to include %q, got %v", mockErr, err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestDoDoesNotRetryPermanentError(t *testing.T) {
+	policy := Policy{MaxAttempts: 3}
+	mockErr := Permanent(errors.New("mock permanent error"))
+
+	attempts, err := Do(policy, nil, nil, func() error {
+		return mockErr
+	})
+	if !IsPermanent(err) {
+		t.Errorf("expected permanent error, got %v", err)
+	}
+
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestDoCancelledByDone(t *testing.T) {
+	policy := Policy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Hour,
+		MaxBackoff:     time.Hour,
+	}
+	done := make(chan struct{})
+	close(done)
+
+	mockErr := errors.New("mock error")
+	attempts, err := Do(policy, nil, done, func() error {
+		return mockErr
+	})
+	if !errors.Is(err, ErrCancelled) {
+		t.Errorf("expected error chain to include %q, got %v", ErrCancelled, err)
+	}
+
+	if !errors.Is(err, mockErr) {
+		t.Errorf("expected error chain to include %q, got %v", mockErr, err)
+	}
+
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestCancelledErrorUnwraps(t *testing.T) {
+	err := error(&CancelledError{Permanent(context.DeadlineExceeded)})
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, ErrCancelled) {
+		t.Errorf("expected error chain to include %q, got %v", ErrCancelled, err)
+	}
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error chain to include %q, got %v", context.DeadlineExceeded, err)
+	}
+
+	if !IsPermanent(err) {
+		t.Error("expected error to be permanent, but was not")
+	}
+}
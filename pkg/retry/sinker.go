@@ -0,0 +1,167 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/batch"
+	"github.com/jhwbarlow/tcp-audit/pkg/contextual"
+)
+
+// Sinker is a sink.Sinker which retries failed sinks of an event according to a Policy.
+// Errors which are permanent are not retried.
+// By registering a done channel, the caller can abandon any wait between attempts.
+// A Sinker is not safe for concurrent use.
+type Sinker struct {
+	sinker sink.Sinker
+	policy Policy
+	rnd    *rand.Rand
+	done   <-chan struct{}
+}
+
+func NewSinker(sinker sink.Sinker, policy Policy) *Sinker {
+	return &Sinker{
+		sinker: sinker,
+		policy: policy,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// RegisterDoneChannel registers a done channel. Closing the channel abandons any wait
+// between attempts, so that shutdown is not delayed by retries.
+func (s *Sinker) RegisterDoneChannel(done <-chan struct{}) {
+	s.done = done
+}
+
+func (s *Sinker) Sink(e *event.Event) error {
+	return s.SinkContext(context.Background(), e)
+}
+
+// SinkContext sinks the event, passing the context on to the wrapped sinker if it accepts
+// one. Once the context is done, any wait between attempts is abandoned, as it is when the
+// done channel is closed.
+func (s *Sinker) SinkContext(ctx context.Context, e *event.Event) error {
+	done, stop := s.doneOrCancelled(ctx)
+	defer stop()
+
+	attempts, err := Do(s.policy, s.rnd, done, func() error {
+		return contextual.Sink(ctx, s.sinker, e)
+	})
+	if err != nil && attempts > 1 {
+		return &AttemptsError{err, attempts}
+	}
+
+	return err
+}
+
+// DoneOrCancelled returns a channel which is closed when either the done channel is closed
+// or the context is done. The returned function must be called to release the goroutine
+// which watches them.
+func (s *Sinker) doneOrCancelled(ctx context.Context) (<-chan struct{}, func()) {
+	if ctx.Done() == nil {
+		return s.done, func() {}
+	}
+
+	if s.done == nil {
+		return ctx.Done(), func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx.Done(), cancel
+}
+
+// SinksBatches reports whether the wrapped sinker sinks batches.
+func (s *Sinker) SinksBatches() bool {
+	_, ok := batch.AsSinker(s.sinker)
+	return ok
+}
+
+// SinkBatch sinks the events as a batch. Each attempt after the first sinks, as a smaller
+// batch, only the events which failed with an error that is not permanent.
+func (s *Sinker) SinkBatch(events []*event.Event) error {
+	return s.SinkBatchContext(context.Background(), events)
+}
+
+// SinkBatchContext sinks the events as SinkBatch does, passing the context on to the
+// wrapped sinker if it accepts one. Once the context is done, any wait between attempts is
+// abandoned.
+func (s *Sinker) SinkBatchContext(ctx context.Context, events []*event.Event) error {
+	done, stop := s.doneOrCancelled(ctx)
+	defer stop()
+
+	errs := make([]error, len(events))
+	eventAttempts := make([]int, len(events))
+	pending := make([]int, len(events)) // Indices of the events still to be sunk
+	for i := range pending {
+		pending[i] = i
+	}
+
+	attempt := 0
+	_, err := Do(s.policy, s.rnd, done, func() error {
+		attempt++
+		pendingEvents := make([]*event.Event, len(pending))
+		for j, i := range pending {
+			pendingEvents[j] = events[i]
+		}
+
+		pendingErrs := batch.EventErrors(batch.SinkContext(ctx, s.sinker, pendingEvents), len(pending))
+		failed := pending[:0]
+		for j, i := range pending {
+			errs[i] = pendingErrs[j]
+			eventAttempts[i] = attempt
+			if errs[i] != nil && !IsPermanent(errs[i]) {
+				failed = append(failed, i)
+			}
+		}
+		pending = failed
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		return errs[pending[0]]
+	})
+
+	for i := range errs {
+		if errs[i] == nil {
+			continue
+		}
+
+		if errors.Is(err, ErrCancelled) && eventAttempts[i] == attempt {
+			errs[i] = &CancelledError{errs[i]}
+		}
+
+		if eventAttempts[i] > 1 {
+			errs[i] = &AttemptsError{errs[i], eventAttempts[i]}
+		}
+	}
+
+	return batch.NewError(errs)
+}
+
+// AttemptsError records the number of attempts made before an operation failed.
+type AttemptsError struct {
+	Err      error
+	Attempts int
+}
+
+func (ae *AttemptsError) Error() string {
+	return fmt.Sprintf("after %d attempts: %v", ae.Attempts, ae.Err)
+}
+
+func (ae *AttemptsError) Unwrap() error {
+	return ae.Err
+}
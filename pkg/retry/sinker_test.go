@@ -0,0 +1,182 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit/pkg/batch"
+)
+
+type mockSinker struct {
+	errsToReturn []error
+	calls        int
+}
+
+func (ms *mockSinker) Sink(*event.Event) error {
+	ms.calls++
+	if len(ms.errsToReturn) == 0 {
+		return nil
+	}
+
+	err := ms.errsToReturn[0]
+	ms.errsToReturn = ms.errsToReturn[1:]
+	return err
+}
+
+func TestSinkerRetries(t *testing.T) {
+	mockSinker := &mockSinker{errsToReturn: []error{errors.New("mock sinker error")}}
+	sinker := NewSinker(mockSinker, Policy{MaxAttempts: 2})
+
+	if err := sinker.Sink(new(event.Event)); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mockSinker.calls != 2 {
+		t.Errorf("expected 2 calls to sinker, got %d", mockSinker.calls)
+	}
+}
+
+func TestSinkerReportsAttempts(t *testing.T) {
+	mockErr := errors.New("mock sinker error")
+	mockSinker := &mockSinker{errsToReturn: []error{mockErr, mockErr}}
+	sinker := NewSinker(mockSinker, Policy{MaxAttempts: 2})
+
+	err := sinker.Sink(new(event.Event))
+	if !errors.Is(err, mockErr) {
+		t.Errorf("expected error chain to include %q, got %v", mockErr, err)
+	}
+
+	var attemptsErr *AttemptsError
+	if !errors.As(err, &attemptsErr) || attemptsErr.Attempts != 2 {
+		t.Errorf("expected AttemptsError with 2 attempts, got %v (of type %T)", err, err)
+	}
+}
+
+// mockBatchSinker fails, on their first attempt, the events whose PIDOnCPU is in failOnce,
+// and always fails those in failAlways, with a permanent error.
+type mockBatchSinker struct {
+	mockSinker
+	failOnce   map[int]bool
+	failAlways map[int]bool
+	batches    [][]*event.Event
+}
+
+func (mbs *mockBatchSinker) SinkBatch(events []*event.Event) error {
+	mbs.batches = append(mbs.batches, events)
+
+	errs := make([]error, len(events))
+	for i, e := range events {
+		switch {
+		case mbs.failAlways[e.PIDOnCPU]:
+			errs[i] = Permanent(errors.New("mock permanent error"))
+		case mbs.failOnce[e.PIDOnCPU]:
+			errs[i] = errors.New("mock sinker error")
+			delete(mbs.failOnce, e.PIDOnCPU)
+		}
+	}
+
+	return batch.NewError(errs)
+}
+
+func TestSinkerRetriesFailedEventsOfBatch(t *testing.T) {
+	mockBatchSinker := &mockBatchSinker{
+		failOnce:   map[int]bool{2: true},
+		failAlways: map[int]bool{3: true},
+	}
+	sinker := NewSinker(mockBatchSinker, Policy{MaxAttempts: 3})
+
+	if !sinker.SinksBatches() {
+		t.Fatal("expected sinker to sink batches, but does not")
+	}
+
+	events := []*event.Event{{PIDOnCPU: 1}, {PIDOnCPU: 2}, {PIDOnCPU: 3}}
+	errs := batch.EventErrors(sinker.SinkBatch(events), len(events))
+
+	if errs[0] != nil || errs[1] != nil {
+		t.Errorf("expected first and second events to be sunk, got errors %v", errs)
+	}
+
+	if !IsPermanent(errs[2]) {
+		t.Errorf("expected permanent error for third event, got %v (of type %T)", errs[2], errs[2])
+	}
+
+	if len(mockBatchSinker.batches) != 2 || len(mockBatchSinker.batches[1]) != 1 {
+		t.Errorf("expected only the second event to be retried, got batches %v", mockBatchSinker.batches)
+	}
+}
+
+func TestSinkerBatchContextCancelsWait(t *testing.T) {
+	mockBatchSinker := &mockBatchSinker{failOnce: map[int]bool{1: true}}
+	sinker := NewSinker(mockBatchSinker, Policy{MaxAttempts: 2, InitialBackoff: time.Hour, MaxBackoff: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	errs := batch.EventErrors(sinker.SinkBatchContext(ctx, []*event.Event{{PIDOnCPU: 1}}), 1)
+	if !errors.Is(errs[0], ErrCancelled) {
+		t.Errorf("expected error chain to include %q, got %v", ErrCancelled, errs[0])
+	}
+
+	if len(mockBatchSinker.batches) != 1 {
+		t.Errorf("expected 1 batch to be sunk, got %d", len(mockBatchSinker.batches))
+	}
+}
+
+func TestSinkerDoesNotSinkBatchesForSingleSinker(t *testing.T) {
+	sinker := NewSinker(new(mockSinker), Policy{MaxAttempts: 2})
+
+	if sinker.SinksBatches() {
+		t.Error("expected sinker not to sink batches, but does")
+	}
+}
+
+type mockContextSinker struct {
+	mockSinker
+	ctx context.Context
+}
+
+func (mcs *mockContextSinker) SinkContext(ctx context.Context, e *event.Event) error {
+	mcs.ctx = ctx
+	return mcs.Sink(e)
+}
+
+func TestSinkerContextPassedOn(t *testing.T) {
+	mockContextSinker := new(mockContextSinker)
+	sinker := NewSinker(mockContextSinker, Policy{MaxAttempts: 2})
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	if err := sinker.SinkContext(ctx, new(event.Event)); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mockContextSinker.ctx == nil || mockContextSinker.ctx.Value(ctxKey{}) != true {
+		t.Error("expected context to be passed on to sinker, but was not")
+	}
+}
+
+func TestSinkerContextCancelsWait(t *testing.T) {
+	mockErr := errors.New("mock sinker error")
+	mockSinker := &mockSinker{errsToReturn: []error{mockErr}}
+	sinker := NewSinker(mockSinker, Policy{MaxAttempts: 2, InitialBackoff: time.Hour, MaxBackoff: time.Hour})
+	sinker.RegisterDoneChannel(make(chan struct{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := sinker.SinkContext(ctx, new(event.Event))
+	if !errors.Is(err, ErrCancelled) {
+		t.Errorf("expected error chain to include %q, got %v", ErrCancelled, err)
+	}
+
+	if !errors.Is(err, mockErr) {
+		t.Errorf("expected error chain to include %q, got %v", mockErr, err)
+	}
+
+	if mockSinker.calls != 1 {
+		t.Errorf("expected 1 call to sinker, got %d", mockSinker.calls)
+	}
+}
@@ -0,0 +1,731 @@
+package rotate
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/batch"
+	"github.com/jhwbarlow/tcp-audit/pkg/jsonl"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The plugin options.
+const (
+	FileOption          = "file"
+	MaxBytesOption      = "max-bytes"
+	IntervalOption      = "interval"
+	CompressOption      = "compress"
+	MaxAgeOption        = "max-age"
+	MaxTotalBytesOption = "max-total-bytes"
+)
+
+const (
+	defaultMaxBytes = 100 << 20
+
+	// The longest the Sinker waits between checks of whether the active file is due to be
+	// rotated by its age, or rotated segments are due to be removed by theirs, when no
+	// events are written
+	maxTickWait = time.Minute
+
+	gzipSuffix     = ".gz"
+	zstdSuffix     = ".zst"
+	tmpSuffix      = ".tmp"
+	segmentTimeFmt = "20060102T150405.000000000Z"
+)
+
+// Maintenance of the segments of a file is serialised across Sinkers, as a reload briefly
+// has two Sinkers, the old and the new, writing to the same file.
+var maintenanceLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex // By absolute path of the active file
+}{locks: make(map[string]*sync.Mutex)}
+
+// MaintenanceLock returns the lock of the segments of the active file at the path.
+func maintenanceLock(path string) *sync.Mutex {
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+	}
+
+	maintenanceLocks.Lock()
+	defer maintenanceLocks.Unlock()
+
+	lock, ok := maintenanceLocks.locks[path]
+	if !ok {
+		lock = new(sync.Mutex)
+		maintenanceLocks.locks[path] = lock
+	}
+
+	return lock
+}
+
+// Compression is the compression applied to rotated segments.
+type Compression int
+
+const (
+	None Compression = iota
+	Gzip
+	Zstd
+)
+
+// ParseCompression parses the name of a compression, as returned by String.
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "none":
+		return None, nil
+	case "gzip":
+		return Gzip, nil
+	case "zstd":
+		return Zstd, nil
+	default:
+		return None, fmt.Errorf("unknown compression %q (expected none, gzip or zstd)", s)
+	}
+}
+
+func (c Compression) String() string {
+	switch c {
+	case None:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("Compression(%d)", int(c))
+	}
+}
+
+// Suffix returns the suffix of the name of a segment with the compression.
+func (c Compression) suffix() string {
+	switch c {
+	case Gzip:
+		return gzipSuffix
+	case Zstd:
+		return zstdSuffix
+	default:
+		return ""
+	}
+}
+
+// Compressed reports whether the segment has been compressed, with any compression, so
+// that changing the compression does not compress segments again.
+func compressed(path string) bool {
+	return strings.HasSuffix(path, gzipSuffix) || strings.HasSuffix(path, zstdSuffix)
+}
+
+// Options configure a Sinker. A zero limit disables it.
+type Options struct {
+	Path          string        // The active file. Rotated segments are kept beside it.
+	MaxBytes      int64         // Size at which the active file is rotated
+	Interval      time.Duration // Age at which the active file is rotated
+	Compression   Compression   // Compression of rotated segments
+	MaxAge        time.Duration // Age at which rotated segments are removed
+	MaxTotalBytes int64         // Total size of rotated segments above which the oldest are removed
+}
+
+// Sinker is a sink.Sinker which writes events as JSON Lines to a file, rotating it when it
+// reaches a maximum size or age. Rotated segments are named after the file and the time of
+// rotation, compressed, and removed once they are too old or take up too much space.
+// Compression and removal happen in the background, so do not hold up sinking. If the file
+// is rotated by age, or segments are removed by age, a timer does so even when no events
+// are written.
+// Segments left uncompressed by a previous run are compressed when the Sinker is created.
+// Events are buffered and flushed at the end of each Sink or SinkBatch call. Close flushes
+// and closes the active file, once any background work has finished.
+// The methods are safe for concurrent use, so that Reopen can be called at any time.
+type Sinker struct {
+	options Options
+	now     func() time.Time
+
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	opened time.Time
+	closed bool
+
+	maintainChan chan struct{} // Buffered, so that requests for maintenance coalesce
+	maintainDone chan struct{}
+	tickStop     chan struct{}
+	tickDone     chan struct{}
+}
+
+// New returns a Sinker which writes to the file at options.Path, creating it if it does
+// not exist and appending to it if it does.
+func New(options Options) (*Sinker, error) {
+	if options.Path == "" {
+		return nil, errors.New("file path not given")
+	}
+
+	s := &Sinker{
+		options:      options,
+		now:          time.Now,
+		maintainChan: make(chan struct{}, 1),
+		maintainDone: make(chan struct{}),
+		tickStop:     make(chan struct{}),
+		tickDone:     make(chan struct{}),
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	go s.maintainLoop()
+	s.maintain() // Finish the work of a previous run, which may have stopped part-way
+
+	if options.Interval > 0 || options.MaxAge > 0 {
+		go s.tickLoop()
+	} else {
+		close(s.tickDone)
+	}
+
+	return s, nil
+}
+
+// NewWithConfig is the plugin constructor. The file option is required; by default,
+// files are rotated at 100MiB and rotated segments are gzipped and kept indefinitely.
+func NewWithConfig(config map[string]string) (sink.Sinker, error) {
+	c := pluginconfig.Config(config)
+	if err := c.CheckKeys(FileOption,
+		MaxBytesOption,
+		IntervalOption,
+		CompressOption,
+		MaxAgeOption,
+		MaxTotalBytesOption); err != nil {
+		return nil, err
+	}
+
+	options := Options{Path: c[FileOption], Compression: Gzip}
+	var err error
+	if options.MaxBytes, err = c.Int64(MaxBytesOption, defaultMaxBytes); err != nil {
+		return nil, err
+	}
+
+	if options.Interval, err = c.Duration(IntervalOption, 0); err != nil {
+		return nil, err
+	}
+
+	if compression, ok := c[CompressOption]; ok {
+		if options.Compression, err = ParseCompression(compression); err != nil {
+			return nil, fmt.Errorf("option %s: %w", CompressOption, err)
+		}
+	}
+
+	if options.MaxAge, err = c.Duration(MaxAgeOption, 0); err != nil {
+		return nil, err
+	}
+
+	if options.MaxTotalBytes, err = c.Int64(MaxTotalBytesOption, 0); err != nil {
+		return nil, err
+	}
+
+	return New(options)
+}
+
+func (s *Sinker) Sink(e *event.Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.write(e); err != nil {
+		return err
+	}
+
+	return s.flush()
+}
+
+// SinkBatch writes the events, flushing them once at the end of the batch. If writing an
+// event fails, neither it nor those after it are written.
+func (s *Sinker) SinkBatch(events []*event.Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	errs := make([]error, len(events))
+	for i, e := range events {
+		if err := s.write(e); err != nil {
+			for j := i; j < len(events); j++ {
+				errs[j] = err
+			}
+			break
+		}
+	}
+
+	if err := s.flush(); err != nil {
+		return err // The buffered events may not have been written, so all are failed
+	}
+
+	return batch.NewError(errs)
+}
+
+// SinkRecord writes the record as a line, so that a Sinker may be used to sink records,
+// such as flow records and alerts, as well as events.
+func (s *Sinker) SinkRecord(kind string, record interface{}) error {
+	return s.sinkLine(record, kind+" record")
+}
+
+// SinkLine writes the value, other than an event, as a line of JSON, flushing it straight
+// away. The description of the value is used in errors.
+func (s *Sinker) sinkLine(value interface{}, description string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	line, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", description, err)
+	}
+
+	if err := s.writeLine(line); err != nil {
+		return fmt.Errorf("writing %s: %w", description, err)
+	}
+
+	return s.flush()
+}
+
+// Reopen flushes and closes the active file and opens the file at the path again, without
+// rotating it. It allows an external tool, such as logrotate, to move the file away.
+func (s *Sinker) Reopen() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return errors.New("sinker closed")
+	}
+
+	if err := s.closeFile(); err != nil {
+		log.Printf("Warning: closing events file before reopening: %v", err)
+	}
+
+	return s.open()
+}
+
+// Close flushes and closes the active file, after waiting for any compression or removal
+// of rotated segments to finish.
+func (s *Sinker) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.closeFile()
+	s.mutex.Unlock()
+
+	close(s.tickStop)
+	<-s.tickDone
+	close(s.maintainChan)
+	<-s.maintainDone
+
+	return err
+}
+
+// Write writes the event to the active file. The mutex must be held.
+func (s *Sinker) write(e *event.Event) error {
+	line, err := json.Marshal(jsonl.NewRecord(e))
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+
+	if err := s.writeLine(line); err != nil {
+		return fmt.Errorf("writing event: %w", err)
+	}
+
+	return nil
+}
+
+// WriteLine writes the line, without its newline, to the active file, first rotating it
+// if it has reached either limit. The mutex must be held.
+func (s *Sinker) writeLine(line []byte) error {
+	if s.closed {
+		return errors.New("sinker closed")
+	}
+	line = append(line, '\n')
+
+	if s.file == nil {
+		// A previous rotation failed to open the new file, so try again
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if s.rotationDue(int64(len(line))) {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("rotating events file: %w", err)
+		}
+	}
+
+	n, err := s.writer.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *Sinker) flush() error {
+	if s.writer == nil {
+		return nil
+	}
+
+	if err := s.writer.Flush(); err != nil {
+		return fmt.Errorf("flushing events file: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Sinker) rotationDue(lineLen int64) bool {
+	if s.size == 0 {
+		return false // Never rotate an empty file, even if a single event exceeds the limit
+	}
+
+	if s.options.MaxBytes > 0 && s.size+lineLen > s.options.MaxBytes {
+		return true
+	}
+
+	return s.options.Interval > 0 && s.now().Sub(s.opened) >= s.options.Interval
+}
+
+// TickLoop calls tick whenever the active file is due to be rotated by its age, and at
+// least every maxTickWait, until the Sinker is closed.
+func (s *Sinker) tickLoop() {
+	defer close(s.tickDone)
+
+	timer := time.NewTimer(s.untilTick())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.tickStop:
+			return
+		case <-timer.C:
+			s.tick()
+			timer.Reset(s.untilTick())
+		}
+	}
+}
+
+// UntilTick returns how long to wait before the next tick.
+func (s *Sinker) untilTick() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	wait := maxTickWait
+	if s.options.Interval > 0 && s.options.Interval < wait {
+		wait = s.options.Interval
+	}
+
+	if s.options.Interval > 0 && s.size != 0 {
+		if due := s.opened.Add(s.options.Interval).Sub(s.now()); due < wait {
+			wait = due
+		}
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait
+}
+
+// Tick rotates the active file if it has reached its maximum age, and otherwise, if
+// segments are removed by age, asks for them to be.
+func (s *Sinker) tick() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.file == nil {
+		return
+	}
+
+	if s.rotationDue(0) {
+		if err := s.rotate(); err != nil {
+			log.Printf("Error: rotating events file: %v", err)
+		}
+		return
+	}
+
+	if s.options.MaxAge > 0 {
+		s.maintain()
+	}
+}
+
+// Rotate closes the active file, renames it as a segment and opens a new active file.
+// The mutex must be held.
+func (s *Sinker) rotate() error {
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+
+	segment := s.options.Path + "." + s.now().UTC().Format(segmentTimeFmt)
+	if err := os.Rename(s.options.Path, segment); err != nil {
+		return fmt.Errorf("renaming events file: %w", err)
+	}
+	s.maintain()
+
+	return s.open()
+}
+
+// Open opens the active file. The mutex must be held, or the Sinker not yet shared.
+func (s *Sinker) open() error {
+	file, err := os.OpenFile(s.options.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("opening events file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening events file: %w", err)
+	}
+
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	s.size = info.Size()
+	s.opened = s.now()
+	if s.size != 0 {
+		s.opened = info.ModTime() // Appending, so the file is as old as its last write at least
+	}
+
+	return nil
+}
+
+// CloseFile flushes and closes the active file. The mutex must be held.
+func (s *Sinker) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+
+	flushErr := s.flush()
+	closeErr := s.file.Close()
+	s.file = nil
+	s.writer = nil
+
+	if flushErr != nil {
+		return flushErr
+	}
+
+	if closeErr != nil {
+		return fmt.Errorf("closing events file: %w", closeErr)
+	}
+
+	return nil
+}
+
+// Maintain asks the background goroutine to compress and remove rotated segments.
+func (s *Sinker) maintain() {
+	select {
+	case s.maintainChan <- struct{}{}:
+	default: // Maintenance is already pending
+	}
+}
+
+func (s *Sinker) maintainLoop() {
+	defer close(s.maintainDone)
+
+	lock := maintenanceLock(s.options.Path)
+	for range s.maintainChan {
+		lock.Lock()
+		if err := s.compressSegments(); err != nil {
+			log.Printf("Error: compressing rotated events files: %v", err)
+		}
+
+		if err := s.removeSegments(); err != nil {
+			log.Printf("Error: removing rotated events files: %v", err)
+		}
+		lock.Unlock()
+	}
+}
+
+// Segment is a rotated segment of the active file.
+type segment struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Segments returns the rotated segments, oldest first.
+func (s *Sinker) segments() ([]segment, error) {
+	dir, base := filepath.Split(s.options.Path)
+	if dir == "" {
+		dir = "."
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing directory: %w", err)
+	}
+
+	var segments []segment
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasPrefix(name, base+".") || strings.HasSuffix(name, tmpSuffix) {
+			continue
+		}
+
+		// The timestamp sorts in time order, as does the name of a segment before and after
+		// it is compressed
+		timestamp := strings.TrimPrefix(name, base+".")
+		timestamp = strings.TrimSuffix(strings.TrimSuffix(timestamp, gzipSuffix), zstdSuffix)
+		if _, err := time.Parse(segmentTimeFmt, timestamp); err != nil {
+			continue // Not a segment
+		}
+
+		segments = append(segments, segment{filepath.Join(dir, name), info.Size(), info.ModTime()})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].path < segments[j].path
+	})
+
+	return segments, nil
+}
+
+func (s *Sinker) compressSegments() error {
+	if s.options.Compression == None {
+		return nil
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if compressed(segment.path) {
+			continue
+		}
+
+		if err := compressFile(segment.path, segment.modTime, s.options.Compression); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CompressFile compresses the file, replacing it with the compressed file, which keeps its
+// modification time so that its age is still that of the segment. The compressed file is
+// written under a unique temporary name, so that, should the file be compressed twice at
+// once, neither overwrites the other as it is written. A file which has already been
+// replaced is skipped.
+func compressFile(path string, modTime time.Time, compression Compression) error {
+	in, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("opening segment: %w", err)
+	}
+	defer in.Close()
+
+	compressedPath := path + compression.suffix()
+	out, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(compressedPath)+".*"+tmpSuffix)
+	if err != nil {
+		return fmt.Errorf("creating compressed segment: %w", err)
+	}
+	tmpPath := out.Name()
+
+	if err := out.Chmod(0640); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("setting mode of compressed segment: %w", err)
+	}
+
+	if err := compress(out, in, compression); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("compressing segment %s: %w", path, err)
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("closing compressed segment: %w", err)
+	}
+
+	if err := os.Chtimes(tmpPath, modTime, modTime); err != nil {
+		log.Printf("Warning: setting time of compressed segment: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, compressedPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("renaming compressed segment: %w", err)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing uncompressed segment: %w", err)
+	}
+
+	return nil
+}
+
+func compress(out *os.File, in io.Reader, compression Compression) error {
+	var writer io.WriteCloser
+	switch compression {
+	case Gzip:
+		writer = gzip.NewWriter(out)
+	case Zstd:
+		encoder, err := zstd.NewWriter(out)
+		if err != nil {
+			return err
+		}
+		writer = encoder
+	default:
+		return fmt.Errorf("unknown compression %v", compression)
+	}
+
+	if _, err := io.Copy(writer, in); err != nil {
+		writer.Close()
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+// RemoveSegments removes the segments older than the maximum age and then, while the
+// total size of the segments exceeds the maximum, the oldest.
+func (s *Sinker) removeSegments() error {
+	if s.options.MaxAge <= 0 && s.options.MaxTotalBytes <= 0 {
+		return nil
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, segment := range segments {
+		total += segment.size
+	}
+
+	now := s.now()
+	for _, segment := range segments {
+		tooOld := s.options.MaxAge > 0 && now.Sub(segment.modTime) > s.options.MaxAge
+		tooBig := s.options.MaxTotalBytes > 0 && total > s.options.MaxTotalBytes
+		if !tooOld && !tooBig {
+			continue
+		}
+
+		if err := os.Remove(segment.path); err != nil {
+			return fmt.Errorf("removing segment: %w", err)
+		}
+		total -= segment.size
+	}
+
+	return nil
+}
@@ -0,0 +1,450 @@
+package rotate
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/record"
+	"github.com/klauspost/compress/zstd"
+)
+
+var _ sink.SinkerCloser = new(Sinker)
+var _ record.Sinker = new(Sinker)
+
+// NewEvent returns the nth event written by a test, whose PID is n so that its line can be
+// told apart from the others.
+func newEvent(n int) *event.Event {
+	return &event.Event{
+		Time:         time.Now(),
+		PIDOnCPU:     n,
+		CommandOnCPU: "sshd",
+		SourceIP:     net.ParseIP("192.168.1.10"),
+		SourcePort:   22,
+		DestIP:       net.ParseIP("192.168.1.20"),
+		DestPort:     uint16(50000 + n),
+		OldState:     tcpstate.StateSynReceived,
+		NewState:     tcpstate.StateEstablished,
+	}
+}
+
+func openSinker(t *testing.T, options Options) *Sinker {
+	sinker, err := New(options)
+	if err != nil {
+		t.Fatalf("creating sinker: %v", err)
+	}
+
+	return sinker
+}
+
+func sinkEvents(t *testing.T, sinker *Sinker, count int) {
+	for i := 0; i < count; i++ {
+		if err := sinker.Sink(newEvent(i)); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	switch {
+	case strings.HasSuffix(path, gzipSuffix):
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		reader = gzipReader
+	case strings.HasSuffix(path, zstdSuffix):
+		zstdReader, err := zstd.NewReader(file)
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines++
+	}
+
+	return lines
+}
+
+func listSegments(t *testing.T, sinker *Sinker) []segment {
+	segments, err := sinker.segments()
+	if err != nil {
+		t.Fatalf("listing segments: %v", err)
+	}
+
+	return segments
+}
+
+func TestSinkerRotatesBySizeAndCompresses(t *testing.T) {
+	for _, compression := range []Compression{Gzip, Zstd} {
+		path := filepath.Join(t.TempDir(), "events.jsonl")
+		sinker := openSinker(t, Options{Path: path, MaxBytes: 1, Compression: compression})
+		sinkEvents(t, sinker, 3) // Each event exceeds the limit, so each is in its own segment
+		if err := sinker.Close(); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		segments := listSegments(t, sinker)
+		if len(segments) != 2 {
+			t.Fatalf("expected 2 rotated segments with %v, got %d", compression, len(segments))
+		}
+
+		total := countLines(t, path)
+		for _, segment := range segments {
+			if !strings.HasSuffix(segment.path, compression.suffix()) {
+				t.Errorf("expected segment %s to be compressed with %v", segment.path, compression)
+			}
+			total += countLines(t, segment.path)
+		}
+
+		if total != 3 {
+			t.Errorf("expected 3 events across all files with %v, got %d", compression, total)
+		}
+	}
+}
+
+// TestCompressFileConcurrently tests that a segment compressed twice at once, as by the old
+// and new Sinkers of a reload, is compressed intact, leaving no temporary files
+func TestCompressFileConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl."+time.Now().UTC().Format(segmentTimeFmt))
+	lines := strings.Repeat(`{"event":"test"}`+"\n", 1000)
+	if err := ioutil.WriteFile(path, []byte(lines), 0640); err != nil {
+		t.Fatalf("writing segment: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = compressFile(path, time.Now(), Gzip)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	if count := countLines(t, path+gzipSuffix); count != 1000 {
+		t.Errorf("expected 1000 lines in compressed segment, got %d", count)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("listing directory: %v", err)
+	}
+
+	if len(infos) != 1 {
+		t.Errorf("expected only the compressed segment to remain, got %d files", len(infos))
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for _, compression := range []Compression{None, Gzip, Zstd} {
+		parsed, err := ParseCompression(compression.String())
+		if err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		if parsed != compression {
+			t.Errorf("expected compression %v, got %v", compression, parsed)
+		}
+	}
+
+	_, err := ParseCompression("lz4")
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestSinkerRotatesByInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sinker := openSinker(t, Options{Path: path, Interval: time.Hour})
+	defer sinker.Close()
+
+	now := time.Now()
+	sinker.mutex.Lock()
+	sinker.now = func() time.Time { return now }
+	sinker.mutex.Unlock()
+
+	sinkEvents(t, sinker, 2)
+	if segments := listSegments(t, sinker); len(segments) != 0 {
+		t.Fatalf("expected no rotation within interval, got %d segments", len(segments))
+	}
+
+	now = now.Add(time.Hour)
+	sinkEvents(t, sinker, 1)
+	segments := listSegments(t, sinker)
+	if len(segments) != 1 {
+		t.Fatalf("expected 1 rotated segment after interval, got %d", len(segments))
+	}
+
+	if lines := countLines(t, segments[0].path); lines != 2 {
+		t.Errorf("expected 2 events in rotated segment, got %d", lines)
+	}
+}
+
+// TestSinkerTickRotatesByInterval tests that the active file is rotated once the interval
+// has passed, though no more events are written
+func TestSinkerTickRotatesByInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sinker := openSinker(t, Options{Path: path, Interval: time.Hour})
+	defer sinker.Close()
+
+	now := time.Now()
+	sinker.mutex.Lock()
+	sinker.now = func() time.Time { return now }
+	sinker.mutex.Unlock()
+
+	sinkEvents(t, sinker, 2)
+	sinker.tick()
+	if segments := listSegments(t, sinker); len(segments) != 0 {
+		t.Fatalf("expected no rotation within interval, got %d segments", len(segments))
+	}
+
+	if wait := sinker.untilTick(); wait <= 0 || wait > time.Hour {
+		t.Errorf("expected tick within the interval, got %v", wait)
+	}
+
+	sinker.mutex.Lock()
+	now = now.Add(time.Hour)
+	sinker.mutex.Unlock()
+
+	if wait := sinker.untilTick(); wait != 0 {
+		t.Errorf("expected tick straight away once the interval has passed, got %v", wait)
+	}
+
+	sinker.tick()
+	segments := listSegments(t, sinker)
+	if len(segments) != 1 {
+		t.Fatalf("expected 1 rotated segment after interval, got %d", len(segments))
+	}
+
+	if lines := countLines(t, segments[0].path); lines != 2 {
+		t.Errorf("expected 2 events in rotated segment, got %d", lines)
+	}
+
+	// The new active file is empty, so is not rotated
+	sinker.mutex.Lock()
+	now = now.Add(time.Hour)
+	sinker.mutex.Unlock()
+
+	sinker.tick()
+	if segments := listSegments(t, sinker); len(segments) != 1 {
+		t.Errorf("expected empty active file not to be rotated, got %d segments", len(segments))
+	}
+}
+
+// TestSinkerTimerRotatesByInterval tests that the timer rotates the active file when the
+// interval passes without events being written
+func TestSinkerTimerRotatesByInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sinker := openSinker(t, Options{Path: path, Interval: 50 * time.Millisecond, Compression: None})
+	defer sinker.Close()
+
+	sinkEvents(t, sinker, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(listSegments(t, sinker)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected active file to be rotated by the timer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSinkerRemovesSegmentsOverTotalSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sinker := openSinker(t, Options{Path: path, MaxBytes: 1, MaxTotalBytes: 1})
+	sinkEvents(t, sinker, 4)
+	if err := sinker.Close(); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// Every segment exceeds the total on its own, so all are removed
+	if segments := listSegments(t, sinker); len(segments) != 0 {
+		t.Errorf("expected all segments to be removed, got %d", len(segments))
+	}
+
+	if lines := countLines(t, path); lines != 1 {
+		t.Errorf("expected active file to be kept, with 1 event, got %d", lines)
+	}
+}
+
+func TestSinkerRemovesSegmentsOverMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+
+	old := time.Now().Add(-2 * time.Hour)
+	oldSegment := path + "." + old.UTC().Format(segmentTimeFmt) + gzipSuffix
+	newSegment := path + "." + time.Now().UTC().Format(segmentTimeFmt) + gzipSuffix
+	unrelated := filepath.Join(dir, "events.jsonl.bak")
+	for _, file := range []string{oldSegment, newSegment, unrelated} {
+		if err := ioutil.WriteFile(file, nil, 0640); err != nil {
+			t.Fatalf("writing %s: %v", file, err)
+		}
+	}
+
+	if err := os.Chtimes(oldSegment, old, old); err != nil {
+		t.Fatalf("setting time of %s: %v", oldSegment, err)
+	}
+
+	sinker := openSinker(t, Options{Path: path, MaxAge: time.Hour})
+	if err := sinker.Close(); err != nil { // Waits for the maintenance done on creation
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	for file, expectExists := range map[string]bool{oldSegment: false, newSegment: true, unrelated: true} {
+		if _, err := os.Stat(file); (err == nil) != expectExists {
+			t.Errorf("expected %s to exist: %v, stat error: %v", file, expectExists, err)
+		}
+	}
+}
+
+func TestSinkerReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+	sinker := openSinker(t, Options{Path: path})
+	defer sinker.Close()
+
+	sinkEvents(t, sinker, 1)
+
+	// As logrotate would, move the file away and then ask for it to be reopened
+	moved := filepath.Join(dir, "moved.jsonl")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatalf("moving file: %v", err)
+	}
+
+	if err := sinker.Reopen(); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	sinkEvents(t, sinker, 2)
+
+	if lines := countLines(t, moved); lines != 1 {
+		t.Errorf("expected 1 event in moved file, got %d", lines)
+	}
+
+	if lines := countLines(t, path); lines != 2 {
+		t.Errorf("expected 2 events in reopened file, got %d", lines)
+	}
+}
+
+func TestSinkerSinkBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sinker := openSinker(t, Options{Path: path})
+
+	if err := sinker.SinkBatch([]*event.Event{newEvent(0), newEvent(1), newEvent(2)}); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if err := sinker.Close(); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if lines := countLines(t, path); lines != 3 {
+		t.Errorf("expected 3 events, got %d", lines)
+	}
+
+	if err := sinker.Sink(newEvent(0)); err == nil {
+		t.Error("expected error sinking to closed sinker, got nil")
+	}
+}
+
+func TestSinkerSinkRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	sinker := openSinker(t, Options{Path: path})
+
+	flowRecord := map[string]string{"close_path": "fin"}
+	for i := 0; i < 2; i++ {
+		if err := sinker.SinkRecord("flow", flowRecord); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	// Each record is flushed as it is sunk
+	if lines := countLines(t, path); lines != 2 {
+		t.Errorf("expected 2 flow records, got %d", lines)
+	}
+
+	if err := sinker.Close(); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if err := sinker.SinkRecord("flow", flowRecord); err == nil {
+		t.Error("expected error sinking to closed sinker, got nil")
+	}
+}
+
+func TestNewWithConfigOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sinker, err := NewWithConfig(map[string]string{
+		FileOption:          path,
+		MaxBytesOption:      "1024",
+		IntervalOption:      "1h",
+		CompressOption:      "none",
+		MaxAgeOption:        "720h",
+		MaxTotalBytesOption: "1048576",
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	defer sinker.(*Sinker).Close()
+
+	expected := Options{
+		Path:          path,
+		MaxBytes:      1024,
+		Interval:      time.Hour,
+		Compression:   None,
+		MaxAge:        720 * time.Hour,
+		MaxTotalBytes: 1 << 20,
+	}
+	if options := sinker.(*Sinker).options; options != expected {
+		t.Errorf("expected options %+v, got %+v", expected, options)
+	}
+}
+
+func TestNewWithConfigErrors(t *testing.T) {
+	for _, config := range []map[string]string{
+		{},
+		{FileOption: "/tmp/events.jsonl", CompressOption: "lz4"},
+		{FileOption: "/tmp/events.jsonl", MaxBytesOption: "big"},
+		{FileOption: "/tmp/events.jsonl", "max-size": "1"},
+	} {
+		_, err := NewWithConfig(config)
+		if err == nil {
+			t.Errorf("expected error for options %v, got nil", config)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
@@ -36,3 +36,13 @@ func (*OSSignalHandler) Install(signals ...os.Signal) (signalChan <-chan os.Sign
 
 	return signalChanOut, doneOut
 }
+
+// Notify relays the given signals on the returned channel, without closing any done channel.
+// It is for signals which do not end the process, such as a request to reload. Signals which
+// arrive while one is pending are coalesced with it.
+func (*OSSignalHandler) Notify(signals ...os.Signal) <-chan os.Signal {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, signals...)
+
+	return signalChan
+}
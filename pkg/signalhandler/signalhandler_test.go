@@ -26,3 +26,20 @@ func TestUnixSignalHandler(t *testing.T) {
 
 	t.Logf("got signal %q", signal)
 }
+
+func TestUnixSignalHandlerNotify(t *testing.T) {
+	handler := NewOSSignalHandler()
+	signalChan := handler.Notify(unix.SIGUSR1)
+
+	process, _ := os.FindProcess(os.Getpid())
+	for i := 0; i < 2; i++ {
+		process.Signal(unix.SIGUSR1)
+
+		signal := <-signalChan
+		if signal != unix.SIGUSR1 {
+			t.Errorf("expected signal %q, got signal %q", unix.SIGUSR1, signal)
+		}
+
+		t.Logf("got signal %q", signal)
+	}
+}
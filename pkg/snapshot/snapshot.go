@@ -0,0 +1,262 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// PolledCommand is the CommandOnCPU of events synthesised from snapshots, marking them as
+// polled, as no process is known for them. Consumers should bear in mind that transitions
+// which are over between two snapshots, including whole short-lived connections, are
+// missing.
+const PolledCommand = "[polled]"
+
+// ErrClosed is returned by Event once the Eventer has been closed.
+var ErrClosed = errors.New("eventer closed")
+
+// NativeEndian is the byte order of the host, in which the kernel presents integers.
+var NativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Socket is a TCP socket found in a snapshot.
+type Socket struct {
+	LocalIP, RemoteIP     net.IP
+	LocalPort, RemotePort uint16
+	State                 tcpstate.State
+	UID, INode            uint32 // INode is 0 if the socket is no longer owned by a user space socket
+	ID                    string // An identifier of the kernel socket, used as the socket info ID
+}
+
+// Lister lists the TCP sockets at the time it is called.
+type Lister func() ([]*Socket, error)
+
+// Options configure an Eventer.
+type Options struct {
+	Interval     time.Duration
+	EmitExisting bool // Whether to emit events for the sockets found by the first snapshot
+}
+
+// Eventer is an event.Eventer which takes snapshots of the TCP sockets on an interval,
+// comparing each with the last to synthesise state transitions. A socket which appears
+// is taken to have moved from CLOSED, and one which disappears to have moved to CLOSED.
+// It cannot see transitions which are over between snapshots and does not know the process
+// responsible, so its events have PolledCommand as their command and a PID of 0. The
+// socket info, when present, has a GID of 0, as it is not available, and a socket state
+// derived from the TCP state.
+// Event may be called concurrently with Close, but not with itself.
+type Eventer struct {
+	list     Lister
+	previous map[socketKey]*Socket
+	pending  []*event.Event
+	tick     <-chan time.Time
+	stop     func()
+	now      func() time.Time
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// SocketKey identifies a socket between snapshots. Listening sockets may share addresses,
+// with SO_REUSEPORT, so are also distinguished by inode.
+type socketKey struct {
+	local, remote string
+	listenINode   uint32
+}
+
+// New returns an Eventer which takes snapshots with the lister as given by the options.
+// The first snapshot is taken straight away, so that a lister which cannot work is
+// reported at startup.
+func New(list Lister, options Options) (*Eventer, error) {
+	if options.Interval <= 0 {
+		return nil, fmt.Errorf("interval %v must be positive", options.Interval)
+	}
+
+	ticker := time.NewTicker(options.Interval)
+	e := &Eventer{
+		list: list,
+		tick: ticker.C,
+		stop: ticker.Stop,
+		now:  time.Now,
+		done: make(chan struct{}),
+	}
+
+	if err := e.poll(); err != nil {
+		ticker.Stop()
+		return nil, err
+	}
+
+	if !options.EmitExisting {
+		e.pending = nil
+	}
+
+	return e, nil
+}
+
+func (e *Eventer) Event() (*event.Event, error) {
+	return e.EventContext(context.Background())
+}
+
+// EventContext returns the next event, taking snapshots as often as the interval allows
+// until there is one, the context is done or the Eventer is closed.
+func (e *Eventer) EventContext(ctx context.Context) (*event.Event, error) {
+	for len(e.pending) == 0 {
+		select {
+		case <-e.tick:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-e.done:
+			return nil, ErrClosed
+		}
+
+		if err := e.poll(); err != nil {
+			return nil, err
+		}
+	}
+
+	next := e.pending[0]
+	e.pending = e.pending[1:]
+	return next, nil
+}
+
+func (e *Eventer) Close() error {
+	e.closeOnce.Do(func() {
+		e.stop()
+		close(e.done)
+	})
+
+	return nil
+}
+
+// Poll takes a snapshot of the sockets and queues the events for the transitions since the
+// previous one. If the snapshot cannot be taken, the previous one is kept.
+func (e *Eventer) poll() error {
+	sockets, err := e.list()
+	if err != nil {
+		return fmt.Errorf("listing sockets: %w", err)
+	}
+
+	current := make(map[socketKey]*Socket, len(sockets))
+	for _, s := range sockets {
+		key := socketKey{
+			local:  net.JoinHostPort(s.LocalIP.String(), strconv.Itoa(int(s.LocalPort))),
+			remote: net.JoinHostPort(s.RemoteIP.String(), strconv.Itoa(int(s.RemotePort))),
+		}
+		if s.State == tcpstate.StateListen {
+			key.listenINode = s.INode
+		}
+		current[key] = s
+	}
+
+	now := e.now()
+	var events []*event.Event
+	for key, s := range current {
+		oldState := tcpstate.StateClosed
+		if previous, ok := e.previous[key]; ok {
+			oldState = previous.State
+		}
+
+		if oldState != s.State {
+			events = append(events, newEvent(now, s, oldState, s.State))
+		}
+	}
+
+	for key, s := range e.previous {
+		if _, ok := current[key]; !ok && s.State != tcpstate.StateClosed {
+			events = append(events, newEvent(now, s, s.State, tcpstate.StateClosed))
+		}
+	}
+
+	// Sort the events, so that those of a snapshot are in a predictable order
+	sort.Slice(events, func(i, j int) bool {
+		return eventOrder(events[i]) < eventOrder(events[j])
+	})
+
+	e.previous = current
+	e.pending = append(e.pending, events...)
+	return nil
+}
+
+func eventOrder(e *event.Event) string {
+	return fmt.Sprintf("%s %s %s", net.JoinHostPort(e.SourceIP.String(), strconv.Itoa(int(e.SourcePort))),
+		net.JoinHostPort(e.DestIP.String(), strconv.Itoa(int(e.DestPort))),
+		e.NewState)
+}
+
+func newEvent(now time.Time, s *Socket, oldState, newState tcpstate.State) *event.Event {
+	e := &event.Event{
+		Time:         now,
+		CommandOnCPU: PolledCommand,
+		SourceIP:     s.LocalIP,
+		SourcePort:   s.LocalPort,
+		DestIP:       s.RemoteIP,
+		DestPort:     s.RemotePort,
+		OldState:     oldState,
+		NewState:     newState,
+	}
+
+	// Sockets without an inode, such as those in TIME-WAIT, are no longer owned by a user
+	// space socket, so have no socket info
+	if s.INode != 0 {
+		e.SocketInfo = &event.SocketInfo{
+			ID:          s.ID,
+			INode:       s.INode,
+			UID:         s.UID,
+			SocketState: socketState(newState),
+		}
+	}
+
+	return e
+}
+
+// SocketState approximates the state of the user space socket from the TCP state.
+func socketState(state tcpstate.State) socketstate.State {
+	switch state {
+	case tcpstate.StateSynSent, tcpstate.StateSynReceived:
+		return socketstate.StateConnecting
+	case tcpstate.StateEstablished, tcpstate.StateCloseWait:
+		return socketstate.StateConnected
+	case tcpstate.StateFinWait1, tcpstate.StateFinWait2, tcpstate.StateClosing,
+		tcpstate.StateLastAck, tcpstate.StateTimeWait:
+		return socketstate.StateDisconnecting
+	default:
+		return socketstate.StateUnconnected
+	}
+}
+
+// KernelState returns the TCP state numbered as by the kernel, in include/net/tcp_states.h.
+func KernelState(state uint8) (tcpstate.State, bool) {
+	s, ok := kernelStates[state]
+	return s, ok
+}
+
+var kernelStates = map[uint8]tcpstate.State{
+	0x01: tcpstate.StateEstablished,
+	0x02: tcpstate.StateSynSent,
+	0x03: tcpstate.StateSynReceived,
+	0x04: tcpstate.StateFinWait1,
+	0x05: tcpstate.StateFinWait2,
+	0x06: tcpstate.StateTimeWait,
+	0x07: tcpstate.StateClosed,
+	0x08: tcpstate.StateCloseWait,
+	0x09: tcpstate.StateLastAck,
+	0x0A: tcpstate.StateListen,
+	0x0B: tcpstate.StateClosing,
+	0x0C: tcpstate.StateSynReceived, // TCP_NEW_SYN_RECV, for request sockets
+}
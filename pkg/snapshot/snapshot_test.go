@@ -0,0 +1,235 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+var _ event.EventerCloser = new(Eventer)
+
+// MockLister returns the sockets it has been given, or the error. If it has been given
+// queued snapshots, it returns the next of those instead.
+type mockLister struct {
+	mutex   sync.Mutex
+	sockets []*Socket
+	queued  [][]*Socket
+	err     error
+}
+
+func (ml *mockLister) list() ([]*Socket, error) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	if len(ml.queued) != 0 {
+		ml.sockets, ml.queued = ml.queued[0], ml.queued[1:]
+	}
+
+	return ml.sockets, ml.err
+}
+
+func (ml *mockLister) set(sockets ...*Socket) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	ml.sockets = sockets
+}
+
+func newSocket(localPort uint16, state tcpstate.State, inode uint32) *Socket {
+	s := &Socket{
+		LocalIP:    net.ParseIP("127.0.0.1"),
+		LocalPort:  localPort,
+		RemoteIP:   net.ParseIP("127.0.0.2"),
+		RemotePort: 443,
+		State:      state,
+		UID:        1000,
+		INode:      inode,
+		ID:         "ffff8880",
+	}
+
+	if state == tcpstate.StateListen {
+		s.RemoteIP, s.RemotePort = net.IPv4zero, 0
+	}
+
+	return s
+}
+
+func newTestEventer(t *testing.T, emitExisting bool, lister *mockLister) (*Eventer, chan time.Time) {
+	eventer, err := New(lister.list, Options{Interval: time.Hour, EmitExisting: emitExisting})
+	if err != nil {
+		t.Fatalf("creating eventer: %v", err)
+	}
+
+	// Take snapshots on demand rather than on the interval
+	tick := make(chan time.Time, 1)
+	eventer.tick = tick
+
+	return eventer, tick
+}
+
+func nextEvent(t *testing.T, eventer *Eventer) *event.Event {
+	e, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return e
+}
+
+func checkTransition(t *testing.T, e *event.Event, sourcePort uint16, old, new tcpstate.State) {
+	if e.SourcePort != sourcePort || e.OldState != old || e.NewState != new {
+		t.Errorf("expected transition of port %d from %v to %v, got %v", sourcePort, old, new, e)
+	}
+
+	if e.CommandOnCPU != PolledCommand || e.PIDOnCPU != 0 {
+		t.Errorf("expected event to be marked as polled, got %v", e)
+	}
+}
+
+func TestEventerTransitions(t *testing.T) {
+	listener := newSocket(8080, tcpstate.StateListen, 4242)
+	lister := &mockLister{sockets: []*Socket{listener}}
+	eventer, tick := newTestEventer(t, false, lister)
+	defer eventer.Close()
+
+	// The listening socket existed at startup, so has no event
+	lister.set(listener, newSocket(53712, tcpstate.StateSynSent, 4243))
+	tick <- time.Now()
+	e := nextEvent(t, eventer)
+	checkTransition(t, e, 53712, tcpstate.StateClosed, tcpstate.StateSynSent)
+
+	expectedInfo := &event.SocketInfo{ID: "ffff8880", INode: 4243, UID: 1000, SocketState: socketstate.StateConnecting}
+	if e.SocketInfo == nil || !e.SocketInfo.Equal(expectedInfo) {
+		t.Errorf("expected socket info %v, got %v", expectedInfo, e.SocketInfo)
+	}
+
+	lister.set(listener, newSocket(53712, tcpstate.StateEstablished, 4243))
+	tick <- time.Now()
+	checkTransition(t, nextEvent(t, eventer), 53712, tcpstate.StateSynSent, tcpstate.StateEstablished)
+
+	// The socket moves to TIME-WAIT, without an inode, and the listener closes
+	lister.set(newSocket(53712, tcpstate.StateTimeWait, 0))
+	tick <- time.Now()
+	e = nextEvent(t, eventer)
+	checkTransition(t, e, 53712, tcpstate.StateEstablished, tcpstate.StateTimeWait)
+	if e.SocketInfo != nil {
+		t.Errorf("expected no socket info without inode, got %v", e.SocketInfo)
+	}
+	checkTransition(t, nextEvent(t, eventer), 8080, tcpstate.StateListen, tcpstate.StateClosed)
+
+	lister.set()
+	tick <- time.Now()
+	checkTransition(t, nextEvent(t, eventer), 53712, tcpstate.StateTimeWait, tcpstate.StateClosed)
+}
+
+func TestEventerDistinguishesListenersByINode(t *testing.T) {
+	lister := &mockLister{sockets: []*Socket{newSocket(8080, tcpstate.StateListen, 1)}}
+	eventer, tick := newTestEventer(t, false, lister)
+	defer eventer.Close()
+
+	// A second listener on the same address, with SO_REUSEPORT
+	lister.set(newSocket(8080, tcpstate.StateListen, 1), newSocket(8080, tcpstate.StateListen, 2))
+	tick <- time.Now()
+
+	e := nextEvent(t, eventer)
+	checkTransition(t, e, 8080, tcpstate.StateClosed, tcpstate.StateListen)
+	if e.SocketInfo == nil || e.SocketInfo.INode != 2 {
+		t.Errorf("expected event for second listener, got %v", e)
+	}
+}
+
+func TestEventerEmitExisting(t *testing.T) {
+	lister := &mockLister{sockets: []*Socket{
+		newSocket(8080, tcpstate.StateListen, 4242),
+		newSocket(53712, tcpstate.StateEstablished, 4243),
+	}}
+	eventer, _ := newTestEventer(t, true, lister)
+	defer eventer.Close()
+
+	checkTransition(t, nextEvent(t, eventer), 53712, tcpstate.StateClosed, tcpstate.StateEstablished)
+	checkTransition(t, nextEvent(t, eventer), 8080, tcpstate.StateClosed, tcpstate.StateListen)
+}
+
+func TestEventerSkipsUnchangedSnapshots(t *testing.T) {
+	listener := newSocket(8080, tcpstate.StateListen, 4242)
+	lister := &mockLister{queued: [][]*Socket{
+		{listener},
+		{listener}, // Nothing has changed, so the eventer takes another snapshot
+		{listener, newSocket(53712, tcpstate.StateSynSent, 4243)},
+	}}
+	eventer, tick := newTestEventer(t, false, lister)
+	defer eventer.Close()
+
+	tick <- time.Now()
+	go func() { tick <- time.Now() }()
+
+	checkTransition(t, nextEvent(t, eventer), 53712, tcpstate.StateClosed, tcpstate.StateSynSent)
+}
+
+func TestEventerListError(t *testing.T) {
+	lister := &mockLister{}
+	eventer, tick := newTestEventer(t, false, lister)
+	defer eventer.Close()
+
+	lister.mutex.Lock()
+	lister.err = errors.New("mock list error")
+	lister.mutex.Unlock()
+	tick <- time.Now()
+
+	_, err := eventer.Event()
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestNewListError(t *testing.T) {
+	_, err := New((&mockLister{err: errors.New("mock list error")}).list, Options{Interval: time.Second})
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestEventerClose(t *testing.T) {
+	eventer, _ := newTestEventer(t, false, &mockLister{})
+
+	errChan := make(chan error)
+	go func() {
+		_, err := eventer.Event()
+		errChan <- err
+	}()
+
+	if err := eventer.Close(); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("expected ErrClosed, got %v (of type %T)", err, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event did not return after Close")
+	}
+}
+
+func TestEventerEventContext(t *testing.T) {
+	eventer, _ := newTestEventer(t, false, &mockLister{})
+	defer eventer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := eventer.EventContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context cancelled error, got %v (of type %T)", err, err)
+	}
+}
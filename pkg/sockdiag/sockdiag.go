@@ -0,0 +1,245 @@
+package sockdiag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+	"github.com/jhwbarlow/tcp-audit/pkg/snapshot"
+	"golang.org/x/sys/unix"
+)
+
+// The plugin options.
+const (
+	IntervalOption     = "interval"
+	EmitExistingOption = "emit-existing"
+)
+
+const (
+	defaultInterval = time.Second
+
+	// From linux/sock_diag.h and linux/inet_diag.h, which golang.org/x/sys/unix does not
+	// provide
+	sockDiagByFamily    = 20
+	sizeofInetDiagReqV2 = 56
+	sizeofInetDiagMsg   = 72
+	allStates           = 0xffffffff
+
+	receiveBufferSize = 64 << 10
+)
+
+// InetDiagSockID is struct inet_diag_sockid. The ports and addresses are in network byte
+// order, and IPv4 addresses are in the first four bytes.
+type inetDiagSockID struct {
+	SPort, DPort [2]byte
+	Src, Dst     [16]byte
+	If           uint32
+	Cookie       [2]uint32
+}
+
+// InetDiagReqV2 is struct inet_diag_req_v2.
+type inetDiagReqV2 struct {
+	Family, Protocol, Ext, Pad uint8
+	States                     uint32
+	ID                         inetDiagSockID
+}
+
+// InetDiagMsg is struct inet_diag_msg.
+type inetDiagMsg struct {
+	Family, State, Timer, Retrans uint8
+	ID                            inetDiagSockID
+	Expires, RQueue, WQueue       uint32
+	UID, INode                    uint32
+}
+
+// Options configure an Eventer.
+type Options struct {
+	Interval     time.Duration
+	EmitExisting bool // Whether to emit events for the sockets found by the first dump
+}
+
+// New returns an Eventer which dumps the TCP sockets with NETLINK_SOCK_DIAG, as given by the
+// options. It sees the sockets in tcp-audit's network namespace, with their owner's UID
+// and inode, and does not need root.
+// The socket info ID is the socket's cookie, in hex.
+func New(options Options) (*snapshot.Eventer, error) {
+	return snapshot.New(List, snapshot.Options{
+		Interval:     options.Interval,
+		EmitExisting: options.EmitExisting,
+	})
+}
+
+// NewWithConfig is the plugin constructor.
+func NewWithConfig(config map[string]string) (event.Eventer, error) {
+	c := pluginconfig.Config(config)
+	if err := c.CheckKeys(IntervalOption, EmitExistingOption); err != nil {
+		return nil, err
+	}
+
+	var options Options
+	var err error
+	if options.Interval, err = c.Duration(IntervalOption, defaultInterval); err != nil {
+		return nil, err
+	}
+
+	if options.EmitExisting, err = c.Bool(EmitExistingOption, false); err != nil {
+		return nil, err
+	}
+
+	return New(options)
+}
+
+// List is a snapshot.Lister which lists the IPv4 and IPv6 TCP sockets with
+// NETLINK_SOCK_DIAG.
+func List() ([]*snapshot.Socket, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, fmt.Errorf("opening netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	var sockets []*snapshot.Socket
+	for seq, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		familySockets, err := dump(fd, family, uint32(seq+1))
+		if err != nil {
+			return nil, err
+		}
+		sockets = append(sockets, familySockets...)
+	}
+
+	return sockets, nil
+}
+
+// Dump requests and receives the dump of the TCP sockets of the address family.
+func dump(fd int, family uint8, seq uint32) ([]*snapshot.Socket, error) {
+	req := new(bytes.Buffer)
+	binary.Write(req, snapshot.NativeEndian, unix.NlMsghdr{
+		Len:   unix.NLMSG_HDRLEN + sizeofInetDiagReqV2,
+		Type:  sockDiagByFamily,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_DUMP,
+		Seq:   seq,
+	})
+	binary.Write(req, snapshot.NativeEndian, inetDiagReqV2{
+		Family:   family,
+		Protocol: unix.IPPROTO_TCP,
+		States:   allStates,
+	})
+
+	if err := unix.Sendto(fd, req.Bytes(), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("sending dump request: %w", err)
+	}
+
+	var sockets []*snapshot.Socket
+	buf := make([]byte, receiveBufferSize)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("receiving dump: %w", err)
+		}
+
+		received, done, err := parseMessages(buf[:n], seq)
+		if err != nil {
+			return nil, err
+		}
+		sockets = append(sockets, received...)
+
+		if done {
+			return sockets, nil
+		}
+	}
+}
+
+// ParseMessages parses the netlink messages received in reply to the request with the
+// sequence number, returning the sockets and whether the dump is done.
+func parseMessages(data []byte, seq uint32) ([]*snapshot.Socket, bool, error) {
+	var sockets []*snapshot.Socket
+	for len(data) >= unix.NLMSG_HDRLEN {
+		var header unix.NlMsghdr
+		binary.Read(bytes.NewReader(data[:unix.NLMSG_HDRLEN]), snapshot.NativeEndian, &header)
+		if header.Len < unix.NLMSG_HDRLEN || int(header.Len) > len(data) {
+			return nil, false, fmt.Errorf("malformed netlink message of length %d", header.Len)
+		}
+
+		body := data[unix.NLMSG_HDRLEN:header.Len]
+		if next := nlmsgAlign(header.Len); next < len(data) {
+			data = data[next:]
+		} else {
+			data = nil
+		}
+		if header.Seq != seq {
+			continue
+		}
+
+		switch header.Type {
+		case unix.NLMSG_DONE:
+			return sockets, true, nil
+		case unix.NLMSG_ERROR:
+			if len(body) < 4 {
+				return nil, false, fmt.Errorf("malformed netlink error message")
+			}
+			if errno := int32(snapshot.NativeEndian.Uint32(body)); errno != 0 {
+				return nil, false, fmt.Errorf("dumping sockets: %w", syscall.Errno(-errno))
+			}
+			return sockets, true, nil
+		case sockDiagByFamily:
+			s, err := parseSocket(body)
+			if err != nil {
+				return nil, false, err
+			}
+			sockets = append(sockets, s)
+		}
+	}
+
+	return sockets, false, nil
+}
+
+func parseSocket(body []byte) (*snapshot.Socket, error) {
+	if len(body) < sizeofInetDiagMsg {
+		return nil, fmt.Errorf("malformed socket message of length %d", len(body))
+	}
+
+	var msg inetDiagMsg
+	binary.Read(bytes.NewReader(body[:sizeofInetDiagMsg]), snapshot.NativeEndian, &msg)
+
+	state, ok := snapshot.KernelState(msg.State)
+	if !ok {
+		return nil, fmt.Errorf("unknown state %#x", msg.State)
+	}
+
+	cookie := uint64(msg.ID.Cookie[1])<<32 | uint64(msg.ID.Cookie[0])
+	return &snapshot.Socket{
+		LocalIP:    address(msg.Family, msg.ID.Src),
+		LocalPort:  binary.BigEndian.Uint16(msg.ID.SPort[:]),
+		RemoteIP:   address(msg.Family, msg.ID.Dst),
+		RemotePort: binary.BigEndian.Uint16(msg.ID.DPort[:]),
+		State:      state,
+		UID:        msg.UID,
+		INode:      msg.INode,
+		ID:         strconv.FormatUint(cookie, 16),
+	}, nil
+}
+
+// Address returns the IP address of the family. IPv4-mapped IPv6 addresses, as used by
+// dual-stack sockets, are returned as IPv4.
+func address(family uint8, raw [16]byte) net.IP {
+	if family == unix.AF_INET {
+		return net.IP(append([]byte(nil), raw[:4]...))
+	}
+
+	ip := net.IP(append([]byte(nil), raw[:]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip
+}
+
+func nlmsgAlign(length uint32) int {
+	return int((length + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1))
+}
@@ -0,0 +1,180 @@
+package sockdiag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/snapshot"
+	"golang.org/x/sys/unix"
+)
+
+func newMessage(t *testing.T, msgType uint16, seq uint32, body interface{}) []byte {
+	bodyBuf := new(bytes.Buffer)
+	if err := binary.Write(bodyBuf, snapshot.NativeEndian, body); err != nil {
+		t.Fatalf("encoding message body: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, snapshot.NativeEndian, unix.NlMsghdr{
+		Len:  uint32(unix.NLMSG_HDRLEN + bodyBuf.Len()),
+		Type: msgType,
+		Seq:  seq,
+	})
+	buf.Write(bodyBuf.Bytes())
+	for buf.Len()%unix.NLMSG_ALIGNTO != 0 {
+		buf.WriteByte(0)
+	}
+
+	return buf.Bytes()
+}
+
+func newSocketMessage(t *testing.T, seq uint32, family, state uint8) []byte {
+	msg := inetDiagMsg{
+		Family: family,
+		State:  state,
+		UID:    1000,
+		INode:  4242,
+		ID: inetDiagSockID{
+			SPort:  [2]byte{0xd1, 0xd0},
+			DPort:  [2]byte{0x01, 0xbb},
+			Cookie: [2]uint32{0x2a, 0x1},
+		},
+	}
+
+	if family == unix.AF_INET {
+		copy(msg.ID.Src[:], net.ParseIP("10.0.0.1").To4())
+		copy(msg.ID.Dst[:], net.ParseIP("10.0.0.2").To4())
+	} else {
+		copy(msg.ID.Src[:], net.ParseIP("2001:db8::1"))
+		copy(msg.ID.Dst[:], net.ParseIP("::ffff:10.0.0.2"))
+	}
+
+	return newMessage(t, sockDiagByFamily, seq, msg)
+}
+
+func TestParseMessages(t *testing.T) {
+	var data []byte
+	data = append(data, newSocketMessage(t, 1, unix.AF_INET, 0x01)...)
+	data = append(data, newSocketMessage(t, 2, unix.AF_INET, 0x01)...) // Another request's, so skipped
+	data = append(data, newSocketMessage(t, 1, unix.AF_INET6, 0x0A)...)
+	data = append(data, newMessage(t, unix.NLMSG_DONE, 1, int32(0))...)
+
+	sockets, done, err := parseMessages(data, 1)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !done {
+		t.Error("expected dump to be done")
+	}
+
+	if len(sockets) != 2 {
+		t.Fatalf("expected 2 sockets, got %d", len(sockets))
+	}
+
+	ipv4, ipv6 := sockets[0], sockets[1]
+	if !ipv4.LocalIP.Equal(net.ParseIP("10.0.0.1")) ||
+		!ipv4.RemoteIP.Equal(net.ParseIP("10.0.0.2")) ||
+		ipv4.LocalPort != 53712 ||
+		ipv4.RemotePort != 443 ||
+		ipv4.State != tcpstate.StateEstablished ||
+		ipv4.UID != 1000 ||
+		ipv4.INode != 4242 ||
+		ipv4.ID != "10000002a" {
+		t.Errorf("unexpected IPv4 socket %+v", ipv4)
+	}
+
+	if !ipv6.LocalIP.Equal(net.ParseIP("2001:db8::1")) ||
+		len(ipv6.RemoteIP) != net.IPv4len ||
+		ipv6.State != tcpstate.StateListen {
+		t.Errorf("unexpected IPv6 socket %+v", ipv6)
+	}
+}
+
+func TestParseMessagesNotDone(t *testing.T) {
+	sockets, done, err := parseMessages(newSocketMessage(t, 1, unix.AF_INET, 0x01), 1)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if done || len(sockets) != 1 {
+		t.Errorf("expected 1 socket and dump not to be done, got %d sockets, done: %v", len(sockets), done)
+	}
+}
+
+func TestParseMessagesErrors(t *testing.T) {
+	truncated := newSocketMessage(t, 1, unix.AF_INET, 0x01)
+	for name, data := range map[string][]byte{
+		"netlink error":   newMessage(t, unix.NLMSG_ERROR, 1, int32(-int32(syscall.EPERM))),
+		"truncated":       truncated[:len(truncated)-8],
+		"short body":      newMessage(t, sockDiagByFamily, 1, uint32(0)),
+		"unknown state":   newSocketMessage(t, 1, unix.AF_INET, 0x0F),
+		"malformed error": newMessage(t, unix.NLMSG_ERROR, 1, uint16(0)),
+	} {
+		_, _, err := parseMessages(data, 1)
+		if err == nil {
+			t.Errorf("expected error for %s, got nil", name)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	sockets, err := List()
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPROTONOSUPPORT) {
+		t.Skipf("sock_diag not available: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	for _, s := range sockets {
+		if s.LocalPort != port || s.State != tcpstate.StateListen {
+			continue
+		}
+
+		if !s.LocalIP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("expected listener on 127.0.0.1, got %v", s.LocalIP)
+		}
+
+		if s.UID != uint32(os.Getuid()) || s.INode == 0 {
+			t.Errorf("expected listener with UID %d and an inode, got %+v", os.Getuid(), s)
+		}
+
+		return
+	}
+
+	t.Errorf("listener on port %d not found among %d sockets", port, len(sockets))
+}
+
+func TestNewWithConfigErrors(t *testing.T) {
+	for _, config := range []map[string]string{
+		{IntervalOption: "0s"},
+		{IntervalOption: "often"},
+		{EmitExistingOption: "maybe"},
+		{"period": "1s"},
+	} {
+		_, err := NewWithConfig(config)
+		if err == nil {
+			t.Errorf("expected error for options %v, got nil", config)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
@@ -0,0 +1,195 @@
+package spool
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/batch"
+	"github.com/jhwbarlow/tcp-audit/pkg/contextual"
+	"github.com/jhwbarlow/tcp-audit/pkg/retry"
+)
+
+// The most spooled events replayed by each sink, so that a large spool is replayed a part
+// at a time rather than holding up a single sink until it is empty
+const defaultReplayChunk = 100
+
+// Sinker is a sink.Sinker which appends events to a Spool when the wrapped sinker fails
+// to sink them, and replays the spooled events, in order, once the wrapped sinker recovers.
+// While the spool holds events, new events are appended to it rather than sunk directly,
+// so that they do not overtake the spooled events. Each sink replays only a bounded chunk
+// of the spooled events, so the spool drains over several sinks.
+// An error is only returned if an event could neither be sunk nor spooled, or if the
+// wrapped sinker returns a permanent error, as replaying the event could never succeed.
+// A Sinker is not safe for concurrent use.
+type Sinker struct {
+	sinker         sink.Sinker
+	spool          *Spool
+	replayInterval time.Duration
+	replayChunk    int
+	replayed       int // Since the spool was last empty
+	nextReplay     time.Time
+}
+
+// NewSinker returns a Sinker which spools events for the given sinker. After a failure,
+// replay is not attempted again until the replayInterval has elapsed.
+func NewSinker(sinker sink.Sinker, spool *Spool, replayInterval time.Duration) *Sinker {
+	return &Sinker{
+		sinker:         sinker,
+		spool:          spool,
+		replayInterval: replayInterval,
+		replayChunk:    defaultReplayChunk,
+	}
+}
+
+func (s *Sinker) Sink(e *event.Event) error {
+	return s.SinkContext(context.Background(), e)
+}
+
+// SinkContext sinks, or spools, the event, passing the context on to the wrapped sinker if
+// it accepts one, including when replaying the spool.
+func (s *Sinker) SinkContext(ctx context.Context, e *event.Event) error {
+	if s.spool.Len() != 0 {
+		if time.Now().After(s.nextReplay) {
+			s.replay(ctx, s.replayChunk)
+		}
+
+		if s.spool.Len() != 0 {
+			return s.append(e)
+		}
+	}
+
+	if err := contextual.Sink(ctx, s.sinker, e); err != nil {
+		if retry.IsPermanent(err) {
+			return err
+		}
+
+		log.Printf("Warning: sinking event failed, spooling until sinker recovers: %v", err)
+		s.nextReplay = time.Now().Add(s.replayInterval)
+		if spoolErr := s.append(e); spoolErr != nil {
+			return fmt.Errorf("sinking event: %v: %w", err, spoolErr)
+		}
+	}
+
+	return nil
+}
+
+// SinksBatches reports whether the wrapped sinker sinks batches.
+func (s *Sinker) SinksBatches() bool {
+	_, ok := batch.AsSinker(s.sinker)
+	return ok
+}
+
+// SinkBatch sinks the events as a batch, spooling those which fail. As with Sink, while
+// the spool holds events the whole batch is spooled. Within a batch, events which succeed
+// may overtake events which fail and are spooled.
+func (s *Sinker) SinkBatch(events []*event.Event) error {
+	return s.SinkBatchContext(context.Background(), events)
+}
+
+// SinkBatchContext sinks, or spools, the events as SinkBatch does, passing the context on
+// to the wrapped sinker if it accepts one, including when replaying the spool.
+func (s *Sinker) SinkBatchContext(ctx context.Context, events []*event.Event) error {
+	if s.spool.Len() != 0 && time.Now().After(s.nextReplay) {
+		s.replay(ctx, s.replayChunk)
+	}
+
+	if s.spool.Len() != 0 {
+		errs := make([]error, len(events))
+		for i, e := range events {
+			errs[i] = s.append(e)
+		}
+
+		return batch.NewError(errs)
+	}
+
+	errs := batch.EventErrors(batch.SinkContext(ctx, s.sinker, events), len(events))
+	spooling := false
+	for i, err := range errs {
+		if err == nil || retry.IsPermanent(err) {
+			continue
+		}
+
+		if !spooling {
+			log.Printf("Warning: sinking events failed, spooling until sinker recovers: %v", err)
+			s.nextReplay = time.Now().Add(s.replayInterval)
+			spooling = true
+		}
+
+		errs[i] = nil
+		if spoolErr := s.append(events[i]); spoolErr != nil {
+			errs[i] = fmt.Errorf("sinking event: %v: %w", err, spoolErr)
+		}
+	}
+
+	return batch.NewError(errs)
+}
+
+// Replay sinks the spooled events, oldest first, stopping at the first failure.
+// The error from the failing sink is returned. Events which fail with a permanent error
+// are discarded, so they do not prevent the events after them from being replayed.
+func (s *Sinker) Replay() error {
+	return s.ReplayContext(context.Background())
+}
+
+// ReplayContext replays the spooled events as Replay does, passing the context on to the
+// wrapped sinker if it accepts one.
+func (s *Sinker) ReplayContext(ctx context.Context) error {
+	return s.replay(ctx, 0)
+}
+
+// Replay replays at most max spooled events, or all of them if max is zero.
+func (s *Sinker) replay(ctx context.Context, max int) error {
+	replayed := 0
+	for s.spool.Len() != 0 && (max == 0 || replayed < max) {
+		e, err := s.spool.Peek()
+		if err != nil {
+			return fmt.Errorf("reading spooled event: %w", err)
+		}
+
+		if err := contextual.Sink(ctx, s.sinker, e); err != nil {
+			if !retry.IsPermanent(err) {
+				s.nextReplay = time.Now().Add(s.replayInterval)
+				return fmt.Errorf("replaying spooled event: %w", err)
+			}
+
+			log.Printf("Error: discarding spooled event which failed permanently: %v", err)
+		}
+
+		if err := s.spool.Commit(); err != nil {
+			return fmt.Errorf("committing spooled event: %w", err)
+		}
+		replayed++
+		s.replayed++
+	}
+
+	if replayed != 0 && s.spool.Len() == 0 {
+		log.Printf("replayed %d spooled events, spool is empty", s.replayed)
+		s.replayed = 0
+	}
+
+	return nil
+}
+
+// RegisterDoneChannel passes the done channel on to the wrapped sinker, if it accepts one.
+func (s *Sinker) RegisterDoneChannel(done <-chan struct{}) {
+	if registerer, ok := s.sinker.(interface{ RegisterDoneChannel(<-chan struct{}) }); ok {
+		registerer.RegisterDoneChannel(done)
+	}
+}
+
+// Pending returns the number of events waiting in the spool.
+func (s *Sinker) Pending() int {
+	return s.spool.Len()
+}
+
+func (s *Sinker) append(e *event.Event) error {
+	if err := s.spool.Append(e); err != nil {
+		return fmt.Errorf("spooling event: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit/pkg/batch"
+	"github.com/jhwbarlow/tcp-audit/pkg/retry"
+)
+
+type mockSinker struct {
+	errToReturn error
+	received    []*event.Event
+}
+
+func (ms *mockSinker) Sink(e *event.Event) error {
+	if ms.errToReturn != nil {
+		return ms.errToReturn
+	}
+
+	ms.received = append(ms.received, e)
+	return nil
+}
+
+func TestSinkerSpoolsAndReplaysInOrder(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 0)
+	defer spool.Close()
+
+	mockSinker := &mockSinker{errToReturn: errors.New("mock sinker error")}
+	sinker := NewSinker(mockSinker, spool, 0)
+
+	// The sinker is failing, so the events must be spooled
+	for i := 1; i <= 2; i++ {
+		if err := sinker.Sink(&event.Event{PIDOnCPU: i}); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	if sinker.Pending() != 2 {
+		t.Fatalf("expected 2 spooled events, got %d", sinker.Pending())
+	}
+
+	// The sinker has recovered, so the spooled events must be replayed before the new one
+	mockSinker.errToReturn = nil
+	if err := sinker.Sink(&event.Event{PIDOnCPU: 3}); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mockSinker.received) != 3 {
+		t.Fatalf("expected 3 sunk events, got %d", len(mockSinker.received))
+	}
+
+	for i, e := range mockSinker.received {
+		if e.PIDOnCPU != i+1 {
+			t.Errorf("expected event %d at position %d, got event %d", i+1, i, e.PIDOnCPU)
+		}
+	}
+
+	if sinker.Pending() != 0 {
+		t.Errorf("expected empty spool, got %d events", sinker.Pending())
+	}
+}
+
+func TestSinkerReplaysInChunks(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 0)
+	defer spool.Close()
+
+	mockSinker := &mockSinker{errToReturn: errors.New("mock sinker error")}
+	sinker := NewSinker(mockSinker, spool, 0)
+	sinker.replayChunk = 2
+
+	for i := 1; i <= 5; i++ {
+		if err := sinker.Sink(&event.Event{PIDOnCPU: i}); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	// Each sink replays a chunk, and spools the new event behind the rest of the spool
+	mockSinker.errToReturn = nil
+	if err := sinker.Sink(&event.Event{PIDOnCPU: 6}); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mockSinker.received) != 2 || sinker.Pending() != 4 {
+		t.Fatalf("expected 2 sunk and 4 spooled events, got %d and %d", len(mockSinker.received), sinker.Pending())
+	}
+
+	for i := 7; sinker.Pending() != 0; i++ {
+		if err := sinker.Sink(&event.Event{PIDOnCPU: i}); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	for i, e := range mockSinker.received {
+		if e.PIDOnCPU != i+1 {
+			t.Errorf("expected event %d at position %d, got event %d", i+1, i, e.PIDOnCPU)
+		}
+	}
+}
+
+func TestSinkerErrorWhenSpoolFull(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 10)
+	defer spool.Close()
+
+	mockErr := errors.New("mock sinker error")
+	sinker := NewSinker(&mockSinker{errToReturn: mockErr}, spool, 0)
+
+	err := sinker.Sink(new(event.Event))
+	if !errors.Is(err, ErrFull) {
+		t.Errorf("expected error chain to include %q, got %v", ErrFull, err)
+	}
+
+	t.Logf("got error %v (of type %T)", err, err)
+}
+
+func TestSinkerDoesNotSpoolPermanentError(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 0)
+	defer spool.Close()
+
+	mockErr := retry.Permanent(errors.New("mock permanent error"))
+	sinker := NewSinker(&mockSinker{errToReturn: mockErr}, spool, 0)
+
+	if err := sinker.Sink(new(event.Event)); !errors.Is(err, mockErr) {
+		t.Errorf("expected error chain to include %q, got %v", mockErr, err)
+	}
+
+	if sinker.Pending() != 0 {
+		t.Errorf("expected event not to be spooled, got %d spooled events", sinker.Pending())
+	}
+}
+
+// mockBatchSinker fails the events whose PIDOnCPU is even while failing is set.
+type mockBatchSinker struct {
+	mockSinker
+	failing bool
+}
+
+func (mbs *mockBatchSinker) SinkBatch(events []*event.Event) error {
+	errs := make([]error, len(events))
+	for i, e := range events {
+		if mbs.failing && e.PIDOnCPU%2 == 0 {
+			errs[i] = errors.New("mock sinker error")
+			continue
+		}
+
+		mbs.received = append(mbs.received, e)
+	}
+
+	return batch.NewError(errs)
+}
+
+func TestSinkerSpoolsFailedEventsOfBatch(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 0)
+	defer spool.Close()
+
+	mockBatchSinker := &mockBatchSinker{failing: true}
+	sinker := NewSinker(mockBatchSinker, spool, 0)
+
+	if !sinker.SinksBatches() {
+		t.Fatal("expected sinker to sink batches, but does not")
+	}
+
+	events := []*event.Event{{PIDOnCPU: 1}, {PIDOnCPU: 2}, {PIDOnCPU: 3}}
+	if err := sinker.SinkBatch(events); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if sinker.Pending() != 1 || len(mockBatchSinker.received) != 2 {
+		t.Fatalf("expected 1 spooled and 2 sunk events, got %d spooled and %d sunk",
+			sinker.Pending(),
+			len(mockBatchSinker.received))
+	}
+
+	// While the spool holds events, a batch is spooled unless the replay succeeds
+	mockBatchSinker.failing = false
+	if err := sinker.SinkBatch([]*event.Event{{PIDOnCPU: 4}}); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if sinker.Pending() != 0 {
+		t.Errorf("expected empty spool, got %d events", sinker.Pending())
+	}
+
+	var pids []int
+	for _, e := range mockBatchSinker.received {
+		pids = append(pids, e.PIDOnCPU)
+	}
+
+	if len(pids) != 4 || pids[2] != 2 || pids[3] != 4 {
+		t.Errorf("expected spooled event to be replayed before the next batch, got order %v", pids)
+	}
+}
+
+type mockContextSinker struct {
+	mockSinker
+	ctxs []context.Context
+}
+
+func (mcs *mockContextSinker) SinkContext(ctx context.Context, e *event.Event) error {
+	mcs.ctxs = append(mcs.ctxs, ctx)
+	return mcs.Sink(e)
+}
+
+func TestSinkerContextPassedOnWhenReplaying(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 0)
+	defer spool.Close()
+
+	mockContextSinker := &mockContextSinker{mockSinker: mockSinker{errToReturn: errors.New("mock sinker error")}}
+	sinker := NewSinker(mockContextSinker, spool, 0)
+
+	if err := sinker.Sink(new(event.Event)); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	mockContextSinker.errToReturn = nil
+	mockContextSinker.ctxs = nil
+	if err := sinker.SinkContext(ctx, new(event.Event)); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mockContextSinker.ctxs) != 2 {
+		t.Fatalf("expected spooled and new events to be sunk, got %d sinks", len(mockContextSinker.ctxs))
+	}
+
+	for i, sinkCtx := range mockContextSinker.ctxs {
+		if sinkCtx.Value(ctxKey{}) != true {
+			t.Errorf("expected context to be passed on for sink %d, but was not", i)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+const (
+	headerLen       = 8 // 4 byte payload length + 4 byte CRC of payload
+	offsetFileLen   = 12
+	offsetSuffix    = ".offset"
+	corruptSuffix   = ".corrupt"
+	maxRecordLength = 1 << 20
+)
+
+var (
+	// ErrFull is returned by Append if the event would take the spool over its maximum size.
+	ErrFull = errors.New("spool full")
+
+	// ErrCorrupt is returned if a record fails its integrity check.
+	ErrCorrupt = errors.New("spool record corrupt")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// SyncPolicy determines when the spool file is fsync'd after an append.
+// A positive policy is the minimum interval between fsyncs.
+type SyncPolicy time.Duration
+
+const (
+	// SyncAlways fsyncs after every append.
+	SyncAlways SyncPolicy = 0
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = -1
+)
+
+// ParseSyncPolicy parses "always", "never" or a duration string giving the minimum
+// interval between fsyncs.
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch policy {
+	case "always":
+		return SyncAlways, nil
+	case "never":
+		return SyncNever, nil
+	}
+
+	interval, err := time.ParseDuration(policy)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("sync policy %q is not \"always\", \"never\" or a positive duration", policy)
+	}
+
+	return SyncPolicy(interval), nil
+}
+
+func (p SyncPolicy) String() string {
+	switch {
+	case p == SyncAlways:
+		return "always"
+	case p < 0:
+		return "never"
+	default:
+		return time.Duration(p).String()
+	}
+}
+
+// Spool is a durable, append-only, on-disk FIFO queue of events.
+// Each record is stored with its length and a CRC so that corruption (for example, from
+// a partial write during a crash) is detected when the spool is opened.
+// The offset of the oldest unconsumed record is stored in a separate offset file, so that
+// consumed records are not replayed after a restart. Once every record has been consumed,
+// the spool file is truncated.
+// A Spool is not safe for concurrent use.
+type Spool struct {
+	file       *os.File
+	path       string
+	maxBytes   int64
+	syncPolicy SyncPolicy
+	lastSync   time.Time
+
+	readOff, writeOff int64
+	records           int
+	peekLen           int64
+	discarded         int64
+}
+
+// Open opens the spool at the given path, creating it if it does not exist.
+// Any existing records are validated. If a corrupt record is found, it and every record
+// after it are moved to a file with a ".corrupt" suffix and removed from the spool.
+// A maxBytes of 0 means the spool size is unlimited.
+func Open(path string, maxBytes int64, syncPolicy SyncPolicy) (*Spool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening spool file: %w", err)
+	}
+
+	s := &Spool{
+		file:       file,
+		path:       path,
+		maxBytes:   maxBytes,
+		syncPolicy: syncPolicy,
+		lastSync:   time.Now(),
+	}
+
+	if err := s.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Recover reads the offset file and validates every record after the offset.
+func (s *Spool) recover() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("getting spool file size: %w", err)
+	}
+	size := info.Size()
+
+	s.readOff = s.readOffset()
+	if s.readOff > size {
+		s.readOff = 0 // Replaying events again is better than losing them
+	}
+
+	off := s.readOff
+	for off < size {
+		recordLen, err := s.validateRecord(off, size)
+		if err != nil {
+			if err := s.quarantine(off, size); err != nil {
+				return err
+			}
+			size = off
+			break
+		}
+
+		off += recordLen
+		s.records++
+	}
+	s.writeOff = size
+
+	return nil
+}
+
+// ValidateRecord checks the record at the given offset is complete and has a valid CRC,
+// returning its total length.
+func (s *Spool) validateRecord(off, size int64) (int64, error) {
+	if size-off < headerLen {
+		return 0, fmt.Errorf("%w: truncated header", ErrCorrupt)
+	}
+
+	_, recordLen, err := s.readRecord(off)
+	if err != nil {
+		return 0, err
+	}
+
+	if off+recordLen > size {
+		return 0, fmt.Errorf("%w: truncated payload", ErrCorrupt)
+	}
+
+	return recordLen, nil
+}
+
+// Quarantine moves the bytes from the given offset to the end of the file to a
+// separate file, then truncates the spool at the offset.
+func (s *Spool) quarantine(off, size int64) error {
+	corruptPath := fmt.Sprintf("%s%s.%d", s.path, corruptSuffix, time.Now().UnixNano())
+	corruptFile, err := os.OpenFile(corruptPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("creating corrupt spool file: %w", err)
+	}
+	defer corruptFile.Close()
+
+	if _, err := io.Copy(corruptFile, io.NewSectionReader(s.file, off, size-off)); err != nil {
+		return fmt.Errorf("copying corrupt spool records: %w", err)
+	}
+
+	if err := s.file.Truncate(off); err != nil {
+		return fmt.Errorf("truncating corrupt spool records: %w", err)
+	}
+
+	s.discarded = size - off
+	return nil
+}
+
+// Discarded returns the number of bytes of corrupt records removed when the spool was opened.
+func (s *Spool) Discarded() int64 {
+	return s.discarded
+}
+
+// Len returns the number of unconsumed records in the spool.
+func (s *Spool) Len() int {
+	return s.records
+}
+
+// Size returns the size of the spool file in bytes.
+func (s *Spool) Size() int64 {
+	return s.writeOff
+}
+
+// Append adds an event to the end of the spool.
+func (s *Spool) Append(e *event.Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+
+	if len(payload) > maxRecordLength {
+		return fmt.Errorf("encoded event too large (%d bytes)", len(payload))
+	}
+
+	record := make([]byte, headerLen+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[headerLen:], payload)
+
+	if s.maxBytes > 0 && s.writeOff+int64(len(record)) > s.maxBytes {
+		return ErrFull
+	}
+
+	if _, err := s.file.WriteAt(record, s.writeOff); err != nil {
+		// Remove any partially written record, so it is not mistaken for corruption
+		s.file.Truncate(s.writeOff)
+		return fmt.Errorf("writing spool record: %w", err)
+	}
+	s.writeOff += int64(len(record))
+	s.records++
+
+	return s.maybeSync(s.file)
+}
+
+// Peek returns the oldest unconsumed event, without consuming it.
+// It returns io.EOF if the spool is empty.
+func (s *Spool) Peek() (*event.Event, error) {
+	if s.records == 0 {
+		return nil, io.EOF
+	}
+
+	payload, recordLen, err := s.readRecord(s.readOff)
+	if err != nil {
+		return nil, err
+	}
+
+	e := new(event.Event)
+	if err := json.Unmarshal(payload, e); err != nil {
+		return nil, fmt.Errorf("%w: decoding event: %v", ErrCorrupt, err)
+	}
+	s.peekLen = recordLen
+
+	return e, nil
+}
+
+// Commit consumes the event returned by the last call to Peek.
+func (s *Spool) Commit() error {
+	if s.peekLen == 0 {
+		return errors.New("commit without peek")
+	}
+
+	s.readOff += s.peekLen
+	s.peekLen = 0
+	s.records--
+
+	if s.records == 0 {
+		// Every record has been consumed, so reclaim the space
+		if err := s.file.Truncate(0); err != nil {
+			return fmt.Errorf("truncating drained spool: %w", err)
+		}
+		s.readOff, s.writeOff = 0, 0
+	}
+
+	return s.writeReadOffset()
+}
+
+// Close syncs and closes the spool file.
+func (s *Spool) Close() error {
+	if s.syncPolicy != SyncNever {
+		if err := s.file.Sync(); err != nil {
+			s.file.Close()
+			return fmt.Errorf("syncing spool file: %w", err)
+		}
+	}
+
+	return s.file.Close()
+}
+
+func (s *Spool) readRecord(off int64) (payload []byte, recordLen int64, err error) {
+	header := make([]byte, headerLen)
+	if _, err := s.file.ReadAt(header, off); err != nil {
+		return nil, 0, fmt.Errorf("%w: reading header: %v", ErrCorrupt, err)
+	}
+
+	payloadLen := binary.BigEndian.Uint32(header[0:4])
+	if payloadLen > maxRecordLength {
+		return nil, 0, fmt.Errorf("%w: implausible record length %d", ErrCorrupt, payloadLen)
+	}
+
+	payload = make([]byte, payloadLen)
+	if _, err := s.file.ReadAt(payload, off+headerLen); err != nil {
+		return nil, 0, fmt.Errorf("%w: reading payload: %v", ErrCorrupt, err)
+	}
+
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, fmt.Errorf("%w: CRC mismatch", ErrCorrupt)
+	}
+
+	return payload, headerLen + int64(payloadLen), nil
+}
+
+// ReadOffset returns the read offset stored in the offset file, or zero if the offset file
+// does not exist or is corrupt.
+func (s *Spool) readOffset() int64 {
+	data, err := ioutil.ReadFile(s.path + offsetSuffix)
+	if err != nil || len(data) != offsetFileLen {
+		return 0
+	}
+
+	if crc32.Checksum(data[0:8], crcTable) != binary.BigEndian.Uint32(data[8:12]) {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(data[0:8]))
+}
+
+// WriteReadOffset atomically replaces the offset file with the current read offset.
+func (s *Spool) writeReadOffset() error {
+	data := make([]byte, offsetFileLen)
+	binary.BigEndian.PutUint64(data[0:8], uint64(s.readOff))
+	binary.BigEndian.PutUint32(data[8:12], crc32.Checksum(data[0:8], crcTable))
+
+	tmpPath := s.path + offsetSuffix + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("creating spool offset file: %w", err)
+	}
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("writing spool offset file: %w", err)
+	}
+
+	if err := s.maybeSync(tmpFile); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("closing spool offset file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, s.path+offsetSuffix); err != nil {
+		return fmt.Errorf("replacing spool offset file: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Spool) maybeSync(file *os.File) error {
+	switch {
+	case s.syncPolicy == SyncNever:
+		return nil
+	case s.syncPolicy > 0 && time.Since(s.lastSync) < time.Duration(s.syncPolicy):
+		return nil
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", file.Name(), err)
+	}
+	s.lastSync = time.Now()
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package spool
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+func openTestSpool(t *testing.T, dir string, maxBytes int64) *Spool {
+	spool, err := Open(filepath.Join(dir, "test.spool"), maxBytes, SyncAlways)
+	if err != nil {
+		t.Fatalf("opening spool: %v", err)
+	}
+
+	return spool
+}
+
+func TestSpoolAppendPeekCommit(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 0)
+	defer spool.Close()
+
+	for i := 1; i <= 2; i++ {
+		if err := spool.Append(&event.Event{PIDOnCPU: i}); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	for i := 1; i <= 2; i++ {
+		e, err := spool.Peek()
+		if err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		if e.PIDOnCPU != i {
+			t.Errorf("expected event %d, got event %d", i, e.PIDOnCPU)
+		}
+
+		if err := spool.Commit(); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	if _, err := spool.Peek(); err != io.EOF {
+		t.Errorf("expected EOF from drained spool, got %v", err)
+	}
+
+	if spool.Size() != 0 {
+		t.Errorf("expected drained spool to be truncated, got size %d", spool.Size())
+	}
+}
+
+func TestSpoolSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, dir, 0)
+	for i := 1; i <= 3; i++ {
+		spool.Append(&event.Event{PIDOnCPU: i})
+	}
+
+	// Consume the first event only
+	spool.Peek()
+	spool.Commit()
+	spool.Close()
+
+	spool = openTestSpool(t, dir, 0)
+	defer spool.Close()
+
+	if spool.Len() != 2 {
+		t.Fatalf("expected 2 events in reopened spool, got %d", spool.Len())
+	}
+
+	e, err := spool.Peek()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if e.PIDOnCPU != 2 {
+		t.Errorf("expected first unconsumed event 2, got event %d", e.PIDOnCPU)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 10)
+	defer spool.Close()
+
+	if err := spool.Append(new(event.Event)); err != ErrFull {
+		t.Errorf("expected %v, got %v", ErrFull, err)
+	}
+}
+
+func TestSpoolCorruptionQuarantined(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, dir, 0)
+	spool.Append(&event.Event{PIDOnCPU: 1})
+	validSize := spool.Size()
+	spool.Append(&event.Event{PIDOnCPU: 2})
+	spool.Close()
+
+	// Corrupt the payload of the second record
+	file, err := os.OpenFile(filepath.Join(dir, "test.spool"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("opening spool file: %v", err)
+	}
+	file.WriteAt([]byte("X"), validSize+headerLen+1)
+	file.Close()
+
+	spool = openTestSpool(t, dir, 0)
+	defer spool.Close()
+
+	if spool.Len() != 1 {
+		t.Errorf("expected 1 valid event, got %d", spool.Len())
+	}
+
+	if spool.Discarded() == 0 {
+		t.Error("expected corrupt bytes to be discarded, but were not")
+	}
+
+	corruptFiles, _ := filepath.Glob(filepath.Join(dir, "test.spool"+corruptSuffix+".*"))
+	if len(corruptFiles) != 1 {
+		t.Errorf("expected 1 corrupt file, got %d", len(corruptFiles))
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, policy := range []string{"always", "never", "1s"} {
+		parsed, err := ParseSyncPolicy(policy)
+		if err != nil {
+			t.Errorf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		if parsed.String() != policy {
+			t.Errorf("expected policy %q, got %q", policy, parsed)
+		}
+	}
+
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
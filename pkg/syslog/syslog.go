@@ -0,0 +1,534 @@
+package syslog
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+	"golang.org/x/sys/unix"
+)
+
+// The plugin options.
+const (
+	NetworkOption            = "network"
+	AddressOption            = "address"
+	FacilityOption           = "facility"
+	SeverityOption           = "severity"
+	HostnameOption           = "hostname"
+	AppNameOption            = "app-name"
+	EnterpriseIDOption       = "enterprise-id"
+	TimeoutOption            = "timeout"
+	CAFileOption             = "ca-file"
+	CertFileOption           = "cert-file"
+	KeyFileOption            = "key-file"
+	ServerNameOption         = "server-name"
+	InsecureSkipVerifyOption = "insecure-skip-verify"
+)
+
+// The networks over which messages can be sent.
+const (
+	NetworkUnix = "unix" // A local socket, such as /dev/log, either datagram or stream
+	NetworkUDP  = "udp"
+	NetworkTCP  = "tcp"
+	NetworkTLS  = "tls"
+)
+
+const (
+	defaultAddress      = "/dev/log"
+	defaultAppName      = "tcp-audit"
+	defaultEnterpriseID = "32473" // Reserved for documentation by RFC 5612, so should be replaced
+	defaultTimeout      = 5 * time.Second
+
+	msgID    = "TCPSTATE"
+	nilValue = "-"
+
+	// Header field lengths, from RFC 5424 section 6
+	maxHostnameLen = 255
+	maxAppNameLen  = 48
+	maxProcIDLen   = 128
+	maxMsgIDLen    = 32
+)
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var severities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// Options configure a Sinker.
+type Options struct {
+	Network      string
+	Address      string
+	Facility     int
+	Severity     int
+	Hostname     string
+	AppName      string
+	EnterpriseID string        // Private enterprise number used in the structured data IDs
+	Timeout      time.Duration // Limit on connecting and on each write
+	TLSConfig    *tls.Config   // Used for NetworkTLS
+}
+
+// Sinker is a sink.Sinker which sends each event as an RFC 5424 syslog message, with the
+// connection's addresses, ports, states, PID and command in structured data.
+// Messages are sent as one datagram each over unix datagram sockets and UDP, with octet
+// counting framing (RFC 6587) over TCP and TLS, and terminated by a newline over unix
+// stream sockets.
+// If the connection is lost, the Sinker reconnects before sending the next message. If
+// sending fails, it reconnects and tries once more before returning the error.
+// The methods are safe for concurrent use.
+type Sinker struct {
+	options Options
+	procID  string
+
+	sdIDs [2]string
+
+	mutex sync.Mutex
+	conn  *connection // Nil when not connected
+}
+
+// Connection is a connection to the syslog server.
+type connection struct {
+	net.Conn
+	raw     syscall.Conn // The underlying socket, beneath any TLS
+	network string       // The network actually dialled, which for NetworkUnix is unixgram or unix
+}
+
+// New returns a Sinker which sends messages as given by the options, connecting straight
+// away so that a bad address is reported at startup.
+func New(options Options) (*Sinker, error) {
+	switch options.Network {
+	case NetworkUnix, NetworkUDP, NetworkTCP, NetworkTLS:
+	default:
+		return nil, fmt.Errorf("unknown network %q (expected %s, %s, %s or %s)",
+			options.Network, NetworkUnix, NetworkUDP, NetworkTCP, NetworkTLS)
+	}
+
+	s := &Sinker{
+		options: options,
+		procID:  truncate(printable(strconv.Itoa(os.Getpid())), maxProcIDLen),
+		sdIDs:   [2]string{"tcp@" + options.EnterpriseID, "socket@" + options.EnterpriseID},
+	}
+	s.options.Hostname = truncate(printable(options.Hostname), maxHostnameLen)
+	s.options.AppName = truncate(printable(options.AppName), maxAppNameLen)
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewWithConfig is the plugin constructor. By default, messages are sent to the local
+// /dev/log socket with the local0 facility and info severity.
+func NewWithConfig(config map[string]string) (sink.Sinker, error) {
+	c := pluginconfig.Config(config)
+	if err := c.CheckKeys(NetworkOption,
+		AddressOption,
+		FacilityOption,
+		SeverityOption,
+		HostnameOption,
+		AppNameOption,
+		EnterpriseIDOption,
+		TimeoutOption,
+		CAFileOption,
+		CertFileOption,
+		KeyFileOption,
+		ServerNameOption,
+		InsecureSkipVerifyOption); err != nil {
+		return nil, err
+	}
+
+	options := Options{
+		Network:      valueOr(c, NetworkOption, NetworkUnix),
+		Address:      c[AddressOption],
+		AppName:      valueOr(c, AppNameOption, defaultAppName),
+		EnterpriseID: valueOr(c, EnterpriseIDOption, defaultEnterpriseID),
+		Hostname:     c[HostnameOption],
+	}
+
+	if options.Address == "" {
+		if options.Network != NetworkUnix {
+			return nil, fmt.Errorf("option %s required for network %s", AddressOption, options.Network)
+		}
+		options.Address = defaultAddress
+	}
+
+	if options.Hostname == "" {
+		options.Hostname, _ = os.Hostname() // The nil value is used if this fails
+	}
+
+	var ok bool
+	if options.Facility, ok = facilities[valueOr(c, FacilityOption, "local0")]; !ok {
+		return nil, fmt.Errorf("option %s: unknown facility %q", FacilityOption, c[FacilityOption])
+	}
+
+	if options.Severity, ok = severities[valueOr(c, SeverityOption, "info")]; !ok {
+		return nil, fmt.Errorf("option %s: unknown severity %q", SeverityOption, c[SeverityOption])
+	}
+
+	if _, err := strconv.ParseUint(options.EnterpriseID, 10, 32); err != nil {
+		return nil, fmt.Errorf("option %s: must be a private enterprise number: %w", EnterpriseIDOption, err)
+	}
+
+	var err error
+	if options.Timeout, err = c.Duration(TimeoutOption, defaultTimeout); err != nil {
+		return nil, err
+	}
+
+	if options.Network == NetworkTLS {
+		if options.TLSConfig, err = tlsConfig(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return New(options)
+}
+
+func valueOr(c pluginconfig.Config, key, def string) string {
+	if value, ok := c[key]; ok && value != "" {
+		return value
+	}
+
+	return def
+}
+
+func tlsConfig(c pluginconfig.Config) (*tls.Config, error) {
+	config := &tls.Config{ServerName: c[ServerNameOption]}
+
+	var err error
+	if config.InsecureSkipVerify, err = c.Bool(InsecureSkipVerifyOption, false); err != nil {
+		return nil, err
+	}
+
+	if caFile := c[CAFileOption]; caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+	}
+
+	certFile, keyFile := c[CertFileOption], c[KeyFileOption]
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("options %s and %s must be given together", CertFileOption, KeyFileOption)
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func (s *Sinker) Sink(e *event.Event) error {
+	return s.sendMessage(s.format(e))
+}
+
+// SinkRecord sends the record as a message whose MSGID is the kind of record, in upper
+// case, and whose text is the record as JSON, so that a Sinker may be used to sink records,
+// such as flow records and alerts, as well as events.
+func (s *Sinker) SinkRecord(kind string, record interface{}) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encoding %s record: %w", kind, err)
+	}
+
+	return s.sendMessage(s.formatRecord(time.Now(), kind, body))
+}
+
+// SendMessage sends the message, reconnecting if needed.
+func (s *Sinker) sendMessage(msg []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn != nil && !s.alive() {
+		s.disconnect()
+	}
+
+	if err := s.send(msg); err != nil {
+		// The connection may have been lost since the last message, so try once more
+		// on a new connection
+		s.disconnect()
+		if retryErr := s.send(msg); retryErr != nil {
+			return fmt.Errorf("sending syslog message: %w", retryErr)
+		}
+	}
+
+	return nil
+}
+
+func (s *Sinker) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Send sends the message, connecting first if not connected. The mutex must be held.
+func (s *Sinker) send(msg []byte) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+
+	if s.options.Timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.options.Timeout))
+	}
+
+	_, err := s.conn.Write(frame(s.conn.network, msg))
+	return err
+}
+
+func (s *Sinker) connect() error {
+	conn, err := s.dial()
+	if err != nil {
+		return fmt.Errorf("connecting to syslog server: %w", err)
+	}
+
+	s.conn = conn
+	return nil
+}
+
+func (s *Sinker) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *Sinker) dial() (*connection, error) {
+	dialer := &net.Dialer{Timeout: s.options.Timeout}
+
+	switch s.options.Network {
+	case NetworkUnix:
+		// The local socket is usually a datagram socket, but may be a stream socket
+		conn, err := dialer.Dial("unixgram", s.options.Address)
+		if err == nil {
+			return newConnection(conn, conn, "unixgram"), nil
+		}
+
+		conn, streamErr := dialer.Dial("unix", s.options.Address)
+		if streamErr != nil {
+			return nil, err
+		}
+
+		return newConnection(conn, conn, "unix"), nil
+	case NetworkTLS:
+		conn, err := dialer.Dial("tcp", s.options.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConn, err := s.handshake(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return newConnection(tlsConn, conn, NetworkTLS), nil
+	default:
+		conn, err := dialer.Dial(s.options.Network, s.options.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		return newConnection(conn, conn, s.options.Network), nil
+	}
+}
+
+func newConnection(conn, raw net.Conn, network string) *connection {
+	// All the connections dialled are sockets
+	return &connection{Conn: conn, raw: raw.(syscall.Conn), network: network}
+}
+
+// Handshake performs the TLS handshake over the connection, within the timeout.
+func (s *Sinker) handshake(conn net.Conn) (net.Conn, error) {
+	config := s.options.TLSConfig.Clone()
+	if config == nil {
+		config = new(tls.Config)
+	}
+
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(s.options.Address)
+	}
+
+	if s.options.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.options.Timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+
+	return tlsConn, nil
+}
+
+// Alive returns false if a stream connection has been closed by the server. As syslog
+// servers never send data, anything other than there being nothing to read, such as the
+// end of the stream or a TLS close notification, means the connection is closing.
+// Datagram connections are always alive. The mutex must be held.
+func (s *Sinker) alive() bool {
+	if s.conn.network == "unixgram" || s.conn.network == NetworkUDP {
+		return true
+	}
+
+	rawConn, err := s.conn.raw.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var peekErr error
+	if err := rawConn.Read(func(fd uintptr) bool {
+		_, _, peekErr = unix.Recvfrom(int(fd), make([]byte, 1), unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		return true // Never wait for the socket to become readable
+	}); err != nil {
+		return false
+	}
+
+	return peekErr == unix.EAGAIN
+}
+
+// Frame frames the message for the network.
+func frame(network string, msg []byte) []byte {
+	switch network {
+	case NetworkTCP, NetworkTLS:
+		return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	case "unix":
+		return append(msg, '\n')
+	default:
+		return msg
+	}
+}
+
+// Format formats the event as an RFC 5424 message.
+func (s *Sinker) format(e *event.Event) []byte {
+	b := new(strings.Builder)
+	s.writeHeader(b, e.Time, msgID)
+
+	writeElement(b, s.sdIDs[0],
+		"srcIP", e.SourceIP.String(),
+		"srcPort", strconv.Itoa(int(e.SourcePort)),
+		"dstIP", e.DestIP.String(),
+		"dstPort", strconv.Itoa(int(e.DestPort)),
+		"oldState", e.OldState.String(),
+		"newState", e.NewState.String(),
+		"pid", strconv.Itoa(e.PIDOnCPU),
+		"comm", e.CommandOnCPU)
+
+	if si := e.SocketInfo; si != nil {
+		writeElement(b, s.sdIDs[1],
+			"id", si.ID,
+			"inode", strconv.FormatUint(uint64(si.INode), 10),
+			"uid", strconv.FormatUint(uint64(si.UID), 10),
+			"gid", strconv.FormatUint(uint64(si.GID), 10),
+			"state", si.SocketState.String())
+	}
+
+	fmt.Fprintf(b, " %s:%d -> %s:%d %s -> %s",
+		e.SourceIP,
+		e.SourcePort,
+		e.DestIP,
+		e.DestPort,
+		e.OldState,
+		e.NewState)
+
+	return []byte(b.String())
+}
+
+// FormatRecord formats the JSON of a record as an RFC 5424 message, without structured
+// data.
+func (s *Sinker) formatRecord(t time.Time, kind string, body []byte) []byte {
+	b := new(strings.Builder)
+	s.writeHeader(b, t, truncate(printable(strings.ToUpper(kind)), maxMsgIDLen))
+	fmt.Fprintf(b, "%s %s", nilValue, body)
+
+	return []byte(b.String())
+}
+
+// WriteHeader writes the header of a message, up to the structured data.
+func (s *Sinker) writeHeader(w io.Writer, t time.Time, msgID string) {
+	fmt.Fprintf(w, "<%d>1 %s %s %s %s %s ",
+		s.options.Facility*8+s.options.Severity,
+		t.Format("2006-01-02T15:04:05.000000Z07:00"),
+		orNil(s.options.Hostname),
+		orNil(s.options.AppName),
+		orNil(s.procID),
+		orNil(msgID))
+}
+
+// WriteElement writes a structured data element with the given parameter names and values.
+func writeElement(w io.Writer, id string, params ...string) {
+	fmt.Fprintf(w, "[%s", id)
+	for i := 0; i+1 < len(params); i += 2 {
+		fmt.Fprintf(w, ` %s="%s"`, params[i], escapeParamValue(params[i+1]))
+	}
+	fmt.Fprint(w, "]")
+}
+
+// EscapeParamValue escapes the characters which RFC 5424 requires to be escaped in
+// parameter values.
+func escapeParamValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// Printable removes characters which are not allowed in header fields, which must be
+// printable US-ASCII without spaces.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+
+	return s
+}
+
+func orNil(s string) string {
+	if s == "" {
+		return nilValue
+	}
+
+	return s
+}
@@ -0,0 +1,477 @@
+package syslog
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+var _ sink.SinkerCloser = new(Sinker)
+
+func newTestEvent() *event.Event {
+	return &event.Event{
+		Time:         time.Date(2021, 9, 28, 21, 12, 36, 123456789, time.UTC),
+		PIDOnCPU:     7337,
+		CommandOnCPU: `cu"r]l\`,
+		SourceIP:     net.ParseIP("10.0.0.1"),
+		DestIP:       net.ParseIP("10.0.0.2"),
+		SourcePort:   53712,
+		DestPort:     443,
+		OldState:     tcpstate.StateClosed,
+		NewState:     tcpstate.StateSynSent,
+	}
+}
+
+func newTestOptions(network, address string) Options {
+	return Options{
+		Network:      network,
+		Address:      address,
+		Facility:     16,
+		Severity:     6,
+		Hostname:     "host",
+		AppName:      "tcp-audit",
+		EnterpriseID: "32473",
+		Timeout:      5 * time.Second,
+	}
+}
+
+func newTestSinker(t *testing.T, options Options) *Sinker {
+	sinker, err := New(options)
+	if err != nil {
+		t.Fatalf("creating sinker: %v", err)
+	}
+
+	return sinker
+}
+
+func sinkEvent(t *testing.T, sinker *Sinker) {
+	if err := sinker.Sink(newTestEvent()); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+// ReadFramed reads an octet-counted message.
+func readFramed(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, count)
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return "", err
+	}
+
+	return string(msg), nil
+}
+
+// ServeStream accepts connections on the listener, sending the messages read on each to
+// the returned channel. If closeAfter is non-zero, each connection is closed by the
+// server after that many messages.
+func serveStream(listener net.Listener, closeAfter int) <-chan string {
+	msgs := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for count := 1; ; count++ {
+					msg, err := readFramed(reader)
+					if err != nil {
+						return
+					}
+					msgs <- msg
+
+					if count == closeAfter {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return msgs
+}
+
+func receive(t *testing.T, msgs <-chan string) string {
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return ""
+	}
+}
+
+func checkMessage(t *testing.T, msg string) {
+	if !strings.HasPrefix(msg, "<134>1 2021-09-28T21:12:36.123456Z host tcp-audit ") {
+		t.Errorf("unexpected header in message %q", msg)
+	}
+
+	expectedSD := ` TCPSTATE [tcp@32473 srcIP="10.0.0.1" srcPort="53712" dstIP="10.0.0.2" dstPort="443" ` +
+		`oldState="CLOSED" newState="SYN-SENT" pid="7337" comm="cu\"r\]l\\"] ` +
+		`10.0.0.1:53712 -> 10.0.0.2:443 CLOSED -> SYN-SENT`
+	if !strings.HasSuffix(msg, expectedSD) {
+		t.Errorf("expected message %q to end with %q", msg, expectedSD)
+	}
+}
+
+func TestSinkerUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer conn.Close()
+
+	sinker := newTestSinker(t, newTestOptions(NetworkUDP, conn.LocalAddr().String()))
+	defer sinker.Close()
+	sinkEvent(t, sinker)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+
+	checkMessage(t, string(buf[:n]))
+}
+
+func TestSinkerUnixDatagram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer conn.Close()
+
+	sinker := newTestSinker(t, newTestOptions(NetworkUnix, path))
+	defer sinker.Close()
+	sinkEvent(t, sinker)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+
+	checkMessage(t, string(buf[:n]))
+}
+
+func TestSinkerUnixStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+
+	sinker := newTestSinker(t, newTestOptions(NetworkUnix, path))
+	defer sinker.Close()
+	sinkEvent(t, sinker)
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accepting: %v", err)
+	}
+	defer conn.Close()
+
+	msg, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+
+	checkMessage(t, strings.TrimSuffix(msg, "\n"))
+}
+
+func TestSinkerTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+	msgs := serveStream(listener, 0)
+
+	sinker := newTestSinker(t, newTestOptions(NetworkTCP, listener.Addr().String()))
+	defer sinker.Close()
+	sinkEvent(t, sinker)
+	sinkEvent(t, sinker)
+
+	checkMessage(t, receive(t, msgs))
+	checkMessage(t, receive(t, msgs))
+}
+
+func TestSinkerTLS(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+	msgs := serveStream(listener, 0)
+
+	options := newTestOptions(NetworkTLS, listener.Addr().String())
+	options.TLSConfig = &tls.Config{RootCAs: pool}
+	sinker := newTestSinker(t, options)
+	defer sinker.Close()
+	sinkEvent(t, sinker)
+
+	checkMessage(t, receive(t, msgs))
+}
+
+func TestSinkerTLSUntrusted(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+	serveStream(listener, 0)
+
+	options := newTestOptions(NetworkTLS, listener.Addr().String())
+	options.TLSConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	_, err = New(options)
+	if err == nil {
+		t.Fatal("expected error connecting to untrusted server, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestSinkerReconnects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+	msgs := serveStream(listener, 1) // The server closes each connection after one message
+
+	sinker := newTestSinker(t, newTestOptions(NetworkTCP, listener.Addr().String()))
+	defer sinker.Close()
+
+	for i := 0; i < 3; i++ {
+		sinkEvent(t, sinker)
+		checkMessage(t, receive(t, msgs))
+
+		// Wait for the server's close to be seen, so that the next message is sent on a
+		// new connection rather than lost
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			sinker.mutex.Lock()
+			alive := sinker.alive()
+			sinker.mutex.Unlock()
+			if !alive {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for server to close connection")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestSinkerReconnectsAfterRestart(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	address := listener.Addr().String()
+	serveStream(listener, 0)
+
+	sinker := newTestSinker(t, newTestOptions(NetworkTCP, address))
+	defer sinker.Close()
+
+	// Take the server down, so sinking fails even after reconnecting
+	listener.Close()
+	sinker.mutex.Lock()
+	sinker.disconnect()
+	sinker.mutex.Unlock()
+
+	err = sinker.Sink(newTestEvent())
+	if err == nil {
+		t.Fatal("expected error with server down, got nil")
+	}
+	t.Logf("got error %q (of type %T)", err, err)
+
+	// Bring the server back on the same address
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("could not listen again on %s: %v", address, err)
+	}
+	defer listener.Close()
+	msgs := serveStream(listener, 0)
+
+	sinkEvent(t, sinker)
+	checkMessage(t, receive(t, msgs))
+}
+
+func TestSinkerSocketInfo(t *testing.T) {
+	sinker := &Sinker{options: newTestOptions(NetworkUDP, ""), procID: "42", sdIDs: [2]string{"tcp@1", "socket@1"}}
+	e := newTestEvent()
+	e.SocketInfo = &event.SocketInfo{
+		ID:          "ffff8880",
+		INode:       42,
+		UID:         1000,
+		GID:         1001,
+		SocketState: socketstate.StateConnecting,
+	}
+
+	msg := string(sinker.format(e))
+	expected := `][socket@1 id="ffff8880" inode="42" uid="1000" gid="1001" state="CONNECTING"] `
+	if !strings.Contains(msg, expected) {
+		t.Errorf("expected message %q to contain %q", msg, expected)
+	}
+
+	if !strings.Contains(msg, " host tcp-audit 42 TCPSTATE [tcp@1 ") {
+		t.Errorf("unexpected header in message %q", msg)
+	}
+}
+
+func TestSinkerSinkRecord(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer conn.Close()
+
+	sinker := newTestSinker(t, newTestOptions(NetworkUDP, conn.LocalAddr().String()))
+	defer sinker.Close()
+	if err := sinker.SinkRecord("dead-letter", map[string]int{"attempts": 3}); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<134>1 ") || !strings.HasSuffix(msg, ` DEAD-LETTER - {"attempts":3}`) {
+		t.Errorf("unexpected record message %q", msg)
+	}
+}
+
+func TestNewWithConfigOptions(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer conn.Close()
+
+	sinker, err := NewWithConfig(map[string]string{
+		NetworkOption:      NetworkUDP,
+		AddressOption:      conn.LocalAddr().String(),
+		FacilityOption:     "auth",
+		SeverityOption:     "notice",
+		HostnameOption:     "my host",
+		AppNameOption:      "audit",
+		EnterpriseIDOption: "99",
+		TimeoutOption:      "1s",
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	defer sinker.(*Sinker).Close()
+
+	expected := Options{
+		Network:      NetworkUDP,
+		Address:      conn.LocalAddr().String(),
+		Facility:     4,
+		Severity:     5,
+		Hostname:     "myhost",
+		AppName:      "audit",
+		EnterpriseID: "99",
+		Timeout:      time.Second,
+	}
+	if options := sinker.(*Sinker).options; options != expected {
+		t.Errorf("expected options %+v, got %+v", expected, options)
+	}
+}
+
+func TestNewWithConfigErrors(t *testing.T) {
+	for _, config := range []map[string]string{
+		{NetworkOption: "sctp", AddressOption: "127.0.0.1:514"},
+		{NetworkOption: NetworkTCP},
+		{NetworkOption: NetworkUDP, AddressOption: "127.0.0.1:514", FacilityOption: "nope"},
+		{NetworkOption: NetworkUDP, AddressOption: "127.0.0.1:514", SeverityOption: "nope"},
+		{NetworkOption: NetworkUDP, AddressOption: "127.0.0.1:514", EnterpriseIDOption: "acme"},
+		{NetworkOption: NetworkUDP, AddressOption: "127.0.0.1:514", TimeoutOption: "soon"},
+		{NetworkOption: NetworkTLS, AddressOption: "127.0.0.1:6514", CertFileOption: "cert.pem"},
+		{NetworkOption: NetworkUnix, AddressOption: filepath.Join(t.TempDir(), "missing")},
+		{NetworkOption: NetworkUDP, AddressOption: "127.0.0.1:514", "port": "514"},
+	} {
+		_, err := NewWithConfig(config)
+		if err == nil {
+			t.Errorf("expected error for options %v, got nil", config)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+// NewTestCertificate returns a self-signed certificate for 127.0.0.1, and a pool which
+// trusts it.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "syslog"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
@@ -0,0 +1,56 @@
+package transform
+
+import (
+	"fmt"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// Transformer is an interface which describes objects which drop, rewrite or enrich
+// TCP state change events between the Eventer and the Sinker.
+// Transform returns the events which replace the given event. Returning no events
+// drops the event, returning one event passes it on (possibly modified) and returning
+// many events adds new events to the stream.
+type Transformer interface {
+	Transform(*event.Event) ([]*event.Event, error)
+}
+
+// TransformerCloser is an interface which describes Transformers which must be closed when
+// no longer needed in order to free resources they have acquired.
+type TransformerCloser interface {
+	Transformer
+	Close() error
+}
+
+// TransformerLoader is an interface describing objects which create/"load" a Transformer.
+type TransformerLoader interface {
+	Load() (Transformer, error)
+}
+
+// Chain is a Transformer which applies each of its Transformers in order. Each event
+// returned by a Transformer is passed to the next Transformer in the chain.
+// An empty Chain passes events through unmodified.
+type Chain []Transformer
+
+func (c Chain) Transform(e *event.Event) ([]*event.Event, error) {
+	events := []*event.Event{e}
+	for i, transformer := range c {
+		transformed := make([]*event.Event, 0, len(events))
+		for _, e := range events {
+			out, err := transformer.Transform(e)
+			if err != nil {
+				return nil, fmt.Errorf("transformer %d: %w", i, err)
+			}
+
+			transformed = append(transformed, out...)
+		}
+
+		if len(transformed) == 0 {
+			return nil, nil
+		}
+
+		events = transformed
+	}
+
+	return events, nil
+}
@@ -0,0 +1,101 @@
+package transform
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+type mockTransformer struct {
+	transform func(*event.Event) ([]*event.Event, error)
+}
+
+func (mt *mockTransformer) Transform(e *event.Event) ([]*event.Event, error) {
+	return mt.transform(e)
+}
+
+func newDuplicatingTransformer() *mockTransformer {
+	return &mockTransformer{func(e *event.Event) ([]*event.Event, error) {
+		duplicate := *e
+		return []*event.Event{e, &duplicate}, nil
+	}}
+}
+
+func newIncrementingTransformer() *mockTransformer {
+	return &mockTransformer{func(e *event.Event) ([]*event.Event, error) {
+		e.PIDOnCPU++
+		return []*event.Event{e}, nil
+	}}
+}
+
+func newDroppingTransformer() *mockTransformer {
+	return &mockTransformer{func(e *event.Event) ([]*event.Event, error) {
+		return nil, nil
+	}}
+}
+
+func TestEmptyChainPassesEventThrough(t *testing.T) {
+	mockEvent := &event.Event{PIDOnCPU: 1}
+
+	events, err := Chain(nil).Transform(mockEvent)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(events) != 1 || events[0] != mockEvent {
+		t.Errorf("expected the event to be passed through, got %v", events)
+	}
+}
+
+func TestChainAppliesTransformersInOrder(t *testing.T) {
+	chain := Chain{newDuplicatingTransformer(), newIncrementingTransformer()}
+
+	events, err := chain.Transform(&event.Event{PIDOnCPU: 1})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	for _, e := range events {
+		if e.PIDOnCPU != 2 {
+			t.Errorf("expected every event to be transformed by the second transformer, got PID %d", e.PIDOnCPU)
+		}
+	}
+}
+
+func TestChainDropsEvent(t *testing.T) {
+	incrementingTransformer := newIncrementingTransformer()
+	chain := Chain{newDroppingTransformer(), incrementingTransformer}
+	mockEvent := &event.Event{PIDOnCPU: 1}
+
+	events, err := chain.Transform(mockEvent)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(events) != 0 {
+		t.Errorf("expected event to be dropped, got %v", events)
+	}
+
+	if mockEvent.PIDOnCPU != 1 {
+		t.Error("expected transformers after a drop not to be called, but were")
+	}
+}
+
+func TestChainError(t *testing.T) {
+	mockErr := errors.New("mock transformer error")
+	chain := Chain{&mockTransformer{func(*event.Event) ([]*event.Event, error) {
+		return nil, mockErr
+	}}}
+
+	_, err := chain.Transform(&event.Event{})
+	if !errors.Is(err, mockErr) {
+		t.Errorf("expected error chain to include %q, got %v", mockErr, err)
+	}
+
+	t.Logf("got error %v (of type %T)", err, err)
+}
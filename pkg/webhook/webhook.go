@@ -0,0 +1,433 @@
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit/pkg/jsonl"
+	"github.com/jhwbarlow/tcp-audit/pkg/pluginconfig"
+	"github.com/jhwbarlow/tcp-audit/pkg/retry"
+)
+
+// The plugin options.
+const (
+	URLOption             = "url"
+	BearerTokenOption     = "bearer-token"
+	BearerTokenFileOption = "bearer-token-file"
+	HMACSecretOption      = "hmac-secret"
+	HMACSecretFileOption  = "hmac-secret-file"
+	HMACHeaderOption      = "hmac-header"
+	GzipOption            = "gzip"
+	TimeoutOption         = "timeout"
+	MaxAttemptsOption     = "max-attempts"
+	InitialBackoffOption  = "initial-backoff"
+	MaxBackoffOption      = "max-backoff"
+
+	// HeaderOptionPrefix prefixes options giving a header to send with each request,
+	// such as "header.X-Api-Key".
+	HeaderOptionPrefix = "header."
+)
+
+const (
+	defaultHMACHeader     = "X-Signature-256"
+	defaultTimeout        = 10 * time.Second
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+	backoffJitter         = 0.2
+
+	hmacPrefix   = "sha256="
+	userAgent    = "tcp-audit"
+	maxErrorBody = 512 // The number of bytes of an error response's body kept in the error
+)
+
+// Options configure a Sinker.
+type Options struct {
+	URL         string
+	Headers     http.Header // Sent with each request
+	BearerToken string      // If set, sent in the Authorization header
+	HMACSecret  []byte      // If set, the body is signed with HMAC-SHA256, in HMACHeader
+	HMACHeader  string
+	Gzip        bool
+	Timeout     time.Duration // Limit on each request
+	Policy      retry.Policy  // Governs retries of requests failing with 429 or 5xx responses
+}
+
+// StatusError reports a request which failed with a non-2xx response.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string        // The start of the response body
+	RetryAfter time.Duration // The wait requested in the Retry-After header, if any
+}
+
+func (se *StatusError) Error() string {
+	if se.Body == "" {
+		return fmt.Sprintf("webhook responded %s", se.Status)
+	}
+
+	return fmt.Sprintf("webhook responded %s: %s", se.Status, se.Body)
+}
+
+// Sinker is a sink.Sinker which POSTs events, as a JSON array of the records written by
+// the jsonl package, to a URL. Batches of events are sent in a single request.
+// Requests failing with a 429 or 5xx response, or without any response, are retried
+// according to the policy, waiting instead as long as the server asks in a Retry-After
+// header. Other failed requests return a permanent error, as retrying cannot succeed.
+// A Sinker is not safe for concurrent use.
+type Sinker struct {
+	options Options
+	client  *http.Client
+	rnd     *rand.Rand
+	now     func() time.Time
+	after   func(time.Duration) <-chan time.Time
+}
+
+// New returns a Sinker which sends events as given by the options.
+func New(options Options) (*Sinker, error) {
+	if err := validateURL(options.URL); err != nil {
+		return nil, err
+	}
+
+	if err := options.Policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid retry policy: %w", err)
+	}
+
+	return &Sinker{
+		options: options,
+		client:  &http.Client{Timeout: options.Timeout},
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:     time.Now,
+		after:   time.After,
+	}, nil
+}
+
+// NewWithConfig is the plugin constructor.
+func NewWithConfig(config map[string]string) (sink.Sinker, error) {
+	c := pluginconfig.Config(config)
+
+	options := Options{
+		URL:        c[URLOption],
+		Headers:    make(http.Header),
+		HMACHeader: c[HMACHeaderOption],
+	}
+
+	// Headers are given by options with the header prefix, which are not checked
+	known := pluginconfig.Config{}
+	for key, value := range c {
+		if strings.HasPrefix(key, HeaderOptionPrefix) {
+			name := strings.TrimPrefix(key, HeaderOptionPrefix)
+			if name == "" {
+				return nil, fmt.Errorf("option %s: missing header name", key)
+			}
+			options.Headers.Set(name, value)
+			continue
+		}
+		known[key] = value
+	}
+
+	if err := known.CheckKeys(URLOption,
+		BearerTokenOption,
+		BearerTokenFileOption,
+		HMACSecretOption,
+		HMACSecretFileOption,
+		HMACHeaderOption,
+		GzipOption,
+		TimeoutOption,
+		MaxAttemptsOption,
+		InitialBackoffOption,
+		MaxBackoffOption); err != nil {
+		return nil, err
+	}
+
+	if options.URL == "" {
+		return nil, fmt.Errorf("option %s required", URLOption)
+	}
+
+	if options.HMACHeader == "" {
+		options.HMACHeader = defaultHMACHeader
+	}
+
+	var err error
+	if options.BearerToken, err = secret(c, BearerTokenOption, BearerTokenFileOption); err != nil {
+		return nil, err
+	}
+
+	hmacSecret, err := secret(c, HMACSecretOption, HMACSecretFileOption)
+	if err != nil {
+		return nil, err
+	}
+	if hmacSecret != "" {
+		options.HMACSecret = []byte(hmacSecret)
+	}
+
+	if options.Gzip, err = c.Bool(GzipOption, false); err != nil {
+		return nil, err
+	}
+
+	if options.Timeout, err = c.Duration(TimeoutOption, defaultTimeout); err != nil {
+		return nil, err
+	}
+
+	maxAttempts, err := c.Int64(MaxAttemptsOption, defaultMaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+
+	options.Policy = retry.Policy{MaxAttempts: int(maxAttempts), Jitter: backoffJitter}
+	if options.Policy.InitialBackoff, err = c.Duration(InitialBackoffOption, defaultInitialBackoff); err != nil {
+		return nil, err
+	}
+
+	if options.Policy.MaxBackoff, err = c.Duration(MaxBackoffOption, defaultMaxBackoff); err != nil {
+		return nil, err
+	}
+
+	return New(options)
+}
+
+// Secret returns the secret given either directly by the option or in the file named by
+// the file option, with surrounding whitespace removed.
+func secret(c pluginconfig.Config, option, fileOption string) (string, error) {
+	value, path := c[option], c[fileOption]
+	if value != "" && path != "" {
+		return "", fmt.Errorf("options %s and %s are mutually exclusive", option, fileOption)
+	}
+
+	if path == "" {
+		return value, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("option %s: reading secret: %w", fileOption, err)
+	}
+
+	return strings.TrimSpace(string(contents)), nil
+}
+
+func validateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("parsing URL: %w", err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("URL %q is not an absolute http or https URL", rawURL)
+	}
+
+	return nil
+}
+
+func (s *Sinker) Sink(e *event.Event) error {
+	return s.SinkContext(context.Background(), e)
+}
+
+// SinkContext sends the event, abandoning the request, or any wait to retry it, when the
+// context is done.
+func (s *Sinker) SinkContext(ctx context.Context, e *event.Event) error {
+	return s.post(ctx, []*event.Event{e})
+}
+
+// SinkBatch sends the events in a single request. As the request succeeds or fails as a
+// whole, so do the events.
+func (s *Sinker) SinkBatch(events []*event.Event) error {
+	return s.SinkBatchContext(context.Background(), events)
+}
+
+// SinkBatchContext sends the events in a single request, abandoning the request, or any
+// wait to retry it, when the context is done.
+func (s *Sinker) SinkBatchContext(ctx context.Context, events []*event.Event) error {
+	return s.post(ctx, events)
+}
+
+func (s *Sinker) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// SinkRecord sends the record, as a single JSON object, so that a Sinker may be used to
+// sink records, such as alerts, as well as events.
+func (s *Sinker) SinkRecord(kind string, record interface{}) error {
+	return s.SinkRecordContext(context.Background(), kind, record)
+}
+
+// SinkRecordContext sends the record, abandoning the request, or any wait to retry it,
+// when the context is done.
+func (s *Sinker) SinkRecordContext(ctx context.Context, kind string, record interface{}) error {
+	return s.postValue(ctx, record, kind+" record")
+}
+
+// Post sends the events, retrying as required.
+func (s *Sinker) post(ctx context.Context, events []*event.Event) error {
+	records := make([]*jsonl.Record, len(events))
+	for i, e := range events {
+		records[i] = jsonl.NewRecord(e)
+	}
+
+	return s.postValue(ctx, records, "events")
+}
+
+// PostValue sends the value as JSON, retrying as required. The description of the value
+// is used in errors.
+func (s *Sinker) postValue(ctx context.Context, value interface{}, description string) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return retry.Permanent(fmt.Errorf("encoding %s: %w", description, err))
+	}
+
+	var signature string
+	if len(s.options.HMACSecret) != 0 {
+		signature = sign(s.options.HMACSecret, body)
+	}
+
+	if s.options.Gzip {
+		if body, err = compress(body); err != nil {
+			return retry.Permanent(err)
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := s.send(ctx, body, signature)
+		if err == nil {
+			return nil
+		}
+
+		if retry.IsPermanent(err) || attempt >= s.options.Policy.MaxAttempts {
+			return err
+		}
+
+		wait := s.options.Policy.Backoff(attempt, s.rnd)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			if statusErr.RetryAfter > s.options.Policy.MaxBackoff {
+				// Retrying sooner than asked would likely be refused, so leave any retry
+				// to the layers above
+				return fmt.Errorf("not retrying, as asked to wait %v, more than the maximum backoff: %w",
+					statusErr.RetryAfter, err)
+			}
+			wait = statusErr.RetryAfter
+		}
+
+		select {
+		case <-s.after(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("abandoning retries: %w (last error: %v)", ctx.Err(), err)
+		}
+	}
+}
+
+// Send makes a single request. Errors for responses which should not be retried are
+// permanent.
+func (s *Sinker) send(ctx context.Context, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, s.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return retry.Permanent(fmt.Errorf("creating request: %w", err))
+	}
+	req = req.WithContext(ctx)
+
+	for name, values := range s.options.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+
+	if s.options.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if s.options.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.options.BearerToken)
+	}
+
+	if signature != "" {
+		req.Header.Set(s.options.HMACHeader, signature)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body) // So that the connection can be reused
+		return nil
+	}
+
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	statusErr := &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       strings.TrimSpace(string(respBody)),
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After"), s.now()),
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return statusErr
+	}
+
+	return retry.Permanent(statusErr)
+}
+
+// Sign returns the signature of the body, as the hex-encoded HMAC-SHA256 prefixed by
+// "sha256=".
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmacPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func compress(body []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer := gzip.NewWriter(buf)
+	if _, err := writer.Write(body); err != nil {
+		return nil, fmt.Errorf("compressing body: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("compressing body: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// RetryAfter returns the wait given by a Retry-After header, which is either a number of
+// seconds or a date, or 0 if there is none or it cannot be parsed.
+func retryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,444 @@
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/sink"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+	"github.com/jhwbarlow/tcp-audit/pkg/batch"
+	"github.com/jhwbarlow/tcp-audit/pkg/jsonl"
+	"github.com/jhwbarlow/tcp-audit/pkg/record"
+	"github.com/jhwbarlow/tcp-audit/pkg/retry"
+)
+
+var _ sink.SinkerCloser = new(Sinker)
+var _ record.ContextSinker = new(Sinker)
+var _ batch.ContextSinker = new(Sinker)
+
+// NewPostedEvent returns an event, to be posted by a test, of a connection from the client
+// port to a service behind the webhook's collector.
+func newPostedEvent(clientPort uint16) *event.Event {
+	return &event.Event{
+		Time:         time.Date(2021, 10, 2, 12, 0, 0, 0, time.UTC),
+		PIDOnCPU:     4242,
+		CommandOnCPU: "nginx",
+		SourceIP:     net.ParseIP("192.0.2.10"),
+		SourcePort:   clientPort,
+		DestIP:       net.ParseIP("198.51.100.20"),
+		DestPort:     8443,
+		OldState:     tcpstate.StateSynSent,
+		NewState:     tcpstate.StateEstablished,
+	}
+}
+
+// MockServer responds to each request with the next of its responses, repeating the last
+// once they run out, and records the requests it receives.
+type mockServer struct {
+	*httptest.Server
+
+	mutex     sync.Mutex
+	responses []mockResponse
+	requests  []*http.Request
+	bodies    [][]byte
+}
+
+type mockResponse struct {
+	status     int
+	retryAfter string
+}
+
+func newMockServer(t *testing.T, responses ...mockResponse) *mockServer {
+	ms := &mockServer{responses: responses}
+	ms.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading request body: %v", err)
+		}
+
+		ms.mutex.Lock()
+		response := ms.responses[len(ms.responses)-1]
+		if len(ms.requests) < len(ms.responses) {
+			response = ms.responses[len(ms.requests)]
+		}
+		ms.requests = append(ms.requests, r)
+		ms.bodies = append(ms.bodies, body)
+		ms.mutex.Unlock()
+
+		if response.retryAfter != "" {
+			w.Header().Set("Retry-After", response.retryAfter)
+		}
+		w.WriteHeader(response.status)
+		w.Write([]byte("response body"))
+	}))
+
+	return ms
+}
+
+func (ms *mockServer) requestCount() int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return len(ms.requests)
+}
+
+func newTestSinker(t *testing.T, options Options) (*Sinker, *[]time.Duration) {
+	sinker, err := New(options)
+	if err != nil {
+		t.Fatalf("creating sinker: %v", err)
+	}
+
+	// Record the waits between attempts rather than waiting
+	waits := new([]time.Duration)
+	sinker.after = func(d time.Duration) <-chan time.Time {
+		*waits = append(*waits, d)
+		c := make(chan time.Time, 1)
+		c <- time.Now()
+		return c
+	}
+
+	return sinker, waits
+}
+
+func newTestOptions(url string) Options {
+	return Options{
+		URL:     url,
+		Timeout: 5 * time.Second,
+		Policy: retry.Policy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Second,
+			MaxBackoff:     time.Minute,
+		},
+	}
+}
+
+func TestSinkerSinkBatch(t *testing.T) {
+	server := newMockServer(t, mockResponse{status: http.StatusOK})
+	defer server.Close()
+
+	options := newTestOptions(server.URL)
+	options.Headers = http.Header{"X-Api-Key": []string{"key"}}
+	options.BearerToken = "token"
+	options.HMACSecret = []byte("secret")
+	options.HMACHeader = "X-Signature"
+	sinker, _ := newTestSinker(t, options)
+	defer sinker.Close()
+
+	events := []*event.Event{newPostedEvent(40000), newPostedEvent(40001)}
+	if err := sinker.SinkBatch(events); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if count := server.requestCount(); count != 1 {
+		t.Fatalf("expected 1 request, got %d", count)
+	}
+
+	req, body := server.requests[0], server.bodies[0]
+	expectedHeaders := map[string]string{
+		"Content-Type":  "application/json",
+		"X-Api-Key":     "key",
+		"Authorization": "Bearer token",
+		"X-Signature":   sign([]byte("secret"), body),
+	}
+	for name, expected := range expectedHeaders {
+		if value := req.Header.Get(name); value != expected {
+			t.Errorf("expected header %s %q, got %q", name, expected, value)
+		}
+	}
+
+	var records []jsonl.Record
+	if err := json.Unmarshal(body, &records); err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	if records[0].SourcePort != 40000 || records[1].SourcePort != 40001 ||
+		records[0].SourceIP != "192.0.2.10" || records[1].NewState != "ESTABLISHED" {
+		t.Errorf("unexpected records %+v", records)
+	}
+}
+
+func TestSinkerSinkRecord(t *testing.T) {
+	server := newMockServer(t, mockResponse{status: http.StatusServiceUnavailable}, mockResponse{status: http.StatusOK})
+	defer server.Close()
+
+	options := newTestOptions(server.URL)
+	options.HMACSecret = []byte("secret")
+	options.HMACHeader = "X-Signature"
+	sinker, _ := newTestSinker(t, options)
+	defer sinker.Close()
+
+	alert := map[string]interface{}{"rule": "syn-flood", "threshold": 100}
+	if err := sinker.SinkRecord("alert", alert); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// The record is retried, and signed, as events are
+	if count := server.requestCount(); count != 2 {
+		t.Fatalf("expected 2 requests, got %d", count)
+	}
+
+	req, body := server.requests[1], server.bodies[1]
+	if value := req.Header.Get("X-Signature"); value != sign([]byte("secret"), body) {
+		t.Errorf("expected signature header, got %q", value)
+	}
+
+	if string(body) != `{"rule":"syn-flood","threshold":100}` {
+		t.Errorf("unexpected record %s", body)
+	}
+}
+
+func TestSinkerGzip(t *testing.T) {
+	server := newMockServer(t, mockResponse{status: http.StatusNoContent})
+	defer server.Close()
+
+	options := newTestOptions(server.URL)
+	options.Gzip = true
+	options.HMACSecret = []byte("secret")
+	options.HMACHeader = defaultHMACHeader
+	sinker, _ := newTestSinker(t, options)
+
+	if err := sinker.Sink(newPostedEvent(40000)); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	req, body := server.requests[0], server.bodies[0]
+	if encoding := req.Header.Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("expected gzip content encoding, got %q", encoding)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("decompressing body: %v", err)
+	}
+
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("decompressing body: %v", err)
+	}
+
+	// The signature is of the uncompressed body
+	if signature := req.Header.Get(defaultHMACHeader); signature != sign([]byte("secret"), decompressed) {
+		t.Errorf("signature %q does not match uncompressed body", signature)
+	}
+
+	var records []jsonl.Record
+	if err := json.Unmarshal(decompressed, &records); err != nil || len(records) != 1 {
+		t.Errorf("expected 1 record, got %d (error: %v)", len(records), err)
+	}
+}
+
+func TestSinkerRetriesHonouringRetryAfter(t *testing.T) {
+	server := newMockServer(t,
+		mockResponse{status: http.StatusServiceUnavailable},
+		mockResponse{status: http.StatusTooManyRequests, retryAfter: "7"},
+		mockResponse{status: http.StatusOK})
+	defer server.Close()
+
+	sinker, waits := newTestSinker(t, newTestOptions(server.URL))
+	if err := sinker.Sink(newPostedEvent(40000)); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if count := server.requestCount(); count != 3 {
+		t.Errorf("expected 3 requests, got %d", count)
+	}
+
+	expected := []time.Duration{time.Second, 7 * time.Second}
+	if len(*waits) != len(expected) || (*waits)[0] != expected[0] || (*waits)[1] != expected[1] {
+		t.Errorf("expected waits %v, got %v", expected, *waits)
+	}
+}
+
+func TestSinkerGivesUpAfterMaxAttempts(t *testing.T) {
+	server := newMockServer(t, mockResponse{status: http.StatusInternalServerError})
+	defer server.Close()
+
+	sinker, _ := newTestSinker(t, newTestOptions(server.URL))
+	err := sinker.Sink(newPostedEvent(40000))
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	t.Logf("got error %q (of type %T)", err, err)
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected *StatusError with status 500, got %v", err)
+	}
+
+	if retry.IsPermanent(err) {
+		t.Error("expected error not to be permanent")
+	}
+
+	if count := server.requestCount(); count != 3 {
+		t.Errorf("expected 3 requests, got %d", count)
+	}
+}
+
+func TestSinkerDoesNotRetryClientErrors(t *testing.T) {
+	server := newMockServer(t, mockResponse{status: http.StatusUnauthorized})
+	defer server.Close()
+
+	sinker, _ := newTestSinker(t, newTestOptions(server.URL))
+	err := sinker.Sink(newPostedEvent(40000))
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !retry.IsPermanent(err) {
+		t.Error("expected error to be permanent")
+	}
+
+	if count := server.requestCount(); count != 1 {
+		t.Errorf("expected 1 request, got %d", count)
+	}
+}
+
+func TestSinkerDoesNotRetryBeyondMaxBackoff(t *testing.T) {
+	server := newMockServer(t,
+		mockResponse{status: http.StatusTooManyRequests, retryAfter: "3600"},
+		mockResponse{status: http.StatusOK})
+	defer server.Close()
+
+	sinker, _ := newTestSinker(t, newTestOptions(server.URL))
+	err := sinker.Sink(newPostedEvent(40000))
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if count := server.requestCount(); count != 1 {
+		t.Errorf("expected 1 request, got %d", count)
+	}
+}
+
+func TestSinkerSinkContextCancelled(t *testing.T) {
+	server := newMockServer(t, mockResponse{status: http.StatusBadGateway})
+	defer server.Close()
+
+	sinker, _ := newTestSinker(t, newTestOptions(server.URL))
+	sinker.after = func(time.Duration) <-chan time.Time { return nil } // Never retry
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := sinker.SinkContext(ctx, newPostedEvent(40000))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %v (of type %T)", err, err)
+	}
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestSinkerSinkBatchContextCancelled(t *testing.T) {
+	server := newMockServer(t, mockResponse{status: http.StatusBadGateway})
+	defer server.Close()
+
+	sinker, _ := newTestSinker(t, newTestOptions(server.URL))
+	sinker.after = func(time.Duration) <-chan time.Time { return nil } // Never retry
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := sinker.SinkBatchContext(ctx, []*event.Event{newPostedEvent(40000), newPostedEvent(40001)})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %v (of type %T)", err, err)
+	}
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, 9, 28, 21, 12, 36, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"soon":                          0,
+		"Tue, 28 Sep 2021 21:13:36 GMT": time.Minute,
+		"Tue, 28 Sep 2021 21:11:36 GMT": 0,
+	} {
+		if wait := retryAfter(value, now); wait != expected {
+			t.Errorf("expected wait %v for %q, got %v", expected, value, wait)
+		}
+	}
+}
+
+func TestNewWithConfigOptions(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("token\n"), 0600); err != nil {
+		t.Fatalf("writing token file: %v", err)
+	}
+
+	sinker, err := NewWithConfig(map[string]string{
+		URLOption:                       "https://collector.example.com/events",
+		HeaderOptionPrefix + "X-Tenant": "audit",
+		BearerTokenFileOption:           tokenFile,
+		HMACSecretOption:                "secret",
+		GzipOption:                      "true",
+		TimeoutOption:                   "2s",
+		MaxAttemptsOption:               "5",
+		InitialBackoffOption:            "100ms",
+		MaxBackoffOption:                "10s",
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	options := sinker.(*Sinker).options
+	if options.BearerToken != "token" ||
+		string(options.HMACSecret) != "secret" ||
+		options.HMACHeader != defaultHMACHeader ||
+		!options.Gzip ||
+		options.Timeout != 2*time.Second ||
+		options.Headers.Get("X-Tenant") != "audit" {
+		t.Errorf("unexpected options %+v", options)
+	}
+
+	expectedPolicy := retry.Policy{
+		MaxAttempts:    5,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		Jitter:         backoffJitter,
+	}
+	if options.Policy != expectedPolicy {
+		t.Errorf("expected policy %+v, got %+v", expectedPolicy, options.Policy)
+	}
+}
+
+func TestNewWithConfigErrors(t *testing.T) {
+	for _, config := range []map[string]string{
+		{},
+		{URLOption: "collector.example.com/events"},
+		{URLOption: "ftp://collector.example.com/events"},
+		{URLOption: "https://collector.example.com", HeaderOptionPrefix: "value"},
+		{URLOption: "https://collector.example.com", BearerTokenOption: "a", BearerTokenFileOption: "b"},
+		{URLOption: "https://collector.example.com", HMACSecretFileOption: "/nonexistent"},
+		{URLOption: "https://collector.example.com", GzipOption: "maybe"},
+		{URLOption: "https://collector.example.com", MaxAttemptsOption: "0"},
+		{URLOption: "https://collector.example.com", InitialBackoffOption: "1m", MaxBackoffOption: "1s"},
+		{URLOption: "https://collector.example.com", "token": "a"},
+	} {
+		_, err := NewWithConfig(config)
+		if err == nil {
+			t.Errorf("expected error for options %v, got nil", config)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}